@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/auth"
+	"dataservice/rule"
+	"dataservice/tool"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// alarm statuses
+const (
+	alarmActive       = "active"
+	alarmAcknowledged = "acknowledged"
+	alarmCleared      = "cleared"
+)
+
+// Alarm raised by a rule on a device
+type Alarm struct {
+	ID             int64      `json:"id"`
+	TenantID       int64      `json:"tenantId"`
+	RuleID         *int64     `json:"ruleId"` // nil once the rule is deleted
+	DeviceID       int64      `json:"deviceId"`
+	Severity       string     `json:"severity"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message"`
+	Value          float64    `json:"value"`
+	RaisedAt       time.Time  `json:"raisedAt"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt,omitempty"`
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+	ClearedAt      *time.Time `json:"clearedAt,omitempty"`
+}
+
+// AlarmEvent alarm transition published onto the events exchange
+type AlarmEvent struct {
+	Type string `json:"type"`
+	*Alarm
+}
+
+const alarmColumns = `id, tenant_id, rule_id, device_id, severity, status, message, value, raised_at, acknowledged_at, acknowledged_by, cleared_at`
+
+func scanAlarm(row rowScanner) (*Alarm, error) {
+	a := &Alarm{}
+	var by sql.NullString
+	err := row.Scan(&a.ID, &a.TenantID, &a.RuleID, &a.DeviceID, &a.Severity, &a.Status, &a.Message, &a.Value,
+		&a.RaisedAt, &a.AcknowledgedAt, &by, &a.ClearedAt)
+	a.AcknowledgedBy = by.String
+	return a, err
+}
+
+// persist transition as alarm and publish it, a raise of an alarm still open is dropped
+func (e *ruleEngine) persist(ctx context.Context, t *transition) error {
+	var row *sql.Row
+	var routingKey string
+	switch t.kind {
+	case rule.Raise:
+		message := fmt.Sprintf("%s: %s, value %g", t.rule.Name, t.rule.cond, t.value)
+		row = e.pgPool.QueryRowContext(ctx, `insert into alarms (tenant_id, rule_id, device_id, severity, status, message, value, raised_at)
+			values ($1, $2, $3, $4, 'active', $5, $6, $7) on conflict (rule_id, device_id) where status <> 'cleared' do nothing
+			returning `+alarmColumns+`;`, t.rule.TenantID, t.rule.ID, t.deviceID, t.rule.Severity, message, t.value, t.at)
+		routingKey = "alarm.raised"
+	case rule.Clear:
+		row = e.pgPool.QueryRowContext(ctx, `update alarms set status = 'cleared', cleared_at = $3
+			where rule_id = $1 and device_id = $2 and status <> 'cleared' returning `+alarmColumns+`;`, t.rule.ID, t.deviceID, t.at)
+		routingKey = "alarm.cleared"
+	default:
+		return nil
+	}
+	a, err := scanAlarm(row)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return dbError(err, "persist alarm")
+	}
+	return e.publish(ctx, routingKey, &AlarmEvent{Type: routingKey, Alarm: a})
+}
+
+func (_global *global) queryAlarm(ctx context.Context, tenantID, id int64) (*Alarm, error) {
+	a, err := scanAlarm(_global.pgPool.QueryRowContext(ctx, `select `+alarmColumns+` from alarms where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query alarm")
+	}
+	return a, nil
+}
+
+// listAlarms of the tenant, newest first, filtered by ?status= and ?deviceId=
+func (_global *global) listAlarms(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	status := c.Query("status")
+	switch status {
+	case "", alarmActive, alarmAcknowledged, alarmCleared:
+	default:
+		c.Error(tool.Invalid("unknown alarm status [%s]", status))
+		return
+	}
+	var deviceID int64
+	if s := c.Query("deviceId"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			c.Error(tool.Invalid("deviceId [%s] is not a number", s))
+			return
+		}
+		deviceID = id
+	}
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select `+alarmColumns+` from alarms
+		where tenant_id = $1 and ($2 = '' or status = $2) and ($3 = 0 or device_id = $3) order by raised_at desc, id desc;`,
+		tenantOf(c), status, deviceID)
+	if err != nil {
+		c.Error(dbError(err, "query alarms"))
+		return
+	}
+	defer rows.Close()
+
+	alarms := []*Alarm{}
+	for rows.Next() {
+		a, err := scanAlarm(rows)
+		if err != nil {
+			c.Error(dbError(err, "scan alarm"))
+			return
+		}
+		alarms = append(alarms, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query alarms"))
+		return
+	}
+	c.JSON(http.StatusOK, alarms)
+}
+
+func (_global *global) getAlarm(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	a, err := _global.queryAlarm(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// ackAlarm acknowledge an active alarm, it stays open until cleared
+func (_global *global) ackAlarm(c *gin.Context) {
+	_global.alarmTransition(c, "alarm.acknowledged", `update alarms set status = 'acknowledged', acknowledged_at = now(), acknowledged_by = $3
+		where tenant_id = $1 and id = $2 and status = 'active' returning `+alarmColumns+`;`, auth.PrincipalOf(c).Subject)
+}
+
+// clearAlarm clear an open alarm by hand, the rule raises it again only once its condition held for the full duration
+func (_global *global) clearAlarm(c *gin.Context) {
+	_global.alarmTransition(c, "alarm.cleared", `update alarms set status = 'cleared', cleared_at = now()
+		where tenant_id = $1 and id = $2 and status <> 'cleared' returning `+alarmColumns+`;`)
+}
+
+func (_global *global) alarmTransition(c *gin.Context, routingKey string, query string, args ...interface{}) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	a, err := scanAlarm(_global.pgPool.QueryRowContext(ctx, query, append([]interface{}{tenantID, id}, args...)...))
+	if err == sql.ErrNoRows {
+		if a, err = _global.queryAlarm(ctx, tenantID, id); err == nil {
+			err = tool.Conflict("alarm [%d] is %s", id, a.Status)
+		}
+	} else if err != nil {
+		err = dbError(err, "update alarm")
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if a.Status == alarmCleared && a.RuleID != nil {
+		_global.rules.reset(*a.RuleID, a.DeviceID)
+	}
+	tool.CheckThenLog(_Log, _global.publishEvent(ctx, routingKey, &AlarmEvent{Type: routingKey, Alarm: a}), "publish alarm event", "alarm", a.ID)
+	c.JSON(http.StatusOK, a)
+}
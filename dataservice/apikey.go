@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/auth"
+	"dataservice/tool"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// APIKey record, the key itself is only returned on creation
+type APIKey struct {
+	ID         int64      `json:"id"`
+	TenantID   int64      `json:"tenantId"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type apiKeyInput struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	TenantID int64    `json:"tenantId"` // other than the own tenant only with the tenants scope
+}
+
+// keyUsageInterval of flushing when api keys were last used
+const keyUsageInterval = 30 * time.Second
+
+// pgKeyStore look up api keys in postgres
+type pgKeyStore struct {
+	_global *global
+}
+
+// LookupAPIKey implements auth.KeyStore, the use is recorded in memory and flushed later
+func (s pgKeyStore) LookupAPIKey(ctx context.Context, hash string) (*auth.Principal, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var name string
+	var tenantID int64
+	var scopes []string
+	err := s._global.pgPool.QueryRowContext(ctx, `select name, tenant_id, scopes from api_keys where key_hash = $1 and revoked_at is null;`,
+		hash).Scan(&name, &tenantID, pq.Array(&scopes))
+	if err != nil {
+		return nil, dbError(err, "look up api key")
+	}
+	s._global.keyUsage.used(hash, time.Now())
+	return &auth.Principal{Subject: name, Method: "apikey", TenantID: tenantID, Scopes: scopes}, nil
+}
+
+// keyUsage last use of api keys by hash, kept in memory and flushed every keyUsageInterval
+type keyUsage struct {
+	sync.Mutex
+	pgPool *sql.DB
+	last   map[string]time.Time // not flushed yet
+}
+
+func newKeyUsage(pgPool *sql.DB) *keyUsage {
+	return &keyUsage{pgPool: pgPool, last: make(map[string]time.Time)}
+}
+
+// used key of hash at
+func (u *keyUsage) used(hash string, at time.Time) {
+	u.Lock()
+	defer u.Unlock()
+
+	if at.After(u.last[hash]) {
+		u.last[hash] = at
+	}
+}
+
+// flush the last uses in one statement, they are kept for the next flush when it fails
+func (u *keyUsage) flush(ctx context.Context) error {
+	u.Lock()
+	last := u.last
+	u.last = make(map[string]time.Time)
+	u.Unlock()
+	if len(last) == 0 {
+		return nil
+	}
+
+	hashes, times := make([]string, 0, len(last)), make([]time.Time, 0, len(last))
+	for hash, at := range last {
+		hashes, times = append(hashes, hash), append(times, at)
+	}
+	_, err := u.pgPool.ExecContext(ctx, `update api_keys k set last_used_at = greatest(k.last_used_at, u.at)
+		from unnest($1::text[], $2::timestamptz[]) as u(hash, at) where k.key_hash = u.hash;`, pq.Array(hashes), pq.Array(times))
+	if err != nil {
+		for hash, at := range last {
+			u.used(hash, at)
+		}
+		return dbError(err, "flush api key usage")
+	}
+	return nil
+}
+
+// run flush every keyUsageInterval until ctx is done, with a last flush on the way out
+func (u *keyUsage) run(ctx context.Context) {
+	ticker := time.NewTicker(keyUsageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.ErrorThenPrint(u.flush(fctx), "flush api key usage")
+			cancel()
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			tool.ErrorThenPrint(u.flush(fctx), "flush api key usage")
+			cancel()
+			return
+		}
+	}
+}
+
+// bootstrapAPIKey store the configured admin key of the default tenant, so the first tenants and keys can be created
+func (_global *global) bootstrapAPIKey(ctx context.Context, key string) error {
+	_, err := _global.pgPool.ExecContext(ctx, `insert into api_keys (tenant_id, name, key_hash, scopes) values ($1, 'bootstrap', $2, $3)
+		on conflict (key_hash) do nothing;`, auth.DefaultTenant, auth.HashKey(key), pq.Array([]string{auth.ScopeAdmin, auth.ScopeTenants}))
+	return dbError(err, "bootstrap api key")
+}
+
+func (_global *global) listAPIKeys(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select id, tenant_id, name, scopes, created_at, last_used_at from api_keys
+		where tenant_id = $1 and revoked_at is null order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(dbError(err, "query api keys"))
+		return
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k := &APIKey{}
+		if err := rows.Scan(&k.ID, &k.TenantID, &k.Name, pq.Array(&k.Scopes), &k.CreatedAt, &k.LastUsedAt); err != nil {
+			c.Error(dbError(err, "scan api key"))
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query api keys"))
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func (_global *global) createAPIKey(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input apiKeyInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		c.Error(tool.Invalid("name is required"))
+		return
+	}
+	if err := auth.ValidScopes(input.Scopes); err != nil {
+		c.Error(err)
+		return
+	}
+	principal := auth.PrincipalOf(c)
+	if input.TenantID == 0 {
+		input.TenantID = principal.TenantID
+	}
+	if input.TenantID != principal.TenantID && !principal.Has(auth.ScopeTenants) {
+		c.Error(tool.Forbidden("missing scope [%s] to create keys of other tenants", auth.ScopeTenants))
+		return
+	}
+	if !principal.Has(auth.ScopeTenants) {
+		for _, scope := range input.Scopes {
+			if scope == auth.ScopeTenants {
+				c.Error(tool.Forbidden("missing scope [%s] to grant it", auth.ScopeTenants))
+				return
+			}
+		}
+	}
+
+	key, err := auth.NewKey()
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInternal, err, "generate api key"))
+		return
+	}
+	k := &APIKey{TenantID: input.TenantID, Name: input.Name, Scopes: input.Scopes, Key: key}
+	err = _global.pgPool.QueryRowContext(ctx, `insert into api_keys (tenant_id, name, key_hash, scopes) values ($1, $2, $3, $4) returning id, created_at;`,
+		k.TenantID, k.Name, auth.HashKey(key), pq.Array(k.Scopes)).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert api key"))
+		return
+	}
+	c.JSON(http.StatusCreated, k)
+}
+
+func (_global *global) revokeAPIKey(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	res, err := _global.pgPool.ExecContext(ctx, `update api_keys set revoked_at = now() where tenant_id = $1 and id = $2 and revoked_at is null;`,
+		tenantOf(c), id)
+	if err != nil {
+		c.Error(dbError(err, "revoke api key"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such api key [%d]", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
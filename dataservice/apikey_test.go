@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("api key usage", func() {
+	It("should keep the last use of each key until flushed", func() {
+		u := newKeyUsage(nil)
+		now := time.Now()
+		u.used("a", now)
+		u.used("a", now.Add(-time.Minute))
+		u.used("b", now.Add(time.Second))
+		Ω(u.last).To(Equal(map[string]time.Time{"a": now, "b": now.Add(time.Second)}))
+
+		Ω(newKeyUsage(nil).flush(context.Background())).To(Succeed(), "nothing to flush")
+	})
+})
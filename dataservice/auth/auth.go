@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"dataservice/tool"
+	"strings"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// scopes of the api
+const (
+	ScopeRead      = "read"
+	ScopeSubscribe = "subscribe"
+	ScopeAdmin     = "admin"
+	ScopeDevices   = "devices"
+	ScopeRules     = "rules"
+	// ScopeTenants manage tenants and their quotas, it is not implied by admin
+	ScopeTenants = "tenants"
+)
+
+// Scopes known by the service
+var Scopes = []string{ScopeRead, ScopeSubscribe, ScopeAdmin, ScopeDevices, ScopeRules, ScopeTenants}
+
+// DefaultTenant own everything when authentication is disabled
+const DefaultTenant int64 = 1
+
+const principalKey = "auth.principal"
+
+// Principal authenticated caller acting within a tenant
+type Principal struct {
+	Subject  string   `json:"subject"`
+	Method   string   `json:"method"`
+	TenantID int64    `json:"tenantId"`
+	Scopes   []string `json:"scopes"`
+}
+
+// Has report whether the principal is granted scope, admin is granted everything of its tenant
+func (p *Principal) Has(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || (s == ScopeAdmin && scope != ScopeTenants) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore look up api keys by hash
+type KeyStore interface {
+	// LookupAPIKey return the principal of a live key, tool.ErrNotFound when there is none
+	LookupAPIKey(ctx context.Context, hash string) (*Principal, error)
+}
+
+// ValidScopes check every scope is known
+func ValidScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return tool.Invalid("scopes are required")
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return tool.Invalid("unknown scope [%s]", scope)
+		}
+	}
+	return nil
+}
+
+// Middleware authenticate requests by api key (X-API-Key or "Authorization: ApiKey")
+// or by JWT bearer token, verifier may be nil when JWT is not configured
+func Middleware(keys KeyStore, verifier *JWTVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := authenticate(c, keys, verifier)
+		if err != nil {
+			c.Error(err)
+			c.Abort()
+			return
+		}
+		c.Set(principalKey, principal)
+	}
+}
+
+// Anonymous grant every request all scopes, for deployments with auth disabled
+func Anonymous() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(principalKey, &Principal{Subject: "anonymous", Method: "none", TenantID: DefaultTenant, Scopes: []string{ScopeAdmin, ScopeTenants}})
+	}
+}
+
+func authenticate(c *gin.Context, keys KeyStore, verifier *JWTVerifier) (*Principal, error) {
+	key := c.GetHeader("X-API-Key")
+	scheme, credential := splitAuthorization(c.GetHeader("Authorization"))
+
+	switch {
+	case key != "":
+	case strings.EqualFold(scheme, "ApiKey"):
+		key = credential
+	case strings.EqualFold(scheme, "Bearer"):
+		if verifier == nil {
+			return nil, tool.Unauthorized("bearer tokens are not accepted")
+		}
+		return verifier.Verify(credential)
+	default:
+		return nil, tool.Unauthorized("missing credential")
+	}
+
+	principal, err := keys.LookupAPIKey(c.Request.Context(), HashKey(key))
+	if tool.KindOf(err) == tool.KindNotFound {
+		return nil, tool.Unauthorized("invalid api key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+func splitAuthorization(header string) (scheme, credential string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// Require scope of the authenticated principal
+func Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := PrincipalOf(c)
+		if principal == nil {
+			c.Error(tool.Unauthorized("missing credential"))
+			c.Abort()
+			return
+		}
+		if !principal.Has(scope) {
+			c.Error(tool.Forbidden("scope [%s] is required", scope))
+			c.Abort()
+			return
+		}
+	}
+}
+
+// PrincipalOf request, nil when unauthenticated
+func PrincipalOf(c *gin.Context) *Principal {
+	if v, ok := c.Get(principalKey); ok {
+		if p, ok := v.(*Principal); ok {
+			return p
+		}
+	}
+	return nil
+}
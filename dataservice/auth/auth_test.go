@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"dataservice/tool"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeKeyStore map[string]*Principal
+
+func (s fakeKeyStore) LookupAPIKey(ctx context.Context, hash string) (*Principal, error) {
+	if p, ok := s[hash]; ok {
+		return p, nil
+	}
+	return nil, tool.NotFound("no such key")
+}
+
+var _ = Describe("auth", func() {
+	gin.SetMode(gin.TestMode)
+
+	var keys fakeKeyStore
+	var verifier *JWTVerifier
+
+	// request runs a guarded route and returns the status, errors are mapped like the service does
+	request := func(scope string, header ...string) int {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Next()
+			if err := c.Errors.Last(); err != nil {
+				switch tool.KindOf(err.Err) {
+				case tool.KindUnauthorized:
+					c.Status(http.StatusUnauthorized)
+				case tool.KindForbidden:
+					c.Status(http.StatusForbidden)
+				default:
+					c.Status(http.StatusInternalServerError)
+				}
+			}
+		})
+		router.GET("/", Middleware(keys, verifier), Require(scope), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	BeforeEach(func() {
+		keys = fakeKeyStore{}
+		verifier = nil
+	})
+
+	Describe("api keys", func() {
+		var key string
+
+		BeforeEach(func() {
+			var err error
+			key, err = NewKey()
+			Ω(err).ToNot(HaveOccurred())
+			keys[HashKey(key)] = &Principal{Subject: "ci", Method: "apikey", Scopes: []string{ScopeRead}}
+		})
+
+		It("should generate distinct keys", func() {
+			other, err := NewKey()
+			Ω(err).ToNot(HaveOccurred())
+			Ω(other).ToNot(Equal(key))
+			Ω(key).To(HavePrefix("ds_"))
+		})
+
+		It("should accept known keys with the scope", func() {
+			Ω(request(ScopeRead, "X-API-Key", key)).To(Equal(http.StatusOK))
+			Ω(request(ScopeRead, "Authorization", "ApiKey "+key)).To(Equal(http.StatusOK))
+		})
+
+		It("should forbid missing scopes", func() {
+			Ω(request(ScopeSubscribe, "X-API-Key", key)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should reject unknown or missing keys", func() {
+			Ω(request(ScopeRead, "X-API-Key", "ds_unknown")).To(Equal(http.StatusUnauthorized))
+			Ω(request(ScopeRead)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject bearer tokens without jwt config", func() {
+			Ω(request(ScopeRead, "Authorization", "Bearer abc")).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("jwt with shared secret", func() {
+		secret := "0123456789abcdef0123456789abcdef"
+
+		sign := func(c jwt.MapClaims) string {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(secret))
+			Ω(err).ToNot(HaveOccurred())
+			return token
+		}
+
+		BeforeEach(func() {
+			var err error
+			verifier, err = NewJWTVerifier(JWTConfig{Key: secret, Issuer: "idp"})
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("should accept tokens with scope claim", func() {
+			token := sign(jwt.MapClaims{"sub": "ops", "iss": "idp", "exp": time.Now().Add(time.Hour).Unix(), "tenant": 2, "scope": "read subscribe"})
+			Ω(request(ScopeSubscribe, "Authorization", "Bearer "+token)).To(Equal(http.StatusOK))
+			Ω(request(ScopeAdmin, "Authorization", "Bearer "+token)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should not imply tenant management from admin", func() {
+			token := sign(jwt.MapClaims{"iss": "idp", "exp": time.Now().Add(time.Hour).Unix(), "tenant": 2, "scope": "admin"})
+			Ω(request(ScopeSubscribe, "Authorization", "Bearer "+token)).To(Equal(http.StatusOK))
+			Ω(request(ScopeTenants, "Authorization", "Bearer "+token)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should reject expired, foreign and unsigned tokens", func() {
+			expired := sign(jwt.MapClaims{"iss": "idp", "exp": time.Now().Add(-time.Hour).Unix(), "scope": "read"})
+			Ω(request(ScopeRead, "Authorization", "Bearer "+expired)).To(Equal(http.StatusUnauthorized))
+
+			foreign := sign(jwt.MapClaims{"iss": "other", "exp": time.Now().Add(time.Hour).Unix(), "tenant": 2, "scope": "read"})
+			Ω(request(ScopeRead, "Authorization", "Bearer "+foreign)).To(Equal(http.StatusUnauthorized))
+
+			tenantless := sign(jwt.MapClaims{"iss": "idp", "exp": time.Now().Add(time.Hour).Unix(), "scope": "read"})
+			Ω(request(ScopeRead, "Authorization", "Bearer "+tenantless)).To(Equal(http.StatusUnauthorized))
+
+			none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"iss": "idp", "exp": time.Now().Add(time.Hour).Unix(), "scope": "admin"}).
+				SignedString(jwt.UnsafeAllowNoneSignatureType)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(request(ScopeRead, "Authorization", "Bearer "+none)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("jwt with jwks file", func() {
+		var private *rsa.PrivateKey
+
+		BeforeEach(func() {
+			var err error
+			private, err = rsa.GenerateKey(rand.Reader, 2048)
+			Ω(err).ToNot(HaveOccurred())
+
+			set := map[string]interface{}{"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(private.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes()),
+			}}}
+			data, err := json.Marshal(set)
+			Ω(err).ToNot(HaveOccurred())
+			dir, err := os.MkdirTemp("", "jwks")
+			Ω(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "jwks.json")
+			Ω(os.WriteFile(file, data, 0600)).To(Succeed())
+
+			verifier, err = NewJWTVerifier(JWTConfig{JWKSFile: file})
+			Ω(err).ToNot(HaveOccurred())
+		})
+
+		It("should verify tokens signed by a key of the set", func() {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix(), "tenant": 2, "scopes": []string{"admin"}})
+			token.Header["kid"] = "k1"
+			signed, err := token.SignedString(private)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(request(ScopeAdmin, "Authorization", "Bearer "+signed)).To(Equal(http.StatusOK))
+
+			token.Header["kid"] = "k2"
+			signed, err = token.SignedString(private)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(request(ScopeAdmin, "Authorization", "Bearer "+signed)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	It("should not build a verifier without keys", func() {
+		v, err := NewJWTVerifier(JWTConfig{})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(v).To(BeNil())
+	})
+
+	It("should validate scopes", func() {
+		Ω(ValidScopes([]string{ScopeRead, ScopeAdmin})).To(Succeed())
+		Ω(tool.KindOf(ValidScopes([]string{"root"}))).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf(ValidScopes(nil))).To(Equal(tool.KindInvalid))
+	})
+})
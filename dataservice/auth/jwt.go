@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"dataservice/tool"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig of bearer token verification, one of Key, KeyFile or JWKSFile is needed
+type JWTConfig struct {
+	Key      string // HMAC secret or PEM public key
+	KeyFile  string // file of a PEM public key
+	JWKSFile string // file of a JSON web key set
+	Issuer   string
+	Audience string
+}
+
+// JWTVerifier verify bearer tokens
+type JWTVerifier struct {
+	keys    map[string]interface{} // by kid, "" is the key of tokens without kid
+	methods []string
+	parser  *jwt.Parser
+}
+
+// claims accepted by the verifier, scopes come in either "scope" or "scopes"
+type claims struct {
+	jwt.RegisteredClaims
+	Tenant int64    `json:"tenant"`
+	Scope  string   `json:"scope"`
+	Scopes []string `json:"scopes"`
+}
+
+// NewJWTVerifier load verification keys, nil is returned when nothing is configured
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{keys: make(map[string]interface{})}
+
+	switch {
+	case cfg.JWKSFile != "":
+		data, err := os.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "read jwks file")
+		}
+		if err := v.loadJWKS(data); err != nil {
+			return nil, err
+		}
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "read jwt key file")
+		}
+		if err := v.loadKey(string(data)); err != nil {
+			return nil, err
+		}
+	case cfg.Key != "":
+		if err := v.loadKey(cfg.Key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(v.methods), jwt.WithExpirationRequired()}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+// loadKey of PEM public key, anything else is taken as an HMAC secret
+func (v *JWTVerifier) loadKey(key string) error {
+	if !strings.Contains(key, "-----BEGIN") {
+		v.addKey("", []byte(key))
+		return nil
+	}
+	if pub, err := jwt.ParseRSAPublicKeyFromPEM([]byte(key)); err == nil {
+		v.addKey("", pub)
+		return nil
+	}
+	if pub, err := jwt.ParseECPublicKeyFromPEM([]byte(key)); err == nil {
+		v.addKey("", pub)
+		return nil
+	}
+	if pub, err := jwt.ParseEdPublicKeyFromPEM([]byte(key)); err == nil {
+		v.addKey("", pub)
+		return nil
+	}
+	return tool.Invalid("unsupported jwt public key")
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func (v *JWTVerifier) loadJWKS(data []byte) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "parse jwks")
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			return tool.Wrap(tool.KindInvalid, err, "parse jwk "+k.Kid)
+		}
+		v.addKey(k.Kid, key)
+	}
+	if len(v.keys) == 0 {
+		return tool.Invalid("jwks has no signing keys")
+	}
+	return nil
+}
+
+func (k *jwk) key() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, tool.Invalid("unsupported curve [%s]", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return decode(k.K)
+	default:
+		return nil, tool.Invalid("unsupported key type [%s]", k.Kty)
+	}
+}
+
+func (v *JWTVerifier) addKey(kid string, key interface{}) {
+	v.keys[kid] = key
+
+	var methods []string
+	switch key.(type) {
+	case []byte:
+		methods = []string{"HS256", "HS384", "HS512"}
+	case *rsa.PublicKey:
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		methods = []string{"ES256", "ES384", "ES512"}
+	default:
+		methods = []string{"EdDSA"}
+	}
+	for _, m := range methods {
+		found := false
+		for _, existing := range v.methods {
+			found = found || existing == m
+		}
+		if !found {
+			v.methods = append(v.methods, m)
+		}
+	}
+}
+
+// Verify token and return its principal
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	var c claims
+	_, err := v.parser.ParseWithClaims(token, &c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+		if len(v.keys) == 1 && kid == "" {
+			for _, key := range v.keys {
+				return key, nil
+			}
+		}
+		return nil, tool.Unauthorized("unknown key [%s]", kid)
+	})
+	if err != nil {
+		return nil, tool.Wrap(tool.KindUnauthorized, err, "verify token")
+	}
+
+	if c.Tenant <= 0 {
+		return nil, tool.Unauthorized("token has no tenant")
+	}
+	scopes := c.Scopes
+	if c.Scope != "" {
+		scopes = append(scopes, strings.Fields(c.Scope)...)
+	}
+	return &Principal{Subject: c.Subject, Method: "jwt", TenantID: c.Tenant, Scopes: scopes}, nil
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/connector/mqtt"
+	"dataservice/policy"
+	"dataservice/tool"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// schemes the mqtt client can dial
+var brokerSchemes = map[string]bool{"tcp": true, "ssl": true, "tls": true, "ws": true, "wss": true}
+
+// Broker record
+type Broker struct {
+	ID              int64             `json:"id"`
+	TenantID        int64             `json:"tenantId"`
+	Name            string            `json:"name"`
+	URL             string            `json:"url"`
+	Username        string            `json:"username"`
+	Password        string            `json:"-"`
+	ClientID        string            `json:"clientId"`
+	ProtocolVersion byte              `json:"protocolVersion"` // 4 for MQTT 3.1.1, 5 for MQTT 5
+	TLS             BrokerTLS         `json:"tls"`
+	Status          *connector.Status `json:"status,omitempty"` // of the connection of this instance
+	Owner           *BrokerOwner      `json:"owner,omitempty"`  // in cluster mode, nil while no instance holds it
+	CreatedAt       time.Time         `json:"createdAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+}
+
+// BrokerTLS options, the private key is never returned
+type BrokerTLS struct {
+	CACert             string `json:"caCert"`
+	Cert               string `json:"cert"`
+	Key                string `json:"-"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// brokerInput body of create and patch, absent fields are left untouched on patch
+type brokerInput struct {
+	Name            *string `json:"name"`
+	URL             *string `json:"url"`
+	Username        *string `json:"username"`
+	Password        *string `json:"password"`
+	ClientID        *string `json:"clientId"`
+	ProtocolVersion *byte   `json:"protocolVersion"`
+	TLS             *struct {
+		CACert             *string `json:"caCert"`
+		Cert               *string `json:"cert"`
+		Key                *string `json:"key"`
+		InsecureSkipVerify *bool   `json:"insecureSkipVerify"`
+	} `json:"tls"`
+}
+
+// Subscription of a broker topic
+type Subscription struct {
+	ID        int64     `json:"id"`
+	BrokerID  int64     `json:"brokerId"`
+	Topic     string    `json:"topic"`
+	QoS       byte      `json:"qos"`
+	Active    bool      `json:"active"`
+	Owner     string    `json:"owner,omitempty"` // instance subscribing it in cluster mode
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// subscriptionInput body of create and patch
+type subscriptionInput struct {
+	Topic *string `json:"topic"`
+	QoS   *byte   `json:"qos"`
+}
+
+func (input *brokerInput) apply(b *Broker) {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+	set(&b.Name, input.Name)
+	set(&b.URL, input.URL)
+	set(&b.Username, input.Username)
+	if input.Password != nil {
+		b.Password = *input.Password
+	}
+	set(&b.ClientID, input.ClientID)
+	if input.ProtocolVersion != nil {
+		b.ProtocolVersion = *input.ProtocolVersion
+	}
+	if input.TLS != nil {
+		set(&b.TLS.CACert, input.TLS.CACert)
+		set(&b.TLS.Cert, input.TLS.Cert)
+		set(&b.TLS.Key, input.TLS.Key)
+		if input.TLS.InsecureSkipVerify != nil {
+			b.TLS.InsecureSkipVerify = *input.TLS.InsecureSkipVerify
+		}
+	}
+}
+
+func (input *subscriptionInput) apply(s *Subscription) {
+	if input.Topic != nil {
+		s.Topic = strings.TrimSpace(*input.Topic)
+	}
+	if input.QoS != nil {
+		s.QoS = *input.QoS
+	}
+}
+
+// validate broker fields
+func (b *Broker) validate() error {
+	if b.URL == "" {
+		return tool.Invalid("url is required")
+	}
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "parse url")
+	}
+	if !brokerSchemes[strings.ToLower(u.Scheme)] {
+		return tool.Invalid("unsupported url scheme [%s]", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return tool.Invalid("url host is required")
+	}
+	if b.ProtocolVersion == 0 {
+		b.ProtocolVersion = mqtt.Version311
+	}
+	if b.ProtocolVersion != mqtt.Version311 && b.ProtocolVersion != mqtt.Version5 {
+		return tool.Invalid("protocolVersion must be %d for MQTT 3.1.1 or %d for MQTT 5", mqtt.Version311, mqtt.Version5)
+	}
+	if len(b.Name) > 128 {
+		return tool.Invalid("name is longer than 128 characters")
+	}
+	if _, err := b.options(nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validate subscription fields
+func (s *Subscription) validate() error {
+	if s.QoS > 2 {
+		return tool.Invalid("qos must be 0, 1 or 2")
+	}
+	return validateTopicFilter(s.Topic)
+}
+
+// validateTopicFilter check mqtt wildcard rules, a shared subscription is $share/{group}/{filter}
+func validateTopicFilter(topic string) error {
+	if topic == "" {
+		return tool.Invalid("topic is required")
+	}
+	if len(topic) > 65535 {
+		return tool.Invalid("topic is too long")
+	}
+	if rest := strings.TrimPrefix(topic, "$share/"); rest != topic {
+		group, filter, _ := strings.Cut(rest, "/")
+		if group == "" || strings.ContainsAny(group, "+#") {
+			return tool.Invalid("shared subscription group of topic [%s] must be a level without wildcards", topic)
+		}
+		if filter == "" {
+			return tool.Invalid("shared subscription [%s] needs a topic filter", topic)
+		}
+		topic = filter
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return tool.Invalid("'#' must be the whole last level of topic [%s]", topic)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return tool.Invalid("'+' must be a whole level of topic [%s]", topic)
+		}
+	}
+	return nil
+}
+
+// key of broker in the connector, tenants never share a connection
+func (b *Broker) key() string {
+	return brokerKey(b.TenantID, b.ID)
+}
+
+func brokerKey(tenantID, id int64) string {
+	return fmt.Sprintf("%d/%d", tenantID, id)
+}
+
+// options of connector connection checked against p
+func (b *Broker) options(p *policy.Policy) (mqtt.Options, error) {
+	opts := mqtt.Options{
+		Broker:          b.URL,
+		Username:        b.Username,
+		Password:        b.Password,
+		ClientID:        b.ClientID,
+		ProtocolVersion: b.ProtocolVersion,
+		Policy:          p,
+	}
+	if b.TLS.CACert != "" || b.TLS.Cert != "" || b.TLS.Key != "" || b.TLS.InsecureSkipVerify {
+		cfg, err := mqtt.NewTLSConfig(b.TLS.CACert, b.TLS.Cert, b.TLS.Key, b.TLS.InsecureSkipVerify)
+		if err != nil {
+			return opts, err
+		}
+		opts.TLS = cfg
+	}
+	return opts, nil
+}
+
+// checkPolicy reject brokers the connector would refuse to dial, unresolvable hosts are left to connect time
+func (b *Broker) checkPolicy(ctx context.Context, p *policy.Policy) error {
+	opts, err := b.options(p)
+	if err != nil {
+		return err
+	}
+	if _, err := mqtt.CheckPolicy(ctx, opts); err != nil && tool.KindOf(err) != tool.KindUnavailable {
+		return err
+	}
+	return nil
+}
+
+// withStatus attach live status of the connector of b
+func (_global *global) withStatus(b *Broker) *Broker {
+	status, _ := _global.connectors.Status(b.key())
+	b.Status = &status
+	return b
+}
+
+const brokerColumns = `id, tenant_id, name, url, username, password, client_id, protocol_version, tls_ca_cert, tls_cert, tls_key, tls_insecure,
+	created_at, updated_at`
+
+func scanBroker(row rowScanner) (*Broker, error) {
+	b := &Broker{}
+	err := row.Scan(&b.ID, &b.TenantID, &b.Name, &b.URL, &b.Username, &b.Password, &b.ClientID, &b.ProtocolVersion,
+		&b.TLS.CACert, &b.TLS.Cert, &b.TLS.Key, &b.TLS.InsecureSkipVerify, &b.CreatedAt, &b.UpdatedAt)
+	return b, err
+}
+
+func (_global *global) queryBrokers(ctx context.Context, tenantID int64) ([]*Broker, error) {
+	return _global.scanBrokers(_global.pgPool.QueryContext(ctx, `select `+brokerColumns+` from brokers where tenant_id = $1 order by id;`, tenantID))
+}
+
+// queryAllBrokers of every tenant
+func (_global *global) queryAllBrokers(ctx context.Context) ([]*Broker, error) {
+	return _global.scanBrokers(_global.pgPool.QueryContext(ctx, `select `+brokerColumns+` from brokers order by id;`))
+}
+
+func (_global *global) scanBrokers(rows *sql.Rows, err error) ([]*Broker, error) {
+	if err != nil {
+		return nil, dbError(err, "query brokers")
+	}
+	defer rows.Close()
+
+	brokers := []*Broker{}
+	for rows.Next() {
+		b, err := scanBroker(rows)
+		if err != nil {
+			return nil, dbError(err, "scan broker")
+		}
+		brokers = append(brokers, b)
+	}
+	return brokers, dbError(rows.Err(), "query brokers")
+}
+
+func (_global *global) queryBroker(ctx context.Context, tenantID, id int64) (*Broker, error) {
+	b, err := scanBroker(_global.pgPool.QueryRowContext(ctx, `select `+brokerColumns+` from brokers where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query broker "+strconv.FormatInt(id, 10))
+	}
+	return b, nil
+}
+
+func insertBroker(ctx context.Context, tx *sql.Tx, b *Broker) error {
+	err := tx.QueryRowContext(ctx, `insert into brokers (tenant_id, name, url, username, password, client_id, tls_ca_cert, tls_cert, tls_key, tls_insecure,
+		protocol_version) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id, created_at, updated_at;`,
+		b.TenantID, b.Name, b.URL, b.Username, b.Password, b.ClientID, b.TLS.CACert, b.TLS.Cert, b.TLS.Key, b.TLS.InsecureSkipVerify, b.ProtocolVersion,
+	).Scan(&b.ID, &b.CreatedAt, &b.UpdatedAt)
+	return dbError(err, "insert broker")
+}
+
+func (_global *global) updateBrokerRow(ctx context.Context, b *Broker) error {
+	err := _global.pgPool.QueryRowContext(ctx, `update brokers set name = $2, url = $3, username = $4, password = $5, client_id = $6,
+		tls_ca_cert = $7, tls_cert = $8, tls_key = $9, tls_insecure = $10, protocol_version = $12, updated_at = now()
+		where id = $1 and tenant_id = $11 returning updated_at;`,
+		b.ID, b.Name, b.URL, b.Username, b.Password, b.ClientID, b.TLS.CACert, b.TLS.Cert, b.TLS.Key, b.TLS.InsecureSkipVerify, b.TenantID, b.ProtocolVersion,
+	).Scan(&b.UpdatedAt)
+	return dbError(err, "update broker "+b.key())
+}
+
+func (_global *global) deleteBrokerRow(ctx context.Context, tenantID, id int64) error {
+	res, err := _global.pgPool.ExecContext(ctx, `delete from brokers where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		return dbError(err, "delete broker")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return tool.NotFound("there is no such broker [%d]", id)
+	}
+	return nil
+}
+
+const subscriptionColumns = `id, broker_id, topic, qos, created_at`
+
+func scanSubscription(row rowScanner) (*Subscription, error) {
+	s := &Subscription{}
+	err := row.Scan(&s.ID, &s.BrokerID, &s.Topic, &s.QoS, &s.CreatedAt)
+	return s, err
+}
+
+func (_global *global) querySubscriptions(ctx context.Context, brokerID int64) ([]*Subscription, error) {
+	rows, err := _global.pgPool.QueryContext(ctx, `select `+subscriptionColumns+` from subscriptions where broker_id = $1 order by id;`, brokerID)
+	if err != nil {
+		return nil, dbError(err, "query subscriptions")
+	}
+	defer rows.Close()
+
+	subs := []*Subscription{}
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, dbError(err, "scan subscription")
+		}
+		subs = append(subs, s)
+	}
+	return subs, dbError(rows.Err(), "query subscriptions")
+}
+
+func (_global *global) querySubscription(ctx context.Context, brokerID, id int64) (*Subscription, error) {
+	s, err := scanSubscription(_global.pgPool.QueryRowContext(ctx,
+		`select `+subscriptionColumns+` from subscriptions where broker_id = $1 and id = $2;`, brokerID, id))
+	if err != nil {
+		return nil, dbError(err, "query subscription "+strconv.FormatInt(id, 10))
+	}
+	return s, nil
+}
+
+// subscribe topic of broker with the message pipeline
+func (_global *global) subscribe(b *Broker, s *Subscription) error {
+	opts, err := b.options(_global.policy)
+	if err != nil {
+		return err
+	}
+	tenantID, brok := b.TenantID, b.key()
+	open := func(ctx context.Context) (connector.Connector, error) {
+		return mqtt.Open(ctx, brok, opts)
+	}
+	return _global.connectors.Subscribe(context.Background(), brok, open, func(ctx context.Context, msg *connector.Message) error {
+		return _global.push(ctx, tenantID, brok, msg)
+	}, connector.Subscription{Topic: s.Topic, QoS: s.QoS, ID: int(s.ID)})
+}
+
+// unsubscribe topic of broker, it is fine when it is not subscribed
+func (_global *global) unsubscribe(b *Broker, topic string) error {
+	if err := _global.connectors.Unsubscribe(b.key(), topic); err != nil && tool.KindOf(err) != tool.KindNotFound {
+		return err
+	}
+	return nil
+}
+
+// resubscribe reconnect broker with its current options and subscriptions
+func (_global *global) resubscribe(ctx context.Context, b *Broker) error {
+	if err := _global.connectors.Close(b.key()); err != nil && tool.KindOf(err) != tool.KindNotFound {
+		return err
+	}
+	subs, err := _global.querySubscriptions(ctx, b.ID)
+	if err != nil {
+		return err
+	}
+	for _, s := range subs {
+		if err := _global.subscribe(b, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pathID(c *gin.Context, name string) (int64, error) {
+	id, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, tool.Wrap(tool.KindInvalid, err, "parse "+name)
+	}
+	return id, nil
+}
+
+func bindInput(c *gin.Context, input interface{}) error {
+	if err := c.ShouldBindJSON(input); err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "decode body")
+	}
+	return nil
+}
+
+func (_global *global) listBrokers(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	brokers, err := _global.queryBrokers(ctx, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	for _, b := range brokers {
+		_global.withStatus(b)
+	}
+	if err := _global.withOwners(ctx, brokers...); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, brokers)
+}
+
+func (_global *global) getBroker(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if err := _global.withOwners(ctx, b); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, _global.withStatus(b))
+}
+
+func (_global *global) createBroker(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input brokerInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	b := &Broker{TenantID: tenantOf(c)}
+	input.apply(b)
+	if err := b.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := b.checkPolicy(ctx, _global.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.inTx(ctx, func(tx *sql.Tx) error {
+		if err := checkBrokerQuota(ctx, tx, b.TenantID); err != nil {
+			return err
+		}
+		return insertBroker(ctx, tx, b)
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusCreated, _global.withStatus(b))
+}
+
+func (_global *global) updateBroker(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input brokerInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(b)
+	if err := b.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := b.checkPolicy(ctx, _global.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := _global.updateBrokerRow(ctx, b); err != nil {
+		c.Error(err)
+		return
+	}
+	if _global.leases != nil {
+		_global.leases.sync(b.ID)
+	} else if _, connected := _global.connectors.Status(b.key()); connected {
+		tool.CheckThenLog(_Log, _global.resubscribe(ctx, b), "resubscribe broker", "broker", b.ID)
+	}
+	c.JSON(http.StatusOK, _global.withStatus(b))
+}
+
+func (_global *global) deleteBroker(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	if err := _global.deleteBrokerRow(ctx, tenantID, id); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := _global.connectors.Close(brokerKey(tenantID, id)); err != nil && tool.KindOf(err) != tool.KindNotFound {
+		c.Error(err)
+		return
+	}
+	_global.edgeNodes.Forget(brokerKey(tenantID, id))
+	c.Status(http.StatusNoContent)
+}
+
+func (_global *global) listSubscriptions(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	subs, err := _global.querySubscriptions(ctx, b.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if err := _global.withOwners(ctx, b); err != nil {
+		c.Error(err)
+		return
+	}
+	status, _ := _global.connectors.Status(b.key())
+	active := make(map[string]bool, len(status.Topics))
+	for _, topic := range status.Topics {
+		active[topic] = true
+	}
+	for _, s := range subs {
+		s.Active = active[s.Topic]
+		if b.Owner != nil {
+			s.Owner = b.Owner.Instance
+			// the owner may be another instance, it subscribes with its next renewal
+			s.Active = s.Active || b.Owner.Instance != _global.cluster.instance
+		}
+	}
+	c.JSON(http.StatusOK, subs)
+}
+
+func (_global *global) createSubscription(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input subscriptionInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	s := &Subscription{BrokerID: b.ID, QoS: 2}
+	input.apply(s)
+	if err := s.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = _global.inTx(ctx, func(tx *sql.Tx) error {
+		if err := checkSubscriptionQuota(ctx, tx, b.TenantID); err != nil {
+			return err
+		}
+		err := tx.QueryRowContext(ctx, `insert into subscriptions (broker_id, topic, qos) values ($1, $2, $3) returning id, created_at;`,
+			s.BrokerID, s.Topic, s.QoS).Scan(&s.ID, &s.CreatedAt)
+		return dbError(err, "insert subscription")
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	// the broker is dialed once the row is committed, a subscription which fails takes its row along
+	if _global.leases == nil {
+		if err := _global.subscribe(b, s); err != nil {
+			tool.CheckThenLog(_Log, _global.compensate(`delete from subscriptions where id = $1;`, s.ID),
+				"drop failed subscription", "broker", b.ID, "topic", s.Topic)
+			c.Error(err)
+			return
+		}
+	}
+	_global.leases.sync(b.ID)
+	s.Active = true
+	c.JSON(http.StatusCreated, s)
+}
+
+func (_global *global) updateSubscription(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	sid, err := pathID(c, "sid")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input subscriptionInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	s, err := _global.querySubscription(ctx, b.ID, sid)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	old := *s
+	input.apply(s)
+	if err := s.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = _global.pgPool.ExecContext(ctx, `update subscriptions set topic = $2, qos = $3 where id = $1;`, s.ID, s.Topic, s.QoS)
+	if err != nil {
+		c.Error(dbError(err, "update subscription"))
+		return
+	}
+	// the broker is dialed once the row is committed, a change which fails puts the row back
+	if _global.leases == nil {
+		if err := _global.replaceSubscription(b, &old, s); err != nil {
+			tool.CheckThenLog(_Log, _global.compensate(`update subscriptions set topic = $2, qos = $3 where id = $1;`, old.ID, old.Topic, old.QoS),
+				"restore subscription row", "broker", b.ID, "topic", old.Topic)
+			c.Error(err)
+			return
+		}
+	}
+	_global.leases.sync(b.ID)
+	s.Active = true
+	c.JSON(http.StatusOK, s)
+}
+
+// replaceSubscription old of broker b with s, old is subscribed again when s fails
+func (_global *global) replaceSubscription(b *Broker, old, s *Subscription) error {
+	if err := _global.unsubscribe(b, old.Topic); err != nil {
+		return err
+	}
+	if err := _global.subscribe(b, s); err != nil {
+		tool.CheckThenLog(_Log, _global.subscribe(b, old), "restore subscription", "broker", b.ID, "topic", old.Topic)
+		return err
+	}
+	return nil
+}
+
+// compensate a committed change which could not be applied to the broker, on a context of its own
+// as the one of the request may be spent by then
+func (_global *global) compensate(query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := _global.pgPool.ExecContext(ctx, query, args...)
+	return dbError(err, "compensate subscription")
+}
+
+func (_global *global) deleteSubscription(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	sid, err := pathID(c, "sid")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	b, err := _global.queryBroker(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	s, err := _global.querySubscription(ctx, b.ID, sid)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _global.leases == nil {
+		if err := _global.unsubscribe(b, s.Topic); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+	if _, err := _global.pgPool.ExecContext(ctx, `delete from subscriptions where id = $1;`, s.ID); err != nil {
+		c.Error(dbError(err, "delete subscription"))
+		return
+	}
+	_global.leases.sync(b.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// loadSubscriptions subscribe every stored subscription, failures are logged and skipped
+func (_global *global) loadSubscriptions(ctx context.Context) error {
+	brokers, err := _global.queryAllBrokers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range brokers {
+		subs, err := _global.querySubscriptions(ctx, b.ID)
+		if err != nil {
+			return err
+		}
+		for _, s := range subs {
+			tool.CheckThenLog(_Log, _global.subscribe(b, s), "restore subscription", "broker", b.ID, "topic", s.Topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+
+	"dataservice/connector/mqtt"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("broker", func() {
+	DescribeTable("validate url",
+		func(url string, kind tool.Kind, valid bool) {
+			err := (&Broker{URL: url}).validate()
+			if valid {
+				Ω(err).ToNot(HaveOccurred())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(kind))
+			}
+		},
+		Entry("tcp", "tcp://mosquitto:1883", tool.KindInternal, true),
+		Entry("websocket", "wss://broker.example.com:8084/mqtt", tool.KindInternal, true),
+		Entry("empty", "", tool.KindInvalid, false),
+		Entry("http", "http://localhost:1883", tool.KindInvalid, false),
+		Entry("no host", "tcp://:1883", tool.KindInvalid, false),
+	)
+
+	It("should default to mqtt 3.1.1 and accept only known protocol versions", func() {
+		b := &Broker{URL: "tcp://a:1883"}
+		Ω(b.validate()).To(Succeed())
+		Ω(b.ProtocolVersion).To(Equal(mqtt.Version311))
+		b.ProtocolVersion = mqtt.Version5
+		Ω(b.validate()).To(Succeed())
+		b.ProtocolVersion = 3
+		Ω(tool.KindOf(b.validate())).To(Equal(tool.KindInvalid))
+	})
+
+	It("should reject broken certificates", func() {
+		b := &Broker{URL: "ssl://localhost:8883", TLS: BrokerTLS{CACert: "not a pem"}}
+		Ω(tool.KindOf(b.validate())).To(Equal(tool.KindInvalid))
+	})
+
+	It("should patch only given fields", func() {
+		b := &Broker{URL: "tcp://a:1883", Username: "user", Password: "secret"}
+		var input brokerInput
+		Ω(json.Unmarshal([]byte(`{"url": " tcp://b:1883 ", "tls": {"insecureSkipVerify": true}}`), &input)).To(Succeed())
+		input.apply(b)
+
+		Ω(b.URL).To(Equal("tcp://b:1883"))
+		Ω(b.Username).To(Equal("user"))
+		Ω(b.Password).To(Equal("secret"))
+		Ω(b.TLS.InsecureSkipVerify).To(BeTrue())
+	})
+
+	It("should not expose secrets", func() {
+		b := &Broker{URL: "tcp://a:1883", Password: "secret", TLS: BrokerTLS{Key: "private"}}
+		out, err := json.Marshal(b)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(out)).ToNot(ContainSubstring("secret"))
+		Ω(string(out)).ToNot(ContainSubstring("private"))
+	})
+})
+
+var _ = Describe("subscription", func() {
+	DescribeTable("validate topic filter",
+		func(topic string, valid bool) {
+			err := (&Subscription{Topic: topic, QoS: 1}).validate()
+			if valid {
+				Ω(err).ToNot(HaveOccurred())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+			}
+		},
+		Entry("plain", "devices/1/telemetry", true),
+		Entry("multi level", "devices/#", true),
+		Entry("single level", "devices/+/telemetry", true),
+		Entry("everything", "#", true),
+		Entry("empty", "", false),
+		Entry("# not last", "devices/#/telemetry", false),
+		Entry("# inside level", "devices/a#", false),
+		Entry("+ inside level", "devices/a+/telemetry", false),
+		Entry("shared", "$share/workers/devices/+/telemetry", true),
+		Entry("shared without group", "$share//devices/#", false),
+		Entry("shared without filter", "$share/workers", false),
+		Entry("shared with wildcard group", "$share/w+/devices/#", false),
+	)
+
+	It("should reject qos above 2", func() {
+		Ω(tool.KindOf((&Subscription{Topic: "a", QoS: 3}).validate())).To(Equal(tool.KindInvalid))
+	})
+})
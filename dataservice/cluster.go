@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/tool"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// clusterConfig of instances splitting the brokers between them
+type clusterConfig struct {
+	enabled      bool
+	instance     string
+	leaseTimeout time.Duration
+}
+
+// BrokerOwner instance holding the lease of a broker
+type BrokerOwner struct {
+	Instance  string    `json:"instance"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ownedBroker as applied to the connector, subscriptions are topics with their qos
+type ownedBroker struct {
+	key       string
+	updatedAt time.Time
+	subs      map[string]byte
+}
+
+// brokerLeases split brokers between the instances of a cluster: each instance claims its fair share of brokers
+// whose lease is free or expired, renews its leases and connects only the brokers it holds;
+// an instance that stops renewing loses its brokers to the others after the lease timeout, and drops them itself.
+// Renewals never wait for brokers, the held brokers are applied to the connector apart from them
+type brokerLeases struct {
+	sync.Mutex // the leases
+	pgPool     *sql.DB
+	instance   string
+	timeout    time.Duration
+	renewed    time.Time // when the last successful renewal started
+	held       []int64   // brokers leased by the last renewal
+	changes    chan struct{}
+	applying   sync.Mutex // the owned brokers and the connector
+	owned      map[int64]*ownedBroker
+	connectors *connector.Registry
+	subscribe  func(b *Broker, s *Subscription) error
+	forget     func(brok string) // session state of a closed broker connection
+}
+
+func newBrokerLeases(pgPool *sql.DB, instance string, timeout time.Duration, connectors *connector.Registry,
+	subscribe func(b *Broker, s *Subscription) error, forget func(brok string)) *brokerLeases {
+	return &brokerLeases{pgPool: pgPool, instance: instance, timeout: timeout, changes: make(chan struct{}, 1),
+		owned: make(map[int64]*ownedBroker), connectors: connectors, subscribe: subscribe, forget: forget}
+}
+
+// fairShare of brokers for each of members instances
+func fairShare(brokers, members int) int {
+	if members < 1 {
+		members = 1
+	}
+	return (brokers + members - 1) / members
+}
+
+// subscriptionChanges turning applied subscriptions into desired ones, a changed qos takes both
+func subscriptionChanges(applied map[string]byte, desired []*Subscription) (unsubscribe []string, subscribe []*Subscription) {
+	want := make(map[string]bool, len(desired))
+	for _, s := range desired {
+		want[s.Topic] = true
+		qos, ok := applied[s.Topic]
+		if ok && qos != s.QoS {
+			unsubscribe = append(unsubscribe, s.Topic)
+		}
+		if !ok || qos != s.QoS {
+			subscribe = append(subscribe, s)
+		}
+	}
+	for topic := range applied {
+		if !want[topic] {
+			unsubscribe = append(unsubscribe, topic)
+		}
+	}
+	sort.Strings(unsubscribe)
+	return
+}
+
+// balance renew the membership and the leases of this instance, claim or release brokers towards its fair share
+// and have the brokers it holds applied to the connector
+func (l *brokerLeases) balance(ctx context.Context) error {
+	l.Lock()
+	defer l.Unlock()
+
+	started := time.Now()
+	timeout := l.timeout.Milliseconds()
+	_, err := l.pgPool.ExecContext(ctx, `insert into cluster_members (instance, seen_at) values ($1, now())
+		on conflict (instance) do update set seen_at = excluded.seen_at;`, l.instance)
+	if err != nil {
+		return dbError(err, "renew cluster membership")
+	}
+	var members, brokers int
+	err = l.pgPool.QueryRowContext(ctx, `select (select count(*) from cluster_members where seen_at > now() - $1::bigint * interval '1 millisecond'),
+		(select count(*) from brokers);`, timeout).Scan(&members, &brokers)
+	if err != nil {
+		return dbError(err, "count cluster members")
+	}
+
+	held, err := l.leases(l.pgPool.QueryContext(ctx, `update broker_leases set expires_at = now() + $2::bigint * interval '1 millisecond'
+		where owner = $1 returning broker_id;`, l.instance, timeout))
+	if err != nil {
+		return dbError(err, "renew broker leases")
+	}
+	l.renewed = started
+	share := fairShare(brokers, members)
+	if len(held) > share {
+		sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+		released := held[share:]
+		_, err := l.pgPool.ExecContext(ctx, `delete from broker_leases where owner = $1 and broker_id = any($2);`, l.instance, pq.Array(released))
+		if err != nil {
+			return dbError(err, "release broker leases")
+		}
+		_Log.Info("release brokers beyond fair share", "instance", l.instance, "brokers", released, "share", share)
+		held = held[:share]
+	} else if len(held) < share {
+		claimed, err := l.leases(l.pgPool.QueryContext(ctx, `insert into broker_leases (broker_id, owner, expires_at)
+			select b.id, $1, now() + $2::bigint * interval '1 millisecond' from brokers b left join broker_leases l on l.broker_id = b.id
+			where l.broker_id is null or l.expires_at < now() order by b.id limit $3
+			on conflict (broker_id) do update set owner = excluded.owner, expires_at = excluded.expires_at where broker_leases.expires_at < now()
+			returning broker_id;`, l.instance, timeout, share-len(held)))
+		if err != nil {
+			return dbError(err, "claim broker leases")
+		}
+		if len(claimed) > 0 {
+			_Log.Info("claim brokers", "instance", l.instance, "brokers", claimed, "share", share)
+		}
+		held = append(held, claimed...)
+	}
+
+	holding := make(map[int64]bool, len(held))
+	for _, id := range held {
+		holding[id] = true
+	}
+	for _, id := range l.held {
+		if !holding[id] {
+			_Log.Warn("lost broker lease", "instance", l.instance, "broker", id)
+		}
+	}
+	l.held = held
+	l.changed()
+	return nil
+}
+
+// changed wake the apply loop, a wake already pending covers this one
+func (l *brokerLeases) changed() {
+	select {
+	case l.changes <- struct{}{}:
+	default:
+	}
+}
+
+// holds whether the leases of this instance cover broker id and are still live
+func (l *brokerLeases) holds(id int64) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if time.Since(l.renewed) > l.timeout {
+		return false
+	}
+	for _, held := range l.held {
+		if held == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *brokerLeases) leases(rows *sql.Rows, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// apply the held brokers to the connector: a changed broker is connected again, one no longer held or gone is dropped
+func (l *brokerLeases) apply(ctx context.Context) error {
+	l.Lock()
+	ids := append([]int64(nil), l.held...)
+	l.Unlock()
+
+	l.applying.Lock()
+	defer l.applying.Unlock()
+
+	brokers, subs := []*Broker{}, map[int64][]*Subscription{}
+	if len(ids) > 0 {
+		var err error
+		if brokers, subs, err = l.query(ctx, ids); err != nil {
+			return err
+		}
+	}
+	current := make(map[int64]bool, len(brokers))
+	for _, b := range brokers {
+		current[b.ID] = true
+	}
+	for id := range l.owned {
+		if !current[id] {
+			l.drop(id)
+		}
+	}
+	for _, b := range brokers {
+		// a lease may expire while slow brokers are dialed
+		if !l.holds(b.ID) {
+			l.drop(b.ID)
+			continue
+		}
+		o := l.owned[b.ID]
+		if o == nil || !o.updatedAt.Equal(b.UpdatedAt) {
+			if o != nil {
+				l.drop(b.ID)
+			}
+			o = &ownedBroker{key: b.key(), updatedAt: b.UpdatedAt, subs: make(map[string]byte)}
+			l.owned[b.ID] = o
+		}
+		unsubscribe, subscribe := subscriptionChanges(o.subs, subs[b.ID])
+		for _, topic := range unsubscribe {
+			if err := l.connectors.Unsubscribe(b.key(), topic); err != nil && tool.KindOf(err) != tool.KindNotFound {
+				_Log.Error("unsubscribe owned broker", "broker", b.ID, "topic", topic, "err", err)
+				continue
+			}
+			delete(o.subs, topic)
+		}
+		for _, s := range subscribe {
+			// failed subscriptions are tried again with the next renewal
+			if err := l.subscribe(b, s); err != nil {
+				_Log.Error("subscribe owned broker", "broker", b.ID, "topic", s.Topic, "err", err)
+				continue
+			}
+			o.subs[s.Topic] = s.QoS
+		}
+	}
+	return nil
+}
+
+// query brokers ids along with their subscriptions by broker
+func (l *brokerLeases) query(ctx context.Context, ids []int64) ([]*Broker, map[int64][]*Subscription, error) {
+	rows, err := l.pgPool.QueryContext(ctx, `select `+brokerColumns+` from brokers where id = any($1) order by id;`, pq.Array(ids))
+	if err != nil {
+		return nil, nil, dbError(err, "query owned brokers")
+	}
+	defer rows.Close()
+
+	brokers := []*Broker{}
+	for rows.Next() {
+		b, err := scanBroker(rows)
+		if err != nil {
+			return nil, nil, dbError(err, "scan broker")
+		}
+		brokers = append(brokers, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, dbError(err, "query owned brokers")
+	}
+
+	rows, err = l.pgPool.QueryContext(ctx, `select `+subscriptionColumns+` from subscriptions where broker_id = any($1) order by id;`, pq.Array(ids))
+	if err != nil {
+		return nil, nil, dbError(err, "query subscriptions")
+	}
+	defer rows.Close()
+
+	subs := make(map[int64][]*Subscription)
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, nil, dbError(err, "scan subscription")
+		}
+		subs[s.BrokerID] = append(subs[s.BrokerID], s)
+	}
+	return brokers, subs, dbError(rows.Err(), "query subscriptions")
+}
+
+// drop broker id from the connector
+func (l *brokerLeases) drop(id int64) {
+	if o := l.owned[id]; o != nil {
+		if err := l.connectors.Close(o.key); err != nil && tool.KindOf(err) != tool.KindNotFound {
+			_Log.Error("close broker", "broker", id, "err", err)
+		}
+		l.forget(o.key)
+	}
+	delete(l.owned, id)
+}
+
+// expire drop all brokers once the lease timeout passed since the last renewal, as the others may have claimed them
+func (l *brokerLeases) expire(now time.Time) {
+	l.Lock()
+	expired := now.Sub(l.renewed) > l.timeout
+	if expired {
+		l.held = nil
+	}
+	l.Unlock()
+	if !expired {
+		return
+	}
+
+	l.applying.Lock()
+	defer l.applying.Unlock()
+
+	if len(l.owned) == 0 {
+		return
+	}
+	_Log.Warn("broker leases expired without renewal, drop brokers", "instance", l.instance, "renewed", l.renewed, "brokers", len(l.owned))
+	for id := range l.owned {
+		l.drop(id)
+	}
+}
+
+// sync broker id soon when this instance holds it, otherwise its owner applies changes with its next renewal
+func (l *brokerLeases) sync(id int64) {
+	if l != nil && l.holds(id) {
+		l.changed()
+	}
+}
+
+// applyChanges apply the held brokers whenever renewals or changes ask for it until ctx is done
+func (l *brokerLeases) applyChanges(ctx context.Context) {
+	for {
+		select {
+		case <-l.changes:
+			actx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.CheckThenLog(_Log, l.apply(actx), "apply held brokers", "instance", l.instance)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// release leases of this instance and leave the cluster, the others take its brokers over with their next renewal
+func (l *brokerLeases) release(ctx context.Context) error {
+	l.applying.Lock()
+	for id := range l.owned {
+		l.drop(id)
+	}
+	l.applying.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.held = nil
+	if _, err := l.pgPool.ExecContext(ctx, `delete from broker_leases where owner = $1;`, l.instance); err != nil {
+		return dbError(err, "release broker leases")
+	}
+	_, err := l.pgPool.ExecContext(ctx, `delete from cluster_members where instance = $1;`, l.instance)
+	return dbError(err, "leave cluster")
+}
+
+// run renew leases three times per lease timeout until ctx is done, leases are released on the way out
+func (l *brokerLeases) run(ctx context.Context) {
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		l.applyChanges(ctx)
+	}()
+	ticker := time.NewTicker(l.timeout / 3)
+	defer ticker.Stop()
+
+	for {
+		bctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		if err := l.balance(bctx); err != nil {
+			tool.ErrorThenPrint(err, "balance broker leases")
+			l.expire(time.Now())
+		}
+		cancel()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			<-applied
+			rctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			tool.ErrorThenPrint(l.release(rctx), "release broker leases")
+			cancel()
+			return
+		}
+	}
+}
+
+// owners of live leases of brokers ids
+func (_global *global) brokerOwners(ctx context.Context, ids []int64) (map[int64]*BrokerOwner, error) {
+	owners := make(map[int64]*BrokerOwner)
+	if _global.leases == nil || len(ids) == 0 {
+		return owners, nil
+	}
+	rows, err := _global.pgPool.QueryContext(ctx, `select broker_id, owner, expires_at from broker_leases
+		where broker_id = any($1) and expires_at > now();`, pq.Array(ids))
+	if err != nil {
+		return nil, dbError(err, "query broker leases")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		o := &BrokerOwner{}
+		if err := rows.Scan(&id, &o.Instance, &o.ExpiresAt); err != nil {
+			return nil, dbError(err, "scan broker lease")
+		}
+		owners[id] = o
+	}
+	return owners, dbError(rows.Err(), "query broker leases")
+}
+
+// withOwners attach the owners of brokers in cluster mode
+func (_global *global) withOwners(ctx context.Context, brokers ...*Broker) error {
+	ids := make([]int64, 0, len(brokers))
+	for _, b := range brokers {
+		ids = append(ids, b.ID)
+	}
+	owners, err := _global.brokerOwners(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, b := range brokers {
+		b.Owner = owners[b.ID]
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"dataservice/connector"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cluster", func() {
+	It("should split brokers into fair shares", func() {
+		Ω(fairShare(0, 2)).To(Equal(0))
+		Ω(fairShare(5, 2)).To(Equal(3))
+		Ω(fairShare(4, 2)).To(Equal(2))
+		Ω(fairShare(3, 0)).To(Equal(3), "this instance counts before its first heartbeat")
+	})
+
+	It("should turn applied subscriptions into desired ones", func() {
+		applied := map[string]byte{"a": 1, "b": 1, "c": 0}
+		desired := []*Subscription{{Topic: "a", QoS: 1}, {Topic: "b", QoS: 2}, {Topic: "d", QoS: 0}}
+		unsubscribe, subscribe := subscriptionChanges(applied, desired)
+		Ω(unsubscribe).To(Equal([]string{"b", "c"}))
+		Ω(subscribe).To(Equal([]*Subscription{desired[1], desired[2]}))
+
+		unsubscribe, subscribe = subscriptionChanges(map[string]byte{}, nil)
+		Ω(unsubscribe).To(BeEmpty())
+		Ω(subscribe).To(BeEmpty())
+	})
+
+	It("should drop owned brokers once their leases expire without renewal", func() {
+		forgotten := []string{}
+		l := newBrokerLeases(nil, "a", time.Minute, connector.NewRegistry(), nil, func(brok string) { forgotten = append(forgotten, brok) })
+		renewed := time.Now()
+		l.renewed = renewed
+		l.owned[1] = &ownedBroker{key: "1", subs: map[string]byte{}}
+
+		l.expire(renewed.Add(time.Minute))
+		Ω(l.owned).To(HaveLen(1))
+		l.expire(renewed.Add(time.Minute + time.Second))
+		Ω(l.owned).To(BeEmpty())
+		Ω(forgotten).To(Equal([]string{"1"}))
+	})
+
+	It("should have only brokers held by live leases synced", func() {
+		l := newBrokerLeases(nil, "a", time.Minute, connector.NewRegistry(), nil, nil)
+		l.held = []int64{1}
+		l.renewed = time.Now()
+
+		l.sync(2)
+		Ω(l.changes).To(BeEmpty())
+		l.sync(1)
+		l.sync(1)
+		Ω(l.changes).To(HaveLen(1), "a pending change covers the next one")
+
+		<-l.changes
+		l.renewed = time.Now().Add(-time.Minute - time.Second)
+		l.sync(1)
+		Ω(l.changes).To(BeEmpty())
+
+		var none *brokerLeases
+		Ω(func() { none.sync(1) }).NotTo(Panic())
+	})
+})
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"dataservice/connector/coap"
+	"dataservice/tool"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// coapConfig of the coap listener of constrained devices
+type coapConfig struct {
+	enabled bool
+	addr    string
+	topic   string // with device.IDPlaceholder, the topic telemetry is handled as
+}
+
+// coapContentTypes of the content formats devices post telemetry in
+var coapContentTypes = map[uint16]string{
+	coap.FormatText: "text/plain",
+	coap.FormatJSON: "application/json",
+	coap.FormatCBOR: "application/cbor",
+}
+
+// coapRequest of a device: telemetry posted to /telemetry/{deviceToken} takes the way of http ingest,
+// a GET of /shadow/{deviceToken} returns the delta of its shadow and registers observers for the next ones
+func (_global *global) coapRequest(req *coap.Request) *coap.Response {
+	path := req.Path()
+	if len(path) != 2 || (path[0] != "telemetry" && path[0] != "shadow") {
+		return &coap.Response{Code: coap.NotFound}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	switch {
+	case path[0] == "telemetry" && (req.Code == coap.POST || req.Code == coap.PUT):
+		format, ok := req.Format()
+		if !ok {
+			format = coap.FormatJSON
+		}
+		contentType, ok := coapContentTypes[format]
+		if !ok {
+			return &coap.Response{Code: coap.UnsupportedContentFormat}
+		}
+		ref, err := _global.deviceByToken(ctx, path[1])
+		if err != nil {
+			return coapError(err, 0)
+		}
+		_, retryAfter, err := _global.ingestBatch(context.Background(), ref, _global.coapListener.topic, contentType, req.Payload)
+		if err != nil {
+			return coapError(err, retryAfter)
+		}
+		return &coap.Response{Code: coap.Changed}
+	case path[0] == "shadow" && req.Code == coap.GET:
+		ref, err := _global.deviceByToken(ctx, path[1])
+		if err != nil {
+			return coapError(err, 0)
+		}
+		sh, err := _global.shadows.query(ctx, ref.id, ref.deviceID)
+		if err != nil {
+			return coapError(err, 0)
+		}
+		payload, err := json.Marshal(shadowDelta{Version: sh.Version, State: sh.Delta, Timestamp: time.Now()})
+		if err != nil {
+			return coapError(tool.Wrap(tool.KindInternal, err, "encode shadow delta"), 0)
+		}
+		return &coap.Response{Code: coap.Content, Format: coap.FormatJSON, Payload: payload, Observe: strconv.FormatInt(ref.id, 10)}
+	}
+	return &coap.Response{Code: coap.MethodNotAllowed}
+}
+
+// coapError response of err with its message as diagnostic payload, max age tells a rate limited device when to come back
+func coapError(err error, retryAfter time.Duration) *coap.Response {
+	resp := &coap.Response{Code: coapCodeOf(err), Format: coap.FormatText, Payload: []byte(err.Error()),
+		MaxAge: uint32(math.Ceil(retryAfter.Seconds()))}
+	if resp.Code >= coap.InternalServerError {
+		_Log.Error("coap request failure", "code", resp.Code.String(), "err", err)
+	} else {
+		_Log.Warn("coap request failure", "code", resp.Code.String(), "err", err)
+	}
+	return resp
+}
+
+// coapCodeOf error kind
+func coapCodeOf(err error) coap.Code {
+	switch tool.KindOf(err) {
+	case tool.KindNotFound:
+		return coap.NotFound
+	case tool.KindUnavailable:
+		return coap.ServiceUnavailable
+	case tool.KindInvalid, tool.KindConflict:
+		return coap.BadRequest
+	case tool.KindUnauthorized:
+		return coap.Unauthorized
+	case tool.KindForbidden:
+		return coap.Forbidden
+	case tool.KindRateLimited:
+		return coap.TooManyRequests
+	default:
+		return coap.InternalServerError
+	}
+}
+
+// notifyCoap observers of the shadow delta of device id
+func (_global *global) notifyCoap(id int64, payload []byte) bool {
+	return _global.coapServer.Notify(strconv.FormatInt(id, 10), coap.FormatJSON, payload) > 0
+}
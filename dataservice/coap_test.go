@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"dataservice/connector/coap"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("coap", func() {
+	request := func(code coap.Code, path string) *coap.Request {
+		m := &coap.Message{Type: coap.Confirmable, Code: code}
+		m.SetPath(path)
+		return &coap.Request{Message: m}
+	}
+
+	It("should route requests by path and method", func() {
+		_global := &global{}
+		Ω(_global.coapRequest(request(coap.POST, "/devices/abc")).Code).To(Equal(coap.NotFound))
+		Ω(_global.coapRequest(request(coap.POST, "/telemetry")).Code).To(Equal(coap.NotFound))
+		Ω(_global.coapRequest(request(coap.GET, "/telemetry/abc")).Code).To(Equal(coap.MethodNotAllowed))
+		Ω(_global.coapRequest(request(coap.DELETE, "/shadow/abc")).Code).To(Equal(coap.MethodNotAllowed))
+
+		req := request(coap.POST, "/telemetry/abc")
+		req.SetUint(coap.OptionContentFormat, 41) // application/xml
+		Ω(_global.coapRequest(req).Code).To(Equal(coap.UnsupportedContentFormat))
+	})
+
+	It("should tell a rate limited device when to come back", func() {
+		resp := coapError(tool.RateLimited("too fast"), 1500*time.Millisecond)
+		Ω(resp.Code).To(Equal(coap.TooManyRequests))
+		Ω(resp.MaxAge).To(Equal(uint32(2)))
+		Ω(string(resp.Payload)).To(Equal("too fast"))
+	})
+
+	DescribeTable("maps error kinds to response codes",
+		func(err error, code coap.Code) {
+			Ω(coapCodeOf(err)).To(Equal(code))
+		},
+		Entry("not found", tool.NotFound("no such device"), coap.NotFound),
+		Entry("invalid", tool.Invalid("bad json"), coap.BadRequest),
+		Entry("unauthorized", tool.Unauthorized("unknown device token"), coap.Unauthorized),
+		Entry("forbidden", tool.Forbidden("quota"), coap.Forbidden),
+		Entry("rate limited", tool.RateLimited("too fast"), coap.TooManyRequests),
+		Entry("unavailable", tool.Unavailable("queue"), coap.ServiceUnavailable),
+		Entry("internal", errors.New("boom"), coap.InternalServerError),
+	)
+})
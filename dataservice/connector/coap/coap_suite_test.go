@@ -0,0 +1,13 @@
+package coap_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCoap(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Coap Suite")
+}
@@ -0,0 +1,288 @@
+package coap
+
+import (
+	"dataservice/tool"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// version of the protocol, RFC 7252
+const version = 1
+
+// payloadMarker between options and payload
+const payloadMarker = 0xff
+
+// Type of message
+type Type uint8
+
+// message types
+const (
+	Confirmable Type = iota
+	NonConfirmable
+	Acknowledgement
+	Reset
+)
+
+// Code of a request method or a response, class in the upper 3 bits and detail in the lower 5
+type Code uint8
+
+// request methods
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+)
+
+// response codes
+const (
+	Created                  Code = 2<<5 | 1
+	Deleted                  Code = 2<<5 | 2
+	Valid                    Code = 2<<5 | 3
+	Changed                  Code = 2<<5 | 4
+	Content                  Code = 2<<5 | 5
+	BadRequest               Code = 4<<5 | 0
+	Unauthorized             Code = 4<<5 | 1
+	BadOption                Code = 4<<5 | 2
+	Forbidden                Code = 4<<5 | 3
+	NotFound                 Code = 4<<5 | 4
+	MethodNotAllowed         Code = 4<<5 | 5
+	RequestEntityTooLarge    Code = 4<<5 | 13
+	UnsupportedContentFormat Code = 4<<5 | 15
+	TooManyRequests          Code = 4<<5 | 29 // RFC 8516
+	InternalServerError      Code = 5<<5 | 0
+	ServiceUnavailable       Code = 5<<5 | 3
+)
+
+// IsRequest method code
+func (c Code) IsRequest() bool {
+	return c > Empty && c>>5 == 0
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// option numbers
+const (
+	OptionURIHost       uint16 = 3
+	OptionObserve       uint16 = 6
+	OptionURIPort       uint16 = 7
+	OptionURIPath       uint16 = 11
+	OptionContentFormat uint16 = 12
+	OptionMaxAge        uint16 = 14
+	OptionURIQuery      uint16 = 15
+	OptionAccept        uint16 = 17
+)
+
+// content formats
+const (
+	FormatText uint16 = 0
+	FormatJSON uint16 = 50
+	FormatCBOR uint16 = 60
+)
+
+// Option of a message, options of the same number may repeat
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// critical options must be understood, the others may be ignored
+func critical(number uint16) bool {
+	return number&1 == 1
+}
+
+// Message of the protocol
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Parse datagram b
+func Parse(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, tool.Invalid("message of %d bytes is shorter than its header", len(b))
+	}
+	if b[0]>>6 != version {
+		return nil, tool.Invalid("unknown version %d", b[0]>>6)
+	}
+	m := &Message{Type: Type(b[0] >> 4 & 0x3), Code: Code(b[1]), MessageID: binary.BigEndian.Uint16(b[2:4])}
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 || len(b) < 4+tkl {
+		return nil, tool.Invalid("token of length %d", tkl)
+	}
+	if tkl > 0 {
+		m.Token = append([]byte(nil), b[4:4+tkl]...)
+	}
+	if m.Code == Empty && (tkl > 0 || len(b) > 4) {
+		return nil, tool.Invalid("empty message with content")
+	}
+
+	b = b[4+tkl:]
+	var number uint16
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return nil, tool.Invalid("payload marker without payload")
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = extended(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = extended(length, b); err != nil {
+			return nil, err
+		}
+		if int(number)+delta > 0xffff {
+			return nil, tool.Invalid("option number beyond 65535")
+		}
+		if len(b) < length {
+			return nil, tool.Invalid("option value of length %d beyond the message", length)
+		}
+		number += uint16(delta)
+		m.Options = append(m.Options, Option{Number: number, Value: append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// extended option delta or length n of its nibble, the rest of b follows
+func extended(n int, b []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, tool.Invalid("truncated option")
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, tool.Invalid("truncated option")
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, tool.Invalid("reserved option nibble")
+	}
+	return n, b, nil
+}
+
+// Marshal m into a datagram, options go in the order of their numbers
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, tool.Invalid("token of length %d", len(m.Token))
+	}
+	b := []byte{version<<6 | byte(m.Type)<<4 | byte(len(m.Token)), byte(m.Code), 0, 0}
+	binary.BigEndian.PutUint16(b[2:], m.MessageID)
+	b = append(b, m.Token...)
+
+	options := append([]Option(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	var number uint16
+	for _, o := range options {
+		delta, dext := nibble(int(o.Number - number))
+		length, lext := nibble(len(o.Value))
+		b = append(b, byte(delta<<4|length))
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	return b, nil
+}
+
+// nibble of option delta or length n and its extended bytes
+func nibble(n int) (int, []byte) {
+	switch {
+	case n < 13:
+		return n, nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(n-269))
+		return 14, ext
+	}
+}
+
+// Option value of number, the first one when it repeats
+func (m *Message) Option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Uint value of option number
+func (m *Message) Uint(number uint16) (uint32, bool) {
+	v, ok := m.Option(number)
+	if !ok || len(v) > 4 {
+		return 0, false
+	}
+	var n uint32
+	for _, b := range v {
+		n = n<<8 | uint32(b)
+	}
+	return n, true
+}
+
+// SetUint option number to v, in the fewest bytes
+func (m *Message) SetUint(number uint16, v uint32) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	m.SetOption(number, b)
+}
+
+// SetOption number to v, replacing its values
+func (m *Message) SetOption(number uint16, v []byte) {
+	options := m.Options[:0]
+	for _, o := range m.Options {
+		if o.Number != number {
+			options = append(options, o)
+		}
+	}
+	m.Options = append(options, Option{Number: number, Value: v})
+}
+
+// Path of the uri path options
+func (m *Message) Path() []string {
+	var path []string
+	for _, o := range m.Options {
+		if o.Number == OptionURIPath {
+			path = append(path, string(o.Value))
+		}
+	}
+	return path
+}
+
+// SetPath to the segments of path
+func (m *Message) SetPath(path string) {
+	options := m.Options[:0]
+	for _, o := range m.Options {
+		if o.Number != OptionURIPath {
+			options = append(options, o)
+		}
+	}
+	m.Options = options
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		m.Options = append(m.Options, Option{Number: OptionURIPath, Value: []byte(s)})
+	}
+}
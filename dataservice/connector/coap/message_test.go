@@ -0,0 +1,66 @@
+package coap_test
+
+import (
+	"bytes"
+	"dataservice/connector/coap"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("message", func() {
+	It("should marshal and parse a message", func() {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.POST, MessageID: 0x1234, Token: []byte{1, 2, 3}, Payload: []byte(`{"t": 1}`)}
+		m.SetPath("/telemetry/" + string(bytes.Repeat([]byte("k"), 300)))
+		m.SetUint(coap.OptionContentFormat, uint32(coap.FormatJSON))
+		m.SetUint(coap.OptionObserve, 0)
+		b, err := m.Marshal()
+		Ω(err).ToNot(HaveOccurred())
+
+		p, err := coap.Parse(b)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(p.Type).To(Equal(coap.Confirmable))
+		Ω(p.Code).To(Equal(coap.POST))
+		Ω(p.MessageID).To(Equal(uint16(0x1234)))
+		Ω(p.Token).To(Equal([]byte{1, 2, 3}))
+		Ω(p.Path()).To(Equal([]string{"telemetry", string(bytes.Repeat([]byte("k"), 300))}))
+		format, ok := p.Uint(coap.OptionContentFormat)
+		Ω(ok).To(BeTrue())
+		Ω(format).To(Equal(uint32(coap.FormatJSON)))
+		observe, ok := p.Uint(coap.OptionObserve)
+		Ω(ok).To(BeTrue())
+		Ω(observe).To(BeZero())
+		Ω(p.Payload).To(Equal([]byte(`{"t": 1}`)))
+	})
+
+	It("should parse an empty message", func() {
+		p, err := coap.Parse([]byte{0x40, 0, 0, 7})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(p.Code).To(Equal(coap.Empty))
+		Ω(p.MessageID).To(Equal(uint16(7)))
+	})
+
+	It("should name codes by class and detail", func() {
+		Ω(coap.Content.String()).To(Equal("2.05"))
+		Ω(coap.TooManyRequests.String()).To(Equal("4.29"))
+		Ω(coap.PUT.IsRequest()).To(BeTrue())
+		Ω(coap.Changed.IsRequest()).To(BeFalse())
+		Ω(coap.Empty.IsRequest()).To(BeFalse())
+	})
+
+	table.DescribeTable("reject malformed messages",
+		func(b []byte) {
+			_, err := coap.Parse(b)
+			Ω(err).To(HaveOccurred())
+		},
+		table.Entry("short header", []byte{0x40, 1}),
+		table.Entry("version", []byte{0x80, 1, 0, 1}),
+		table.Entry("token length", []byte{0x49, 1, 0, 1, 1, 2, 3, 4, 5, 6, 7, 8, 9}),
+		table.Entry("truncated token", []byte{0x44, 1, 0, 1, 1}),
+		table.Entry("empty with token", []byte{0x41, 0, 0, 1, 1}),
+		table.Entry("payload marker alone", []byte{0x40, 2, 0, 1, 0xff}),
+		table.Entry("reserved nibble", []byte{0x40, 2, 0, 1, 0xf1, 0}),
+		table.Entry("option beyond message", []byte{0x40, 2, 0, 1, 0xb5, 'a'}),
+	)
+})
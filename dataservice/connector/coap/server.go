@@ -0,0 +1,419 @@
+package coap
+
+import (
+	"dataservice/logger"
+	"dataservice/tool"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// transmission parameters of RFC 7252 section 4.8
+const (
+	ackTimeout       = 2 * time.Second
+	ackRandomFactor  = 1.5
+	maxRetransmit    = 4
+	exchangeLifetime = 247 * time.Second
+)
+
+// maxDatagram read from the socket
+const maxDatagram = 64 << 10
+
+var _Log = logger.Component("coap")
+
+// Request received by the server
+type Request struct {
+	*Message
+	Addr net.Addr
+}
+
+// Observe option of the request: 0 registers the client, 1 deregisters it, -1 when there is none
+func (r *Request) Observe() int {
+	v, ok := r.Uint(OptionObserve)
+	if !ok {
+		return -1
+	}
+	return int(v)
+}
+
+// Format of the payload, ok is false without content format
+func (r *Request) Format() (format uint16, ok bool) {
+	v, ok := r.Uint(OptionContentFormat)
+	return uint16(v), ok
+}
+
+// Response of a handler; a GET asking to observe registers the client for the notifications of Observe, unless it is empty
+type Response struct {
+	Code    Code
+	Format  uint16 // of a non empty payload
+	Payload []byte
+	MaxAge  uint32 // seconds, when a 4.29 may be tried again
+	Observe string
+}
+
+// Handler of requests, called on its own goroutine for each of them
+type Handler func(req *Request) *Response
+
+type exchangeKey struct {
+	addr string
+	id   uint16
+}
+
+// exchange of a request, kept to answer its retransmissions
+type exchange struct {
+	at       time.Time
+	response []byte // nil while the handler runs
+	acked    bool   // an empty ack went out, the response follows as a confirmable message of its own
+}
+
+type observerKey struct {
+	addr, token string
+}
+
+// observer of a resource, seq orders its notifications
+type observer struct {
+	addr  net.Addr
+	token []byte
+	seq   uint32
+}
+
+// Server of CoAP over UDP: confirmable requests get piggybacked responses, or an empty ack and a separate response when
+// the handler is slow; clients observing a resource get confirmable notifications and are dropped once one goes unacknowledged
+type Server struct {
+	sync.Mutex
+	conn       net.PacketConn
+	handler    Handler
+	ackTimeout time.Duration
+	nextID     uint16
+	exchanges  map[exchangeKey]*exchange
+	prunedAt   time.Time
+	observers  map[string]map[observerKey]*observer // by resource key
+	observed   map[observerKey]string               // resource key of each observer
+	pending    map[uint16]chan bool                 // confirmable messages awaiting their ack, true on reset
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Listen on udp addr and serve requests with handler until the server is closed
+func Listen(addr string, handler Handler) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "listen on "+addr)
+	}
+	s := newServer(conn, handler, ackTimeout)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serve()
+	}()
+	_Log.Info("coap server listening", "addr", conn.LocalAddr().String())
+	return s, nil
+}
+
+func newServer(conn net.PacketConn, handler Handler, ackTimeout time.Duration) *Server {
+	return &Server{
+		conn:       conn,
+		handler:    handler,
+		ackTimeout: ackTimeout,
+		nextID:     uint16(rand.Intn(0x10000)),
+		exchanges:  make(map[exchangeKey]*exchange),
+		observers:  make(map[string]map[observerKey]*observer),
+		observed:   make(map[observerKey]string),
+		pending:    make(map[uint16]chan bool),
+		done:       make(chan struct{}),
+	}
+}
+
+// Addr the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close the socket and wait for the running handlers and notifications
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			_Log.Warn("read datagram", "err", err)
+			continue
+		}
+		m, err := Parse(buf[:n])
+		if err != nil {
+			_Log.Debug("drop malformed message", "addr", addr.String(), "err", err)
+			if n >= 4 && Type(buf[0]>>4&0x3) == Confirmable {
+				s.send(&Message{Type: Reset, MessageID: uint16(buf[2])<<8 | uint16(buf[3])}, addr)
+			}
+			continue
+		}
+		s.receive(m, addr)
+	}
+}
+
+// receive message m of addr
+func (s *Server) receive(m *Message, addr net.Addr) {
+	switch {
+	case m.Type == Acknowledgement || m.Type == Reset:
+		s.Lock()
+		ack := s.pending[m.MessageID]
+		delete(s.pending, m.MessageID)
+		s.Unlock()
+		if ack != nil {
+			ack <- m.Type == Reset
+		}
+		return
+	case !m.Code.IsRequest():
+		// pings and responses, the server sends no requests
+		if m.Type == Confirmable {
+			s.send(&Message{Type: Reset, MessageID: m.MessageID}, addr)
+		}
+		return
+	}
+
+	now := time.Now()
+	key := exchangeKey{addr.String(), m.MessageID}
+	s.Lock()
+	s.prune(now)
+	if x := s.exchanges[key]; x != nil {
+		// a retransmission: answer it again, or acknowledge a request the handler is still busy with
+		response, ack := x.response, false
+		if response == nil && m.Type == Confirmable && !x.acked {
+			x.acked, ack = true, true
+		}
+		s.Unlock()
+		if response != nil {
+			s.write(response, addr)
+		} else if ack {
+			s.send(&Message{Type: Acknowledgement, MessageID: m.MessageID}, addr)
+		}
+		return
+	}
+	s.exchanges[key] = &exchange{at: now}
+	s.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.handle(&Request{Message: m, Addr: addr}, key)
+	}()
+}
+
+// prune exchanges past their lifetime, once a second at most
+func (s *Server) prune(now time.Time) {
+	if now.Sub(s.prunedAt) < time.Second {
+		return
+	}
+	s.prunedAt = now
+	for key, x := range s.exchanges {
+		if x.response != nil && now.Sub(x.at) > exchangeLifetime {
+			delete(s.exchanges, key)
+		}
+	}
+}
+
+// handle req and respond the way it came: piggybacked on the ack of a confirmable one unless that went out already
+func (s *Server) handle(req *Request, key exchangeKey) {
+	resp := s.respond(req)
+	out := &Message{Code: resp.Code, Token: req.Token, Payload: resp.Payload}
+	if len(resp.Payload) > 0 {
+		out.SetUint(OptionContentFormat, uint32(resp.Format))
+	}
+	if resp.MaxAge > 0 {
+		out.SetUint(OptionMaxAge, resp.MaxAge)
+	}
+	if req.Code == GET {
+		if req.Observe() == 0 && resp.Observe != "" && resp.Code == Content {
+			out.SetUint(OptionObserve, s.observe(resp.Observe, req.Addr, req.Token))
+		} else {
+			// a GET of the same token without observe ends the observation as well
+			s.cancel(req.Addr, req.Token)
+		}
+	}
+
+	s.Lock()
+	x := s.exchanges[key]
+	separate := x.acked
+	switch {
+	case req.Type == NonConfirmable:
+		out.Type, out.MessageID = NonConfirmable, s.id()
+	case separate:
+		out.Type, out.MessageID = Confirmable, s.id()
+	default:
+		out.Type, out.MessageID = Acknowledgement, req.MessageID
+	}
+	b, err := out.Marshal()
+	if err != nil {
+		s.Unlock()
+		_Log.Error("encode response", "addr", req.Addr.String(), "err", err)
+		return
+	}
+	x.at, x.response = time.Now(), b
+	if separate {
+		// retransmissions of the request get the empty ack again
+		x.response, _ = (&Message{Type: Acknowledgement, MessageID: req.MessageID}).Marshal()
+	}
+	s.Unlock()
+
+	if separate {
+		if !s.confirm(out, req.Addr) {
+			_Log.Warn("separate response not acknowledged", "addr", req.Addr.String(), "code", out.Code.String())
+		}
+		return
+	}
+	s.write(b, req.Addr)
+}
+
+// respond to req, critical options the server does not know are refused
+func (s *Server) respond(req *Request) *Response {
+	for _, o := range req.Options {
+		switch o.Number {
+		case OptionURIHost, OptionURIPort, OptionURIPath, OptionURIQuery, OptionAccept:
+		default:
+			if critical(o.Number) {
+				return &Response{Code: BadOption, Payload: []byte(fmt.Sprintf("option %d is not supported", o.Number))}
+			}
+		}
+	}
+	if resp := s.handler(req); resp != nil {
+		return resp
+	}
+	return &Response{Code: InternalServerError}
+}
+
+// observe register the observer addr of resource key with token, the sequence of its registration follows
+func (s *Server) observe(key string, addr net.Addr, token []byte) uint32 {
+	s.Lock()
+	defer s.Unlock()
+
+	ok := observerKey{addr.String(), string(token)}
+	if prev, found := s.observed[ok]; found {
+		delete(s.observers[prev], ok)
+	}
+	if s.observers[key] == nil {
+		s.observers[key] = make(map[observerKey]*observer)
+	}
+	o := &observer{addr: addr, token: token, seq: 1}
+	s.observers[key][ok] = o
+	s.observed[ok] = key
+	return o.seq
+}
+
+// cancel the observation of addr with token, if any
+func (s *Server) cancel(addr net.Addr, token []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	ok := observerKey{addr.String(), string(token)}
+	if key, found := s.observed[ok]; found {
+		delete(s.observers[key], ok)
+		if len(s.observers[key]) == 0 {
+			delete(s.observers, key)
+		}
+		delete(s.observed, ok)
+	}
+}
+
+// Notify the observers of resource key with payload in format, n is how many there are;
+// observers not acknowledging their notification are dropped
+func (s *Server) Notify(key string, format uint16, payload []byte) (n int) {
+	s.Lock()
+	notifications := make([]*Message, 0, len(s.observers[key]))
+	observers := make([]*observer, 0, len(s.observers[key]))
+	for _, o := range s.observers[key] {
+		o.seq = (o.seq + 1) & 0xffffff
+		m := &Message{Type: Confirmable, Code: Content, MessageID: s.id(), Token: o.token, Payload: payload}
+		m.SetUint(OptionObserve, o.seq)
+		m.SetUint(OptionContentFormat, uint32(format))
+		notifications = append(notifications, m)
+		observers = append(observers, o)
+	}
+	s.Unlock()
+
+	for i, m := range notifications {
+		o := observers[i]
+		s.wg.Add(1)
+		go func(m *Message) {
+			defer s.wg.Done()
+			if !s.confirm(m, o.addr) {
+				_Log.Info("observer gone", "key", key, "addr", o.addr.String())
+				s.cancel(o.addr, o.token)
+			}
+		}(m)
+	}
+	return len(notifications)
+}
+
+// Observers of resource key
+func (s *Server) Observers(key string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.observers[key])
+}
+
+// id of the next message of the server, locked by the caller
+func (s *Server) id() uint16 {
+	s.nextID++
+	return s.nextID
+}
+
+// confirm send confirmable m to addr until it is acknowledged, with exponential back-off;
+// false when it is reset, never acknowledged or the server closes
+func (s *Server) confirm(m *Message, addr net.Addr) bool {
+	b, err := m.Marshal()
+	if err != nil {
+		_Log.Error("encode message", "addr", addr.String(), "err", err)
+		return false
+	}
+	ack := make(chan bool, 1)
+	s.Lock()
+	s.pending[m.MessageID] = ack
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.pending, m.MessageID)
+		s.Unlock()
+	}()
+
+	timeout := time.Duration(float64(s.ackTimeout) * (1 + rand.Float64()*(ackRandomFactor-1)))
+	for i := 0; i <= maxRetransmit; i++ {
+		s.write(b, addr)
+		select {
+		case reset := <-ack:
+			return !reset
+		case <-time.After(timeout):
+			timeout *= 2
+		case <-s.done:
+			return false
+		}
+	}
+	return false
+}
+
+func (s *Server) send(m *Message, addr net.Addr) {
+	b, err := m.Marshal()
+	if err != nil {
+		_Log.Error("encode message", "addr", addr.String(), "err", err)
+		return
+	}
+	s.write(b, addr)
+}
+
+func (s *Server) write(b []byte, addr net.Addr) {
+	if _, err := s.conn.WriteTo(b, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		_Log.Warn("write datagram", "addr", addr.String(), "err", err)
+	}
+}
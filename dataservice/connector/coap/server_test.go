@@ -0,0 +1,187 @@
+package coap
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// client of a test server over loopback
+type client struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (c *client) send(m *Message) {
+	b, err := m.Marshal()
+	Ω(err).ToNot(HaveOccurred())
+	_, err = c.conn.WriteTo(b, c.addr)
+	Ω(err).ToNot(HaveOccurred())
+}
+
+func (c *client) receive() *Message {
+	buf := make([]byte, maxDatagram)
+	Ω(c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+	n, _, err := c.conn.ReadFrom(buf)
+	Ω(err).ToNot(HaveOccurred())
+	m, err := Parse(buf[:n])
+	Ω(err).ToNot(HaveOccurred())
+	return m
+}
+
+var _ = Describe("server", func() {
+	var s *Server
+	var c *client
+	var calls int32
+	var release chan struct{}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&calls, 0)
+		release = make(chan struct{})
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Ω(err).ToNot(HaveOccurred())
+		s = newServer(conn, func(req *Request) *Response {
+			atomic.AddInt32(&calls, 1)
+			path := req.Path()
+			switch {
+			case req.Code == GET && len(path) == 2 && path[0] == "shadow":
+				return &Response{Code: Content, Format: FormatJSON, Payload: []byte(`{}`), Observe: path[1]}
+			case req.Code == POST && len(path) == 1 && path[0] == "slow":
+				<-release
+				return &Response{Code: Changed}
+			case req.Code == POST:
+				return &Response{Code: Changed, Payload: req.Payload}
+			}
+			return &Response{Code: NotFound}
+		}, 10*time.Millisecond)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve()
+		}()
+
+		cc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Ω(err).ToNot(HaveOccurred())
+		c = &client{conn: cc, addr: s.Addr()}
+	})
+
+	AfterEach(func() {
+		c.conn.Close()
+		Ω(s.Close()).To(Succeed())
+	})
+
+	It("should piggyback the response and answer retransmissions alike", func() {
+		req := &Message{Type: Confirmable, Code: POST, MessageID: 1, Token: []byte{9}, Payload: []byte("21")}
+		req.SetPath("/telemetry/abc")
+		c.send(req)
+		resp := c.receive()
+		Ω(resp.Type).To(Equal(Acknowledgement))
+		Ω(resp.MessageID).To(Equal(uint16(1)))
+		Ω(resp.Token).To(Equal([]byte{9}))
+		Ω(resp.Code).To(Equal(Changed))
+		Ω(resp.Payload).To(Equal([]byte("21")))
+
+		c.send(req)
+		Ω(c.receive()).To(Equal(resp))
+		Ω(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+	})
+
+	It("should answer non confirmable requests alike", func() {
+		req := &Message{Type: NonConfirmable, Code: POST, MessageID: 2, Payload: []byte("21")}
+		c.send(req)
+		resp := c.receive()
+		Ω(resp.Type).To(Equal(NonConfirmable))
+		Ω(resp.Code).To(Equal(Changed))
+	})
+
+	It("should acknowledge a slow request and respond separately", func() {
+		req := &Message{Type: Confirmable, Code: POST, MessageID: 3, Token: []byte{7}}
+		req.SetPath("/slow")
+		c.send(req)
+		Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(Equal(int32(1)))
+		c.send(req)
+		ack := c.receive()
+		Ω(ack.Type).To(Equal(Acknowledgement))
+		Ω(ack.Code).To(Equal(Empty))
+		Ω(ack.MessageID).To(Equal(uint16(3)))
+
+		close(release)
+		resp := c.receive()
+		Ω(resp.Type).To(Equal(Confirmable))
+		Ω(resp.Code).To(Equal(Changed))
+		Ω(resp.Token).To(Equal([]byte{7}))
+		c.send(&Message{Type: Acknowledgement, MessageID: resp.MessageID})
+	})
+
+	It("should reset pings", func() {
+		c.send(&Message{Type: Confirmable, MessageID: 4})
+		resp := c.receive()
+		Ω(resp.Type).To(Equal(Reset))
+		Ω(resp.MessageID).To(Equal(uint16(4)))
+	})
+
+	It("should refuse unknown critical options", func() {
+		req := &Message{Type: Confirmable, Code: POST, MessageID: 5}
+		req.SetOption(27, []byte{0}) // block1
+		c.send(req)
+		Ω(c.receive().Code).To(Equal(BadOption))
+		Ω(atomic.LoadInt32(&calls)).To(BeZero())
+	})
+
+	It("should notify observers until they go away", func() {
+		req := &Message{Type: Confirmable, Code: GET, MessageID: 6, Token: []byte{1, 1}}
+		req.SetPath("/shadow/7")
+		req.SetUint(OptionObserve, 0)
+		c.send(req)
+		resp := c.receive()
+		Ω(resp.Code).To(Equal(Content))
+		seq, ok := resp.Uint(OptionObserve)
+		Ω(ok).To(BeTrue())
+		Ω(s.Observers("7")).To(Equal(1))
+
+		Ω(s.Notify("7", FormatJSON, []byte(`{"on": true}`))).To(Equal(1))
+		n := c.receive()
+		Ω(n.Type).To(Equal(Confirmable))
+		Ω(n.Token).To(Equal([]byte{1, 1}))
+		Ω(n.Payload).To(Equal([]byte(`{"on": true}`)))
+		next, _ := n.Uint(OptionObserve)
+		Ω(next).To(BeNumerically(">", seq))
+		c.send(&Message{Type: Acknowledgement, MessageID: n.MessageID})
+		Consistently(func() int { return s.Observers("7") }, 100*time.Millisecond).Should(Equal(1))
+
+		Ω(s.Notify("7", FormatJSON, []byte(`{"on": false}`))).To(Equal(1))
+		n = c.receive()
+		c.send(&Message{Type: Reset, MessageID: n.MessageID})
+		Eventually(func() int { return s.Observers("7") }).Should(BeZero())
+		Ω(s.Notify("7", FormatJSON, []byte(`{}`))).To(BeZero())
+	})
+
+	It("should drop observers not acknowledging notifications", func() {
+		req := &Message{Type: NonConfirmable, Code: GET, MessageID: 7, Token: []byte{2}}
+		req.SetPath("/shadow/8")
+		req.SetUint(OptionObserve, 0)
+		c.send(req)
+		c.receive()
+		Ω(s.Notify("8", FormatJSON, []byte(`{}`))).To(Equal(1))
+		Eventually(func() int { return s.Observers("8") }, 2*time.Second).Should(BeZero())
+	})
+
+	It("should end an observation on a GET without observe", func() {
+		req := &Message{Type: Confirmable, Code: GET, MessageID: 8, Token: []byte{3}}
+		req.SetPath("/shadow/9")
+		req.SetUint(OptionObserve, 0)
+		c.send(req)
+		c.receive()
+		Ω(s.Observers("9")).To(Equal(1))
+
+		req = &Message{Type: Confirmable, Code: GET, MessageID: 9, Token: []byte{3}}
+		req.SetPath("/shadow/9")
+		c.send(req)
+		_, ok := c.receive().Uint(OptionObserve)
+		Ω(ok).To(BeFalse())
+		Ω(s.Observers("9")).To(BeZero())
+	})
+})
@@ -0,0 +1,212 @@
+package connector
+
+import (
+	"context"
+	"dataservice/tool"
+	"sync"
+)
+
+// Message received on a subscription, the properties are carried by the protocols which have them
+type Message struct {
+	Topic           string
+	Payload         string
+	QoS             byte
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  []UserProperty
+	SubscriptionID  int // of the subscription the message matched, 0 when unknown
+}
+
+// UserProperty of a message, keys may repeat
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Processor of the messages a connector receives
+type Processor func(ctx context.Context, msg *Message) error
+
+// Subscription of a topic, id identifies it in the messages of protocols which carry it, 0 for none
+type Subscription struct {
+	Topic string
+	QoS   byte
+	ID    int
+}
+
+// Status live status of a connector
+type Status struct {
+	Connected bool     `json:"connected"`
+	Topics    []string `json:"topics"`
+}
+
+// Connector of one connection of a protocol, messages of its subscriptions go to the processor it is started with
+type Connector interface {
+	Start(ctx context.Context, process Processor) error
+	Stop() error
+	Subscribe(s Subscription) error
+	Unsubscribe(topic string) error
+	Status() Status
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+}
+
+// Opener of a connector, not started yet
+type Opener func(ctx context.Context) (Connector, error)
+
+// Registry of connectors by key, a connector is opened with its first subscription and stopped with its last
+type Registry struct {
+	sync.RWMutex
+	connectors map[string]Connector
+}
+
+// NewRegistry without any connector
+func NewRegistry() *Registry {
+	return &Registry{connectors: make(map[string]Connector)}
+}
+
+// Get connector of key
+func (r *Registry) Get(key string) (Connector, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	c, ok := r.connectors[key]
+	return c, ok
+}
+
+// add connector of key opened with open unless there is one, created reports whether it is new
+func (r *Registry) add(ctx context.Context, key string, open Opener) (c Connector, created bool, err error) {
+	if c, ok := r.Get(key); ok {
+		return c, false, nil
+	}
+	opened, err := open(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	// another subscription may have opened one meanwhile, the one opened here never started
+	if c, ok := r.connectors[key]; ok {
+		return c, false, nil
+	}
+	r.connectors[key] = opened
+	return opened, true, nil
+}
+
+// remove connector c if it is still the one registered under key
+func (r *Registry) remove(key string, c Connector) (removed bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.connectors[key] == c {
+		delete(r.connectors, key)
+		removed = true
+	}
+	return
+}
+
+// Subscribe s on the connector of key, a new one is opened with open and started with process;
+// a connector stopped with its last topic meanwhile is left to its end and s goes to a fresh one
+func (r *Registry) Subscribe(ctx context.Context, key string, open Opener, process Processor, s Subscription) error {
+	for {
+		c, err := r.subscribe(ctx, key, open, process, s)
+		if c == nil {
+			return err
+		}
+		if current, ok := r.Get(key); ok && current == c {
+			return err
+		}
+	}
+}
+
+// subscribe s on the connector of key, c is nil unless s went to a connector that may have been removed meanwhile
+func (r *Registry) subscribe(ctx context.Context, key string, open Opener, process Processor, s Subscription) (c Connector, err error) {
+	c, created, err := r.add(ctx, key, open)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return c, c.Subscribe(s)
+	}
+	err = c.Start(ctx, process)
+	if err == nil {
+		err = c.Subscribe(s)
+	}
+	if err != nil {
+		if r.remove(key, c) {
+			c.Stop()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Unsubscribe topic of the connector of key, the connector is stopped with its last topic
+func (r *Registry) Unsubscribe(key, topic string) error {
+	c, ok := r.Get(key)
+	if !ok {
+		return tool.NotFound("there is no such connector [%s]", key)
+	}
+	if err := c.Unsubscribe(topic); err != nil {
+		return err
+	}
+	if r.removeIdle(key, c) {
+		return c.Stop()
+	}
+	return nil
+}
+
+// removeIdle remove connector c if it is still the one registered under key and has no topics,
+// checked under the lock so a subscription coming in meanwhile either keeps it or sees it gone
+func (r *Registry) removeIdle(key string, c Connector) (removed bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.connectors[key] == c && len(c.Status().Topics) == 0 {
+		delete(r.connectors, key)
+		removed = true
+	}
+	return
+}
+
+// Close drop all topics of the connector of key and stop it
+func (r *Registry) Close(key string) error {
+	c, ok := r.Get(key)
+	if !ok {
+		return tool.NotFound("there is no such connector [%s]", key)
+	}
+	if r.remove(key, c) {
+		return c.Stop()
+	}
+	return nil
+}
+
+// Status of the connector of key, ok is false when there is none
+func (r *Registry) Status(key string) (status Status, ok bool) {
+	c, ok := r.Get(key)
+	if !ok {
+		return Status{Topics: []string{}}, false
+	}
+	return c.Status(), true
+}
+
+// Publish payload on topic of the connector of key
+func (r *Registry) Publish(key, topic string, qos byte, retained bool, payload []byte) error {
+	c, ok := r.Get(key)
+	if !ok {
+		return tool.NotFound("there is no such connector [%s]", key)
+	}
+	return c.Publish(topic, qos, retained, payload)
+}
+
+// Stop every connector
+func (r *Registry) Stop() {
+	r.Lock()
+	connectors := r.connectors
+	r.connectors = make(map[string]Connector)
+	r.Unlock()
+	for _, c := range connectors {
+		c.Stop()
+	}
+}
@@ -0,0 +1,161 @@
+package modbus
+
+import (
+	"context"
+	"dataservice/tool"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tables of the modbus data model
+const (
+	TableCoil     = "coil"
+	TableDiscrete = "discrete"
+	TableInput    = "input"
+	TableHolding  = "holding"
+)
+
+// read function codes of the tables
+var functions = map[string]byte{TableCoil: 1, TableDiscrete: 2, TableHolding: 3, TableInput: 4}
+
+// most items one read may ask for
+const (
+	maxBits  = 2000
+	maxWords = 125
+)
+
+// mbapLength of the application protocol header, unit id included
+const mbapLength = 7
+
+// Exception returned by a server for a request it refused
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+var exceptionNames = map[byte]string{1: "illegal function", 2: "illegal data address", 3: "illegal data value", 4: "server device failure",
+	6: "server device busy", 10: "gateway path unavailable", 11: "gateway target device failed to respond"}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("modbus exception %d (%s) of function %d", e.Code, exceptionNames[e.Code], e.Function)
+}
+
+// Client of a modbus tcp server, one request at a time
+type Client struct {
+	sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+	txID    uint16
+}
+
+// DialFunc connecting to address, like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dial the modbus tcp server at address through dial, a plain dialer when nil; timeout bounds the connect and each request
+func Dial(ctx context.Context, dial DialFunc, address string, timeout time.Duration) (*Client, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: timeout}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "dial modbus server "+address)
+	}
+	return &Client{conn: conn, timeout: timeout}, nil
+}
+
+// Close the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Read quantity items of table from address of unit, bits of coils and discrete inputs are words of 0 or 1
+func (c *Client) Read(unit byte, table string, address, quantity uint16) ([]uint16, error) {
+	function, ok := functions[table]
+	if !ok {
+		return nil, tool.Invalid("unknown table [%s]", table)
+	}
+	bits := function <= 2
+	if quantity == 0 || (bits && quantity > maxBits) || (!bits && quantity > maxWords) {
+		return nil, tool.Invalid("read of %d items of table %s", quantity, table)
+	}
+	pdu := []byte{function, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], quantity)
+	resp, err := c.request(unit, pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 2 || int(resp[1]) != len(resp)-2 {
+		return nil, tool.Unavailable("malformed response of function %d", function)
+	}
+	data := resp[2:]
+	items := make([]uint16, quantity)
+	if bits {
+		if len(data) < (int(quantity)+7)/8 {
+			return nil, tool.Unavailable("short response of function %d", function)
+		}
+		for i := range items {
+			items[i] = uint16(data[i/8] >> (i % 8) & 1)
+		}
+		return items, nil
+	}
+	if len(data) != 2*int(quantity) {
+		return nil, tool.Unavailable("short response of function %d", function)
+	}
+	for i := range items {
+		items[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return items, nil
+}
+
+// request pdu of unit, the pdu of the response follows; exceptions are errors
+func (c *Client) request(unit byte, pdu []byte) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.txID++
+	adu := make([]byte, mbapLength, mbapLength+len(pdu))
+	binary.BigEndian.PutUint16(adu[0:], c.txID)
+	binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+	adu[6] = unit
+	adu = append(adu, pdu...)
+
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "set deadline")
+	}
+	if _, err := c.conn.Write(adu); err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "write request")
+	}
+	for {
+		header := make([]byte, mbapLength)
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return nil, tool.Wrap(tool.KindUnavailable, err, "read response")
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			return nil, tool.Unavailable("malformed response header")
+		}
+		resp := make([]byte, length-1)
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return nil, tool.Wrap(tool.KindUnavailable, err, "read response")
+		}
+		// responses of earlier requests which timed out are skipped
+		if binary.BigEndian.Uint16(header[0:]) != c.txID {
+			continue
+		}
+		if resp[0] == pdu[0]|0x80 && len(resp) == 2 {
+			return nil, &Exception{Function: pdu[0], Code: resp[1]}
+		}
+		if resp[0] != pdu[0] {
+			return nil, tool.Unavailable("response of function %d to function %d", resp[0], pdu[0])
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,13 @@
+package modbus_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestModbus(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Modbus Suite")
+}
@@ -0,0 +1,235 @@
+package modbus
+
+import (
+	"context"
+	"dataservice/connector"
+	"dataservice/logger"
+	"dataservice/tool"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _Log = logger.Component("modbus")
+
+// Device polled: the register map of unit at the address of a modbus tcp server, every interval
+type Device struct {
+	ID        int64
+	Address   string
+	Unit      byte
+	Interval  time.Duration
+	Registers []Register
+}
+
+// Status live status of a polled device
+type Status struct {
+	Connected  bool       `json:"connected"`
+	LastPollAt *time.Time `json:"lastPollAt"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+// Connector polling a device on a connection of its own, each reading goes to the processor as a json message
+// on every subscribed topic; a failed poll drops the connection and the next one dials again
+type Connector struct {
+	sync.Mutex
+	device  Device
+	blocks  []*block
+	timeout time.Duration
+	dial    DialFunc
+	topics  map[string]byte // qos by topic
+	status  Status
+	stopped bool
+	stop    context.CancelFunc // nil until started
+	done    chan struct{}
+}
+
+var _ connector.Connector = (*Connector)(nil)
+
+// Open connector of device d dialing through dial, timeout bounds the connect and each read
+func Open(d Device, dial DialFunc, timeout time.Duration) (*Connector, error) {
+	if d.Interval <= 0 {
+		return nil, tool.Invalid("poll interval must be positive")
+	}
+	if err := ValidateMap(d.Registers); err != nil {
+		return nil, err
+	}
+	return &Connector{device: d, blocks: plan(d.Registers), timeout: timeout, dial: dial, topics: make(map[string]byte),
+		done: make(chan struct{})}, nil
+}
+
+// Start polling with readings going to process
+func (c *Connector) Start(ctx context.Context, process connector.Processor) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stopped {
+		return tool.Unavailable("modbus device %d connector is stopped", c.device.ID)
+	}
+	if c.stop != nil {
+		return tool.Conflict("modbus device %d is polled already", c.device.ID)
+	}
+	ctx, c.stop = context.WithCancel(context.Background())
+	go func() {
+		defer close(c.done)
+		c.run(ctx, process)
+	}()
+	_Log.Info("device polled", "device", c.device.ID, "address", c.device.Address, "unit", c.device.Unit, "interval", c.device.Interval)
+	return nil
+}
+
+// Stop polling
+func (c *Connector) Stop() error {
+	c.Lock()
+	if c.stopped {
+		c.Unlock()
+		return nil
+	}
+	c.stopped = true
+	stop := c.stop
+	c.Unlock()
+	if stop != nil {
+		stop()
+		<-c.done
+	}
+	_Log.Info("device no longer polled", "device", c.device.ID)
+	return nil
+}
+
+// Subscribe topic readings go on
+func (c *Connector) Subscribe(s connector.Subscription) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stopped {
+		return tool.Unavailable("modbus device %d connector is stopped", c.device.ID)
+	}
+	if _, ok := c.topics[s.Topic]; ok {
+		return tool.Conflict("modbus device %d topic [%s] already subscribed", c.device.ID, s.Topic)
+	}
+	c.topics[s.Topic] = s.QoS
+	return nil
+}
+
+// Unsubscribe topic, polling goes on without topics
+func (c *Connector) Unsubscribe(topic string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.topics[topic]; !ok {
+		return tool.NotFound("there is no such topic [%s] on modbus device %d", topic, c.device.ID)
+	}
+	delete(c.topics, topic)
+	return nil
+}
+
+// Status of the connection and the topics
+func (c *Connector) Status() connector.Status {
+	c.Lock()
+	defer c.Unlock()
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return connector.Status{Connected: c.status.Connected, Topics: topics}
+}
+
+// PollStatus of the device
+func (c *Connector) PollStatus() Status {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.status
+}
+
+// Publish is not supported, modbus servers are only read
+func (c *Connector) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return tool.Invalid("modbus device %d takes no messages", c.device.ID)
+}
+
+// run poll every interval until ctx is done
+func (c *Connector) run(ctx context.Context, process connector.Processor) {
+	var client *Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+	ticker := time.NewTicker(c.device.Interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if client == nil {
+			client, err = Dial(ctx, c.dial, c.device.Address, c.timeout)
+		}
+		var values map[string]interface{}
+		if err == nil {
+			values, err = c.poll(client)
+		}
+		if err != nil && ctx.Err() == nil {
+			_Log.Warn("poll device failure", "device", c.device.ID, "address", c.device.Address, "err", err)
+			// exceptions leave the connection usable, anything else may have left a response behind
+			if _, ok := err.(*Exception); !ok && client != nil {
+				client.Close()
+				client = nil
+			}
+		}
+		c.Lock()
+		c.status.Connected = client != nil
+		c.status.LastError = ""
+		if err != nil {
+			c.status.LastError = err.Error()
+		}
+		topics := make(map[string]byte, len(c.topics))
+		for topic, qos := range c.topics {
+			topics[topic] = qos
+		}
+		c.Unlock()
+		if values != nil {
+			c.emit(ctx, process, topics, values)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// emit values to process as a message on each of topics
+func (c *Connector) emit(ctx context.Context, process connector.Processor, topics map[string]byte, values map[string]interface{}) {
+	payload, err := json.Marshal(values)
+	if err != nil {
+		_Log.Error("encode reading", "device", c.device.ID, "err", err)
+		return
+	}
+	for topic, qos := range topics {
+		msg := &connector.Message{Topic: topic, Payload: string(payload), QoS: qos, ContentType: "application/json"}
+		tool.CheckThenLog(_Log, process(ctx, msg), "process reading", "device", c.device.ID, "topic", topic)
+	}
+}
+
+// poll the register map once
+func (c *Connector) poll(client *Client) (map[string]interface{}, error) {
+	d := c.device
+	values := make(map[string]interface{}, len(d.Registers))
+	for _, b := range c.blocks {
+		items, err := client.Read(d.Unit, b.table, b.address, b.quantity)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range b.members {
+			r := &d.Registers[i]
+			values[r.Name] = r.Decode(items[r.Address-b.address:])
+		}
+	}
+	now := time.Now()
+	c.Lock()
+	c.status.LastPollAt = &now
+	c.Unlock()
+	return values, nil
+}
@@ -0,0 +1,258 @@
+package modbus
+
+import (
+	"context"
+	"dataservice/connector"
+	"dataservice/tool"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// standIn modbus tcp server of one unit, items missing from its tables are illegal addresses
+type standIn struct {
+	sync.Mutex
+	listener net.Listener
+	unit     byte
+	tables   map[byte]map[uint16]uint16 // by read function
+	requests int
+}
+
+func newStandIn(unit byte) *standIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).ToNot(HaveOccurred())
+	s := &standIn{listener: l, unit: unit, tables: map[byte]map[uint16]uint16{1: {}, 2: {}, 3: {}, 4: {}}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standIn) set(function byte, address uint16, items ...uint16) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, v := range items {
+		s.tables[function][address+uint16(i)] = v
+	}
+}
+
+func (s *standIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, mbapLength)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := s.respond(header[6], pdu)
+		if resp == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(header[4:], uint16(len(resp)+1))
+		if _, err := conn.Write(append(header, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *standIn) respond(unit byte, pdu []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests++
+	if unit != s.unit {
+		return nil
+	}
+	function := pdu[0]
+	table, ok := s.tables[function]
+	if !ok {
+		return []byte{function | 0x80, 1}
+	}
+	address, quantity := binary.BigEndian.Uint16(pdu[1:]), binary.BigEndian.Uint16(pdu[3:])
+	items := make([]uint16, quantity)
+	for i := range items {
+		v, ok := table[address+uint16(i)]
+		if !ok {
+			return []byte{function | 0x80, 2}
+		}
+		items[i] = v
+	}
+	if function <= 2 {
+		data := make([]byte, (quantity+7)/8)
+		for i, v := range items {
+			data[i/8] |= byte(v&1) << (i % 8)
+		}
+		return append([]byte{function, byte(len(data))}, data...)
+	}
+	data := make([]byte, 2*quantity)
+	for i, v := range items {
+		binary.BigEndian.PutUint16(data[2*i:], v)
+	}
+	return append([]byte{function, byte(len(data))}, data...)
+}
+
+var _ = Describe("connector", func() {
+	var s *standIn
+	var c *Connector
+	var messages chan *connector.Message
+
+	process := func(ctx context.Context, msg *connector.Message) error {
+		messages <- msg
+		return nil
+	}
+	// open and start a connector of device d with readings on topic modbus/{id}
+	poll := func(d Device, timeout time.Duration, dial DialFunc) *Connector {
+		c, err := Open(d, dial, timeout)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(c.Subscribe(connector.Subscription{Topic: fmt.Sprintf("modbus/%d", d.ID), QoS: 1})).To(Succeed())
+		Ω(c.Start(context.Background(), process)).To(Succeed())
+		return c
+	}
+	values := func(msg *connector.Message) map[string]interface{} {
+		var v map[string]interface{}
+		Ω(json.Unmarshal([]byte(msg.Payload), &v)).To(Succeed())
+		return v
+	}
+
+	BeforeEach(func() {
+		s = newStandIn(7)
+		c = nil
+		messages = make(chan *connector.Message, 100)
+	})
+
+	AfterEach(func() {
+		if c != nil {
+			c.Stop()
+		}
+		s.listener.Close()
+	})
+
+	It("should read items of every table", func() {
+		s.set(1, 0, 1, 0, 1)
+		s.set(2, 5, 1)
+		s.set(3, 100, 0x41c8, 0x0000, 42)
+		s.set(4, 0, 0xffff)
+		c, err := Dial(context.Background(), nil, s.listener.Addr().String(), time.Second)
+		Ω(err).ToNot(HaveOccurred())
+		defer c.Close()
+
+		items, err := c.Read(7, TableCoil, 0, 3)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(items).To(Equal([]uint16{1, 0, 1}))
+		items, err = c.Read(7, TableDiscrete, 5, 1)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(items).To(Equal([]uint16{1}))
+		items, err = c.Read(7, TableHolding, 100, 3)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(items).To(Equal([]uint16{0x41c8, 0, 42}))
+		items, err = c.Read(7, TableInput, 0, 1)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(items).To(Equal([]uint16{0xffff}))
+
+		_, err = c.Read(7, TableHolding, 200, 1)
+		Ω(err).To(Equal(&Exception{Function: 3, Code: 2}))
+		_, err = c.Read(7, TableHolding, 0, maxWords+1)
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("should poll the register map and process readings on its topics", func() {
+		s.set(3, 0, 0x0000, 0x41c8, 1200)
+		s.set(1, 10, 1)
+		c = poll(Device{ID: 3, Address: s.listener.Addr().String(), Unit: 7, Interval: 20 * time.Millisecond, Registers: []Register{
+			{Name: "temperature", Type: TypeFloat32, ByteOrder: OrderCDAB},
+			{Name: "rpm", Address: 2, Scale: 0.1},
+			{Name: "running", Table: TableCoil, Address: 10},
+		}}, time.Second, nil)
+
+		var msg *connector.Message
+		Eventually(messages).Should(Receive(&msg))
+		Ω(msg.Topic).To(Equal("modbus/3"))
+		Ω(msg.QoS).To(Equal(byte(1)))
+		Ω(msg.ContentType).To(Equal("application/json"))
+		Ω(values(msg)).To(Equal(map[string]interface{}{"temperature": 25.0, "rpm": 120.0, "running": true}))
+
+		s.set(3, 2, 1300)
+		Eventually(func() interface{} {
+			return values(<-messages)["rpm"]
+		}).Should(Equal(130.0))
+		status := c.PollStatus()
+		Ω(status.Connected).To(BeTrue())
+		Ω(status.LastPollAt).ToNot(BeNil())
+		Ω(status.LastError).To(BeEmpty())
+		Ω(c.Status()).To(Equal(connector.Status{Connected: true, Topics: []string{"modbus/3"}}))
+	})
+
+	It("should report failed polls and keep polling", func() {
+		c = poll(Device{ID: 4, Address: s.listener.Addr().String(), Unit: 7, Interval: 20 * time.Millisecond,
+			Registers: []Register{{Name: "rpm", Address: 9}}}, time.Second, nil)
+		Eventually(func() string {
+			return c.PollStatus().LastError
+		}).Should(ContainSubstring("illegal data address"))
+		Ω(c.PollStatus().Connected).To(BeTrue(), "exceptions keep the connection")
+
+		s.set(3, 9, 5)
+		var msg *connector.Message
+		Eventually(messages).Should(Receive(&msg))
+		Ω(values(msg)).To(HaveKeyWithValue("rpm", 5.0))
+	})
+
+	It("should drop the connection of a server gone quiet", func() {
+		c = poll(Device{ID: 5, Address: s.listener.Addr().String(), Unit: 8, Interval: 20 * time.Millisecond,
+			Registers: []Register{{Name: "rpm"}}}, 50*time.Millisecond, nil)
+		Eventually(func() string {
+			return c.PollStatus().LastError
+		}).Should(ContainSubstring("read response"))
+		Ω(c.PollStatus().Connected).To(BeFalse())
+		Ω(messages).ToNot(Receive())
+	})
+
+	It("should connect through the dial function", func() {
+		c = poll(Device{ID: 9, Address: s.listener.Addr().String(), Unit: 7, Interval: time.Hour, Registers: []Register{{Name: "a"}}},
+			time.Second, func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, tool.Forbidden("address [%s] is not allowed", address)
+			})
+		Eventually(func() string {
+			return c.PollStatus().LastError
+		}).Should(ContainSubstring("is not allowed"))
+		Ω(messages).ToNot(Receive())
+	})
+
+	It("should keep topics and refuse them once stopped", func() {
+		s.set(3, 0, 1)
+		c = poll(Device{ID: 6, Address: s.listener.Addr().String(), Unit: 7, Interval: time.Hour, Registers: []Register{{Name: "a"}}},
+			time.Second, nil)
+		Eventually(messages).Should(Receive())
+		Ω(tool.KindOf(c.Subscribe(connector.Subscription{Topic: "modbus/6"}))).To(Equal(tool.KindConflict))
+		Ω(tool.KindOf(c.Publish("modbus/6", 0, false, []byte("x")))).To(Equal(tool.KindInvalid))
+		Ω(c.Unsubscribe("modbus/6")).To(Succeed())
+		Ω(tool.KindOf(c.Unsubscribe("modbus/6"))).To(Equal(tool.KindNotFound))
+
+		Ω(c.Stop()).To(Succeed())
+		Ω(c.Stop()).To(Succeed())
+		Ω(tool.KindOf(c.Subscribe(connector.Subscription{Topic: "modbus/6"}))).To(Equal(tool.KindUnavailable))
+	})
+
+	It("should not open devices without interval or register map", func() {
+		_, err := Open(Device{ID: 1, Address: "plc:502", Registers: []Register{{Name: "a"}}}, nil, time.Second)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = Open(Device{ID: 1, Address: "plc:502", Interval: time.Second}, nil, time.Second)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+})
@@ -0,0 +1,230 @@
+package modbus
+
+import (
+	"dataservice/tool"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// value types of registers
+const (
+	TypeBool    = "bool"
+	TypeInt16   = "int16"
+	TypeUint16  = "uint16"
+	TypeInt32   = "int32"
+	TypeUint32  = "uint32"
+	TypeFloat32 = "float32"
+	TypeInt64   = "int64"
+	TypeUint64  = "uint64"
+	TypeFloat64 = "float64"
+)
+
+// words a value of each type takes
+var typeWords = map[string]int{TypeBool: 1, TypeInt16: 1, TypeUint16: 1, TypeInt32: 2, TypeUint32: 2, TypeFloat32: 2,
+	TypeInt64: 4, TypeUint64: 4, TypeFloat64: 4}
+
+// byte orders of values over several bytes, A being the most significant byte
+const (
+	OrderABCD = "ABCD" // big endian
+	OrderDCBA = "DCBA" // little endian
+	OrderBADC = "BADC" // big endian words of swapped bytes
+	OrderCDAB = "CDAB" // little endian words of big endian bytes
+)
+
+// Register of a register map, the value of Name is read from Address on with the words its type takes
+type Register struct {
+	Name      string  `json:"name"`
+	Table     string  `json:"table"`
+	Address   uint16  `json:"address"`
+	Type      string  `json:"type"`
+	Scale     float64 `json:"scale"`
+	ByteOrder string  `json:"byteOrder"`
+}
+
+// Validate r and fill in its defaults: holding registers of uint16 in big endian, scale 1;
+// coils and discrete inputs are bool
+func (r *Register) Validate() error {
+	if r.Name == "" {
+		return tool.Invalid("register name is required")
+	}
+	if r.Table == "" {
+		r.Table = TableHolding
+	}
+	if _, ok := functions[r.Table]; !ok {
+		return tool.Invalid("register [%s] has unknown table [%s]", r.Name, r.Table)
+	}
+	bits := r.Table == TableCoil || r.Table == TableDiscrete
+	switch {
+	case r.Type == "" && bits:
+		r.Type = TypeBool
+	case r.Type == "":
+		r.Type = TypeUint16
+	}
+	if _, ok := typeWords[r.Type]; !ok {
+		return tool.Invalid("register [%s] has unknown type [%s]", r.Name, r.Type)
+	}
+	if bits != (r.Type == TypeBool) {
+		return tool.Invalid("register [%s] of table %s cannot be %s", r.Name, r.Table, r.Type)
+	}
+	if int(r.Address)+r.words() > 0x10000 {
+		return tool.Invalid("register [%s] goes beyond address 65535", r.Name)
+	}
+	if r.Scale == 0 {
+		r.Scale = 1
+	}
+	if math.IsNaN(r.Scale) || math.IsInf(r.Scale, 0) {
+		return tool.Invalid("register [%s] has scale %g", r.Name, r.Scale)
+	}
+	if r.ByteOrder == "" {
+		r.ByteOrder = OrderABCD
+	}
+	switch r.ByteOrder {
+	case OrderABCD, OrderDCBA, OrderBADC, OrderCDAB:
+	default:
+		return tool.Invalid("register [%s] has unknown byte order [%s]", r.Name, r.ByteOrder)
+	}
+	return nil
+}
+
+func (r *Register) words() int {
+	return typeWords[r.Type]
+}
+
+// ValidateMap of registers, names are unique
+func ValidateMap(registers []Register) error {
+	if len(registers) == 0 {
+		return tool.Invalid("register map is empty")
+	}
+	names := make(map[string]bool, len(registers))
+	for i := range registers {
+		if err := registers[i].Validate(); err != nil {
+			return err
+		}
+		if names[registers[i].Name] {
+			return tool.Invalid("register [%s] appears twice", registers[i].Name)
+		}
+		names[registers[i].Name] = true
+	}
+	return nil
+}
+
+// Decode value of r from its words: integers stay integers at scale 1, the others are scaled floats
+func (r *Register) Decode(words []uint16) interface{} {
+	if r.Type == TypeBool {
+		return words[0] != 0
+	}
+	b := make([]byte, 2*r.words())
+	for i, w := range words[:r.words()] {
+		binary.BigEndian.PutUint16(b[2*i:], w)
+	}
+	reorder(b, r.ByteOrder)
+
+	var v float64
+	switch r.Type {
+	case TypeInt16:
+		i := int16(binary.BigEndian.Uint16(b))
+		if r.Scale == 1 {
+			return int64(i)
+		}
+		v = float64(i)
+	case TypeUint16:
+		u := binary.BigEndian.Uint16(b)
+		if r.Scale == 1 {
+			return uint64(u)
+		}
+		v = float64(u)
+	case TypeInt32:
+		i := int32(binary.BigEndian.Uint32(b))
+		if r.Scale == 1 {
+			return int64(i)
+		}
+		v = float64(i)
+	case TypeUint32:
+		u := binary.BigEndian.Uint32(b)
+		if r.Scale == 1 {
+			return uint64(u)
+		}
+		v = float64(u)
+	case TypeInt64:
+		i := int64(binary.BigEndian.Uint64(b))
+		if r.Scale == 1 {
+			return i
+		}
+		v = float64(i)
+	case TypeUint64:
+		u := binary.BigEndian.Uint64(b)
+		if r.Scale == 1 {
+			return u
+		}
+		v = float64(u)
+	case TypeFloat32:
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case TypeFloat64:
+		v = math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return v * r.Scale
+}
+
+// reorder bytes b read in order into big endian
+func reorder(b []byte, order string) {
+	switch order {
+	case OrderDCBA:
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	case OrderBADC:
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+	case OrderCDAB:
+		for i, j := 0, len(b)-2; i < j; i, j = i+2, j-2 {
+			b[i], b[i+1], b[j], b[j+1] = b[j], b[j+1], b[i], b[i+1]
+		}
+	}
+}
+
+// block of contiguous items of a table read at once
+type block struct {
+	table    string
+	address  uint16
+	quantity uint16
+	members  []int // indexes of the registers in the block
+}
+
+// plan reads of registers: registers of a table which touch or overlap share a block as long as it stays in bounds of one read
+func plan(registers []Register) []*block {
+	order := make([]int, len(registers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := registers[order[i]], registers[order[j]]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Address < b.Address
+	})
+
+	var blocks []*block
+	var last *block
+	for _, i := range order {
+		r := registers[i]
+		end := int(r.Address) + r.words()
+		limit := maxWords
+		if r.Type == TypeBool {
+			limit = maxBits
+		}
+		if last != nil && last.table == r.Table && int(r.Address) <= int(last.address)+int(last.quantity) &&
+			end-int(last.address) <= limit {
+			if end > int(last.address)+int(last.quantity) {
+				last.quantity = uint16(end - int(last.address))
+			}
+			last.members = append(last.members, i)
+			continue
+		}
+		last = &block{table: r.Table, address: r.Address, quantity: uint16(r.words()), members: []int{i}}
+		blocks = append(blocks, last)
+	}
+	return blocks
+}
@@ -0,0 +1,95 @@
+package modbus
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("register", func() {
+	It("should fill in defaults", func() {
+		r := Register{Name: "rpm"}
+		Ω(r.Validate()).To(Succeed())
+		Ω(r).To(Equal(Register{Name: "rpm", Table: TableHolding, Type: TypeUint16, Scale: 1, ByteOrder: OrderABCD}))
+
+		r = Register{Name: "running", Table: TableCoil}
+		Ω(r.Validate()).To(Succeed())
+		Ω(r.Type).To(Equal(TypeBool))
+	})
+
+	table.DescribeTable("reject invalid registers",
+		func(r Register) {
+			Ω(r.Validate()).ToNot(Succeed())
+		},
+		table.Entry("name", Register{}),
+		table.Entry("table", Register{Name: "a", Table: "memory"}),
+		table.Entry("type", Register{Name: "a", Type: "int8"}),
+		table.Entry("bool of registers", Register{Name: "a", Type: TypeBool}),
+		table.Entry("number of coils", Register{Name: "a", Table: TableCoil, Type: TypeInt16}),
+		table.Entry("beyond the address space", Register{Name: "a", Address: 0xffff, Type: TypeInt32}),
+		table.Entry("byte order", Register{Name: "a", ByteOrder: "ACBD"}),
+	)
+
+	It("should reject maps with a name twice", func() {
+		Ω(ValidateMap(nil)).ToNot(Succeed())
+		Ω(ValidateMap([]Register{{Name: "a"}, {Name: "a", Address: 1}})).ToNot(Succeed())
+	})
+
+	table.DescribeTable("decode values in byte order",
+		func(typ, order string, scale float64, words []uint16, value interface{}) {
+			r := Register{Name: "v", Type: typ, ByteOrder: order, Scale: scale}
+			Ω(r.Validate()).To(Succeed())
+			Ω(r.Decode(words)).To(Equal(value))
+		},
+		table.Entry("uint16", TypeUint16, OrderABCD, 0.0, []uint16{0x1234}, uint64(0x1234)),
+		table.Entry("int16 swapped", TypeInt16, OrderBADC, 0.0, []uint16{0xfeff}, int64(-2)),
+		table.Entry("int16 scaled", TypeInt16, "", 0.1, []uint16{0xfff6}, -1.0),
+		table.Entry("uint32 ABCD", TypeUint32, OrderABCD, 0.0, []uint16{0x0102, 0x0304}, uint64(0x01020304)),
+		table.Entry("uint32 CDAB", TypeUint32, OrderCDAB, 0.0, []uint16{0x0304, 0x0102}, uint64(0x01020304)),
+		table.Entry("uint32 BADC", TypeUint32, OrderBADC, 0.0, []uint16{0x0201, 0x0403}, uint64(0x01020304)),
+		table.Entry("uint32 DCBA", TypeUint32, OrderDCBA, 0.0, []uint16{0x0403, 0x0201}, uint64(0x01020304)),
+		table.Entry("float32", TypeFloat32, OrderABCD, 0.0, []uint16{0x41c8, 0x0000}, 25.0),
+		table.Entry("float32 CDAB scaled", TypeFloat32, OrderCDAB, 2.0, []uint16{0x0000, 0x41c8}, 50.0),
+		table.Entry("int64 CDAB", TypeInt64, OrderCDAB, 0.0, []uint16{0xfffe, 0xffff, 0xffff, 0xffff}, int64(-2)),
+		table.Entry("float64", TypeFloat64, OrderABCD, 0.0, []uint16{0x4039, 0, 0, 0}, 25.0),
+	)
+
+	It("should plan reads of touching registers together", func() {
+		registers := []Register{
+			{Name: "b", Address: 2, Type: TypeFloat32},
+			{Name: "a", Address: 0, Type: TypeInt32},
+			{Name: "c", Address: 10},
+			{Name: "d", Address: 0, Table: TableInput},
+			{Name: "e", Address: 3, Table: TableCoil},
+			{Name: "f", Address: 4, Table: TableCoil},
+			{Name: "g", Address: 200},
+			{Name: "h", Address: 150, Type: TypeFloat64},
+			{Name: "i", Address: 11, Type: TypeInt64},
+		}
+		Ω(ValidateMap(registers)).To(Succeed())
+		var reads [][3]interface{}
+		for _, b := range plan(registers) {
+			reads = append(reads, [3]interface{}{b.table, b.address, b.quantity})
+		}
+		Ω(reads).To(Equal([][3]interface{}{
+			{TableCoil, uint16(3), uint16(2)},
+			{TableHolding, uint16(0), uint16(4)},
+			{TableHolding, uint16(10), uint16(5)},
+			{TableHolding, uint16(150), uint16(4)},
+			{TableHolding, uint16(200), uint16(1)},
+			{TableInput, uint16(0), uint16(1)},
+		}))
+	})
+
+	It("should keep blocks within one read", func() {
+		var registers []Register
+		for i := 0; i < 130; i++ {
+			registers = append(registers, Register{Name: string(rune('a' + i)), Address: uint16(i)})
+		}
+		Ω(ValidateMap(registers)).To(Succeed())
+		blocks := plan(registers)
+		Ω(blocks).To(HaveLen(2))
+		Ω(blocks[0].quantity).To(Equal(uint16(maxWords)))
+		Ω(blocks[1].quantity).To(Equal(uint16(5)))
+	})
+})
@@ -1,177 +1,303 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"dataservice/connector"
+	"dataservice/logger"
+	"dataservice/policy"
 	"dataservice/tool"
+	"dataservice/tracing"
 	"fmt"
-	"log"
+	"sort"
 	"sync"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type messageProcessor func(topic, message string)
+// resolveTimeout bound the broker host resolution of the policy check
+const resolveTimeout = 5 * time.Second
 
-type brokerKey struct {
-	broker   string
-	username string
-}
+// publishTimeout bound the wait for the broker to take a published message
+const publishTimeout = 10 * time.Second
 
-type broker struct {
-	sync.RWMutex
-	username string
-	password string
-	broker   string
-	mapTopic map[string]*struct{}
-	client   mqtt.Client
-	chQuit   chan struct{}
-	chMsg    chan mqtt.Message
+// protocol versions
+const (
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+// Message received on a subscription, the properties are carried by MQTT 5 connections only
+type Message = connector.Message
+
+// UserProperty of an MQTT 5 message, keys may repeat
+type UserProperty = connector.UserProperty
+
+// received message along with the trace context started on receipt
+type received struct {
+	ctx   context.Context
+	span  trace.Span
+	msg   *Message
+	msgID uint16
 }
 
-type global struct {
-	sync.RWMutex
-	mapConn map[string]*broker
+// Options of broker connection
+type Options struct {
+	Broker          string
+	Username        string
+	Password        string
+	ClientID        string
+	TLS             *tls.Config
+	ProtocolVersion byte           // Version311 when zero
+	Policy          *policy.Policy // of the brokers it may dial, nil allows any
+	Address         string         // ip:port websocket connections dial instead of resolving the url again, set by the policy check
 }
 
-var _Global = global{
-	mapConn: make(map[string]*broker),
+// client of a broker connection in one of the protocol versions
+type client interface {
+	connect() error
+	isConnected() bool
+	subscribe(topic string, qos byte, id int) error
+	unsubscribe(topic string) error
+	publish(topic string, qos byte, retained bool, payload []byte) error
+	disconnect()
 }
 
-// fetch or create it
-func (_global *global) addBroker(brok string) *broker {
-	_global.Lock()
-	defer _global.Unlock()
+// Connector of one broker connection, it dials with its first subscription when it is not connected yet
+type Connector struct {
+	sync.RWMutex
+	name     string
+	mapTopic map[string]*struct{}
+	client   client
+	chQuit   chan struct{}
+	chMsg    chan received
+	started  bool
+	stopped  bool
+}
 
-	_broker := _global.mapConn[brok]
-	if _broker == nil {
-		chQuit := make(chan struct{})
-		chMsg := make(chan mqtt.Message)
+var _ connector.Connector = (*Connector)(nil)
 
-		opts := mqtt.NewClientOptions()
-		opts.SetAutoReconnect(true)
-		opts.AddBroker(brok)
-		opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-			chMsg <- msg
-		})
-		client := mqtt.NewClient(opts)
+var _Log = logger.Component("mqtt")
 
-		_broker = &broker{
-			client:   client,
-			mapTopic: make(map[string]*struct{}),
-			chQuit:   chQuit,
-			chMsg:    chMsg,
+// NewTLSConfig build tls config from PEM encoded certificates, all of them are optional
+func NewTLSConfig(caCert, cert, key string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, tool.Invalid("parse ca certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse client certificate")
 		}
-		_global.mapConn[brok] = _broker
+		cfg.Certificates = []tls.Certificate{pair}
 	}
+	return cfg, nil
+}
 
-	return _broker
+// Open connector named name of the broker connection made with o, once the broker passes the policy
+func Open(ctx context.Context, name string, o Options) (*Connector, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	o, err := CheckPolicy(ctx, o)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	return newConnector(name, o), nil
 }
 
-func (_global *global) delBroker(brok string) {
-	_global.Lock()
-	defer _global.Unlock()
+func newConnector(name string, o Options) *Connector {
+	c := &Connector{
+		name:     name,
+		mapTopic: make(map[string]*struct{}),
+		chQuit:   make(chan struct{}),
+		chMsg:    make(chan received),
+	}
 
-	delete(_global.mapConn, brok)
+	// parent carries the trace context a message brought along, if any
+	deliver := func(parent context.Context, msg *Message, msgID uint16) {
+		ctx, span := tracing.Tracer().Start(parent, "mqtt receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "mqtt"),
+				attribute.String("messaging.destination.name", msg.Topic),
+				attribute.String("server.address", o.Broker),
+				attribute.Int("messaging.message.id", int(msgID)),
+				attribute.Int("messaging.mqtt.qos", int(msg.QoS)),
+			))
+		select {
+		case c.chMsg <- received{ctx: ctx, span: span, msg: msg, msgID: msgID}:
+		case <-c.chQuit:
+			span.End()
+		}
+	}
+	if o.ProtocolVersion == Version5 {
+		c.client = newV5Client(name, o, deliver)
+	} else {
+		c.client = newV3Client(o, deliver)
+	}
+	return c
 }
 
-func (_broker *broker) hasTopic(topic string) bool {
-	_broker.RLock()
-	defer _broker.RUnlock()
+func (c *Connector) hasTopic(topic string) bool {
+	c.RLock()
+	defer c.RUnlock()
 
-	return _broker.mapTopic[topic] != nil
+	return c.mapTopic[topic] != nil
 }
 
-func (_broker *broker) addTopic(topic string) {
-	_broker.Lock()
-	defer _broker.Unlock()
+func (c *Connector) isStopped() bool {
+	c.RLock()
+	defer c.RUnlock()
 
-	if _broker.mapTopic[topic] == nil {
-		_broker.mapTopic[topic] = &struct{}{}
-	}
+	return c.stopped
 }
 
-func (_broker *broker) delTopic(topic string) {
-	_broker.Lock()
-	defer _broker.Unlock()
+func (c *Connector) addTopic(topic string) {
+	c.Lock()
+	defer c.Unlock()
 
-	delete(_broker.mapTopic, topic)
-	if len(_broker.mapTopic) == 0 {
-		close(_broker.chQuit)
+	if c.mapTopic[topic] == nil {
+		c.mapTopic[topic] = &struct{}{}
 	}
 }
 
-// SubBrokerTopic Subscribe broker topic
-func SubBrokerTopic(user, pass, brok, topic string, msgProc messageProcessor) (err error) {
-	return _Global.subBrokerTopic(user, pass, brok, topic, msgProc)
+func (c *Connector) delTopic(topic string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.mapTopic, topic)
 }
 
-func (_global *global) subBrokerTopic(user, pass, brok, topic string, msgProc messageProcessor) (err error) {
-	defer func() {
-		err = tool.Error(recover())
-	}()
+func (c *Connector) topics() []string {
+	c.RLock()
+	defer c.RUnlock()
 
-	_broker := _global.addBroker(brok)
+	topics := make([]string, 0, len(c.mapTopic))
+	for topic := range c.mapTopic {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
 
-	// broker, err := base64.StdEncoding.DecodeString(c.Param("broker"))
-	// tool.CheckThenPanic(err, "connect mqtt broker")
-	// topic, err := base64.StdEncoding.DecodeString(c.Param("topic"))
-	// tool.CheckThenPanic(err, "connect mqtt topic")
+// Start connect the broker and dispatch its messages to process until Stop
+func (c *Connector) Start(ctx context.Context, process connector.Processor) error {
+	c.Lock()
+	if c.started || c.stopped {
+		c.Unlock()
+		return tool.Conflict("connector of broker [%s] already started", c.name)
+	}
+	c.started = true
+	c.Unlock()
 
-	if _broker.client.IsConnected() == false {
-		if token := _broker.client.Connect(); token.Wait() {
-			tool.CheckThenPanic(token.Error(), "client connect")
-		}
+	go c.serve(process)
+	if err := c.client.connect(); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("connect broker [%s]", c.name))
 	}
-	if _broker.hasTopic(topic) == false {
-		if token := _broker.client.Subscribe(topic, byte(2), nil); token.Wait() {
-			tool.CheckThenPanic(token.Error(), fmt.Sprintf("subscribe broker [%s] topic [%s]", brok, topic))
-		}
-		_broker.addTopic(topic)
-	}
-
-	go func() {
-		quit := false
-		for !quit {
-			select {
-			case msg := <-_broker.chMsg:
-				topic, payload := msg.Topic(), (string(msg.Payload()))
-				log.Printf("received topic: %s, message: %s\n", topic, payload)
-				if msgProc != nil {
-					go msgProc(topic, payload)
-				}
-			case <-_broker.chQuit:
-				quit = true
-				log.Printf("message channel for broker [%s] closed", brok)
+	return nil
+}
+
+// serve dispatch messages of the broker until the connector stops
+func (c *Connector) serve(process connector.Processor) {
+	quit := false
+	for !quit {
+		select {
+		case rcv := <-c.chMsg:
+			topic, msgID := rcv.msg.Topic, rcv.msgID
+			logger.Payload(_Log, "message received", rcv.msg.Payload, "broker", c.name, "topic", topic, "msgId", msgID)
+			if process != nil {
+				go func() {
+					defer rcv.span.End()
+					if err := process(rcv.ctx, rcv.msg); err != nil {
+						rcv.span.SetStatus(codes.Error, err.Error())
+						_Log.Error("process message", "broker", c.name, "topic", topic, "msgId", msgID, "err", err)
+					}
+				}()
+			} else {
+				rcv.span.End()
 			}
+		case <-c.chQuit:
+			quit = true
+			_Log.Info("message channel closed", "broker", c.name)
 		}
-		_broker.client.Disconnect(0)
-		_global.delBroker(brok)
-		log.Printf("connection for broker [%s] closed", brok)
-	}()
+	}
+	c.client.disconnect()
+	_Log.Info("connection closed", "broker", c.name)
+}
+
+// Stop drop all topics and close the connection
+func (c *Connector) Stop() error {
+	c.Lock()
+	defer c.Unlock()
 
-	return
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+	close(c.chQuit)
+	if !c.started {
+		c.client.disconnect()
+	}
+	return nil
 }
 
-// UnSubBrokerTopic Unsubscribe broker topic
-func UnSubBrokerTopic(brok, topic string) (err error) {
-	return _Global.unSubBrokerTopic(brok, topic)
+// Subscribe topic of the broker, id identifies the subscription in the messages of MQTT 5 connections
+func (c *Connector) Subscribe(s connector.Subscription) error {
+	if c.isStopped() {
+		return tool.Unavailable("broker [%s] connector is stopped", c.name)
+	}
+	if c.hasTopic(s.Topic) {
+		return tool.Conflict("broker [%s] topic [%s] already subscribed", c.name, s.Topic)
+	}
+	if c.client.isConnected() == false {
+		if err := c.client.connect(); err != nil {
+			return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("connect broker [%s]", c.name))
+		}
+	}
+	if err := c.client.subscribe(s.Topic, s.QoS, s.ID); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("subscribe broker [%s] topic [%s]", c.name, s.Topic))
+	}
+	c.addTopic(s.Topic)
+	_Log.Info("topic subscribed", "broker", c.name, "topic", s.Topic)
+	return nil
 }
 
-func (_global *global) unSubBrokerTopic(brok, topic string) (err error) {
-	defer func() {
-		err = tool.Error(recover())
-	}()
+// Unsubscribe topic of the broker, the connection stays up without topics
+func (c *Connector) Unsubscribe(topic string) error {
+	if c.hasTopic(topic) == false {
+		return tool.NotFound("there is no such topic [%s] on broker [%s]", topic, c.name)
+	}
 
-	_broker := _global.mapConn[brok]
-	if _broker == nil {
-		panic("there is no such broker")
+	if err := c.client.unsubscribe(topic); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("unsubscribe broker [%s] topic [%s]", c.name, topic))
 	}
-	if _broker.hasTopic(topic) == false {
-		panic("there is no such topic")
+	c.delTopic(topic)
+	_Log.Info("topic unsubscribed", "broker", c.name, "topic", topic)
+	return nil
+}
+
+// Status of the connection
+func (c *Connector) Status() connector.Status {
+	return connector.Status{
+		Connected: c.client.isConnected(),
+		Topics:    c.topics(),
 	}
+}
 
-	if token := _broker.client.Unsubscribe(topic); token.Wait() {
-		tool.CheckThenPanic(token.Error(), fmt.Sprintf("unsubscribe broker [%s] topic [%s]", brok, topic))
+// Publish payload on topic of the broker
+func (c *Connector) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if err := c.client.publish(topic, qos, retained, payload); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("publish broker [%s] topic [%s]", c.name, topic))
 	}
-	_broker.delTopic(topic)
-	return
+	logger.Payload(_Log, "message published", string(payload), "broker", c.name, "topic", topic)
+	return nil
 }
@@ -1,11 +1,15 @@
 package mqtt
 
 import (
+	"context"
+	"dataservice/connector"
 	"os/exec"
 
+	"github.com/eclipse/paho.golang/paho"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	. "github.com/onsi/gomega/gstruct"
+	"github.com/onsi/gomega/gstruct"
 )
 
 var _ = BeforeSuite(func() {
@@ -24,31 +28,53 @@ var _ = Describe("mqtt", func() {
 	brok := "tcp://localhost:1883"
 	topi := "myTopic"
 
-	FDescribe("subscribe and unsubscribe", func() {
+	Describe("subscribe and unsubscribe", func() {
 		It("one topic", func() {
+			c, err := Open(context.Background(), brok, Options{Broker: brok})
+			Ω(err).ToNot(HaveOccurred())
+			Ω(c.Start(context.Background(), nil)).To(Succeed(), "cannot connect")
+			defer c.Stop()
 
 			By("subscribe")
-			err := SubBrokerTopic(brok, topi, nil)
+			err = c.Subscribe(connector.Subscription{Topic: topi, QoS: 2})
 			Ω(err).ToNot(HaveOccurred(), "cannot subscribe")
-			Ω(_Global.mapConn).To(HaveLen(1))
-			_broker := _Global.mapConn[brok]
-			Ω(_broker.client).ToNot(BeZero())
-			Ω(_broker.chMsg).ToNot(BeZero())
-			Ω(_broker.chQuit).ToNot(BeZero())
-			Ω(_broker.mapTopic).To(And(
+			Ω(c.client).ToNot(BeZero())
+			Ω(c.mapTopic).To(And(
 				Not(BeZero()),
 				HaveLen(1),
-				MatchAllKeys(Keys{
+				gstruct.MatchAllKeys(gstruct.Keys{
 					topi: Not(BeZero()),
 				})))
+			Ω(c.Subscribe(connector.Subscription{Topic: topi})).ToNot(Succeed(), "already subscribed")
 
 			By("unsubscribe")
-			err = UnSubBrokerTopic(brok, topi)
+			err = c.Unsubscribe(topi)
 			Ω(err).ToNot(HaveOccurred(), "cannot unsubscribe")
-			Ω(_broker.chQuit).To(BeClosed())
-			Eventually(func() int {
-				return len(_Global.mapConn)
-			}).Should(Equal(0))
+			Ω(c.Status()).To(Equal(connector.Status{Connected: true, Topics: []string{}}))
+
+			By("stop")
+			Ω(c.Stop()).To(Succeed())
+			Ω(c.chQuit).To(BeClosed())
+			Eventually(c.client.isConnected).Should(BeFalse())
+		})
+
+		It("should stop the connector with its last topic in a registry", func() {
+			r := connector.NewRegistry()
+			open := func(ctx context.Context) (connector.Connector, error) {
+				return Open(ctx, brok, Options{Broker: brok})
+			}
+			Ω(r.Subscribe(context.Background(), brok, open, nil, connector.Subscription{Topic: topi})).To(Succeed())
+			Ω(r.Subscribe(context.Background(), brok, open, nil, connector.Subscription{Topic: topi + "/2"})).To(Succeed())
+			status, ok := r.Status(brok)
+			Ω(ok).To(BeTrue())
+			Ω(status.Topics).To(Equal([]string{topi, topi + "/2"}))
+
+			Ω(r.Unsubscribe(brok, topi)).To(Succeed())
+			_, ok = r.Get(brok)
+			Ω(ok).To(BeTrue())
+			Ω(r.Unsubscribe(brok, topi+"/2")).To(Succeed())
+			_, ok = r.Get(brok)
+			Ω(ok).To(BeFalse())
 		})
 	})
 
@@ -58,38 +84,91 @@ var _ = Describe("mqtt", func() {
 
 	Describe("publish and receive", func() {
 		var chMsg chan string
-		var _broker *broker
+		var c *Connector
 
 		BeforeEach(func() {
 			chMsg = make(chan string)
 
-			err := SubBrokerTopic(brok, topi, func(topic, message string) {
-				chMsg <- message
+			var err error
+			c, err = Open(context.Background(), brok, Options{Broker: brok})
+			Ω(err).ToNot(HaveOccurred())
+			err = c.Start(context.Background(), func(ctx context.Context, msg *Message) error {
+				chMsg <- msg.Payload
+				return nil
 			})
+			Ω(err).ToNot(HaveOccurred(), "cannot connect")
+			err = c.Subscribe(connector.Subscription{Topic: topi, QoS: 2})
 			Ω(err).ToNot(HaveOccurred(), "cannot subscribe")
-
-			_broker = _Global.mapConn[brok]
-			Ω(_broker).ToNot(BeNil())
 		})
 
 		AfterEach(func() {
-			err := UnSubBrokerTopic(brok, topi)
+			err := c.Unsubscribe(topi)
 			Ω(err).ToNot(HaveOccurred(), "cannot unsubscribe")
-
-			close(chMsg)
+			Ω(c.Stop()).To(Succeed())
 		})
 
 		It("should publish and receive message success", func() {
 			By("publish")
-			token := _broker.client.Publish(topi, byte(2), false, "hello")
-			token.Wait()
-			Ω(token.Error()).ToNot(HaveOccurred(), "cannot publish")
+			err := c.Publish(topi, byte(2), false, []byte("hello"))
+			Ω(err).ToNot(HaveOccurred(), "cannot publish")
 
 			By("receive")
 			Ω(<-chMsg).To(Equal("hello"))
 		})
 	})
 
+	Describe("mqtt 5", func() {
+		brok5 := brok + "/v5"
+
+		It("should receive properties with the message", func() {
+			chMsg := make(chan *Message, 1)
+			c, err := Open(context.Background(), brok5, Options{Broker: brok, ProtocolVersion: Version5})
+			Ω(err).ToNot(HaveOccurred())
+			err = c.Start(context.Background(), func(ctx context.Context, msg *Message) error {
+				chMsg <- msg
+				return nil
+			})
+			Ω(err).ToNot(HaveOccurred(), "cannot connect")
+			defer c.Stop()
+			err = c.Subscribe(connector.Subscription{Topic: "$share/group/" + topi, QoS: 1, ID: 7})
+			Ω(err).ToNot(HaveOccurred(), "cannot subscribe")
+
+			pub := newV5Client("publisher", Options{Broker: brok}, nil)
+			Ω(pub.connect()).To(Succeed())
+			defer pub.disconnect()
+			cm, err := pub.manager()
+			Ω(err).ToNot(HaveOccurred())
+			_, err = cm.Publish(context.Background(), &paho.Publish{Topic: topi, QoS: 1, Payload: []byte("hello"), Properties: &paho.PublishProperties{
+				ContentType: "text/plain",
+				User:        paho.UserProperties{{Key: "site", Value: "a"}, {Key: "site", Value: "b"}},
+			}})
+			Ω(err).ToNot(HaveOccurred(), "cannot publish")
+
+			var msg *Message
+			Eventually(chMsg, "5s").Should(Receive(&msg))
+			Ω(msg.Topic).To(Equal(topi))
+			Ω(msg.Payload).To(Equal("hello"))
+			Ω(msg.ContentType).To(Equal("text/plain"))
+			Ω(msg.SubscriptionID).To(Equal(7))
+			Ω(msg.UserProperties).To(Equal([]UserProperty{{Key: "site", Value: "a"}, {Key: "site", Value: "b"}}))
+		})
+
+		It("should resolve topic aliases per connection", func() {
+			var a topicAliases
+			alias := func(n uint16) *uint16 { return &n }
+			topic, err := a.resolve(1, "plant/a", alias(3))
+			Ω(err).ToNot(HaveOccurred())
+			Ω(topic).To(Equal("plant/a"))
+			Ω(a.resolve(1, "", alias(3))).To(Equal("plant/a"))
+			Ω(a.resolve(1, "plant/b", nil)).To(Equal("plant/b"))
+
+			_, err = a.resolve(2, "", alias(3))
+			Ω(err).To(HaveOccurred(), "a new connection starts without aliases")
+			_, err = a.resolve(2, "x", alias(topicAliasMaximum+1))
+			Ω(err).To(HaveOccurred())
+		})
+	})
+
 	Describe("mixture", func() {
 
 	})
@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"dataservice/tool"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// default ports of schemes when the broker url has none
+var defaultPorts = map[string]int{"tcp": 1883, "ssl": 8883, "tls": 8883, "ws": 80, "wss": 443}
+
+// schemes dialed over a plain socket, their connections are pinned to the checked address
+var pinnedSchemes = map[string]bool{"tcp": true, "ssl": true, "tls": true}
+
+// schemes dialed over websockets, their urls keep the host name for the Host header and dials go to the checked address
+var websocketSchemes = map[string]bool{"ws": true, "wss": true}
+
+// CheckPolicy check the broker url of o against its policy, the returned options dial the checked address
+func CheckPolicy(ctx context.Context, o Options) (Options, error) {
+	if o.Policy == nil {
+		return o, nil
+	}
+	u, err := url.Parse(o.Broker)
+	if err != nil {
+		return o, tool.Wrap(tool.KindInvalid, err, "parse broker url")
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	port := defaultPorts[scheme]
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return o, tool.Wrap(tool.KindInvalid, err, "parse broker port")
+		}
+	}
+	ips, err := o.Policy.Check(ctx, scheme, host, port)
+	if err != nil {
+		return o, err
+	}
+
+	// pin the checked address, so a second resolution at dial time cannot be steered elsewhere
+	if pinnedSchemes[scheme] && net.ParseIP(host) == nil {
+		if scheme != "tcp" {
+			cfg := &tls.Config{}
+			if o.TLS != nil {
+				cfg = o.TLS.Clone()
+			}
+			if cfg.ServerName == "" {
+				cfg.ServerName = u.Hostname()
+			}
+			o.TLS = cfg
+		}
+		u.Host = net.JoinHostPort(ips[0].String(), strconv.Itoa(port))
+		o.Broker = u.String()
+	}
+	if websocketSchemes[scheme] && net.ParseIP(host) == nil {
+		o.Address = net.JoinHostPort(ips[0].String(), strconv.Itoa(port))
+	}
+	return o, nil
+}
@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"context"
+	"dataservice/policy"
+	"dataservice/tool"
+	"errors"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("policy", func() {
+	var p *policy.Policy
+
+	BeforeEach(func() {
+		var err error
+		p, err = policy.Parse([]string{"tcp", "SSL"}, []string{"*.example.com", "mosquitto"},
+			[]string{"127.0.0.0/8", "10.0.0.0/8", "::1/128"}, []string{"1883", "8000-8999"})
+		Ω(err).ToNot(HaveOccurred())
+		p.Resolve = func(ctx context.Context, host string) ([]net.IP, error) {
+			switch host {
+			case "broker.example.com", "mosquitto":
+				return []net.IP{net.ParseIP("203.0.113.7")}, nil
+			case "internal.example.com":
+				return []net.IP{net.ParseIP("203.0.113.8"), net.ParseIP("10.1.2.3")}, nil
+			case "loopback.example.com":
+				return []net.IP{net.ParseIP("::1")}, nil
+			}
+			return nil, errors.New("no such host")
+		}
+	})
+
+	DescribeTable("check",
+		func(broker string, kind tool.Kind, allowed bool) {
+			_, err := CheckPolicy(context.Background(), Options{Broker: broker, Policy: p})
+			if allowed {
+				Ω(err).ToNot(HaveOccurred())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(kind), "%v", err)
+			}
+		},
+		Entry("allowed host", "tcp://broker.example.com:1883", tool.KindInternal, true),
+		Entry("default port", "tcp://mosquitto", tool.KindInternal, true),
+		Entry("port in range", "ssl://broker.example.com:8883", tool.KindInternal, true),
+		Entry("scheme", "ws://broker.example.com:8080", tool.KindForbidden, false),
+		Entry("host", "tcp://evil.com:1883", tool.KindForbidden, false),
+		Entry("port", "tcp://broker.example.com:22", tool.KindForbidden, false),
+		Entry("any denied address", "tcp://internal.example.com:1883", tool.KindForbidden, false),
+		Entry("ipv6 loopback", "tcp://loopback.example.com:1883", tool.KindForbidden, false),
+		Entry("unresolvable", "tcp://gone.example.com:1883", tool.KindUnavailable, false),
+	)
+
+	It("should pin the checked address", func() {
+		o, err := CheckPolicy(context.Background(), Options{Broker: "ssl://broker.example.com:8883", Policy: p})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(o.Broker).To(Equal("ssl://203.0.113.7:8883"))
+		Ω(o.TLS.ServerName).To(Equal("broker.example.com"))
+	})
+
+	It("should pin websocket dials and keep the host name in the url", func() {
+		p.Schemes = append(p.Schemes, "wss")
+		o, err := CheckPolicy(context.Background(), Options{Broker: "wss://broker.example.com:8443/mqtt", Policy: p})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(o.Broker).To(Equal("wss://broker.example.com:8443/mqtt"))
+		Ω(o.Address).To(Equal("203.0.113.7:8443"))
+	})
+
+	It("should check the policy of the options", func() {
+		_, err := CheckPolicy(context.Background(), Options{Broker: "tcp://evil.com:1883", Policy: p})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+		o, err := CheckPolicy(context.Background(), Options{Broker: "tcp://mosquitto", Policy: p})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(o.Broker).To(Equal("tcp://203.0.113.7:1883"))
+	})
+
+	It("should allow everything without policy", func() {
+		o, err := CheckPolicy(context.Background(), Options{Broker: "tcp://localhost:1883"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(o.Broker).To(Equal("tcp://localhost:1883"))
+	})
+})
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v3Client MQTT 3.1.1 connection, messages carry no properties
+type v3Client struct {
+	mqtt.Client
+}
+
+func newV3Client(o Options, deliver func(ctx context.Context, msg *Message, msgID uint16)) *v3Client {
+	opts := mqtt.NewClientOptions()
+	opts.SetAutoReconnect(true)
+	opts.AddBroker(o.Broker)
+	opts.SetUsername(o.Username)
+	opts.SetPassword(o.Password)
+	opts.SetClientID(o.ClientID)
+	if o.TLS != nil {
+		opts.SetTLSConfig(o.TLS)
+	}
+	if o.Address != "" {
+		opts.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+			return dialWebsocket(uri, o.Address, options.TLSConfig, options.ConnectTimeout)
+		})
+	}
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		deliver(context.Background(), &Message{Topic: msg.Topic(), Payload: string(msg.Payload()), QoS: msg.Qos()}, msg.MessageID())
+	})
+	return &v3Client{Client: mqtt.NewClient(opts)}
+}
+
+func (c *v3Client) connect() error {
+	token := c.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (c *v3Client) isConnected() bool {
+	return c.IsConnected()
+}
+
+func (c *v3Client) subscribe(topic string, qos byte, id int) error {
+	token := c.Subscribe(topic, qos, nil)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *v3Client) unsubscribe(topic string) error {
+	token := c.Unsubscribe(topic)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *v3Client) publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := c.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return errors.New("timed out")
+	}
+	return token.Error()
+}
+
+func (c *v3Client) disconnect() {
+	c.Disconnect(0)
+}
@@ -0,0 +1,282 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"dataservice/tool"
+	"dataservice/tracing"
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/gorilla/websocket"
+)
+
+// topicAliasMaximum the broker may use on MQTT 5 connections, aliases are not used for the few messages published
+const topicAliasMaximum = 64
+
+// maxSubscriptionID of the protocol, larger ids are not sent
+const maxSubscriptionID = 268435455
+
+// connectTimeout bound the first connection of MQTT 5 clients, later ones are retried in the background
+const connectTimeout = 10 * time.Second
+
+type v5Subscription struct {
+	qos byte
+	id  int
+}
+
+// v5Client MQTT 5 connection, subscriptions are renewed on every reconnect as sessions do not outlive connections
+type v5Client struct {
+	sync.Mutex
+	brok      string
+	cfg       autopaho.ClientConfig
+	cm        *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected atomic.Bool
+	subs      map[string]v5Subscription
+	aliases   topicAliases
+	deliver   func(ctx context.Context, msg *Message, msgID uint16)
+}
+
+func newV5Client(brok string, o Options, deliver func(ctx context.Context, msg *Message, msgID uint16)) *v5Client {
+	c := &v5Client{brok: brok, subs: make(map[string]v5Subscription), deliver: deliver}
+	c.cfg = autopaho.ClientConfig{
+		TlsCfg:                        o.TLS,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectTimeout:                connectTimeout,
+		ConnectUsername:               o.Username,
+		ConnectPassword:               []byte(o.Password),
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if cp.Properties == nil {
+				cp.Properties = &paho.ConnectProperties{}
+			}
+			cp.Properties.TopicAliasMaximum = paho.Uint16(topicAliasMaximum)
+			return cp, nil
+		},
+		OnConnectionUp: c.up,
+		OnConnectError: func(err error) {
+			_Log.Warn("connect broker failure", "broker", brok, "err", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          o.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.received},
+			OnClientError: func(err error) {
+				c.connected.Store(false)
+				_Log.Warn("connection lost", "broker", brok, "err", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connected.Store(false)
+				_Log.Warn("disconnected by broker", "broker", brok, "reason", d.ReasonCode)
+			},
+		},
+	}
+	if u, err := url.Parse(o.Broker); err == nil {
+		c.cfg.ServerUrls = []*url.URL{u}
+	}
+	if o.Address != "" {
+		c.cfg.WebSocketCfg = &autopaho.WebSocketConfig{Dialer: func(_ *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+			return websocketDialer(o.Address, tlsCfg, connectTimeout)
+		}}
+	}
+	return c
+}
+
+func (c *v5Client) connect() error {
+	if len(c.cfg.ServerUrls) == 0 {
+		return tool.Invalid("broker url is not valid")
+	}
+	c.Lock()
+	if c.cm == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cm, err := autopaho.NewConnection(ctx, c.cfg)
+		if err != nil {
+			c.Unlock()
+			cancel()
+			return err
+		}
+		c.cm, c.cancel = cm, cancel
+	}
+	cm := c.cm
+	c.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		c.disconnect()
+		return err
+	}
+	return nil
+}
+
+// up renew the subscriptions on a new connection
+func (c *v5Client) up(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+	c.connected.Store(true)
+	c.Lock()
+	subs := make(map[string]v5Subscription, len(c.subs))
+	for topic, s := range c.subs {
+		subs[topic] = s
+	}
+	c.Unlock()
+	for topic, s := range subs {
+		if err := c.sub(cm, topic, s); err != nil {
+			_Log.Error("renew subscription", "broker", c.brok, "topic", topic, "err", err)
+		}
+	}
+}
+
+func (c *v5Client) isConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *v5Client) manager() (*autopaho.ConnectionManager, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.cm == nil {
+		return nil, errors.New("not connected")
+	}
+	return c.cm, nil
+}
+
+func (c *v5Client) subscribe(topic string, qos byte, id int) error {
+	cm, err := c.manager()
+	if err != nil {
+		return err
+	}
+	s := v5Subscription{qos: qos, id: id}
+	if err := c.sub(cm, topic, s); err != nil {
+		return err
+	}
+	c.Lock()
+	c.subs[topic] = s
+	c.Unlock()
+	return nil
+}
+
+func (c *v5Client) sub(cm *autopaho.ConnectionManager, topic string, s v5Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	sub := &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: s.qos}}}
+	if s.id > 0 && s.id <= maxSubscriptionID {
+		sub.Properties = &paho.SubscribeProperties{SubscriptionIdentifier: &s.id}
+	}
+	_, err := cm.Subscribe(ctx, sub)
+	if errors.Is(err, paho.ErrInvalidArguments) && sub.Properties != nil {
+		// the broker does not support subscription identifiers
+		sub.Properties = nil
+		_, err = cm.Subscribe(ctx, sub)
+	}
+	return err
+}
+
+func (c *v5Client) unsubscribe(topic string) error {
+	cm, err := c.manager()
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	delete(c.subs, topic)
+	c.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err = cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	return err
+}
+
+func (c *v5Client) publish(topic string, qos byte, retained bool, payload []byte) error {
+	cm, err := c.manager()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err = cm.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload})
+	return err
+}
+
+func (c *v5Client) disconnect() {
+	c.Lock()
+	cm, cancel := c.cm, c.cancel
+	c.cm, c.cancel = nil, nil
+	c.Unlock()
+	c.connected.Store(false)
+	if cm == nil {
+		return
+	}
+	ctx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	if err := cm.Disconnect(ctx); err != nil {
+		_Log.Debug("disconnect broker", "broker", c.brok, "err", err)
+	}
+	cancel()
+}
+
+// received message with its properties, the trace context of its user properties is continued
+func (c *v5Client) received(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := &Message{Topic: p.Topic, Payload: string(p.Payload), QoS: p.QoS}
+	parent := context.Background()
+	if props := p.Properties; props != nil {
+		topic, err := c.aliases.resolve(pr.Client, p.Topic, props.TopicAlias)
+		if err != nil {
+			_Log.Warn("drop message", "broker", c.brok, "err", err)
+			return true, nil
+		}
+		msg.Topic = topic
+		msg.ContentType, msg.ResponseTopic, msg.CorrelationData = props.ContentType, props.ResponseTopic, props.CorrelationData
+		if props.SubscriptionIdentifier != nil {
+			msg.SubscriptionID = *props.SubscriptionIdentifier
+		}
+		carrier := tracing.UserProperties{}
+		for _, u := range props.User {
+			msg.UserProperties = append(msg.UserProperties, UserProperty{Key: u.Key, Value: u.Value})
+			if _, ok := carrier[u.Key]; !ok {
+				carrier[u.Key] = u.Value
+			}
+		}
+		parent = tracing.Extract(parent, carrier)
+	}
+	c.deliver(parent, msg, p.PacketID)
+	return true, nil
+}
+
+// topicAliases the broker set up on the current connection, each connection starts without any
+type topicAliases struct {
+	sync.Mutex
+	conn   interface{}
+	topics map[uint16]string
+}
+
+// resolve topic of a message received on conn, an alias along with a topic sets it up
+func (a *topicAliases) resolve(conn interface{}, topic string, alias *uint16) (string, error) {
+	if alias == nil {
+		return topic, nil
+	}
+	if *alias == 0 || *alias > topicAliasMaximum {
+		return "", tool.Invalid("topic alias [%d] is out of range", *alias)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.conn != conn || a.topics == nil {
+		a.conn, a.topics = conn, make(map[uint16]string)
+	}
+	if topic != "" {
+		a.topics[*alias] = topic
+		return topic, nil
+	}
+	topic, ok := a.topics[*alias]
+	if !ok {
+		return "", tool.Invalid("topic alias [%d] is not set up", *alias)
+	}
+	return topic, nil
+}
@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketDialer of connections to address, the url dialed only names the host for the Host header and tls
+func websocketDialer(address string, tlsCfg *tls.Config, timeout time.Duration) *websocket.Dialer {
+	d := net.Dialer{Timeout: timeout}
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, address)
+		},
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  tlsCfg,
+		Subprotocols:     []string{"mqtt"},
+	}
+}
+
+// dialWebsocket connection of uri at address
+func dialWebsocket(uri *url.URL, address string, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	u := *uri
+	u.User = nil
+	ws, _, err := websocketDialer(address, tlsCfg, timeout).Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &websocketConn{Conn: ws}, nil
+}
+
+// websocketConn stream of bytes over binary websocket messages
+type websocketConn struct {
+	*websocket.Conn
+	rio sync.Mutex
+	wio sync.Mutex
+	r   io.Reader
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	c.rio.Lock()
+	defer c.rio.Unlock()
+
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("websocket", func() {
+	It("should dial the pinned address and stream over binary messages", func() {
+		hosts := make(chan string, 1)
+		upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			for {
+				kind, b, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				ws.WriteMessage(kind, append(b, b...))
+			}
+		}))
+		defer server.Close()
+
+		u, _ := url.Parse("ws://broker.invalid:8080/mqtt")
+		conn, err := dialWebsocket(u, strings.TrimPrefix(server.URL, "http://"), nil, time.Second)
+		Ω(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Ω(<-hosts).To(Equal("broker.invalid:8080"))
+
+		_, err = conn.Write([]byte("ab"))
+		Ω(err).ToNot(HaveOccurred())
+		b := make([]byte, 3)
+		n, err := conn.Read(b)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(b[:n])).To(Equal("aba"))
+		n, err = conn.Read(b)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(b[:n])).To(Equal("b"))
+	})
+})
@@ -0,0 +1,201 @@
+package connector_test
+
+import (
+	"context"
+	"dataservice/connector"
+	"dataservice/tool"
+	"sort"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fake connector keeping its topics and what it published in memory
+type fake struct {
+	sync.Mutex
+	started   bool
+	stopped   bool
+	failStart bool
+	topics    map[string]bool
+	published []string
+	process   connector.Processor
+	// beforeSubscribe runs once ahead of the next subscription
+	beforeSubscribe func()
+}
+
+func (f *fake) Start(ctx context.Context, process connector.Processor) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.failStart {
+		return tool.Unavailable("broker is down")
+	}
+	f.started, f.process = true, process
+	return nil
+}
+
+func (f *fake) Stop() error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.stopped = true
+	return nil
+}
+
+func (f *fake) Subscribe(s connector.Subscription) error {
+	f.Lock()
+	before := f.beforeSubscribe
+	f.beforeSubscribe = nil
+	f.Unlock()
+	if before != nil {
+		before()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.stopped {
+		return tool.Unavailable("connector is stopped")
+	}
+	if f.topics[s.Topic] {
+		return tool.Conflict("topic [%s] already subscribed", s.Topic)
+	}
+	f.topics[s.Topic] = true
+	return nil
+}
+
+func (f *fake) Unsubscribe(topic string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.topics[topic] {
+		return tool.NotFound("there is no such topic [%s]", topic)
+	}
+	delete(f.topics, topic)
+	return nil
+}
+
+func (f *fake) Status() connector.Status {
+	f.Lock()
+	defer f.Unlock()
+
+	topics := []string{}
+	for topic := range f.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return connector.Status{Connected: f.started && !f.stopped, Topics: topics}
+}
+
+func (f *fake) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.published = append(f.published, topic+" "+string(payload))
+	return nil
+}
+
+var _ = Describe("registry", func() {
+	var r *connector.Registry
+	var opened []*fake
+	var open connector.Opener
+
+	BeforeEach(func() {
+		r = connector.NewRegistry()
+		opened = nil
+		open = func(ctx context.Context) (connector.Connector, error) {
+			f := &fake{topics: make(map[string]bool)}
+			opened = append(opened, f)
+			return f, nil
+		}
+	})
+
+	It("should open and start a connector with its first subscription", func() {
+		process := func(ctx context.Context, msg *connector.Message) error { return nil }
+		Ω(r.Subscribe(context.Background(), "1/1", open, process, connector.Subscription{Topic: "a"})).To(Succeed())
+		Ω(r.Subscribe(context.Background(), "1/1", open, process, connector.Subscription{Topic: "b"})).To(Succeed())
+		Ω(opened).To(HaveLen(1))
+		Ω(opened[0].started).To(BeTrue())
+		Ω(opened[0].process).ToNot(BeNil())
+
+		status, ok := r.Status("1/1")
+		Ω(ok).To(BeTrue())
+		Ω(status).To(Equal(connector.Status{Connected: true, Topics: []string{"a", "b"}}))
+		err := r.Subscribe(context.Background(), "1/1", open, process, connector.Subscription{Topic: "a"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindConflict))
+		Ω(opened[0].stopped).To(BeFalse(), "a failed subscription keeps a connector in use")
+	})
+
+	It("should stop a connector with its last topic", func() {
+		Ω(r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "a"})).To(Succeed())
+		Ω(r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "b"})).To(Succeed())
+
+		Ω(r.Unsubscribe("1/1", "a")).To(Succeed())
+		Ω(opened[0].stopped).To(BeFalse())
+		Ω(tool.KindOf(r.Unsubscribe("1/1", "a"))).To(Equal(tool.KindNotFound))
+		Ω(r.Unsubscribe("1/1", "b")).To(Succeed())
+		Ω(opened[0].stopped).To(BeTrue())
+		_, ok := r.Get("1/1")
+		Ω(ok).To(BeFalse())
+		Ω(tool.KindOf(r.Unsubscribe("1/1", "b"))).To(Equal(tool.KindNotFound))
+
+		status, ok := r.Status("1/1")
+		Ω(ok).To(BeFalse())
+		Ω(status.Topics).To(BeEmpty())
+	})
+
+	It("should subscribe on a fresh connector when the one found stops with its last topic meanwhile", func() {
+		Ω(r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "a"})).To(Succeed())
+		opened[0].beforeSubscribe = func() {
+			Ω(r.Unsubscribe("1/1", "a")).To(Succeed())
+		}
+		Ω(r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "b"})).To(Succeed())
+		Ω(opened).To(HaveLen(2))
+		Ω(opened[0].stopped).To(BeTrue())
+		status, ok := r.Status("1/1")
+		Ω(ok).To(BeTrue())
+		Ω(status.Topics).To(Equal([]string{"b"}))
+	})
+
+	It("should forget a connector which does not start", func() {
+		open := func(ctx context.Context) (connector.Connector, error) {
+			f := &fake{topics: make(map[string]bool), failStart: true}
+			opened = append(opened, f)
+			return f, nil
+		}
+		err := r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "a"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindUnavailable))
+		Ω(opened[0].stopped).To(BeTrue())
+		_, ok := r.Get("1/1")
+		Ω(ok).To(BeFalse())
+	})
+
+	It("should not register connectors which fail to open", func() {
+		failed := func(ctx context.Context) (connector.Connector, error) {
+			return nil, tool.Forbidden("broker is not allowed")
+		}
+		err := r.Subscribe(context.Background(), "1/1", failed, nil, connector.Subscription{Topic: "a"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+		_, ok := r.Get("1/1")
+		Ω(ok).To(BeFalse())
+	})
+
+	It("should publish, close and stop connectors by key", func() {
+		Ω(tool.KindOf(r.Publish("1/1", "t", 0, false, []byte("x")))).To(Equal(tool.KindNotFound))
+		Ω(r.Subscribe(context.Background(), "1/1", open, nil, connector.Subscription{Topic: "a"})).To(Succeed())
+		Ω(r.Subscribe(context.Background(), "1/2", open, nil, connector.Subscription{Topic: "a"})).To(Succeed())
+		Ω(r.Publish("1/1", "t", 0, false, []byte("x"))).To(Succeed())
+		Ω(opened[0].published).To(Equal([]string{"t x"}))
+
+		Ω(r.Close("1/1")).To(Succeed())
+		Ω(opened[0].stopped).To(BeTrue())
+		Ω(tool.KindOf(r.Close("1/1"))).To(Equal(tool.KindNotFound))
+
+		r.Stop()
+		Ω(opened[1].stopped).To(BeTrue())
+		_, ok := r.Get("1/2")
+		Ω(ok).To(BeFalse())
+	})
+
+})
@@ -0,0 +1,37 @@
+package connector
+
+import (
+	"dataservice/tool"
+	"strings"
+)
+
+// MatchTopic against an mqtt topic filter, "+" matches one level and a trailing "#" any levels
+func MatchTopic(filter, topic string) bool {
+	levels := strings.Split(topic, "/")
+	for i, level := range strings.Split(filter, "/") {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) || (level != "+" && level != levels[i]) {
+			return false
+		}
+	}
+	return len(strings.Split(filter, "/")) == len(levels)
+}
+
+// ValidFilter check an mqtt topic filter
+func ValidFilter(filter string) error {
+	if filter == "" {
+		return tool.Invalid("topic filter is required")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return tool.Invalid("'#' must be the whole last level of filter [%s]", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return tool.Invalid("'+' must be a whole level of filter [%s]", filter)
+		}
+	}
+	return nil
+}
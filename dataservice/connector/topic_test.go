@@ -0,0 +1,31 @@
+package connector_test
+
+import (
+	"dataservice/connector"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("topic", func() {
+	DescribeTable("match topic",
+		func(filter, topic string, matched bool) {
+			Ω(connector.MatchTopic(filter, topic)).To(Equal(matched))
+		},
+		Entry("exact", "a/b", "a/b", true),
+		Entry("single level", "a/+/c", "a/b/c", true),
+		Entry("multi level", "a/#", "a/b/c", true),
+		Entry("multi level of parent", "a/#", "a", true),
+		Entry("shorter", "a/+", "a/b/c", false),
+		Entry("longer", "a/b/c", "a/b", false),
+	)
+
+	It("should validate filters", func() {
+		Ω(connector.ValidFilter("devices/+/telemetry")).To(Succeed())
+		Ω(tool.KindOf(connector.ValidFilter("a/#/b"))).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf(connector.ValidFilter("a+"))).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf(connector.ValidFilter(""))).To(Equal(tool.KindInvalid))
+	})
+})
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/tool"
+	"errors"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// dbTimeout bound every database round trip of a request
+const dbTimeout = 5 * time.Second
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dbContext derive a bounded context from the request
+func dbContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), dbTimeout)
+}
+
+// dbError classify database errors into typed errors
+func dbError(err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return tool.Wrap(tool.KindNotFound, err, msg)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation", "exclusion_violation":
+			return tool.Wrap(tool.KindConflict, err, msg)
+		case "foreign_key_violation":
+			return tool.Wrap(tool.KindNotFound, err, msg)
+		case "check_violation", "not_null_violation", "invalid_text_representation":
+			return tool.Wrap(tool.KindInvalid, err, msg)
+		}
+		if pqErr.Code.Class() == "08" {
+			return tool.Wrap(tool.KindUnavailable, err, msg)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return tool.Wrap(tool.KindUnavailable, err, msg)
+	}
+	return tool.Wrap(tool.KindInternal, err, msg)
+}
+
+// inTx run fn in a transaction, it is committed only when fn succeeds
+func (_global *global) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := _global.pgPool.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err, "begin transaction")
+	}
+	if err := fn(tx); err != nil {
+		tool.ErrorThenPrint(tx.Rollback(), "rollback transaction")
+		return err
+	}
+	return dbError(tx.Commit(), "commit transaction")
+}
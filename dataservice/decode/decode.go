@@ -0,0 +1,167 @@
+package decode
+
+import (
+	"bytes"
+	"dataservice/tool"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// payload formats
+const (
+	FormatCBOR     = "cbor"
+	FormatMsgPack  = "msgpack"
+	FormatProtobuf = "protobuf"
+)
+
+// Decoder turn a binary payload into json
+type Decoder interface {
+	Decode(payload []byte) (json.RawMessage, error)
+}
+
+// Spec of a decoder, descriptors and message type are for protobuf only
+type Spec struct {
+	Format      string
+	Descriptors *Descriptors
+	MessageType string
+}
+
+// Factory create the decoder of spec
+type Factory func(spec Spec) (Decoder, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{
+		FormatCBOR:     func(Spec) (Decoder, error) { return cborDecoder{}, nil },
+		FormatMsgPack:  func(Spec) (Decoder, error) { return msgpackDecoder{}, nil },
+		FormatProtobuf: newProtobufDecoder,
+	}
+	contentTypes = map[string]string{
+		"application/cbor":        FormatCBOR,
+		"application/msgpack":     FormatMsgPack,
+		"application/x-msgpack":   FormatMsgPack,
+		"application/vnd.msgpack": FormatMsgPack,
+		"application/protobuf":    FormatProtobuf,
+		"application/x-protobuf":  FormatProtobuf,
+	}
+)
+
+// Register factory of format, it replaces the one registered before
+func Register(format string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	factories[format] = f
+}
+
+// Formats registered, sorted
+func Formats() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	formats := make([]string, 0, len(factories))
+	for f := range factories {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// New decoder of spec
+func New(spec Spec) (Decoder, error) {
+	mu.RLock()
+	f, ok := factories[spec.Format]
+	mu.RUnlock()
+	if !ok {
+		return nil, tool.Invalid("unknown format [%s], one of %s", spec.Format, strings.Join(Formats(), ", "))
+	}
+	return f(spec)
+}
+
+// FormatOf well known content type, parameters are ignored; empty when there is none
+func FormatOf(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return contentTypes[mediaType]
+}
+
+// ValidContentType check content type is a media type
+func ValidContentType(contentType string) error {
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return tool.Invalid("content type [%s] is not a media type", contentType)
+	}
+	return nil
+}
+
+type cborDecoder struct{}
+
+func (cborDecoder) Decode(payload []byte) (json.RawMessage, error) {
+	var v interface{}
+	if err := cbor.Unmarshal(payload, &v); err != nil {
+		return nil, fmt.Errorf("decode cbor: %w", err)
+	}
+	return marshal(v)
+}
+
+type msgpackDecoder struct{}
+
+func (msgpackDecoder) Decode(payload []byte) (json.RawMessage, error) {
+	r := bytes.NewReader(payload)
+	dec := msgpack.NewDecoder(r)
+	// keys of any type, they become strings in json
+	dec.SetMapDecoder(func(dec *msgpack.Decoder) (interface{}, error) { return dec.DecodeUntypedMap() })
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode msgpack: %w", err)
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("decode msgpack: %d bytes of trailing data", r.Len())
+	}
+	return marshal(v)
+}
+
+// marshal decoded value as json, map keys become strings and byte strings base64
+func marshal(v interface{}) (json.RawMessage, error) {
+	b, err := json.Marshal(jsonable(v))
+	if err != nil {
+		return nil, fmt.Errorf("encode json: %w", err)
+	}
+	return b, nil
+}
+
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonable(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonable(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonable(e)
+		}
+		return v
+	case cbor.Tag:
+		return jsonable(v.Content)
+	case big.Int:
+		return &v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,13 @@
+package decode_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDecode(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Decode Suite")
+}
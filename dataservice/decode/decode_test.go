@@ -0,0 +1,95 @@
+package decode_test
+
+import (
+	"dataservice/decode"
+	"dataservice/tool"
+
+	"github.com/fxamacker/cbor/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var _ = Describe("decode", func() {
+	It("should decode cbor into json", func() {
+		d, err := decode.New(decode.Spec{Format: decode.FormatCBOR})
+		Ω(err).ToNot(HaveOccurred())
+		payload, err := cbor.Marshal(map[interface{}]interface{}{"temperature": 21.5, 7: []byte{1, 2}, "tags": []string{"a"}})
+		Ω(err).ToNot(HaveOccurred())
+		out, err := d.Decode(payload)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(MatchJSON(`{"temperature": 21.5, "7": "AQI=", "tags": ["a"]}`))
+
+		_, err = d.Decode(append(payload, 0x01))
+		Ω(err).To(HaveOccurred())
+		_, err = d.Decode([]byte{0xff})
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("should decode msgpack into json", func() {
+		d, err := decode.New(decode.Spec{Format: decode.FormatMsgPack})
+		Ω(err).ToNot(HaveOccurred())
+		payload, err := msgpack.Marshal(map[string]interface{}{"rpm": 1200, "ok": true, "nested": map[int]string{1: "x"}})
+		Ω(err).ToNot(HaveOccurred())
+		out, err := d.Decode(payload)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(MatchJSON(`{"rpm": 1200, "ok": true, "nested": {"1": "x"}}`))
+
+		_, err = d.Decode(append(payload, 0x01))
+		Ω(err).To(MatchError(ContainSubstring("trailing data")))
+	})
+
+	It("should decode protobuf with descriptors of a .proto file", func() {
+		descriptors, err := decode.ParseProto("sensor.proto", `
+			syntax = "proto3";
+			package acme;
+			import "google/protobuf/timestamp.proto";
+			message Reading {
+				double temperature = 1;
+				string unit_name = 2;
+				google.protobuf.Timestamp at = 3;
+				message Extra { int32 code = 1; }
+				Extra extra = 4;
+			}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(descriptors.MessageTypes()).To(Equal([]string{"acme.Reading", "acme.Reading.Extra"}))
+
+		d, err := decode.New(decode.Spec{Format: decode.FormatProtobuf, Descriptors: descriptors, MessageType: "acme.Reading"})
+		Ω(err).ToNot(HaveOccurred())
+		var payload []byte
+		payload = protowire.AppendTag(payload, 1, protowire.Fixed64Type)
+		payload = protowire.AppendFixed64(payload, 0x4035800000000000) // 21.5
+		payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+		payload = protowire.AppendString(payload, "C")
+		out, err := d.Decode(payload)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(out)).To(Equal(`{"temperature":21.5,"unit_name":"C"}`))
+
+		_, err = d.Decode([]byte{0x0a})
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("should reject unknown message types and broken descriptors", func() {
+		descriptors, err := decode.ParseProto("a.proto", `syntax = "proto3"; message A { int32 x = 1; }`)
+		Ω(err).ToNot(HaveOccurred())
+		_, err = decode.New(decode.Spec{Format: decode.FormatProtobuf, Descriptors: descriptors, MessageType: "B"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindNotFound))
+		_, err = decode.New(decode.Spec{Format: decode.FormatProtobuf, MessageType: "A"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+
+		_, err = decode.ParseProto("b.proto", `syntax = "proto3"; message B { unknown x = 1; }`)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = decode.ParseDescriptorSet([]byte{0xff, 0xff})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = decode.New(decode.Spec{Format: "xml"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should know the formats of well known content types", func() {
+		Ω(decode.FormatOf("application/cbor")).To(Equal(decode.FormatCBOR))
+		Ω(decode.FormatOf("application/x-msgpack; charset=binary")).To(Equal(decode.FormatMsgPack))
+		Ω(decode.FormatOf("application/json")).To(BeEmpty())
+		Ω(decode.FormatOf("")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,149 @@
+package decode
+
+import (
+	"bytes"
+	"context"
+	"dataservice/tool"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Descriptors of protobuf messages, from a .proto file or a descriptor set
+type Descriptors struct {
+	files *protoregistry.Files
+}
+
+// ParseProto compile .proto source named name, the well known google/protobuf imports are available
+func ParseProto(name, source string) (*Descriptors, error) {
+	c := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{name: source}),
+		}),
+	}
+	compiled, err := c.Compile(context.Background(), name)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "compile proto")
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	for _, fd := range compiled {
+		add(fd)
+	}
+	return newDescriptors(set)
+}
+
+// ParseDescriptorSet read a serialized FileDescriptorSet as written by protoc --descriptor_set_out --include_imports
+func ParseDescriptorSet(b []byte) (*Descriptors, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "read descriptor set")
+	}
+	return newDescriptors(set)
+}
+
+func newDescriptors(set *descriptorpb.FileDescriptorSet) (*Descriptors, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "link descriptors")
+	}
+	return &Descriptors{files: files}, nil
+}
+
+// MessageTypes full names of the messages declared, well known google types aside, sorted
+func (d *Descriptors) MessageTypes() []string {
+	names := []string{}
+	var add func(messages protoreflect.MessageDescriptors)
+	add = func(messages protoreflect.MessageDescriptors) {
+		for i := 0; i < messages.Len(); i++ {
+			m := messages.Get(i)
+			if !m.IsMapEntry() {
+				names = append(names, string(m.FullName()))
+			}
+			add(m.Messages())
+		}
+	}
+	d.files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		if fd.Package() != "google.protobuf" {
+			add(fd.Messages())
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// message descriptor of full name
+func (d *Descriptors) message(name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, tool.NotFound("there is no message type [%s]", name)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, tool.Invalid("[%s] is not a message type", name)
+	}
+	return md, nil
+}
+
+type protobufDecoder struct {
+	message protoreflect.MessageDescriptor
+	options protojson.MarshalOptions
+}
+
+func newProtobufDecoder(spec Spec) (Decoder, error) {
+	if spec.Descriptors == nil {
+		return nil, tool.Invalid("protobuf needs descriptors")
+	}
+	if spec.MessageType == "" {
+		return nil, tool.Invalid("protobuf needs a message type")
+	}
+	md, err := spec.Descriptors.message(spec.MessageType)
+	if err != nil {
+		return nil, err
+	}
+	return &protobufDecoder{
+		message: md,
+		// field names as in the .proto file, so schemas and rules read like the device firmware
+		options: protojson.MarshalOptions{UseProtoNames: true, Resolver: dynamicpb.NewTypes(spec.Descriptors.files)},
+	}, nil
+}
+
+func (d *protobufDecoder) Decode(payload []byte) (json.RawMessage, error) {
+	m := dynamicpb.NewMessage(d.message)
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return nil, fmt.Errorf("decode protobuf %s: %w", d.message.FullName(), err)
+	}
+	b, err := d.options.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("encode json: %w", err)
+	}
+	// protojson varies its whitespace on purpose
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, b); err != nil {
+		return nil, fmt.Errorf("encode json: %w", err)
+	}
+	return compact.Bytes(), nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/decode"
+	"dataservice/tool"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// descriptor kinds
+const (
+	descriptorProto = "proto"
+	descriptorSet   = "descriptor_set"
+)
+
+// Descriptor protobuf message descriptors uploaded as .proto source or as descriptor set
+type Descriptor struct {
+	ID           int64     `json:"id"`
+	TenantID     int64     `json:"tenantId"`
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	MessageTypes []string  `json:"messageTypes"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// descriptorInput body of create, either the .proto source or a base64 FileDescriptorSet
+type descriptorInput struct {
+	Name          string `json:"name"`
+	Proto         string `json:"proto"`
+	DescriptorSet []byte `json:"descriptorSet"`
+}
+
+// parseDescriptor content of kind, name is the .proto file name imports refer to
+func parseDescriptor(kind, name string, content []byte) (*decode.Descriptors, error) {
+	if kind == descriptorProto {
+		return decode.ParseProto(name, string(content))
+	}
+	return decode.ParseDescriptorSet(content)
+}
+
+// Decoder turn binary payloads of matching topics or content types into json before they are transformed and stored
+type Decoder struct {
+	ID           int64     `json:"id"`
+	TenantID     int64     `json:"tenantId"`
+	Name         string    `json:"name"`
+	Format       string    `json:"format"`
+	TopicFilter  string    `json:"topicFilter"`  // empty for any topic
+	ContentType  string    `json:"contentType"`  // empty for any content type
+	DescriptorID *int64    `json:"descriptorId"` // protobuf only
+	MessageType  string    `json:"messageType"`  // protobuf only
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+
+	decoder decode.Decoder
+}
+
+// decoderInput body of create and patch
+type decoderInput struct {
+	Name         *string `json:"name"`
+	Format       *string `json:"format"`
+	TopicFilter  *string `json:"topicFilter"`
+	ContentType  *string `json:"contentType"`
+	DescriptorID *int64  `json:"descriptorId"`
+	MessageType  *string `json:"messageType"`
+	Enabled      *bool   `json:"enabled"`
+}
+
+func (input *decoderInput) apply(d *Decoder) {
+	if input.Name != nil {
+		d.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Format != nil {
+		d.Format = strings.TrimSpace(*input.Format)
+	}
+	if input.TopicFilter != nil {
+		d.TopicFilter = strings.TrimSpace(*input.TopicFilter)
+	}
+	if input.ContentType != nil {
+		d.ContentType = strings.TrimSpace(*input.ContentType)
+	}
+	if input.DescriptorID != nil {
+		d.DescriptorID = input.DescriptorID
+	}
+	if input.MessageType != nil {
+		d.MessageType = strings.TrimSpace(*input.MessageType)
+	}
+	if input.Enabled != nil {
+		d.Enabled = *input.Enabled
+	}
+	if d.Format != decode.FormatProtobuf {
+		d.DescriptorID, d.MessageType = nil, ""
+	}
+}
+
+// build validate decoder and create its decoder, descriptors are those of DescriptorID
+func (d *Decoder) build(descriptors *decode.Descriptors) (err error) {
+	if d.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if d.TopicFilter == "" && d.ContentType == "" {
+		return tool.Invalid("topicFilter or contentType is required")
+	}
+	if d.TopicFilter != "" {
+		if err := connector.ValidFilter(d.TopicFilter); err != nil {
+			return err
+		}
+	}
+	if d.ContentType != "" {
+		if err := decode.ValidContentType(d.ContentType); err != nil {
+			return err
+		}
+	}
+	if d.Format == decode.FormatProtobuf && d.DescriptorID == nil {
+		return tool.Invalid("descriptorId is required for protobuf")
+	}
+	d.decoder, err = decode.New(decode.Spec{Format: d.Format, Descriptors: descriptors, MessageType: d.MessageType})
+	return err
+}
+
+// applies to messages on topic of content type
+func (d *Decoder) applies(topic, contentType string) bool {
+	return (d.TopicFilter == "" || connector.MatchTopic(d.TopicFilter, topic)) && (d.ContentType == "" || sameMediaType(d.ContentType, contentType))
+}
+
+func sameMediaType(a, b string) bool {
+	ma, _, err := mime.ParseMediaType(a)
+	if err != nil {
+		return false
+	}
+	mb, _, err := mime.ParseMediaType(b)
+	return err == nil && ma == mb
+}
+
+const decoderColumns = `id, tenant_id, name, format, topic_filter, content_type, descriptor_id, message_type, enabled, created_at, updated_at`
+
+func scanDecoder(row rowScanner) (*Decoder, error) {
+	d := &Decoder{}
+	err := row.Scan(&d.ID, &d.TenantID, &d.Name, &d.Format, &d.TopicFilter, &d.ContentType, &d.DescriptorID, &d.MessageType, &d.Enabled,
+		&d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+func queryDecoders(ctx context.Context, pgPool *sql.DB, query string, args ...interface{}) ([]*Decoder, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+decoderColumns+` from decoders `+query, args...)
+	if err != nil {
+		return nil, dbError(err, "query decoders")
+	}
+	defer rows.Close()
+
+	decoders := []*Decoder{}
+	for rows.Next() {
+		d, err := scanDecoder(rows)
+		if err != nil {
+			return nil, dbError(err, "scan decoder")
+		}
+		decoders = append(decoders, d)
+	}
+	return decoders, dbError(rows.Err(), "query decoders")
+}
+
+// queryDescriptors parsed, of tenant
+func queryDescriptors(ctx context.Context, pgPool *sql.DB, tenantID, id int64) (*decode.Descriptors, error) {
+	var kind, name string
+	var content []byte
+	err := pgPool.QueryRowContext(ctx, `select kind, name, content from descriptors where tenant_id = $1 and id = $2;`, tenantID, id).
+		Scan(&kind, &name, &content)
+	if err == sql.ErrNoRows {
+		return nil, tool.NotFound("there is no such descriptor [%d]", id)
+	}
+	if err != nil {
+		return nil, dbError(err, "query descriptor")
+	}
+	return parseDescriptor(kind, name, content)
+}
+
+type cachedDecoders struct {
+	decoders []*Decoder
+	expires  time.Time
+}
+
+// payloadDecoder turn binary telemetry into json with the first matching decoder of its tenant,
+// the well known binary content types are decoded without one
+type payloadDecoder struct {
+	sync.Mutex
+	pgPool  *sql.DB
+	tenants map[int64]cachedDecoders
+}
+
+func newPayloadDecoder(pgPool *sql.DB) *payloadDecoder {
+	return &payloadDecoder{pgPool: pgPool, tenants: make(map[int64]cachedDecoders)}
+}
+
+func (pd *payloadDecoder) tenantDecoders(ctx context.Context, tenantID int64) ([]*Decoder, error) {
+	pd.Lock()
+	cached, ok := pd.tenants[tenantID]
+	pd.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.decoders, nil
+	}
+
+	loaded, err := queryDecoders(ctx, pd.pgPool, `where tenant_id = $1 and enabled order by id;`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	decoders := loaded[:0]
+	parsed := make(map[int64]*decode.Descriptors)
+	for _, d := range loaded {
+		var descriptors *decode.Descriptors
+		if d.DescriptorID != nil {
+			if descriptors = parsed[*d.DescriptorID]; descriptors == nil {
+				if descriptors, err = queryDescriptors(ctx, pd.pgPool, tenantID, *d.DescriptorID); err != nil {
+					_Log.Warn("skip decoder of broken descriptor", "decoder", d.ID, "descriptor", *d.DescriptorID, "err", err)
+					continue
+				}
+				parsed[*d.DescriptorID] = descriptors
+			}
+		}
+		if err := d.build(descriptors); err != nil {
+			_Log.Warn("skip broken decoder", "decoder", d.ID, "err", err)
+			continue
+		}
+		decoders = append(decoders, d)
+	}
+	pd.Lock()
+	pd.tenants[tenantID] = cachedDecoders{decoders: decoders, expires: time.Now().Add(registryTTL)}
+	pd.Unlock()
+	return decoders, nil
+}
+
+// forget cached decoders of tenant
+func (pd *payloadDecoder) forget(tenantID int64) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	delete(pd.tenants, tenantID)
+}
+
+// decode message on topic of content type, it is returned as is when no decoder applies;
+// err tells the decoder which failed, the raw message is to be kept
+func (pd *payloadDecoder) decode(ctx context.Context, tenantID int64, topic, contentType, message string) (string, error) {
+	decoders, err := pd.tenantDecoders(ctx, tenantID)
+	if err != nil {
+		_Log.Error("load decoders, pass message on undecoded", "tenant", tenantID, "err", err)
+		return message, nil
+	}
+	return pd.run(decoders, topic, contentType, message)
+}
+
+func (pd *payloadDecoder) run(decoders []*Decoder, topic, contentType, message string) (string, error) {
+	name, decoder := "", decode.Decoder(nil)
+	for _, d := range decoders {
+		if d.applies(topic, contentType) {
+			name, decoder = d.Name, d.decoder
+			break
+		}
+	}
+	if decoder == nil {
+		format := decode.FormatOf(contentType)
+		if format == "" || format == decode.FormatProtobuf {
+			return message, nil
+		}
+		name = format
+		if decoder, _ = decode.New(decode.Spec{Format: format}); decoder == nil {
+			return message, nil
+		}
+	}
+	out, err := decoder.Decode([]byte(message))
+	if err != nil {
+		return "", fmt.Errorf("decoder [%s]: %w", name, err)
+	}
+	return string(out), nil
+}
+
+func (_global *global) queryDecoder(ctx context.Context, tenantID, id int64) (*Decoder, error) {
+	d, err := scanDecoder(_global.pgPool.QueryRowContext(ctx, `select `+decoderColumns+` from decoders where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query decoder")
+	}
+	return d, nil
+}
+
+// buildDecoder with the descriptors it refers to
+func (_global *global) buildDecoder(ctx context.Context, d *Decoder) error {
+	var descriptors *decode.Descriptors
+	if d.DescriptorID != nil {
+		var err error
+		if descriptors, err = queryDescriptors(ctx, _global.pgPool, d.TenantID, *d.DescriptorID); err != nil {
+			return err
+		}
+	}
+	return d.build(descriptors)
+}
+
+func (_global *global) listDecoders(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	decoders, err := queryDecoders(ctx, _global.pgPool, `where tenant_id = $1 order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, decoders)
+}
+
+func (_global *global) getDecoder(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDecoder(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (_global *global) createDecoder(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input decoderInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	d := &Decoder{TenantID: tenantOf(c), Enabled: true}
+	input.apply(d)
+	if err := _global.buildDecoder(ctx, d); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into decoders (tenant_id, name, format, topic_filter, content_type, descriptor_id, message_type, enabled)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id, created_at, updated_at;`,
+		d.TenantID, d.Name, d.Format, d.TopicFilter, d.ContentType, d.DescriptorID, d.MessageType, d.Enabled).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert decoder"))
+		return
+	}
+	_global.decoders.forget(d.TenantID)
+	c.JSON(http.StatusCreated, d)
+}
+
+func (_global *global) updateDecoder(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input decoderInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDecoder(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(d)
+	if err := _global.buildDecoder(ctx, d); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update decoders set name = $3, format = $4, topic_filter = $5, content_type = $6, descriptor_id = $7,
+		message_type = $8, enabled = $9, updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		d.TenantID, d.ID, d.Name, d.Format, d.TopicFilter, d.ContentType, d.DescriptorID, d.MessageType, d.Enabled).Scan(&d.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update decoder"))
+		return
+	}
+	_global.decoders.forget(d.TenantID)
+	c.JSON(http.StatusOK, d)
+}
+
+func (_global *global) deleteDecoder(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	res, err := _global.pgPool.ExecContext(ctx, `delete from decoders where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		c.Error(dbError(err, "delete decoder"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such decoder [%d]", id))
+		return
+	}
+	_global.decoders.forget(tenantID)
+	c.Status(http.StatusNoContent)
+}
+
+const descriptorColumns = `id, tenant_id, name, kind, content, created_at`
+
+func scanDescriptor(row rowScanner) (*Descriptor, error) {
+	d := &Descriptor{}
+	var content []byte
+	if err := row.Scan(&d.ID, &d.TenantID, &d.Name, &d.Kind, &content, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	d.MessageTypes = []string{}
+	if descriptors, err := parseDescriptor(d.Kind, d.Name, content); err == nil {
+		d.MessageTypes = descriptors.MessageTypes()
+	}
+	return d, nil
+}
+
+func (_global *global) listDescriptors(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select `+descriptorColumns+` from descriptors where tenant_id = $1 order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(dbError(err, "query descriptors"))
+		return
+	}
+	defer rows.Close()
+
+	descriptors := []*Descriptor{}
+	for rows.Next() {
+		d, err := scanDescriptor(rows)
+		if err != nil {
+			c.Error(dbError(err, "scan descriptor"))
+			return
+		}
+		descriptors = append(descriptors, d)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query descriptors"))
+		return
+	}
+	c.JSON(http.StatusOK, descriptors)
+}
+
+func (_global *global) getDescriptor(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := scanDescriptor(_global.pgPool.QueryRowContext(ctx, `select `+descriptorColumns+` from descriptors where tenant_id = $1 and id = $2;`,
+		tenantOf(c), id))
+	if err != nil {
+		c.Error(dbError(err, "query descriptor"))
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// createDescriptor upload a .proto file or a descriptor set, it must compile
+func (_global *global) createDescriptor(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input descriptorInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	d := &Descriptor{TenantID: tenantOf(c), Name: strings.TrimSpace(input.Name)}
+	if d.Name == "" {
+		c.Error(tool.Invalid("name is required"))
+		return
+	}
+	var content []byte
+	switch {
+	case input.Proto != "" && len(input.DescriptorSet) > 0:
+		c.Error(tool.Invalid("either proto or descriptorSet"))
+		return
+	case input.Proto != "":
+		d.Kind, content = descriptorProto, []byte(input.Proto)
+	case len(input.DescriptorSet) > 0:
+		d.Kind, content = descriptorSet, input.DescriptorSet
+	default:
+		c.Error(tool.Invalid("proto or descriptorSet is required"))
+		return
+	}
+	descriptors, err := parseDescriptor(d.Kind, d.Name, content)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d.MessageTypes = descriptors.MessageTypes()
+	err = _global.pgPool.QueryRowContext(ctx, `insert into descriptors (tenant_id, name, kind, content) values ($1, $2, $3, $4)
+		returning id, created_at;`, d.TenantID, d.Name, d.Kind, content).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert descriptor"))
+		return
+	}
+	c.JSON(http.StatusCreated, d)
+}
+
+// deleteDescriptor which no decoder refers to
+func (_global *global) deleteDescriptor(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var used bool
+	err = _global.pgPool.QueryRowContext(ctx, `select exists (select 1 from decoders where descriptor_id = $1);`, id).Scan(&used)
+	if err != nil {
+		c.Error(dbError(err, "query decoders"))
+		return
+	}
+	if used {
+		c.Error(tool.Conflict("descriptor [%d] is used by a decoder", id))
+		return
+	}
+	res, err := _global.pgPool.ExecContext(ctx, `delete from descriptors where tenant_id = $1 and id = $2;`, tenantOf(c), id)
+	if err != nil {
+		c.Error(dbError(err, "delete descriptor"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such descriptor [%d]", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
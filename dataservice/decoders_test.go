@@ -0,0 +1,62 @@
+package main
+
+import (
+	"dataservice/decode"
+
+	"github.com/fxamacker/cbor/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var _ = Describe("decoders", func() {
+	pd := newPayloadDecoder(nil)
+	built := func(d *Decoder) *Decoder {
+		Ω(d.build(nil)).To(Succeed())
+		return d
+	}
+
+	It("should validate decoders", func() {
+		id := int64(1)
+		Ω((&Decoder{Name: "d", Format: decode.FormatCBOR, TopicFilter: "devices/#"}).build(nil)).To(Succeed())
+		Ω((&Decoder{Name: "d", Format: decode.FormatMsgPack, ContentType: "application/x-msgpack"}).build(nil)).To(Succeed())
+		Ω((&Decoder{Name: "d", Format: decode.FormatCBOR}).build(nil)).ToNot(Succeed())
+		Ω((&Decoder{Name: "d", Format: "xml", TopicFilter: "#"}).build(nil)).ToNot(Succeed())
+		Ω((&Decoder{Name: "d", Format: decode.FormatCBOR, ContentType: "not a type"}).build(nil)).ToNot(Succeed())
+		Ω((&Decoder{Name: "d", Format: decode.FormatProtobuf, TopicFilter: "#"}).build(nil)).ToNot(Succeed())
+		Ω((&Decoder{Name: "d", Format: decode.FormatProtobuf, TopicFilter: "#", DescriptorID: &id}).build(nil)).ToNot(Succeed())
+	})
+
+	It("should decode with the first matching decoder", func() {
+		decoders := []*Decoder{
+			built(&Decoder{Name: "packed", Format: decode.FormatMsgPack, TopicFilter: "packed/#"}),
+			built(&Decoder{Name: "concise", Format: decode.FormatCBOR, ContentType: "application/octet-stream"}),
+		}
+		payload, _ := msgpack.Marshal(map[string]int{"rpm": 1200})
+		out, err := pd.run(decoders, "packed/pump-1", "", string(payload))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(MatchJSON(`{"rpm": 1200}`))
+
+		payload, _ = cbor.Marshal(map[string]int{"rpm": 900})
+		out, err = pd.run(decoders, "other", "application/octet-stream; x=1", string(payload))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(MatchJSON(`{"rpm": 900}`))
+	})
+
+	It("should decode well known content types and pass others on", func() {
+		payload, _ := cbor.Marshal(map[string]bool{"on": true})
+		out, err := pd.run(nil, "a", "application/cbor", string(payload))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(MatchJSON(`{"on": true}`))
+
+		out, err = pd.run(nil, "a", "", `{"on": true}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(out).To(Equal(`{"on": true}`))
+	})
+
+	It("should tell which decoder failed", func() {
+		decoders := []*Decoder{built(&Decoder{Name: "concise", Format: decode.FormatCBOR, TopicFilter: "#"})}
+		_, err := pd.run(decoders, "a", "", "\xff\xfe")
+		Ω(err).To(MatchError(ContainSubstring("decoder [concise]: decode cbor")))
+	})
+})
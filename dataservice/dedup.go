@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/tool"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// dedup modes, the idempotency key of a message is built from its content or from an id the device puts into it;
+// without a timestamp field, content mode drops a genuinely repeated identical reading within the same window for good
+const (
+	dedupContent   = "content"
+	dedupMessageID = "messageId"
+	dedupNone      = "none"
+)
+
+// DedupPolicy how messages on matching topics are told apart from their redeliveries
+type DedupPolicy struct {
+	ID             int64     `json:"id"`
+	TenantID       int64     `json:"tenantId"`
+	Name           string    `json:"name"`
+	TopicFilter    string    `json:"topicFilter"`    // empty for any topic
+	Mode           string    `json:"mode"`           // content, messageId or none
+	IDField        string    `json:"idField"`        // messageId only, field of the json message holding the id
+	TimestampField string    `json:"timestampField"` // field of the json message holding the device timestamp, if any
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// dedupPolicyInput body of create and patch
+type dedupPolicyInput struct {
+	Name           *string `json:"name"`
+	TopicFilter    *string `json:"topicFilter"`
+	Mode           *string `json:"mode"`
+	IDField        *string `json:"idField"`
+	TimestampField *string `json:"timestampField"`
+}
+
+func (input *dedupPolicyInput) apply(p *DedupPolicy) {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+	set(&p.Name, input.Name)
+	set(&p.TopicFilter, input.TopicFilter)
+	set(&p.Mode, input.Mode)
+	set(&p.IDField, input.IDField)
+	set(&p.TimestampField, input.TimestampField)
+	if p.Mode != dedupMessageID {
+		p.IDField = ""
+	}
+}
+
+func (p *DedupPolicy) validate() error {
+	if p.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if p.TopicFilter != "" {
+		if err := connector.ValidFilter(p.TopicFilter); err != nil {
+			return err
+		}
+	}
+	switch p.Mode {
+	case dedupContent, dedupNone:
+	case dedupMessageID:
+		if p.IDField == "" {
+			return tool.Invalid("idField is required for mode messageId")
+		}
+	default:
+		return tool.Invalid("mode must be %s, %s or %s", dedupContent, dedupMessageID, dedupNone)
+	}
+	return nil
+}
+
+// applies to messages on topic
+func (p *DedupPolicy) applies(topic string) bool {
+	return p.TopicFilter == "" || connector.MatchTopic(p.TopicFilter, topic)
+}
+
+// key of message of tenant on topic of device ref, empty when the policy does not deduplicate it;
+// the timestamp field of the message, or its receipt time truncated to window, tells repeated readings apart,
+// a message id stands on its own unless there is a timestamp field
+func (p *DedupPolicy) key(tenantID int64, topic string, ref deviceRef, message string, now time.Time, window time.Duration) string {
+	if p.Mode != dedupContent && p.Mode != dedupMessageID {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if p.Mode == dedupMessageID || p.TimestampField != "" {
+		// not an object, the fields are missing
+		json.Unmarshal([]byte(message), &fields)
+	}
+	field := func(name string) []byte {
+		raw, ok := fields[name]
+		if !ok {
+			return nil
+		}
+		var b bytes.Buffer
+		if json.Compact(&b, raw) != nil {
+			return raw
+		}
+		return b.Bytes()
+	}
+
+	id := field(p.IDField)
+	byID := p.Mode == dedupMessageID && id != nil
+
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(tenantID, 10)))
+	h.Write([]byte{0})
+	if ref.id > 0 {
+		h.Write([]byte("device:" + strconv.FormatInt(ref.id, 10)))
+	} else {
+		h.Write([]byte("topic:" + topic))
+	}
+	h.Write([]byte{0})
+	if stamp := field(p.TimestampField); p.TimestampField != "" && stamp != nil {
+		h.Write(stamp)
+	} else if !byID {
+		h.Write([]byte(now.Truncate(window).UTC().Format(time.RFC3339)))
+	}
+	h.Write([]byte{0})
+	if byID {
+		h.Write([]byte("id:"))
+		h.Write(id)
+	} else {
+		// a message without its id is told apart by its content
+		h.Write([]byte("content:" + message))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+const dedupPolicyColumns = `id, tenant_id, name, topic_filter, mode, id_field, timestamp_field, created_at, updated_at`
+
+func scanDedupPolicy(row rowScanner) (*DedupPolicy, error) {
+	p := &DedupPolicy{}
+	err := row.Scan(&p.ID, &p.TenantID, &p.Name, &p.TopicFilter, &p.Mode, &p.IDField, &p.TimestampField, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func queryDedupPolicies(ctx context.Context, pgPool *sql.DB, tenantID int64) ([]*DedupPolicy, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+dedupPolicyColumns+` from dedup_policies where tenant_id = $1 order by id;`, tenantID)
+	if err != nil {
+		return nil, dbError(err, "query dedup policies")
+	}
+	defer rows.Close()
+
+	policies := []*DedupPolicy{}
+	for rows.Next() {
+		p, err := scanDedupPolicy(rows)
+		if err != nil {
+			return nil, dbError(err, "scan dedup policy")
+		}
+		policies = append(policies, p)
+	}
+	return policies, dbError(rows.Err(), "query dedup policies")
+}
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+// dedupWindow keys seen within ttl, at most size of them
+type dedupWindow struct {
+	sync.Mutex
+	ttl   time.Duration
+	size  int
+	keys  map[string]*list.Element
+	order *list.List // of dedupEntry, oldest first
+}
+
+func newDedupWindow(ttl time.Duration, size int) *dedupWindow {
+	return &dedupWindow{ttl: ttl, size: size, keys: make(map[string]*list.Element), order: list.New()}
+}
+
+// seen reports whether key was seen within the window, it is remembered otherwise
+func (w *dedupWindow) seen(key string, now time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	for e := w.order.Front(); e != nil && now.Sub(e.Value.(dedupEntry).at) >= w.ttl; e = w.order.Front() {
+		w.remove(e)
+	}
+	if _, ok := w.keys[key]; ok {
+		return true
+	}
+	w.keys[key] = w.order.PushBack(dedupEntry{key: key, at: now})
+	if w.order.Len() > w.size {
+		w.remove(w.order.Front())
+	}
+	return false
+}
+
+// release key, a message that was not passed on may come again
+func (w *dedupWindow) release(key string) {
+	w.Lock()
+	defer w.Unlock()
+
+	if e, ok := w.keys[key]; ok {
+		w.remove(e)
+	}
+}
+
+// remove entry, caller holds the lock
+func (w *dedupWindow) remove(e *list.Element) {
+	delete(w.keys, e.Value.(dedupEntry).key)
+	w.order.Remove(e)
+}
+
+type cachedDedupPolicies struct {
+	policies []*DedupPolicy
+	expires  time.Time
+}
+
+// deduplicator key messages by the first matching policy of their tenant, or by the default mode,
+// and drop those seen within the window; the unique key of stored messages catches the others
+type deduplicator struct {
+	sync.Mutex
+	pgPool   *sql.DB
+	fallback DedupPolicy
+	window   time.Duration
+	seen     *dedupWindow
+	tenants  map[int64]cachedDedupPolicies
+}
+
+func newDeduplicator(pgPool *sql.DB, cfg dedupConfig) *deduplicator {
+	return &deduplicator{pgPool: pgPool, fallback: DedupPolicy{Name: "default", Mode: cfg.mode}, window: cfg.window,
+		seen: newDedupWindow(cfg.window, cfg.windowSize), tenants: make(map[int64]cachedDedupPolicies)}
+}
+
+func (d *deduplicator) tenantPolicies(ctx context.Context, tenantID int64) ([]*DedupPolicy, error) {
+	d.Lock()
+	cached, ok := d.tenants[tenantID]
+	d.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.policies, nil
+	}
+
+	policies, err := queryDedupPolicies(ctx, d.pgPool, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	d.tenants[tenantID] = cachedDedupPolicies{policies: policies, expires: time.Now().Add(registryTTL)}
+	d.Unlock()
+	return policies, nil
+}
+
+// forget cached policies of tenant
+func (d *deduplicator) forget(tenantID int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.tenants, tenantID)
+}
+
+// key of message of tenant on topic of device ref received at now, empty when it is not deduplicated
+func (d *deduplicator) key(ctx context.Context, tenantID int64, topic string, ref deviceRef, message string, now time.Time) string {
+	policies, err := d.tenantPolicies(ctx, tenantID)
+	if err != nil {
+		_Log.Error("load dedup policies, apply the default", "tenant", tenantID, "err", err)
+	}
+	policy := &d.fallback
+	for _, p := range policies {
+		if p.applies(topic) {
+			policy = p
+			break
+		}
+	}
+	return policy.key(tenantID, topic, ref, message, now, d.window)
+}
+
+func (_global *global) queryDedupPolicy(ctx context.Context, tenantID, id int64) (*DedupPolicy, error) {
+	p, err := scanDedupPolicy(_global.pgPool.QueryRowContext(ctx,
+		`select `+dedupPolicyColumns+` from dedup_policies where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query dedup policy")
+	}
+	return p, nil
+}
+
+func (_global *global) listDedupPolicies(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	policies, err := queryDedupPolicies(ctx, _global.pgPool, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, policies)
+}
+
+func (_global *global) getDedupPolicy(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	p, err := _global.queryDedupPolicy(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func (_global *global) createDedupPolicy(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input dedupPolicyInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	p := &DedupPolicy{TenantID: tenantOf(c), Mode: dedupContent}
+	input.apply(p)
+	if err := p.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into dedup_policies (tenant_id, name, topic_filter, mode, id_field, timestamp_field)
+		values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`,
+		p.TenantID, p.Name, p.TopicFilter, p.Mode, p.IDField, p.TimestampField).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert dedup policy"))
+		return
+	}
+	_global.dedup.forget(p.TenantID)
+	c.JSON(http.StatusCreated, p)
+}
+
+func (_global *global) updateDedupPolicy(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input dedupPolicyInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	p, err := _global.queryDedupPolicy(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(p)
+	if err := p.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update dedup_policies set name = $3, topic_filter = $4, mode = $5, id_field = $6, timestamp_field = $7,
+		updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		p.TenantID, p.ID, p.Name, p.TopicFilter, p.Mode, p.IDField, p.TimestampField).Scan(&p.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update dedup policy"))
+		return
+	}
+	_global.dedup.forget(p.TenantID)
+	c.JSON(http.StatusOK, p)
+}
+
+func (_global *global) deleteDedupPolicy(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	res, err := _global.pgPool.ExecContext(ctx, `delete from dedup_policies where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		c.Error(dbError(err, "delete dedup policy"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such dedup policy [%d]", id))
+		return
+	}
+	_global.dedup.forget(tenantID)
+	c.Status(http.StatusNoContent)
+}
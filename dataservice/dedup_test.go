@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dedup", func() {
+	now := time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC)
+	device := deviceRef{id: 7}
+
+	It("should validate policies", func() {
+		Ω((&DedupPolicy{Name: "p", Mode: dedupContent, TopicFilter: "devices/+/telemetry"}).validate()).To(Succeed())
+		Ω(tool.KindOf((&DedupPolicy{Name: "p", Mode: dedupMessageID}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&DedupPolicy{Name: "p", Mode: "hash"}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&DedupPolicy{Mode: dedupNone}).validate())).To(Equal(tool.KindInvalid))
+	})
+
+	It("should key content by device and receipt window", func() {
+		p := &DedupPolicy{Mode: dedupContent}
+		key := p.key(1, "devices/a/telemetry", device, `{"t": 1}`, now, time.Minute)
+		Ω(key).ToNot(BeEmpty())
+		Ω(p.key(1, "devices/a/telemetry", device, `{"t": 1}`, now.Add(20*time.Second), time.Minute)).To(Equal(key))
+		Ω(p.key(1, "devices/a/telemetry", device, `{"t": 1}`, now.Add(time.Minute), time.Minute)).ToNot(Equal(key))
+		Ω(p.key(1, "devices/a/telemetry", device, `{"t": 2}`, now, time.Minute)).ToNot(Equal(key))
+		Ω(p.key(1, "devices/a/telemetry", deviceRef{id: 8}, `{"t": 1}`, now, time.Minute)).ToNot(Equal(key))
+		Ω(p.key(2, "devices/a/telemetry", device, `{"t": 1}`, now, time.Minute)).ToNot(Equal(key))
+		Ω((&DedupPolicy{Mode: dedupNone}).key(1, "devices/a/telemetry", device, `{"t": 1}`, now, time.Minute)).To(BeEmpty())
+	})
+
+	It("should key by the timestamp field of the message when it has one", func() {
+		p := &DedupPolicy{Mode: dedupContent, TimestampField: "ts"}
+		key := p.key(1, "a", device, `{"ts": 100, "t": 1}`, now, time.Minute)
+		Ω(p.key(1, "a", device, `{"ts": 100, "t": 1}`, now.Add(time.Hour), time.Minute)).To(Equal(key))
+		Ω(p.key(1, "a", device, `{"ts": 101, "t": 1}`, now, time.Minute)).ToNot(Equal(key))
+	})
+
+	It("should key by the message id the device supplies", func() {
+		p := &DedupPolicy{Mode: dedupMessageID, IDField: "msgId", TimestampField: "ts"}
+		key := p.key(1, "a", device, `{"msgId": "m1", "ts": 5, "t": 1}`, now, time.Minute)
+		Ω(p.key(1, "a", device, `{"msgId":"m1","ts":5,"t":2}`, now, time.Minute)).To(Equal(key))
+		Ω(p.key(1, "a", device, `{"msgId": "m2", "ts": 5, "t": 1}`, now, time.Minute)).ToNot(Equal(key))
+		Ω(p.key(1, "a", device, `{"ts": 5, "t": 1}`, now, time.Minute)).ToNot(BeEmpty(), "falls back to the content")
+	})
+
+	It("should key by the message id alone across windows without a timestamp field", func() {
+		p := &DedupPolicy{Mode: dedupMessageID, IDField: "msgId"}
+		key := p.key(1, "a", device, `{"msgId": "m1", "t": 1}`, now, time.Minute)
+		Ω(p.key(1, "a", device, `{"msgId": "m1", "t": 1}`, now.Add(time.Hour), time.Minute)).To(Equal(key))
+		Ω(p.key(1, "a", deviceRef{id: 8}, `{"msgId": "m1", "t": 1}`, now, time.Minute)).ToNot(Equal(key))
+		Ω(p.key(1, "a", device, `{"t": 1}`, now.Add(time.Hour), time.Minute)).
+			ToNot(Equal(p.key(1, "a", device, `{"t": 1}`, now, time.Minute)), "content falls back to the window")
+	})
+
+	It("should remember keys within a bounded window", func() {
+		w := newDedupWindow(time.Minute, 2)
+		Ω(w.seen("a", now)).To(BeFalse())
+		Ω(w.seen("a", now.Add(time.Second))).To(BeTrue())
+		Ω(w.seen("a", now.Add(time.Minute))).To(BeFalse(), "expired")
+
+		Ω(w.seen("b", now.Add(time.Minute))).To(BeFalse())
+		Ω(w.seen("c", now.Add(time.Minute))).To(BeFalse())
+		Ω(w.seen("a", now.Add(time.Minute))).To(BeFalse(), "evicted by size")
+
+		w.release("c")
+		Ω(w.seen("c", now.Add(time.Minute))).To(BeFalse())
+	})
+})
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/auth"
+	"dataservice/device"
+	"dataservice/tool"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// registryTTL bound how long other instances may miss a device or template change
+const registryTTL = 30 * time.Second
+
+// Device record, the token is only returned on creation and rotation
+type Device struct {
+	ID             int64           `json:"id"`
+	TenantID       int64           `json:"tenantId"`
+	DeviceID       string          `json:"deviceId"`
+	Name           string          `json:"name"`
+	Type           string          `json:"type"`
+	Metadata       json.RawMessage `json:"metadata"`
+	Token          string          `json:"token,omitempty"`
+	AutoRegistered bool            `json:"autoRegistered"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// deviceInput body of create and patch, deviceId cannot be patched
+type deviceInput struct {
+	DeviceID *string         `json:"deviceId"`
+	Name     *string         `json:"name"`
+	Type     *string         `json:"type"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// TopicTemplate extracting device ids from topics of a tenant
+type TopicTemplate struct {
+	ID             int64     `json:"id"`
+	TenantID       int64     `json:"tenantId"`
+	Template       string    `json:"template"`
+	Filter         string    `json:"filter"`
+	UnknownDevices string    `json:"unknownDevices"`
+	DeviceType     string    `json:"deviceType"`
+	Kind           string    `json:"kind"`
+	CreatedAt      time.Time `json:"createdAt"`
+
+	parsed *device.Template
+}
+
+type topicTemplateInput struct {
+	Template       string `json:"template"`
+	UnknownDevices string `json:"unknownDevices"`
+	DeviceType     string `json:"deviceType"`
+	Kind           string `json:"kind"`
+}
+
+func (input *deviceInput) apply(d *Device) {
+	if input.DeviceID != nil {
+		d.DeviceID = strings.TrimSpace(*input.DeviceID)
+	}
+	if input.Name != nil {
+		d.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Type != nil {
+		d.Type = strings.TrimSpace(*input.Type)
+	}
+	if input.Metadata != nil {
+		d.Metadata = input.Metadata
+	}
+}
+
+// validateDeviceID ids must fit in a single topic level
+func validateDeviceID(id string) error {
+	if id == "" {
+		return tool.Invalid("deviceId is required")
+	}
+	if len(id) > 128 {
+		return tool.Invalid("deviceId is longer than 128 characters")
+	}
+	if strings.ContainsAny(id, "/+#") {
+		return tool.Invalid("deviceId [%s] must not contain '/', '+' or '#'", id)
+	}
+	return nil
+}
+
+// validate device fields
+func (d *Device) validate() error {
+	if err := validateDeviceID(d.DeviceID); err != nil {
+		return err
+	}
+	if len(d.Name) > 128 || len(d.Type) > 128 {
+		return tool.Invalid("name and type must not be longer than 128 characters")
+	}
+	if len(d.Metadata) == 0 {
+		d.Metadata = json.RawMessage(`{}`)
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(d.Metadata, &metadata); err != nil || metadata == nil {
+		return tool.Invalid("metadata must be a json object")
+	}
+	return nil
+}
+
+// validate template fields and parse it
+func (t *TopicTemplate) validate() error {
+	if t.UnknownDevices == "" {
+		t.UnknownDevices = device.UnknownReject
+	}
+	if err := device.ValidUnknown(t.UnknownDevices); err != nil {
+		return err
+	}
+	if t.Kind == "" {
+		t.Kind = device.KindTelemetry
+	}
+	if err := device.ValidKind(t.Kind); err != nil {
+		return err
+	}
+	parsed, err := device.ParseTemplate(t.Template)
+	if err != nil {
+		return err
+	}
+	t.parsed, t.Filter = parsed, parsed.Filter()
+	return nil
+}
+
+// deviceKey of a device in the registry cache
+type deviceKey struct {
+	tenantID int64
+	deviceID string
+}
+
+type cachedDevice struct {
+	id         int64 // 0 for unknown devices
+	deviceType string
+	expires    time.Time
+}
+
+// deviceRef device a topic resolved to
+type deviceRef struct {
+	id         int64 // 0 when no template matches
+	tenantID   int64
+	deviceID   string
+	deviceType string
+	kind       string // of the template matched
+}
+
+type cachedTemplates struct {
+	templates []*TopicTemplate
+	expires   time.Time
+}
+
+// deviceRegistry resolve topics to devices, templates and device ids are cached per tenant
+type deviceRegistry struct {
+	sync.Mutex
+	pgPool    *sql.DB
+	templates map[int64]cachedTemplates
+	devices   map[deviceKey]cachedDevice
+}
+
+func newDeviceRegistry(pgPool *sql.DB) *deviceRegistry {
+	return &deviceRegistry{
+		pgPool:    pgPool,
+		templates: make(map[int64]cachedTemplates),
+		devices:   make(map[deviceKey]cachedDevice),
+	}
+}
+
+// resolve the device of topic, a zero ref when no template matches, unknown devices are registered or rejected as the template says
+func (r *deviceRegistry) resolve(ctx context.Context, tenantID int64, topic string) (deviceRef, error) {
+	templates, err := r.tenantTemplates(ctx, tenantID)
+	if err != nil {
+		return deviceRef{}, err
+	}
+	for _, t := range templates {
+		deviceID, ok := t.parsed.Match(topic)
+		if !ok {
+			continue
+		}
+		ref := deviceRef{tenantID: tenantID, deviceID: deviceID, kind: t.Kind}
+		cached, err := r.lookup(ctx, tenantID, deviceID)
+		if err != nil {
+			return deviceRef{}, err
+		}
+		if cached.id == 0 {
+			if t.UnknownDevices != device.UnknownRegister {
+				return deviceRef{}, tool.Forbidden("unknown device [%s] on topic [%s]", deviceID, topic)
+			}
+			if cached, err = r.register(ctx, tenantID, deviceID, t.DeviceType); err != nil {
+				return deviceRef{}, err
+			}
+		}
+		ref.id, ref.deviceType = cached.id, cached.deviceType
+		return ref, nil
+	}
+	return deviceRef{}, nil
+}
+
+// admit device of topic whose id does not come from a template, an unknown one is registered or rejected
+// as the first template of the tenant matching topic says, and rejected when no template matches
+func (r *deviceRegistry) admit(ctx context.Context, tenantID int64, topic, deviceID string) (deviceRef, error) {
+	cached, err := r.lookup(ctx, tenantID, deviceID)
+	if err != nil {
+		return deviceRef{}, err
+	}
+	if cached.id == 0 {
+		templates, err := r.tenantTemplates(ctx, tenantID)
+		if err != nil {
+			return deviceRef{}, err
+		}
+		var matched *TopicTemplate
+		for _, t := range templates {
+			if _, ok := t.parsed.Match(topic); ok {
+				matched = t
+				break
+			}
+		}
+		if matched == nil || matched.UnknownDevices != device.UnknownRegister {
+			return deviceRef{}, tool.Forbidden("unknown device [%s] on topic [%s]", deviceID, topic)
+		}
+		if cached, err = r.register(ctx, tenantID, deviceID, matched.DeviceType); err != nil {
+			return deviceRef{}, err
+		}
+	}
+	return deviceRef{id: cached.id, tenantID: tenantID, deviceID: deviceID, deviceType: cached.deviceType, kind: device.KindTelemetry}, nil
+}
+
+func (r *deviceRegistry) tenantTemplates(ctx context.Context, tenantID int64) ([]*TopicTemplate, error) {
+	r.Lock()
+	cached, ok := r.templates[tenantID]
+	r.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.templates, nil
+	}
+
+	templates, err := queryTopicTemplates(ctx, r.pgPool, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	r.templates[tenantID] = cachedTemplates{templates: templates, expires: time.Now().Add(registryTTL)}
+	r.Unlock()
+	return templates, nil
+}
+
+func (r *deviceRegistry) lookup(ctx context.Context, tenantID int64, deviceID string) (cachedDevice, error) {
+	key := deviceKey{tenantID, deviceID}
+	r.Lock()
+	cached, ok := r.devices[key]
+	r.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	cached = cachedDevice{}
+	err := r.pgPool.QueryRowContext(ctx, `select id, type from devices where tenant_id = $1 and device_id = $2;`,
+		tenantID, deviceID).Scan(&cached.id, &cached.deviceType)
+	if err != nil && err != sql.ErrNoRows {
+		return cached, dbError(err, "look up device")
+	}
+	return r.remember(key, cached), nil
+}
+
+func (r *deviceRegistry) register(ctx context.Context, tenantID int64, deviceID, deviceType string) (cachedDevice, error) {
+	cached := cachedDevice{}
+	// a concurrent registration of the same device wins, the no-op update returns its row
+	err := r.pgPool.QueryRowContext(ctx, `insert into devices (tenant_id, device_id, name, type, auto_registered) values ($1, $2, $2, $3, true)
+		on conflict (tenant_id, device_id) do update set device_id = excluded.device_id returning id, type;`,
+		tenantID, deviceID, deviceType).Scan(&cached.id, &cached.deviceType)
+	if err != nil {
+		return cached, dbError(err, "register device")
+	}
+	_Log.Info("device registered", "tenant", tenantID, "device", deviceID, "id", cached.id)
+	return r.remember(deviceKey{tenantID, deviceID}, cached), nil
+}
+
+func (r *deviceRegistry) remember(key deviceKey, cached cachedDevice) cachedDevice {
+	r.Lock()
+	defer r.Unlock()
+
+	cached.expires = time.Now().Add(registryTTL)
+	r.devices[key] = cached
+	return cached
+}
+
+// forgetDevice drop cached id of device
+func (r *deviceRegistry) forgetDevice(tenantID int64, deviceID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.devices, deviceKey{tenantID, deviceID})
+}
+
+// forgetTemplates drop cached templates of tenant
+func (r *deviceRegistry) forgetTemplates(tenantID int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.templates, tenantID)
+}
+
+const deviceColumns = `id, tenant_id, device_id, name, type, metadata, auto_registered, created_at, updated_at`
+
+func scanDevice(row rowScanner) (*Device, error) {
+	d := &Device{}
+	var metadata []byte
+	err := row.Scan(&d.ID, &d.TenantID, &d.DeviceID, &d.Name, &d.Type, &metadata, &d.AutoRegistered, &d.CreatedAt, &d.UpdatedAt)
+	d.Metadata = metadata
+	return d, err
+}
+
+func (_global *global) queryDevice(ctx context.Context, tenantID, id int64) (*Device, error) {
+	d, err := scanDevice(_global.pgPool.QueryRowContext(ctx, `select `+deviceColumns+` from devices where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query device")
+	}
+	return d, nil
+}
+
+const topicTemplateColumns = `id, tenant_id, template, unknown_devices, device_type, kind, created_at`
+
+func queryTopicTemplates(ctx context.Context, pgPool *sql.DB, tenantID int64) ([]*TopicTemplate, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+topicTemplateColumns+` from topic_templates where tenant_id = $1 order by id;`, tenantID)
+	if err != nil {
+		return nil, dbError(err, "query topic templates")
+	}
+	defer rows.Close()
+
+	templates := []*TopicTemplate{}
+	for rows.Next() {
+		t := &TopicTemplate{}
+		if err := rows.Scan(&t.ID, &t.TenantID, &t.Template, &t.UnknownDevices, &t.DeviceType, &t.Kind, &t.CreatedAt); err != nil {
+			return nil, dbError(err, "scan topic template")
+		}
+		if err := t.validate(); err != nil {
+			_Log.Warn("skip broken topic template", "tenant", tenantID, "template", t.Template, "err", err)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates, dbError(rows.Err(), "query topic templates")
+}
+
+func (_global *global) listDevices(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	query, args := `select `+deviceColumns+` from devices where tenant_id = $1`, []interface{}{tenantOf(c)}
+	if t := c.Query("type"); t != "" {
+		query, args = query+` and type = $2`, append(args, t)
+	}
+	rows, err := _global.pgPool.QueryContext(ctx, query+` order by id;`, args...)
+	if err != nil {
+		c.Error(dbError(err, "query devices"))
+		return
+	}
+	defer rows.Close()
+
+	devices := []*Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			c.Error(dbError(err, "scan device"))
+			return
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query devices"))
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+func (_global *global) getDevice(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (_global *global) createDevice(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input deviceInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	d := &Device{TenantID: tenantOf(c)}
+	input.apply(d)
+	if err := d.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	token, err := auth.NewKey()
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInternal, err, "generate device token"))
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `insert into devices (tenant_id, device_id, name, type, metadata, token_hash)
+		values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`,
+		d.TenantID, d.DeviceID, d.Name, d.Type, []byte(d.Metadata), auth.HashKey(token),
+	).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert device"))
+		return
+	}
+	_global.devices.forgetDevice(d.TenantID, d.DeviceID)
+	d.Token = token
+	c.JSON(http.StatusCreated, d)
+}
+
+func (_global *global) updateDevice(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input deviceInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	if input.DeviceID != nil {
+		c.Error(tool.Invalid("deviceId cannot be changed"))
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(d)
+	if err := d.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update devices set name = $3, type = $4, metadata = $5, updated_at = now()
+		where tenant_id = $1 and id = $2 returning updated_at;`, d.TenantID, d.ID, d.Name, d.Type, []byte(d.Metadata)).Scan(&d.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update device"))
+		return
+	}
+	_global.devices.forgetDevice(d.TenantID, d.DeviceID)
+	c.JSON(http.StatusOK, d)
+}
+
+// rotateDeviceToken replace the token of device, the old one stops working at once
+func (_global *global) rotateDeviceToken(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	token, err := auth.NewKey()
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInternal, err, "generate device token"))
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update devices set token_hash = $3, updated_at = now()
+		where tenant_id = $1 and id = $2 returning updated_at;`, d.TenantID, d.ID, auth.HashKey(token)).Scan(&d.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "rotate device token"))
+		return
+	}
+	d.Token = token
+	c.JSON(http.StatusOK, d)
+}
+
+func (_global *global) deleteDevice(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	var deviceID string
+	err = _global.pgPool.QueryRowContext(ctx, `delete from devices where tenant_id = $1 and id = $2 returning device_id;`, tenantID, id).Scan(&deviceID)
+	if err != nil {
+		c.Error(dbError(err, "delete device"))
+		return
+	}
+	_global.devices.forgetDevice(tenantID, deviceID)
+	_global.presence.forget(id)
+	_global.shadows.forget(id)
+	_global.latest.cache.forgetDevice(id)
+	// its modbus pollers are gone along with it
+	tool.CheckThenLog(_Log, _global.pollers.sync(ctx), "sync modbus pollers")
+	c.Status(http.StatusNoContent)
+}
+
+func (_global *global) listTopicTemplates(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	templates, err := queryTopicTemplates(ctx, _global.pgPool, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func (_global *global) createTopicTemplate(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input topicTemplateInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	t := &TopicTemplate{
+		TenantID:       tenantOf(c),
+		Template:       strings.TrimSpace(input.Template),
+		UnknownDevices: input.UnknownDevices,
+		DeviceType:     strings.TrimSpace(input.DeviceType),
+		Kind:           input.Kind,
+	}
+	if err := t.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into topic_templates (tenant_id, template, unknown_devices, device_type, kind)
+		values ($1, $2, $3, $4, $5) returning id, created_at;`, t.TenantID, t.Template, t.UnknownDevices, t.DeviceType, t.Kind).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert topic template"))
+		return
+	}
+	_global.devices.forgetTemplates(t.TenantID)
+	c.JSON(http.StatusCreated, t)
+}
+
+func (_global *global) deleteTopicTemplate(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	res, err := _global.pgPool.ExecContext(ctx, `delete from topic_templates where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		c.Error(dbError(err, "delete topic template"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such topic template [%d]", id))
+		return
+	}
+	_global.devices.forgetTemplates(tenantID)
+	c.Status(http.StatusNoContent)
+}
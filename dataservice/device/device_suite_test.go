@@ -0,0 +1,13 @@
+package device_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDevice(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Device Suite")
+}
@@ -0,0 +1,30 @@
+package device
+
+import "reflect"
+
+// Merge patch into doc, keys set to null are removed, doc is left untouched
+func Merge(doc, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(doc)+len(patch))
+	for k, v := range doc {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// Delta of desired keys whose value the device has not reported yet
+func Delta(desired, reported map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+	for k, want := range desired {
+		if got, ok := reported[k]; !ok || !reflect.DeepEqual(want, got) {
+			delta[k] = want
+		}
+	}
+	return delta
+}
@@ -0,0 +1,35 @@
+package device_test
+
+import (
+	"encoding/json"
+
+	"dataservice/device"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func doc(s string) map[string]interface{} {
+	var m map[string]interface{}
+	Ω(json.Unmarshal([]byte(s), &m)).To(Succeed())
+	return m
+}
+
+var _ = Describe("shadow", func() {
+	It("should merge a patch and remove null keys", func() {
+		d := doc(`{"a": 1, "b": {"x": 1}, "c": true}`)
+		merged := device.Merge(d, doc(`{"a": 2, "b": {"y": 2}, "c": null, "d": "new"}`))
+
+		Ω(merged).To(Equal(doc(`{"a": 2, "b": {"y": 2}, "d": "new"}`)))
+		Ω(d).To(Equal(doc(`{"a": 1, "b": {"x": 1}, "c": true}`)))
+	})
+
+	It("should give desired keys not reported yet", func() {
+		desired := doc(`{"interval": 10, "mode": "eco", "limits": {"max": 80}, "led": true}`)
+		reported := doc(`{"interval": 10, "mode": "boost", "limits": {"max": 80}, "temperature": 21}`)
+
+		Ω(device.Delta(desired, reported)).To(Equal(doc(`{"mode": "eco", "led": true}`)))
+		Ω(device.Delta(reported, reported)).To(BeEmpty())
+		Ω(device.Delta(nil, reported)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,39 @@
+package device
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ParseStatus read the state of a birth or last will message, ok is false when payload says neither,
+// plain payloads like "online", "offline", "1" and "0" are understood as well as
+// json objects with an "online" boolean or a "status" / "state" string
+func ParseStatus(payload []byte) (online, ok bool) {
+	if online, ok = parseState(string(payload)); ok {
+		return
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return false, false
+	}
+	if v, found := doc["online"].(bool); found {
+		return v, true
+	}
+	for _, key := range []string{"status", "state"} {
+		if v, found := doc[key].(string); found {
+			return parseState(v)
+		}
+	}
+	return false, false
+}
+
+func parseState(s string) (online, ok bool) {
+	switch strings.ToLower(strings.Trim(strings.TrimSpace(s), `"`)) {
+	case "online", "connected", "up", "true", "1":
+		return true, true
+	case "offline", "disconnected", "down", "lost", "false", "0":
+		return false, true
+	}
+	return false, false
+}
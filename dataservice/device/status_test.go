@@ -0,0 +1,29 @@
+package device_test
+
+import (
+	"dataservice/device"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("status", func() {
+	DescribeTable("parse",
+		func(payload string, online, ok bool) {
+			o, k := device.ParseStatus([]byte(payload))
+			Ω(k).To(Equal(ok))
+			Ω(o).To(Equal(online))
+		},
+		Entry("online", "online", true, true),
+		Entry("offline upper case", " OFFLINE\n", false, true),
+		Entry("zero", "0", false, true),
+		Entry("json string", `"connected"`, true, true),
+		Entry("json bool", `{"online": false}`, false, true),
+		Entry("json status", `{"status": "lost", "at": 1}`, false, true),
+		Entry("json state", `{"state": "up"}`, true, true),
+		Entry("unknown word", "sleeping", false, false),
+		Entry("unrelated json", `{"temperature": 21}`, false, false),
+		Entry("empty", "", false, false),
+	)
+})
@@ -0,0 +1,115 @@
+package device
+
+import (
+	"dataservice/tool"
+	"strings"
+)
+
+// IDPlaceholder level of a template carrying the device id
+const IDPlaceholder = "{deviceId}"
+
+// policies for devices a template finds but the registry does not know
+const (
+	UnknownRegister = "register"
+	UnknownReject   = "reject"
+)
+
+// kinds of topics a template matches, status topics carry birth and last will messages,
+// attributes topics carry reported state of the device shadow
+const (
+	KindTelemetry  = "telemetry"
+	KindStatus     = "status"
+	KindAttributes = "attributes"
+)
+
+// Template of topics carrying a device id, like devices/{deviceId}/telemetry,
+// levels may also be the mqtt wildcards "+" and a trailing "#"
+type Template struct {
+	levels []string
+	id     int // level of the device id
+}
+
+// ParseTemplate check and split template into levels
+func ParseTemplate(template string) (*Template, error) {
+	if template == "" {
+		return nil, tool.Invalid("template is required")
+	}
+	t := &Template{levels: strings.Split(template, "/"), id: -1}
+	for i, level := range t.levels {
+		switch {
+		case level == IDPlaceholder:
+			if t.id >= 0 {
+				return nil, tool.Invalid("%s appears more than once in template [%s]", IDPlaceholder, template)
+			}
+			t.id = i
+		case strings.ContainsAny(level, "{}"):
+			return nil, tool.Invalid("unknown placeholder [%s] in template [%s]", level, template)
+		case strings.Contains(level, "#") && (level != "#" || i != len(t.levels)-1):
+			return nil, tool.Invalid("'#' must be the whole last level of template [%s]", template)
+		case strings.Contains(level, "+") && level != "+":
+			return nil, tool.Invalid("'+' must be a whole level of template [%s]", template)
+		}
+	}
+	if t.id < 0 {
+		return nil, tool.Invalid("template [%s] has no %s level", template, IDPlaceholder)
+	}
+	return t, nil
+}
+
+// Match topic against the template and extract the device id
+func (t *Template) Match(topic string) (deviceID string, ok bool) {
+	levels := strings.Split(topic, "/")
+	for i, level := range t.levels {
+		if level == "#" {
+			return deviceID, true
+		}
+		if i >= len(levels) {
+			return "", false
+		}
+		switch level {
+		case IDPlaceholder:
+			if levels[i] == "" {
+				return "", false
+			}
+			deviceID = levels[i]
+		case "+":
+		default:
+			if level != levels[i] {
+				return "", false
+			}
+		}
+	}
+	if len(levels) != len(t.levels) {
+		return "", false
+	}
+	return deviceID, true
+}
+
+// String of the template as parsed
+func (t *Template) String() string {
+	return strings.Join(t.levels, "/")
+}
+
+// Filter mqtt topic filter subscribing every topic of the template
+func (t *Template) Filter() string {
+	levels := make([]string, len(t.levels))
+	copy(levels, t.levels)
+	levels[t.id] = "+"
+	return strings.Join(levels, "/")
+}
+
+// ValidUnknown check the policy of unknown devices
+func ValidUnknown(policy string) error {
+	if policy != UnknownRegister && policy != UnknownReject {
+		return tool.Invalid("unknown device policy must be %s or %s", UnknownRegister, UnknownReject)
+	}
+	return nil
+}
+
+// ValidKind check the kind of template
+func ValidKind(kind string) error {
+	if kind != KindTelemetry && kind != KindStatus && kind != KindAttributes {
+		return tool.Invalid("template kind must be %s, %s or %s", KindTelemetry, KindStatus, KindAttributes)
+	}
+	return nil
+}
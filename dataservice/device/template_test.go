@@ -0,0 +1,57 @@
+package device_test
+
+import (
+	"dataservice/device"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("template", func() {
+	DescribeTable("parse",
+		func(template string, valid bool) {
+			_, err := device.ParseTemplate(template)
+			if valid {
+				Ω(err).ToNot(HaveOccurred())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+			}
+		},
+		Entry("telemetry", "devices/{deviceId}/telemetry", true),
+		Entry("wildcards", "+/{deviceId}/#", true),
+		Entry("id only", "{deviceId}", true),
+		Entry("empty", "", false),
+		Entry("no id", "devices/+/telemetry", false),
+		Entry("id twice", "{deviceId}/{deviceId}", false),
+		Entry("id inside level", "devices/dev-{deviceId}", false),
+		Entry("unknown placeholder", "{tenant}/{deviceId}", false),
+		Entry("# not last", "devices/#/{deviceId}", false),
+	)
+
+	DescribeTable("match",
+		func(template, topic, deviceID string, ok bool) {
+			t, err := device.ParseTemplate(template)
+			Ω(err).ToNot(HaveOccurred())
+			id, matched := t.Match(topic)
+			Ω(matched).To(Equal(ok))
+			Ω(id).To(Equal(deviceID))
+		},
+		Entry("exact", "devices/{deviceId}/telemetry", "devices/pump-1/telemetry", "pump-1", true),
+		Entry("other literal", "devices/{deviceId}/telemetry", "devices/pump-1/attributes", "", false),
+		Entry("shorter", "devices/{deviceId}/telemetry", "devices/pump-1", "", false),
+		Entry("longer", "devices/{deviceId}/telemetry", "devices/pump-1/telemetry/x", "", false),
+		Entry("empty id", "devices/{deviceId}/telemetry", "devices//telemetry", "", false),
+		Entry("single level", "+/{deviceId}", "site-a/pump-1", "pump-1", true),
+		Entry("multi level", "devices/{deviceId}/#", "devices/pump-1/a/b", "pump-1", true),
+		Entry("multi level of nothing", "devices/{deviceId}/#", "devices/pump-1", "pump-1", true),
+	)
+
+	It("should give the topic filter subscribing the template", func() {
+		t, err := device.ParseTemplate("devices/{deviceId}/telemetry")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(t.Filter()).To(Equal("devices/+/telemetry"))
+		Ω(t.String()).To(Equal("devices/{deviceId}/telemetry"))
+	})
+})
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"dataservice/device"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("device", func() {
+	DescribeTable("validate",
+		func(deviceID, metadata string, valid bool) {
+			err := (&Device{DeviceID: deviceID, Metadata: json.RawMessage(metadata)}).validate()
+			if valid {
+				Ω(err).ToNot(HaveOccurred())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+			}
+		},
+		Entry("plain", "pump-1", `{"site": "a"}`, true),
+		Entry("no metadata", "pump-1", ``, true),
+		Entry("no id", "", `{}`, false),
+		Entry("id with level separator", "pump/1", `{}`, false),
+		Entry("id with wildcard", "pump+", `{}`, false),
+		Entry("metadata array", "pump-1", `[1]`, false),
+		Entry("metadata null", "pump-1", `null`, false),
+	)
+
+	It("should not expose the token hash or keep an empty metadata", func() {
+		d := &Device{DeviceID: "pump-1"}
+		Ω(d.validate()).To(Succeed())
+		out, err := json.Marshal(d)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(string(out)).To(ContainSubstring(`"metadata":{}`))
+		Ω(string(out)).ToNot(ContainSubstring("token"))
+	})
+})
+
+var _ = Describe("topic template", func() {
+	It("should default to reject unknown devices", func() {
+		t := &TopicTemplate{Template: "devices/{deviceId}/telemetry"}
+		Ω(t.validate()).To(Succeed())
+		Ω(t.UnknownDevices).To(Equal(device.UnknownReject))
+		Ω(t.Filter).To(Equal("devices/+/telemetry"))
+	})
+
+	It("should reject unknown policies", func() {
+		t := &TopicTemplate{Template: "devices/{deviceId}/telemetry", UnknownDevices: "ignore"}
+		Ω(tool.KindOf(t.validate())).To(Equal(tool.KindInvalid))
+	})
+})
+
+var _ = Describe("device registry", func() {
+	var r *deviceRegistry
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		r = newDeviceRegistry(nil)
+		t := &TopicTemplate{Template: "devices/{deviceId}/telemetry"}
+		Ω(t.validate()).To(Succeed())
+		expires := time.Now().Add(time.Minute)
+		status := &TopicTemplate{Template: "devices/{deviceId}/status", Kind: device.KindStatus}
+		Ω(status.validate()).To(Succeed())
+		r.templates[1] = cachedTemplates{templates: []*TopicTemplate{t, status}, expires: expires}
+		r.templates[2] = cachedTemplates{templates: []*TopicTemplate{}, expires: expires}
+		r.devices[deviceKey{1, "pump-1"}] = cachedDevice{id: 7, deviceType: "pump", expires: expires}
+		r.devices[deviceKey{1, "pump-2"}] = cachedDevice{id: 0, expires: expires}
+	})
+
+	It("should resolve known devices", func() {
+		ref, err := r.resolve(ctx, 1, "devices/pump-1/telemetry")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ref).To(Equal(deviceRef{id: 7, tenantID: 1, deviceID: "pump-1", deviceType: "pump", kind: device.KindTelemetry}))
+	})
+
+	It("should tell status topics", func() {
+		ref, err := r.resolve(ctx, 1, "devices/pump-1/status")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ref.id).To(Equal(int64(7)))
+		Ω(ref.kind).To(Equal(device.KindStatus))
+	})
+
+	It("should reject unknown devices", func() {
+		_, err := r.resolve(ctx, 1, "devices/pump-2/telemetry")
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+	})
+
+	It("should leave topics without template to no device", func() {
+		ref, err := r.resolve(ctx, 1, "sites/a/weather")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ref.id).To(BeZero())
+	})
+
+	It("should admit known devices of topics without their id", func() {
+		ref, err := r.admit(ctx, 1, "spBv1.0/g/DDATA/n/pump-1", "pump-1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ref.id).To(Equal(int64(7)))
+	})
+
+	It("should reject unknown devices of topics without their id unless a template registers them", func() {
+		_, err := r.admit(ctx, 1, "spBv1.0/g/DDATA/n/pump-2", "pump-2")
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+
+		sparkplug := &TopicTemplate{Template: "spBv1.0/{deviceId}/#"}
+		Ω(sparkplug.validate()).To(Succeed())
+		r.templates[1] = cachedTemplates{templates: []*TopicTemplate{sparkplug}, expires: time.Now().Add(time.Minute)}
+		_, err = r.admit(ctx, 1, "spBv1.0/g/DDATA/n/pump-2", "pump-2")
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+	})
+
+	It("should keep tenants apart", func() {
+		ref, err := r.resolve(ctx, 2, "devices/pump-1/telemetry")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ref.id).To(BeZero())
+	})
+})
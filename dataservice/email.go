@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"dataservice/notify"
+	"dataservice/tool"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/streadway/amqp"
+)
+
+// emailQueue durable queue of alarm events to be mailed
+const emailQueue = "email"
+
+// emailAttempts of a digest before it is dropped
+const emailAttempts = 3
+
+// default templates of digests, the recipient is .Recipient and the alarm events .Events
+const (
+	defaultEmailSubject = `{{if eq (len .Events) 1}}{{with index .Events 0}}[{{.Severity}}] {{.Type}}: {{.Message}}{{end}}{{else}}{{len .Events}} alarm notifications{{end}}`
+	defaultEmailBody    = "{{range .Events}}{{.RaisedAt.Format \"2006-01-02 15:04:05Z07:00\"}} {{.Type}} [{{.Severity}}] device {{.DeviceID}}: {{.Message}}\n{{end}}"
+)
+
+// emailConfig of alarm notifications by mail, disabled without smtp host
+type emailConfig struct {
+	smtp         notify.SMTP
+	digestWindow time.Duration
+	subject      string
+	body         string
+}
+
+// emailDigest alarm events waiting for a recipient
+type emailDigest struct {
+	events   []*AlarmEvent
+	attempts int
+}
+
+// emailNotifier mail alarm events to the recipients of their rules, the events of a window
+// are sent to a recipient in one digest so a flapping rule does not flood inboxes
+type emailNotifier struct {
+	sync.Mutex
+	pgPool  *sql.DB
+	window  time.Duration
+	subject *template.Template
+	body    *template.Template
+	send    func(to []string, subject, body string) error
+	pending map[string]*emailDigest // by recipient
+}
+
+func newEmailNotifier(pgPool *sql.DB, config emailConfig) (*emailNotifier, error) {
+	subject, err := template.New("subject").Parse(config.subject)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "parse email subject template")
+	}
+	body, err := template.New("body").Parse(config.body)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "parse email body template")
+	}
+	smtp := config.smtp
+	return &emailNotifier{
+		pgPool:  pgPool,
+		window:  config.digestWindow,
+		subject: subject,
+		body:    body,
+		send:    smtp.Send,
+		pending: make(map[string]*emailDigest),
+	}, nil
+}
+
+// consume alarm events, an event is acknowledged once it waits in the digests,
+// digests of the current window are lost when the instance dies
+func (n *emailNotifier) consume(ch *amqp.Channel) error {
+	q, err := ch.QueueDeclare(emailQueue, true, false, false, false, nil)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "declare email queue")
+	}
+	for _, key := range []string{"alarm.raised", "alarm.cleared"} {
+		if err := ch.QueueBind(q.Name, key, eventsExchange, false, nil); err != nil {
+			return tool.Wrap(tool.KindUnavailable, err, "bind email queue")
+		}
+	}
+	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "register email consumer")
+	}
+
+	go func() {
+		for msg := range msgs {
+			ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			err := n.enqueue(ctx, msg.Body)
+			cancel()
+			if err != nil {
+				_Log.Error("look up alarm recipients, requeue event", "event", msg.RoutingKey, "err", err)
+				tool.CheckThenLog(_Log, msg.Nack(false, true), "requeue event")
+				time.Sleep(time.Second)
+				continue
+			}
+			tool.CheckThenLog(_Log, msg.Ack(false), "ack event")
+		}
+	}()
+	return nil
+}
+
+// enqueue alarm event for the recipients of its rule
+func (n *emailNotifier) enqueue(ctx context.Context, body []byte) error {
+	event := &AlarmEvent{}
+	if err := json.Unmarshal(body, event); err != nil || event.Alarm == nil || event.RuleID == nil {
+		return nil
+	}
+	recipients, err := queryRecipients(ctx, n.pgPool, *event.RuleID)
+	if err != nil {
+		return err
+	}
+	n.add(event, recipients)
+	return nil
+}
+
+func (n *emailNotifier) add(event *AlarmEvent, recipients []string) {
+	n.Lock()
+	defer n.Unlock()
+
+	for _, to := range recipients {
+		d := n.pending[to]
+		if d == nil {
+			d = &emailDigest{}
+			n.pending[to] = d
+		}
+		d.events = append(d.events, event)
+	}
+}
+
+// run send digests every window until ctx is done, the last ones are sent on the way out
+func (n *emailNotifier) run(ctx context.Context) {
+	ticker := time.NewTicker(n.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.flush()
+		case <-ctx.Done():
+			n.flush()
+			return
+		}
+	}
+}
+
+// flush digests, a failed one is tried again with the next window
+func (n *emailNotifier) flush() {
+	n.Lock()
+	pending := n.pending
+	n.pending = make(map[string]*emailDigest)
+	n.Unlock()
+
+	for to, d := range pending {
+		subject, body, err := n.render(to, d.events)
+		if err == nil {
+			err = n.send([]string{to}, subject, body)
+		}
+		if err == nil {
+			continue
+		}
+		d.attempts++
+		if d.attempts >= emailAttempts {
+			_Log.Error("drop alarm digest", "to", to, "events", len(d.events), "err", err)
+			continue
+		}
+		_Log.Warn("send alarm digest, retry with the next window", "to", to, "events", len(d.events), "err", err)
+		n.Lock()
+		if later := n.pending[to]; later != nil {
+			d.events = append(d.events, later.events...)
+		}
+		n.pending[to] = d
+		n.Unlock()
+	}
+}
+
+// render subject and body of the digest of a recipient
+func (n *emailNotifier) render(to string, events []*AlarmEvent) (string, string, error) {
+	data := struct {
+		Recipient string
+		Events    []*AlarmEvent
+	}{to, events}
+	var subject, body bytes.Buffer
+	if err := n.subject.Execute(&subject, data); err != nil {
+		return "", "", tool.Wrap(tool.KindInvalid, err, "render email subject")
+	}
+	if err := n.body.Execute(&body, data); err != nil {
+		return "", "", tool.Wrap(tool.KindInvalid, err, "render email body")
+	}
+	return subject.String(), body.String(), nil
+}
+
+func queryRecipients(ctx context.Context, pgPool *sql.DB, ruleID int64) ([]string, error) {
+	rows, err := pgPool.QueryContext(ctx, `select email from rule_recipients where rule_id = $1 order by email;`, ruleID)
+	if err != nil {
+		return nil, dbError(err, "query recipients")
+	}
+	defer rows.Close()
+
+	recipients := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, dbError(err, "scan recipient")
+		}
+		recipients = append(recipients, email)
+	}
+	return recipients, dbError(rows.Err(), "query recipients")
+}
+
+// recipientsInput body of putRecipients
+type recipientsInput struct {
+	Recipients []string `json:"recipients"`
+}
+
+func (_global *global) getRecipients(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, err := _global.queryRule(ctx, tenantOf(c), id); err != nil {
+		c.Error(err)
+		return
+	}
+	recipients, err := queryRecipients(ctx, _global.pgPool, id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, recipientsInput{Recipients: recipients})
+}
+
+// putRecipients replace the mail recipients of a rule
+func (_global *global) putRecipients(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input recipientsInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	recipients, err := notify.ParseAddresses(input.Recipients)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, err := _global.queryRule(ctx, tenantOf(c), id); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `delete from rule_recipients where rule_id = $1;`, id); err != nil {
+			return dbError(err, "delete recipients")
+		}
+		_, err := tx.ExecContext(ctx, `insert into rule_recipients (rule_id, email) select $1, unnest($2::text[]) on conflict do nothing;`,
+			id, pq.Array(recipients))
+		return dbError(err, "insert recipients")
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	recipients, err = queryRecipients(ctx, _global.pgPool, id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, recipientsInput{Recipients: recipients})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("email", func() {
+	type mail struct {
+		to            []string
+		subject, body string
+	}
+	var n *emailNotifier
+	var sent []mail
+	var failing bool
+	ruleID := int64(3)
+	raisedAt := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	event := func(t string, deviceID int64) *AlarmEvent {
+		return &AlarmEvent{Type: t, Alarm: &Alarm{ID: deviceID, RuleID: &ruleID, DeviceID: deviceID, Severity: "critical",
+			Message: "overheat: temperature > 80, value 91", RaisedAt: raisedAt}}
+	}
+
+	BeforeEach(func() {
+		var err error
+		n, err = newEmailNotifier(nil, emailConfig{digestWindow: time.Minute, subject: defaultEmailSubject, body: defaultEmailBody})
+		Ω(err).ToNot(HaveOccurred())
+		sent, failing = nil, false
+		n.send = func(to []string, subject, body string) error {
+			if failing {
+				return errors.New("connection refused")
+			}
+			sent = append(sent, mail{to, subject, body})
+			return nil
+		}
+	})
+
+	It("should mail a single alarm on its own", func() {
+		n.add(event("alarm.raised", 7), []string{"ops@example.com"})
+		n.flush()
+
+		Ω(sent).To(HaveLen(1))
+		Ω(sent[0].to).To(Equal([]string{"ops@example.com"}))
+		Ω(sent[0].subject).To(Equal("[critical] alarm.raised: overheat: temperature > 80, value 91"))
+		Ω(sent[0].body).To(Equal("2026-01-01 08:00:00Z alarm.raised [critical] device 7: overheat: temperature > 80, value 91\n"))
+	})
+
+	It("should batch the alarms of a window into one digest per recipient", func() {
+		n.add(event("alarm.raised", 7), []string{"ops@example.com", "night@example.com"})
+		n.add(event("alarm.cleared", 7), []string{"ops@example.com"})
+		n.add(event("alarm.raised", 7), []string{"ops@example.com"})
+		n.flush()
+
+		Ω(sent).To(HaveLen(2))
+		for _, m := range sent {
+			if m.to[0] == "ops@example.com" {
+				Ω(m.subject).To(Equal("3 alarm notifications"))
+				Ω(m.body).To(ContainSubstring("alarm.cleared"))
+			} else {
+				Ω(m.subject).To(HavePrefix("[critical]"))
+			}
+		}
+
+		n.flush()
+		Ω(sent).To(HaveLen(2))
+	})
+
+	It("should retry a failed digest with the next window and drop it after the last attempt", func() {
+		failing = true
+		n.add(event("alarm.raised", 7), []string{"ops@example.com"})
+		n.flush()
+		n.add(event("alarm.cleared", 7), []string{"ops@example.com"})
+		failing = false
+		n.flush()
+		Ω(sent).To(HaveLen(1))
+		Ω(sent[0].subject).To(Equal("2 alarm notifications"))
+
+		failing = true
+		n.add(event("alarm.raised", 8), []string{"ops@example.com"})
+		for i := 0; i < emailAttempts; i++ {
+			n.flush()
+		}
+		Ω(n.pending).To(BeEmpty())
+	})
+
+	It("should reject broken templates", func() {
+		_, err := newEmailNotifier(nil, emailConfig{subject: "{{", body: defaultEmailBody})
+		Ω(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"dataservice/tool"
+	"dataservice/tracing"
+	"encoding/json"
+
+	"github.com/streadway/amqp"
+)
+
+// eventsExchange topic exchange of service events, routed by event type like device.online
+const eventsExchange = "events"
+
+// declareEvents exchange, consumers bind their own queues to it
+func (_global *global) declareEvents() error {
+	err := _global.amqpChan.ExchangeDeclare(eventsExchange, "topic", true, false, false, false, nil)
+	return tool.Wrap(tool.KindUnavailable, err, "declare events exchange")
+}
+
+// publishEvent as json onto the events exchange, the trace context travels in the headers
+func (_global *global) publishEvent(ctx context.Context, routingKey string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return tool.Wrap(tool.KindInternal, err, "encode event")
+	}
+	headers := amqp.Table{}
+	tracing.Inject(ctx, tracing.AMQPHeaders(headers))
+	err = _global.amqpChan.Publish(eventsExchange, routingKey, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+	return tool.Wrap(tool.KindUnavailable, err, "publish event "+routingKey)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"dataservice/auth"
+	"dataservice/connector"
+	"dataservice/decode"
+	"dataservice/device"
+	"dataservice/tool"
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+)
+
+// maxIngestBody of one ingest request
+const maxIngestBody = 1 << 20
+
+// ingestConfig of the http ingest endpoint
+type ingestConfig struct {
+	topic        string  // with device.IDPlaceholder, the topic messages are handled as
+	rate         float64 // messages per second of each device
+	burst        int
+	confirmAfter time.Duration // bound of the wait for the queue to confirm
+}
+
+// publishConfirms of the messages published with a context, publish leaves them alone unless the context asks for them
+type publishConfirms struct {
+	sync.Mutex
+	acks    []<-chan bool
+	refused error
+}
+
+type confirmsKey struct{}
+
+// withConfirms context collecting the confirms of what is published with it
+func withConfirms(ctx context.Context) (context.Context, *publishConfirms) {
+	pc := &publishConfirms{}
+	return context.WithValue(ctx, confirmsKey{}, pc), pc
+}
+
+// confirmsOf ctx, nil when nobody waits for them
+func confirmsOf(ctx context.Context) *publishConfirms {
+	pc, _ := ctx.Value(confirmsKey{}).(*publishConfirms)
+	return pc
+}
+
+func (pc *publishConfirms) add(ack <-chan bool) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	pc.acks = append(pc.acks, ack)
+}
+
+// refuse the messages, err tells why they were dropped
+func (pc *publishConfirms) refuse(err error) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	if pc.refused == nil {
+		pc.refused = err
+	}
+}
+
+// wait for every confirm, a nack or the end of ctx fails
+func (pc *publishConfirms) wait(ctx context.Context) error {
+	pc.Lock()
+	acks, refused := pc.acks, pc.refused
+	pc.Unlock()
+
+	if refused != nil {
+		return refused
+	}
+	for _, ack := range acks {
+		select {
+		case ok := <-ack:
+			if !ok {
+				return tool.Unavailable("message queue refused a message")
+			}
+		case <-ctx.Done():
+			return tool.Wrap(tool.KindUnavailable, ctx.Err(), "wait for message queue confirm")
+		}
+	}
+	return nil
+}
+
+// confirmedPublisher publish on a channel in confirm mode, each message gets the ack or nack of the queue
+type confirmedPublisher struct {
+	sync.Mutex
+	ch      *amqp.Channel
+	next    uint64
+	pending map[uint64]chan bool
+}
+
+func newConfirmedPublisher(conn *amqp.Connection) (*confirmedPublisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "open a channel")
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, tool.Wrap(tool.KindUnavailable, err, "put channel in confirm mode")
+	}
+	p := &confirmedPublisher{ch: ch, pending: make(map[uint64]chan bool)}
+	go p.listen(ch.NotifyPublish(make(chan amqp.Confirmation, 256)))
+	return p, nil
+}
+
+// publish msg, the returned channel tells whether the queue took it
+func (p *confirmedPublisher) publish(exchange, key string, msg amqp.Publishing) (<-chan bool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	// delivery tags count the publishes of the channel from 1
+	ack := make(chan bool, 1)
+	if err := p.ch.Publish(exchange, key, false, false, msg); err != nil {
+		return nil, err
+	}
+	p.next++
+	p.pending[p.next] = ack
+	return ack, nil
+}
+
+// listen for confirms until the channel is closed, what is pending then is nacked
+func (p *confirmedPublisher) listen(confirms <-chan amqp.Confirmation) {
+	for c := range confirms {
+		p.Lock()
+		ack := p.pending[c.DeliveryTag]
+		delete(p.pending, c.DeliveryTag)
+		p.Unlock()
+		if ack != nil {
+			ack <- c.Ack
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for tag, ack := range p.pending {
+		ack <- false
+		delete(p.pending, tag)
+	}
+}
+
+func (p *confirmedPublisher) close() error {
+	return p.ch.Close()
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimiter token buckets of devices, full buckets are forgotten
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[int64]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[int64]*tokenBucket)}
+}
+
+// take n tokens of key at now, wait is how long until they are there when refused
+func (l *rateLimiter) take(key int64, n int, now time.Time) (ok bool, wait time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.buckets) > 10000 {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.at).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens < float64(n) {
+		return false, time.Duration((float64(n) - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+// splitBatch body of content type into messages, a json array is a batch of them
+func splitBatch(contentType string, body []byte) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if contentType != "" && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") && mediaType != "text/plain" {
+		if decode.FormatOf(contentType) == "" {
+			return nil, tool.Invalid("unsupported content type [%s]", contentType)
+		}
+		// binary payloads are decoded on the way like those of mqtt
+		return []string{string(body)}, nil
+	}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return nil, tool.Invalid("body is not valid json")
+	}
+	if len(body) == 0 || body[0] != '[' {
+		return []string{string(body)}, nil
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "decode batch")
+	}
+	if len(batch) == 0 {
+		return nil, tool.Invalid("batch is empty")
+	}
+	messages := make([]string, 0, len(batch))
+	for _, m := range batch {
+		messages = append(messages, string(m))
+	}
+	return messages, nil
+}
+
+// deviceByToken of its token, Unauthorized for unknown tokens
+func (_global *global) deviceByToken(ctx context.Context, token string) (deviceRef, error) {
+	ref := deviceRef{kind: device.KindTelemetry}
+	err := _global.pgPool.QueryRowContext(ctx, `select id, tenant_id, device_id, type from devices where token_hash = $1;`,
+		auth.HashKey(token)).Scan(&ref.id, &ref.tenantID, &ref.deviceID, &ref.deviceType)
+	if err == sql.ErrNoRows {
+		return ref, tool.Unauthorized("unknown device token")
+	}
+	return ref, dbError(err, "look up device token")
+}
+
+// ingestTelemetry of the device of the token in the path, one message or a json array of them
+func (_global *global) ingestTelemetry(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	ref, err := _global.deviceByToken(ctx, c.Param("token"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIngestBody+1))
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInvalid, err, "read body"))
+		return
+	}
+	if len(body) > maxIngestBody {
+		c.Error(tool.Invalid("body is larger than %d bytes", maxIngestBody))
+		return
+	}
+	accepted, retryAfter, err := _global.ingestBatch(c.Request.Context(), ref, _global.httpIngest.topic, c.ContentType(), body)
+	if err != nil {
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"accepted": accepted})
+}
+
+// ingestBatch of device ref in body, handled as messages on topic: they take the path of mqtt messages and are accepted
+// once the queue confirmed every one of them; retryAfter tells a device beyond its rate when to come back
+func (_global *global) ingestBatch(ctx context.Context, ref deviceRef, topic, contentType string, body []byte) (accepted int, retryAfter time.Duration, err error) {
+	messages, err := splitBatch(contentType, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(messages) > _global.httpIngest.burst {
+		return 0, 0, tool.Invalid("batch of %d messages is larger than the burst of %d", len(messages), _global.httpIngest.burst)
+	}
+	if ok, wait := _global.ingestLimits.take(ref.id, len(messages), time.Now()); !ok {
+		return 0, wait, tool.RateLimited("device [%s] sends more than %g messages per second", ref.deviceID, _global.httpIngest.rate)
+	}
+
+	cctx, confirms := withConfirms(ctx)
+	topic = strings.ReplaceAll(topic, device.IDPlaceholder, ref.deviceID)
+	for _, m := range messages {
+		msg := &connector.Message{Topic: topic, Payload: m, QoS: 1, ContentType: contentType}
+		pctx, span := startPush(cctx, ref.tenantID, msg)
+		err := _global.pushDevice(pctx, ref.tenantID, ref, msg)
+		endPush(span, err)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	wctx, stop := context.WithTimeout(ctx, _global.httpIngest.confirmAfter)
+	defer stop()
+	if err := confirms.wait(wctx); err != nil {
+		return 0, 0, err
+	}
+	return len(messages), 0, nil
+}
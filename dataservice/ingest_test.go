@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ingest", func() {
+	It("should split json batches into messages", func() {
+		messages, err := splitBatch("application/json", []byte(` [{"t": 1}, {"t": 2}] `))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(messages).To(Equal([]string{`{"t": 1}`, `{"t": 2}`}))
+
+		messages, err = splitBatch("", []byte(`{"t": 1}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(messages).To(Equal([]string{`{"t": 1}`}))
+
+		messages, err = splitBatch("application/cbor", []byte{0xa1, 0x61, 0x74, 0x01})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(messages).To(HaveLen(1), "binary payloads are decoded later")
+
+		for _, body := range []string{`[]`, `{"t": `, ``} {
+			_, err := splitBatch("application/json", []byte(body))
+			Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid), body)
+		}
+		_, err = splitBatch("image/png", []byte("png"))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should limit the rate of each device", func() {
+		now := time.Now()
+		l := newRateLimiter(2, 4)
+		ok, _ := l.take(1, 4, now)
+		Ω(ok).To(BeTrue())
+		ok, wait := l.take(1, 1, now)
+		Ω(ok).To(BeFalse())
+		Ω(wait).To(Equal(500 * time.Millisecond))
+		ok, _ = l.take(2, 1, now)
+		Ω(ok).To(BeTrue(), "devices are limited apart")
+
+		ok, _ = l.take(1, 1, now.Add(500*time.Millisecond))
+		Ω(ok).To(BeTrue())
+		ok, _ = l.take(1, 4, now.Add(time.Hour))
+		Ω(ok).To(BeTrue(), "the bucket holds no more than the burst")
+		ok, _ = l.take(1, 1, now.Add(time.Hour))
+		Ω(ok).To(BeFalse())
+	})
+
+	It("should wait for the confirms of what is published", func() {
+		ctx, confirms := withConfirms(context.Background())
+		Ω(confirmsOf(ctx)).To(BeIdenticalTo(confirms))
+		Ω(confirmsOf(context.Background())).To(BeNil())
+
+		acked, nacked := make(chan bool, 1), make(chan bool, 1)
+		confirms.add(acked)
+		acked <- true
+		Ω(confirms.wait(ctx)).To(Succeed())
+
+		ctx, confirms = withConfirms(context.Background())
+		confirms.add(nacked)
+		nacked <- false
+		Ω(tool.KindOf(confirms.wait(ctx))).To(Equal(tool.KindUnavailable))
+
+		ctx, confirms = withConfirms(context.Background())
+		confirms.add(make(chan bool))
+		wctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		Ω(tool.KindOf(confirms.wait(wctx))).To(Equal(tool.KindUnavailable))
+
+		ctx, confirms = withConfirms(context.Background())
+		confirms.refuse(tool.Forbidden("quota"))
+		Ω(tool.KindOf(confirms.wait(ctx))).To(Equal(tool.KindForbidden))
+	})
+})
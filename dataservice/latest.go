@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// LatestValue of a key of a device
+type LatestValue struct {
+	Value json.RawMessage `json:"value"`
+	TS    time.Time       `json:"ts"`
+}
+
+type latestKey struct {
+	deviceID int64
+	key      string
+}
+
+type latestEntry struct {
+	key     latestKey
+	value   *LatestValue // nil for keys the device never sent
+	expires time.Time
+}
+
+// latestCache bounded cache of latest values, least recently used entries go first
+type latestCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[latestKey]*list.Element
+	order   list.List // of *latestEntry, most recently used in front
+}
+
+func newLatestCache(size int, ttl time.Duration) *latestCache {
+	return &latestCache{size: size, ttl: ttl, entries: make(map[latestKey]*list.Element)}
+}
+
+// get cached value, ok is false when it has to be read
+func (c *latestCache) get(k latestKey, now time.Time) (value *LatestValue, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el := c.entries[k]
+	if el == nil {
+		return nil, false
+	}
+	entry := el.Value.(*latestEntry)
+	if now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, k)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// put value read or written, a cached value newer than it is kept
+func (c *latestCache) put(k latestKey, value *LatestValue, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el := c.entries[k]; el != nil {
+		entry := el.Value.(*latestEntry)
+		if entry.value == nil || value == nil || !value.TS.Before(entry.value.TS) {
+			entry.value = value
+		}
+		entry.expires = now.Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&latestEntry{key: k, value: value, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*latestEntry).key)
+	}
+}
+
+// forgetDevice drop every cached key of device
+func (c *latestCache) forgetDevice(deviceID int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k, el := range c.entries {
+		if k.deviceID == deviceID {
+			c.order.Remove(el)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// latestValues of devices, read through the cache
+type latestValues struct {
+	pgPool *sql.DB
+	cache  *latestCache
+}
+
+// written values of device by a persisted message at ts
+func (l *latestValues) written(deviceID int64, message string, ts time.Time) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(message), &fields) != nil {
+		return
+	}
+	now := time.Now()
+	for key, value := range fields {
+		l.cache.put(latestKey{deviceID, key}, &LatestValue{Value: value, TS: ts}, now)
+	}
+}
+
+// get values of keys of device, keys never sent are left out
+func (l *latestValues) get(ctx context.Context, deviceID int64, keys []string) (map[string]*LatestValue, error) {
+	values := make(map[string]*LatestValue, len(keys))
+	now := time.Now()
+	var missing []string
+	for _, key := range keys {
+		value, ok := l.cache.get(latestKey{deviceID, key}, now)
+		switch {
+		case !ok:
+			missing = append(missing, key)
+		case value != nil:
+			values[key] = value
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	read, err := l.query(ctx, `select key, value, ts from latest_values where device_id = $1 and key = any($2);`, deviceID, pq.Array(missing))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range missing {
+		value := read[key]
+		l.cache.put(latestKey{deviceID, key}, value, now)
+		if value != nil {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// all values of device, straight from the table
+func (l *latestValues) all(ctx context.Context, deviceID int64) (map[string]*LatestValue, error) {
+	values, err := l.query(ctx, `select key, value, ts from latest_values where device_id = $1;`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for key, value := range values {
+		l.cache.put(latestKey{deviceID, key}, value, now)
+	}
+	return values, nil
+}
+
+func (l *latestValues) query(ctx context.Context, query string, args ...interface{}) (map[string]*LatestValue, error) {
+	rows, err := l.pgPool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, dbError(err, "query latest values")
+	}
+	defer rows.Close()
+
+	values := make(map[string]*LatestValue)
+	for rows.Next() {
+		var key string
+		var value []byte
+		v := &LatestValue{}
+		if err := rows.Scan(&key, &value, &v.TS); err != nil {
+			return nil, dbError(err, "scan latest value")
+		}
+		v.Value = value
+		values[key] = v
+	}
+	return values, dbError(rows.Err(), "query latest values")
+}
+
+// getLatest values of device, of the comma separated keys or all of them
+func (_global *global) getLatest(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var keys []string
+	for _, key := range strings.Split(c.Query("keys"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	var values map[string]*LatestValue
+	if len(keys) == 0 {
+		values, err = _global.latest.all(ctx, d.ID)
+	} else {
+		values, err = _global.latest.get(ctx, d.ID, keys)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, values)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("latest values", func() {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	value := func(v string, ts time.Time) *LatestValue {
+		return &LatestValue{Value: json.RawMessage(v), TS: ts}
+	}
+
+	It("should evict the least recently used key", func() {
+		c := newLatestCache(2, time.Minute)
+		c.put(latestKey{1, "a"}, value("1", now), now)
+		c.put(latestKey{1, "b"}, value("2", now), now)
+		_, ok := c.get(latestKey{1, "a"}, now)
+		Ω(ok).To(BeTrue())
+		c.put(latestKey{1, "c"}, value("3", now), now)
+
+		_, ok = c.get(latestKey{1, "b"}, now)
+		Ω(ok).To(BeFalse())
+		_, ok = c.get(latestKey{1, "a"}, now)
+		Ω(ok).To(BeTrue())
+	})
+
+	It("should expire entries", func() {
+		c := newLatestCache(10, time.Minute)
+		c.put(latestKey{1, "a"}, value("1", now), now)
+		_, ok := c.get(latestKey{1, "a"}, now.Add(2*time.Minute))
+		Ω(ok).To(BeFalse())
+	})
+
+	It("should keep a newer value", func() {
+		c := newLatestCache(10, time.Minute)
+		c.put(latestKey{1, "a"}, value("2", now), now)
+		c.put(latestKey{1, "a"}, value("1", now.Add(-time.Second)), now)
+		v, _ := c.get(latestKey{1, "a"}, now)
+		Ω(string(v.Value)).To(Equal("2"))
+	})
+
+	It("should serve written and absent keys from the cache", func() {
+		l := &latestValues{cache: newLatestCache(10, time.Minute)}
+		l.written(7, `{"temperature": 21.5, "state": {"on": true}}`, now)
+		l.cache.put(latestKey{7, "humidity"}, nil, time.Now())
+
+		values, err := l.get(context.Background(), 7, []string{"temperature", "state", "humidity"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(values).To(HaveLen(2))
+		Ω(string(values["temperature"].Value)).To(Equal("21.5"))
+		Ω(string(values["state"].Value)).To(MatchJSON(`{"on": true}`))
+		Ω(values["temperature"].TS).To(Equal(now))
+	})
+
+	It("should forget a deleted device", func() {
+		c := newLatestCache(10, time.Minute)
+		c.put(latestKey{1, "a"}, value("1", now), now)
+		c.put(latestKey{2, "a"}, value("1", now), now)
+		c.forgetDevice(1)
+		_, ok := c.get(latestKey{1, "a"}, now)
+		Ω(ok).To(BeFalse())
+		_, ok = c.get(latestKey{2, "a"}, now)
+		Ω(ok).To(BeTrue())
+	})
+})
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Config of logging
+type Config struct {
+	Level  string // debug, info, warn, error
+	Format string // json, text
+	// PayloadSampling log one payload of every PayloadSampling messages at info level, 0 disables payload logs
+	PayloadSampling uint64
+}
+
+var payloadSampling atomic.Uint64
+var payloadCounter atomic.Uint64
+
+// Init install the default logger writing to w
+func Init(cfg Config, w io.Writer) {
+	payloadSampling.Store(cfg.PayloadSampling)
+	payloadCounter.Store(0)
+	slog.SetDefault(New(cfg, w))
+}
+
+// New create a logger writing to w
+func New(cfg Config, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: ParseLevel(cfg.Level)}
+	var handler slog.Handler
+	if strings.EqualFold(cfg.Format, "text") {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(handler)
+}
+
+// ParseLevel parse level name, unknown names fall back to info
+func ParseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// Component logger tagged with component name, it follows the default logger
+// even when that is installed after the component logger was created.
+func Component(name string) *slog.Logger {
+	return slog.New(&deferred{}).With("component", name)
+}
+
+// deferred resolve the default handler on every record
+type deferred struct {
+	wraps []func(slog.Handler) slog.Handler
+}
+
+func (h *deferred) handler() slog.Handler {
+	handler := slog.Default().Handler()
+	for _, wrap := range h.wraps {
+		handler = wrap(handler)
+	}
+	return handler
+}
+
+func (h *deferred) with(wrap func(slog.Handler) slog.Handler) *deferred {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wraps), len(h.wraps)+1)
+	copy(wraps, h.wraps)
+	return &deferred{wraps: append(wraps, wrap)}
+}
+
+func (h *deferred) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *deferred) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *deferred) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *deferred) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// Payload log message payload at info level, sampled by config: turning sampling on is what asks for payloads,
+// messages count towards the sample only while info is enabled
+func Payload(l *slog.Logger, msg, payload string, args ...any) {
+	n := payloadSampling.Load()
+	if n == 0 || !l.Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+	if (payloadCounter.Add(1)-1)%n != 0 {
+		return
+	}
+	l.Info(msg, append(args, "payload", payload)...)
+}
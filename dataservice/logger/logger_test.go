@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("logger", func() {
+	var buf *bytes.Buffer
+	var origin *slog.Logger
+
+	lines := func() []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			m := map[string]interface{}{}
+			Ω(json.Unmarshal([]byte(line), &m)).To(Succeed())
+			out = append(out, m)
+		}
+		return out
+	}
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		origin = slog.Default()
+	})
+
+	AfterEach(func() {
+		slog.SetDefault(origin)
+	})
+
+	It("should parse levels", func() {
+		Ω(ParseLevel("debug")).To(Equal(slog.LevelDebug))
+		Ω(ParseLevel("WARN")).To(Equal(slog.LevelWarn))
+		Ω(ParseLevel("nonsense")).To(Equal(slog.LevelInfo))
+	})
+
+	It("should tag component loggers created before init", func() {
+		l := Component("mqtt")
+		Init(Config{Level: "info", Format: "json"}, buf)
+
+		l.With("broker", "tcp://localhost:1883").Info("connected")
+		l.Debug("hidden")
+
+		out := lines()
+		Ω(out).To(HaveLen(1))
+		Ω(out[0]).To(HaveKeyWithValue("component", "mqtt"))
+		Ω(out[0]).To(HaveKeyWithValue("broker", "tcp://localhost:1883"))
+		Ω(out[0]).To(HaveKeyWithValue("msg", "connected"))
+	})
+
+	It("should sample payloads", func() {
+		Init(Config{Level: "debug", Format: "json", PayloadSampling: 3}, buf)
+		l := Component("mqtt")
+
+		for i := 0; i < 7; i++ {
+			Payload(l, "message received", "hello", "topic", "t")
+		}
+
+		out := lines()
+		Ω(out).To(HaveLen(3))
+		Ω(out[0]).To(HaveKeyWithValue("payload", "hello"))
+		Ω(out[0]).To(HaveKeyWithValue("topic", "t"))
+	})
+
+	It("should log sampled payloads at the default level", func() {
+		Init(Config{Level: "info", Format: "json", PayloadSampling: 2}, buf)
+		l := Component("mqtt")
+
+		for i := 0; i < 4; i++ {
+			Payload(l, "message received", "hello")
+		}
+		Ω(lines()).To(HaveLen(2))
+	})
+
+	It("should not count payloads while info is disabled", func() {
+		Init(Config{Level: "warn", Format: "json", PayloadSampling: 2}, buf)
+		l := Component("mqtt")
+		Payload(l, "message received", "dropped")
+		Ω(buf.Len()).To(BeZero())
+		Ω(payloadCounter.Load()).To(BeZero())
+	})
+
+	It("should not log payloads when sampling disabled", func() {
+		Init(Config{Level: "debug", Format: "text"}, buf)
+		Payload(Component("mqtt"), "message received", "hello")
+		Ω(buf.Len()).To(BeZero())
+	})
+})
@@ -4,11 +4,18 @@ import (
 	"container/list"
 	"context"
 	"database/sql"
-	"dataservice/connector/mqtt"
+	"dataservice/auth"
+	"dataservice/connector"
+	"dataservice/connector/coap"
+	"dataservice/device"
+	"dataservice/logger"
+	"dataservice/notify"
+	"dataservice/policy"
+	"dataservice/sparkplug"
 	"dataservice/tool"
-	"encoding/base64"
+	"dataservice/tracing"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,18 +26,77 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // config
 type config struct {
 	serverPort, pgConnStr, amqpConnStr string
+	trace                              tracing.Config
+	log                                logger.Config
+	auth                               authConfig
+	policy                             *policy.Policy
+	offlineTimeout                     time.Duration
+	shadow                             shadowConfig
+	latestCacheSize                    int
+	latestCacheTTL                     time.Duration
+	webhook                            webhookConfig
+	mail                               emailConfig
+	transformTimeout                   time.Duration
+	cluster                            clusterConfig
+	deduplication                      dedupConfig
+	httpIngest                         ingestConfig
+	coapListener                       coapConfig
+	modbusPoll                         modbusConfig
+}
+
+// dedupConfig of message deduplication
+type dedupConfig struct {
+	mode       string // of topics without a policy
+	window     time.Duration
+	windowSize int
+}
+
+// shadowConfig of device shadow deltas
+type shadowConfig struct {
+	deltaTopic string
+	qos        byte
+}
+
+// authConfig of api authentication
+type authConfig struct {
+	enabled      bool
+	bootstrapKey string
+	jwt          auth.JWTConfig
 }
 
 // resource
 type resource struct {
-	pgPool   *sql.DB
-	amqpConn *amqp.Connection
-	amqpChan *amqp.Channel
+	pgPool       *sql.DB
+	connectors   *connector.Registry
+	amqpConn     *amqp.Connection
+	amqpChan     *amqp.Channel
+	usage        *messageUsage
+	keyUsage     *keyUsage
+	devices      *deviceRegistry
+	presence     *presenceTracker
+	shadows      *shadowService
+	latest       *latestValues
+	rules        *ruleEngine
+	webhooks     *webhookDispatcher
+	email        *emailNotifier // nil without smtp host
+	transforms   *transformer
+	schemas      *payloadValidator
+	decoders     *payloadDecoder
+	edgeNodes    *sparkplug.Host
+	leases       *brokerLeases // nil unless in cluster mode
+	dedup        *deduplicator
+	confirmed    *confirmedPublisher // publishes of http ingest, confirmed by the queue
+	ingestLimits *rateLimiter        // of devices on http and coap ingest
+	coapServer   *coap.Server        // nil unless the coap listener is enabled
+	pollers      *modbusPollers      // nil unless modbus polling is enabled
 }
 
 // global
@@ -41,12 +107,44 @@ type global struct {
 
 var _Global global
 
+var _Log = logger.Component("main")
+
+// amqp headers carrying the tenant, the device, the mqtt 5 properties and the idempotency key of a message
+const (
+	tenantHeader     = "tenant"
+	deviceHeader     = "device"
+	deviceTypeHeader = "deviceType"
+	propertiesHeader = "properties"
+	dedupKeyHeader   = "dedupKey"
+)
+
+// messageProperties of an MQTT 5 message kept in its stored envelope
+type messageProperties struct {
+	ContentType     string                   `json:"contentType,omitempty"`
+	ResponseTopic   string                   `json:"responseTopic,omitempty"`
+	CorrelationData []byte                   `json:"correlationData,omitempty"`
+	UserProperties  []connector.UserProperty `json:"userProperties,omitempty"`
+}
+
+// propertiesOf msg, nil when it carries none
+func propertiesOf(msg *connector.Message) *messageProperties {
+	if msg.ContentType == "" && msg.ResponseTopic == "" && len(msg.CorrelationData) == 0 && len(msg.UserProperties) == 0 {
+		return nil
+	}
+	return &messageProperties{ContentType: msg.ContentType, ResponseTopic: msg.ResponseTopic,
+		CorrelationData: msg.CorrelationData, UserProperties: msg.UserProperties}
+}
+
 func main() {
 	_Global.loadConfig()
 	defer _Global.initResource()()
 	_Global.loadData()
 
-	go _Global.pull()
+	tool.CheckThenPanic(_Global.pull(), "pull messages")
+	tool.CheckThenPanic(_Global.webhooks.consume(_Global.amqpChan), "consume events for webhooks")
+	if _Global.email != nil {
+		tool.CheckThenPanic(_Global.email.consume(_Global.amqpChan), "consume alarms for email")
+	}
 	_Global.serve()
 }
 
@@ -59,9 +157,19 @@ func (_global *global) loadConfig() {
 		tool.CheckThenPrint(err, "read config file")
 	}
 
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", "json")
+	viper.SetDefault("log.payloadSampling", 0)
+	_global.log = logger.Config{
+		Level:           viper.GetString("log.level"),
+		Format:          viper.GetString("log.format"),
+		PayloadSampling: viper.GetUint64("log.payloadSampling"),
+	}
+	logger.Init(_global.log, os.Stdout)
+
 	viper.SetDefault("server.port", "8000")
 	_global.serverPort = viper.GetString("server.port")
-	log.Printf("config of server port -- %s", _global.serverPort)
+	_Log.Info("config of server", "port", _global.serverPort)
 
 	viper.SetDefault("postgres.user", "guest")
 	viper.SetDefault("postgres.pass", "guest")
@@ -69,35 +177,274 @@ func (_global *global) loadConfig() {
 	viper.SetDefault("postgres.port", "5432")
 	viper.SetDefault("postgres.db", "thingspanel")
 	_global.pgConnStr = fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", viper.GetString("postgres.user"), viper.GetString("postgres.pass"), viper.GetString("postgres.host"), viper.GetString("postgres.port"), viper.GetString("postgres.db"))
-	log.Printf("config of postgres -- %s", _global.pgConnStr)
+	_Log.Info("config of postgres", "host", viper.GetString("postgres.host"), "port", viper.GetString("postgres.port"), "db", viper.GetString("postgres.db"))
 
 	viper.SetDefault("amqp.user", "guest")
 	viper.SetDefault("amqp.pass", "guest")
 	viper.SetDefault("amqp.host", "localhost")
 	viper.SetDefault("amqp.port", "5672")
 	_global.amqpConnStr = fmt.Sprintf("amqp://%s:%s@%s:%s/", viper.GetString("amqp.user"), viper.GetString("amqp.pass"), viper.GetString("amqp.host"), viper.GetString("amqp.port"))
-	log.Printf("config of amqp -- %s", _global.amqpConnStr)
+	_Log.Info("config of amqp", "host", viper.GetString("amqp.host"), "port", viper.GetString("amqp.port"))
+
+	viper.SetDefault("otel.endpoint", "")
+	viper.SetDefault("otel.insecure", true)
+	viper.SetDefault("otel.serviceName", "dataservice")
+	viper.SetDefault("otel.sampleRatio", 1.0)
+	_global.trace = tracing.Config{
+		Endpoint:    viper.GetString("otel.endpoint"),
+		Insecure:    viper.GetBool("otel.insecure"),
+		ServiceName: viper.GetString("otel.serviceName"),
+		SampleRatio: viper.GetFloat64("otel.sampleRatio"),
+	}
+	_Log.Info("config of otel", "endpoint", _global.trace.Endpoint)
+
+	viper.SetDefault("auth.enabled", true)
+	_global.auth = authConfig{
+		enabled:      viper.GetBool("auth.enabled"),
+		bootstrapKey: viper.GetString("auth.bootstrapKey"),
+		jwt: auth.JWTConfig{
+			Key:      viper.GetString("auth.jwt.key"),
+			KeyFile:  viper.GetString("auth.jwt.keyFile"),
+			JWKSFile: viper.GetString("auth.jwt.jwksFile"),
+			Issuer:   viper.GetString("auth.jwt.issuer"),
+			Audience: viper.GetString("auth.jwt.audience"),
+		},
+	}
+	viper.SetDefault("mqtt.policy.schemes", []string{"tcp", "ssl", "tls", "ws", "wss"})
+	viper.SetDefault("mqtt.policy.hosts", []string{})
+	viper.SetDefault("mqtt.policy.denyCIDRs", policy.DefaultDenyCIDRs)
+	viper.SetDefault("mqtt.policy.ports", []string{})
+	brokerPolicy, err := policy.Parse(viper.GetStringSlice("mqtt.policy.schemes"), viper.GetStringSlice("mqtt.policy.hosts"),
+		viper.GetStringSlice("mqtt.policy.denyCIDRs"), viper.GetStringSlice("mqtt.policy.ports"))
+	tool.CheckThenPanic(err, "parse mqtt policy")
+	_global.policy = brokerPolicy
+	_Log.Info("config of mqtt policy", "schemes", viper.GetStringSlice("mqtt.policy.schemes"), "hosts", viper.GetStringSlice("mqtt.policy.hosts"),
+		"denyCIDRs", viper.GetStringSlice("mqtt.policy.denyCIDRs"), "ports", viper.GetStringSlice("mqtt.policy.ports"))
+
+	viper.SetDefault("devices.offlineTimeout", "5m")
+	_global.offlineTimeout = viper.GetDuration("devices.offlineTimeout")
+	if _global.offlineTimeout <= 0 {
+		tool.CheckThenPanic(tool.Invalid("devices.offlineTimeout must be positive"), "read devices config")
+	}
+	_Log.Info("config of devices", "offlineTimeout", _global.offlineTimeout)
+
+	viper.SetDefault("shadow.deltaTopic", "devices/"+device.IDPlaceholder+"/shadow/delta")
+	viper.SetDefault("shadow.qos", 1)
+	_global.shadow = shadowConfig{deltaTopic: viper.GetString("shadow.deltaTopic"), qos: byte(viper.GetUint("shadow.qos"))}
+	if _global.shadow.qos > 2 {
+		tool.CheckThenPanic(tool.Invalid("shadow.qos must be 0, 1 or 2"), "read shadow config")
+	}
+	_Log.Info("config of shadow", "deltaTopic", _global.shadow.deltaTopic, "qos", _global.shadow.qos)
+
+	viper.SetDefault("latest.cacheSize", 100000)
+	viper.SetDefault("latest.cacheTTL", "10s")
+	_global.latestCacheSize, _global.latestCacheTTL = viper.GetInt("latest.cacheSize"), viper.GetDuration("latest.cacheTTL")
+	_Log.Info("config of latest values", "cacheSize", _global.latestCacheSize, "cacheTTL", _global.latestCacheTTL)
+
+	viper.SetDefault("webhooks.workers", 4)
+	viper.SetDefault("webhooks.timeout", "10s")
+	viper.SetDefault("webhooks.maxAttempts", 8)
+	viper.SetDefault("webhooks.backoff", "5s")
+	viper.SetDefault("webhooks.maxBackoff", "10m")
+	viper.SetDefault("webhooks.policy.schemes", []string{"http", "https"})
+	viper.SetDefault("webhooks.policy.hosts", []string{})
+	viper.SetDefault("webhooks.policy.denyCIDRs", policy.DefaultDenyCIDRs)
+	viper.SetDefault("webhooks.policy.ports", []string{})
+	webhookPolicy, err := policy.Parse(viper.GetStringSlice("webhooks.policy.schemes"), viper.GetStringSlice("webhooks.policy.hosts"),
+		viper.GetStringSlice("webhooks.policy.denyCIDRs"), viper.GetStringSlice("webhooks.policy.ports"))
+	tool.CheckThenPanic(err, "parse webhooks policy")
+	_global.webhook = webhookConfig{
+		workers:     viper.GetInt("webhooks.workers"),
+		timeout:     viper.GetDuration("webhooks.timeout"),
+		maxAttempts: viper.GetInt("webhooks.maxAttempts"),
+		backoff:     viper.GetDuration("webhooks.backoff"),
+		maxBackoff:  viper.GetDuration("webhooks.maxBackoff"),
+		policy:      webhookPolicy,
+	}
+	if _global.webhook.workers <= 0 || _global.webhook.timeout <= 0 || _global.webhook.maxAttempts <= 0 || _global.webhook.backoff <= 0 {
+		tool.CheckThenPanic(tool.Invalid("webhooks workers, timeout, maxAttempts and backoff must be positive"), "read webhooks config")
+	}
+	_Log.Info("config of webhooks", "workers", _global.webhook.workers, "timeout", _global.webhook.timeout,
+		"maxAttempts", _global.webhook.maxAttempts, "backoff", _global.webhook.backoff, "maxBackoff", _global.webhook.maxBackoff)
+	_Log.Info("config of webhooks policy", "schemes", viper.GetStringSlice("webhooks.policy.schemes"),
+		"hosts", viper.GetStringSlice("webhooks.policy.hosts"), "denyCIDRs", viper.GetStringSlice("webhooks.policy.denyCIDRs"),
+		"ports", viper.GetStringSlice("webhooks.policy.ports"))
+
+	viper.SetDefault("email.port", 587)
+	viper.SetDefault("email.startTLS", true)
+	viper.SetDefault("email.timeout", "10s")
+	viper.SetDefault("email.digestWindow", "1m")
+	viper.SetDefault("email.subject", defaultEmailSubject)
+	viper.SetDefault("email.body", defaultEmailBody)
+	_global.mail = emailConfig{
+		smtp: notify.SMTP{
+			Host:     viper.GetString("email.host"),
+			Port:     viper.GetInt("email.port"),
+			Username: viper.GetString("email.username"),
+			Password: viper.GetString("email.password"),
+			From:     viper.GetString("email.from"),
+			StartTLS: viper.GetBool("email.startTLS"),
+			Timeout:  viper.GetDuration("email.timeout"),
+		},
+		digestWindow: viper.GetDuration("email.digestWindow"),
+		subject:      viper.GetString("email.subject"),
+		body:         viper.GetString("email.body"),
+	}
+	if _global.mail.smtp.Host != "" {
+		if _, err := notify.ParseAddresses([]string{_global.mail.smtp.From}); err != nil {
+			tool.CheckThenPanic(err, "read email config")
+		}
+		if _global.mail.digestWindow <= 0 {
+			tool.CheckThenPanic(tool.Invalid("email.digestWindow must be positive"), "read email config")
+		}
+	}
+	_Log.Info("config of email", "enabled", _global.mail.smtp.Host != "", "host", _global.mail.smtp.Host, "port", _global.mail.smtp.Port,
+		"startTLS", _global.mail.smtp.StartTLS, "digestWindow", _global.mail.digestWindow)
+
+	viper.SetDefault("transforms.timeout", "50ms")
+	_global.transformTimeout = viper.GetDuration("transforms.timeout")
+	if _global.transformTimeout <= 0 {
+		tool.CheckThenPanic(tool.Invalid("transforms.timeout must be positive"), "read transforms config")
+	}
+	_Log.Info("config of transforms", "timeout", _global.transformTimeout)
+
+	viper.SetDefault("cluster.enabled", false)
+	viper.SetDefault("cluster.leaseTimeout", "15s")
+	_global.cluster = clusterConfig{
+		enabled:      viper.GetBool("cluster.enabled"),
+		instance:     viper.GetString("cluster.instance"),
+		leaseTimeout: viper.GetDuration("cluster.leaseTimeout"),
+	}
+	if _global.cluster.enabled {
+		if _global.cluster.instance == "" {
+			_global.cluster.instance, err = os.Hostname()
+			tool.CheckThenPanic(err, "read cluster config")
+		}
+		if _global.cluster.leaseTimeout <= 0 {
+			tool.CheckThenPanic(tool.Invalid("cluster.leaseTimeout must be positive"), "read cluster config")
+		}
+	}
+	viper.SetDefault("dedup.mode", dedupNone)
+	viper.SetDefault("dedup.window", "1m")
+	viper.SetDefault("dedup.windowSize", 100000)
+	_global.deduplication = dedupConfig{
+		mode:       viper.GetString("dedup.mode"),
+		window:     viper.GetDuration("dedup.window"),
+		windowSize: viper.GetInt("dedup.windowSize"),
+	}
+	if _global.deduplication.mode != dedupContent && _global.deduplication.mode != dedupNone {
+		tool.CheckThenPanic(tool.Invalid("dedup.mode must be %s or %s", dedupContent, dedupNone), "read dedup config")
+	}
+	if _global.deduplication.window <= 0 || _global.deduplication.windowSize <= 0 {
+		tool.CheckThenPanic(tool.Invalid("dedup.window and dedup.windowSize must be positive"), "read dedup config")
+	}
+	_Log.Info("config of dedup", "mode", _global.deduplication.mode, "window", _global.deduplication.window, "windowSize", _global.deduplication.windowSize)
+
+	viper.SetDefault("ingest.topic", "ingest/"+device.IDPlaceholder)
+	viper.SetDefault("ingest.rate", 10)
+	viper.SetDefault("ingest.burst", 100)
+	viper.SetDefault("ingest.confirmTimeout", "5s")
+	_global.httpIngest = ingestConfig{
+		topic:        viper.GetString("ingest.topic"),
+		rate:         viper.GetFloat64("ingest.rate"),
+		burst:        viper.GetInt("ingest.burst"),
+		confirmAfter: viper.GetDuration("ingest.confirmTimeout"),
+	}
+	if _global.httpIngest.rate <= 0 || _global.httpIngest.burst <= 0 || _global.httpIngest.confirmAfter <= 0 {
+		tool.CheckThenPanic(tool.Invalid("ingest rate, burst and confirmTimeout must be positive"), "read ingest config")
+	}
+	_Log.Info("config of ingest", "topic", _global.httpIngest.topic, "rate", _global.httpIngest.rate, "burst", _global.httpIngest.burst,
+		"confirmTimeout", _global.httpIngest.confirmAfter)
+
+	viper.SetDefault("coap.enabled", false)
+	viper.SetDefault("coap.addr", ":5683")
+	viper.SetDefault("coap.topic", "coap/"+device.IDPlaceholder)
+	_global.coapListener = coapConfig{
+		enabled: viper.GetBool("coap.enabled"),
+		addr:    viper.GetString("coap.addr"),
+		topic:   viper.GetString("coap.topic"),
+	}
+	_Log.Info("config of coap", "enabled", _global.coapListener.enabled, "addr", _global.coapListener.addr, "topic", _global.coapListener.topic)
+
+	viper.SetDefault("modbus.enabled", false)
+	viper.SetDefault("modbus.timeout", "5s")
+	viper.SetDefault("modbus.syncInterval", "30s")
+	viper.SetDefault("modbus.topic", "modbus/"+device.IDPlaceholder)
+	viper.SetDefault("modbus.policy.hosts", []string{})
+	viper.SetDefault("modbus.policy.denyCIDRs", policy.DefaultDenyCIDRs)
+	viper.SetDefault("modbus.policy.ports", []string{})
+	modbusPolicy, err := policy.Parse([]string{"tcp"}, viper.GetStringSlice("modbus.policy.hosts"),
+		viper.GetStringSlice("modbus.policy.denyCIDRs"), viper.GetStringSlice("modbus.policy.ports"))
+	tool.CheckThenPanic(err, "parse modbus policy")
+	_global.modbusPoll = modbusConfig{
+		enabled:      viper.GetBool("modbus.enabled"),
+		timeout:      viper.GetDuration("modbus.timeout"),
+		syncInterval: viper.GetDuration("modbus.syncInterval"),
+		topic:        viper.GetString("modbus.topic"),
+		policy:       modbusPolicy,
+	}
+	if _global.modbusPoll.timeout <= 0 || _global.modbusPoll.syncInterval <= 0 {
+		tool.CheckThenPanic(tool.Invalid("modbus.timeout and modbus.syncInterval must be positive"), "read modbus config")
+	}
+	// pollers are not leased, every instance of a cluster would poll every device
+	if _global.modbusPoll.enabled && _global.cluster.enabled {
+		tool.CheckThenPanic(tool.Invalid("modbus.enabled is not supported along with cluster.enabled"), "read modbus config")
+	}
+	_Log.Info("config of modbus", "enabled", _global.modbusPoll.enabled, "timeout", _global.modbusPoll.timeout,
+		"syncInterval", _global.modbusPoll.syncInterval, "topic", _global.modbusPoll.topic)
+	_Log.Info("config of modbus policy", "hosts", viper.GetStringSlice("modbus.policy.hosts"),
+		"denyCIDRs", viper.GetStringSlice("modbus.policy.denyCIDRs"), "ports", viper.GetStringSlice("modbus.policy.ports"))
+
+	_Log.Info("config of cluster", "enabled", _global.cluster.enabled, "instance", _global.cluster.instance, "leaseTimeout", _global.cluster.leaseTimeout)
+
+	_Log.Info("config of auth", "enabled", _global.auth.enabled, "jwt", _global.auth.jwt.Key != "" || _global.auth.jwt.KeyFile != "" || _global.auth.jwt.JWKSFile != "")
 }
 
+// restore stored subscriptions
 func (_global *global) loadData() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// _, err := _global.pgPool.ExecContext(ctx, `insert into messages (msg) values ($1);`, message)
-	// tool.CheckThenPrint(err, "persistent message")
+	if _global.auth.bootstrapKey != "" {
+		tool.CheckThenLog(_Log, _global.bootstrapAPIKey(ctx, _global.auth.bootstrapKey), "bootstrap api key")
+	}
+	tool.CheckThenLog(_Log, _global.presence.load(ctx), "load device presence")
+	tool.CheckThenLog(_Log, _global.rules.rebuild(ctx), "rebuild rule windows")
+	if _global.leases == nil {
+		// in cluster mode brokers are subscribed by the instance holding their lease
+		tool.CheckThenLog(_Log, _global.loadSubscriptions(ctx), "load subscriptions")
+	}
+}
+
+// background run fn until resources are released
+func background(freeSteps *list.List, run func(ctx context.Context)) {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(done)
+	}()
+	freeSteps.PushBack(func() {
+		stop()
+		<-done
+	})
 }
 
 // init resources
 func (_global *global) initResource() (freeFunc func()) {
-	log.Println("Prepare resources")
+	_Log.Info("prepare resources")
 
 	var err error
 	var freeSteps list.List
 
+	shutdownTracing, err := tracing.Init(_global.trace)
+	tool.CheckThenPanic(err, "init tracing")
+	freeSteps.PushBack(shutdownTracing)
+
 	for i := 0; i < 10; i++ {
 		_global.pgPool, err = sql.Open("postgres", _global.pgConnStr)
 		if err != nil {
-			log.Println("open postgres failure, retry after 3 seconds")
+			_Log.Warn("open postgres failure, retry after 3 seconds", "err", err)
 			time.Sleep(3 * time.Second)
 		} else {
 			break
@@ -106,17 +453,42 @@ func (_global *global) initResource() (freeFunc func()) {
 	tool.CheckThenPanic(err, "open data source")
 	freeSteps.PushBack(func() {
 		if _global.amqpChan != nil {
-			tool.CheckThenPrint(_global.amqpChan.Close(), "close amqp channel")
+			tool.CheckThenLog(_Log, _global.amqpChan.Close(), "close amqp channel")
 		}
 	})
 	_global.pgPool.SetConnMaxLifetime(0)
 	_global.pgPool.SetMaxIdleConns(3)
 	_global.pgPool.SetMaxOpenConns(3)
+	_global.connectors = connector.NewRegistry()
+	_global.devices = newDeviceRegistry(_global.pgPool)
+	_global.presence = newPresenceTracker(_global.pgPool, _global.offlineTimeout, _global.publishEvent)
+	_global.shadows = newShadowService(_global.pgPool, _global.shadow.deltaTopic, _global.shadow.qos, _global.connectors.Publish)
+	_global.presence.onOnline = _global.shadows.online
+	_global.latest = &latestValues{pgPool: _global.pgPool, cache: newLatestCache(_global.latestCacheSize, _global.latestCacheTTL)}
+	_global.rules = newRuleEngine(_global.pgPool, _global.publishEvent)
+	_global.webhooks = newWebhookDispatcher(_global.pgPool, _global.webhook)
+	_global.transforms = newTransformer(_global.pgPool, _global.transformTimeout)
+	_global.schemas = newPayloadValidator(_global.pgPool)
+	_global.decoders = newPayloadDecoder(_global.pgPool)
+	_global.edgeNodes = sparkplug.NewHost()
+	_global.dedup = newDeduplicator(_global.pgPool, _global.deduplication)
+	_global.ingestLimits = newRateLimiter(_global.httpIngest.rate, _global.httpIngest.burst)
+	if _global.modbusPoll.enabled {
+		_global.pollers = newModbusPollers(_global.pgPool, _global.connectors, _global.modbusPoll, _global.processReading)
+	}
+	if _global.cluster.enabled {
+		_global.leases = newBrokerLeases(_global.pgPool, _global.cluster.instance, _global.cluster.leaseTimeout, _global.connectors,
+			_global.subscribe, _global.edgeNodes.Forget)
+	}
+	if _global.mail.smtp.Host != "" {
+		_global.email, err = newEmailNotifier(_global.pgPool, _global.mail)
+		tool.CheckThenPanic(err, "create email notifier")
+	}
 
 	for i := 0; i < 10; i++ {
 		_global.amqpConn, err = amqp.Dial(_global.amqpConnStr)
 		if err != nil {
-			log.Println("open rabbitmq failure, retry after 3 seconds")
+			_Log.Warn("open rabbitmq failure, retry after 3 seconds", "err", err)
 			time.Sleep(3 * time.Second)
 		} else {
 			break
@@ -125,19 +497,55 @@ func (_global *global) initResource() (freeFunc func()) {
 	tool.CheckThenPanic(err, "connect amqp")
 	freeSteps.PushBack(func() {
 		if _global.amqpConn != nil {
-			tool.CheckThenPrint(_global.amqpConn.Close(), "close amqp connection")
+			tool.CheckThenLog(_Log, _global.amqpConn.Close(), "close amqp connection")
 		}
 	})
 	_global.amqpChan, err = _global.amqpConn.Channel()
 	tool.CheckThenPanic(err, "open a channel")
+	_global.confirmed, err = newConfirmedPublisher(_global.amqpConn)
+	tool.CheckThenPanic(err, "open a confirmed channel")
+	freeSteps.PushBack(func() {
+		tool.CheckThenLog(_Log, _global.confirmed.close(), "close confirmed channel")
+	})
 	freeSteps.PushBack(func() {
 		if _global.pgPool != nil {
-			tool.CheckThenPrint(_global.pgPool.Close(), "close data source")
+			tool.CheckThenLog(_Log, _global.pgPool.Close(), "close data source")
 		}
 	})
 
+	tool.CheckThenPanic(_global.declareEvents(), "declare events exchange")
+	// connectors push into the channels, they stop before those close
+	freeSteps.PushBack(_global.connectors.Stop)
+
+	// flushing loops go last, they are released first while the data source and channel are still open
+	_global.usage = newMessageUsage(_global.pgPool)
+	background(&freeSteps, _global.usage.run)
+	_global.keyUsage = newKeyUsage(_global.pgPool)
+	background(&freeSteps, _global.keyUsage.run)
+	background(&freeSteps, _global.presence.run)
+	background(&freeSteps, _global.schemas.run)
+	background(&freeSteps, _global.rules.run)
+	background(&freeSteps, _global.webhooks.run)
+	if _global.email != nil {
+		background(&freeSteps, _global.email.run)
+	}
+	if _global.leases != nil {
+		background(&freeSteps, _global.leases.run)
+	}
+	if _global.pollers != nil {
+		background(&freeSteps, _global.pollers.run)
+	}
+	if _global.coapListener.enabled {
+		_global.coapServer, err = coap.Listen(_global.coapListener.addr, _global.coapRequest)
+		tool.CheckThenPanic(err, "listen coap")
+		_global.shadows.notify = _global.notifyCoap
+		freeSteps.PushBack(func() {
+			tool.CheckThenLog(_Log, _global.coapServer.Close(), "close coap server")
+		})
+	}
+
 	return func() {
-		log.Println("Release resources")
+		_Log.Info("release resources")
 
 		for freeStep := freeSteps.Back(); freeStep != nil; freeStep = freeStep.Prev() {
 			if fc, ok := freeStep.Value.(func()); ok {
@@ -150,8 +558,131 @@ func (_global *global) initResource() (freeFunc func()) {
 // serve server
 func (_global *global) serve() {
 	router := gin.Default()
+	router.Use(errorHandler())
 	router.GET("/ping", ping)
-	router.GET("/connect/mqtt/:broker/:topic", _global.mqttSubscribe)
+	// devices authenticate by their token
+	router.POST("/ingest/:token", _global.ingestTelemetry)
+
+	api := router.Group("", _global.authenticator())
+	read, subscribe, admin := auth.Require(auth.ScopeRead), auth.Require(auth.ScopeSubscribe), auth.Require(auth.ScopeAdmin)
+
+	brokers := api.Group("/brokers")
+	brokers.GET("", read, _global.listBrokers)
+	brokers.POST("", subscribe, _global.createBroker)
+	brokers.GET("/:id", read, _global.getBroker)
+	brokers.PATCH("/:id", subscribe, _global.updateBroker)
+	brokers.DELETE("/:id", subscribe, _global.deleteBroker)
+	brokers.GET("/:id/subscriptions", read, _global.listSubscriptions)
+	brokers.POST("/:id/subscriptions", subscribe, _global.createSubscription)
+	brokers.PATCH("/:id/subscriptions/:sid", subscribe, _global.updateSubscription)
+	brokers.DELETE("/:id/subscriptions/:sid", subscribe, _global.deleteSubscription)
+
+	modbusPollers := api.Group("/modbus-pollers")
+	modbusPollers.GET("", read, _global.listModbusPollers)
+	modbusPollers.POST("", subscribe, _global.createModbusPoller)
+	modbusPollers.GET("/:id", read, _global.getModbusPoller)
+	modbusPollers.PATCH("/:id", subscribe, _global.updateModbusPoller)
+	modbusPollers.DELETE("/:id", subscribe, _global.deleteModbusPoller)
+
+	apiKeys := api.Group("/apikeys", admin)
+	apiKeys.GET("", _global.listAPIKeys)
+	apiKeys.POST("", _global.createAPIKey)
+	apiKeys.DELETE("/:id", _global.revokeAPIKey)
+
+	devices := api.Group("/devices")
+	manage := auth.Require(auth.ScopeDevices)
+	devices.GET("", read, _global.listDevices)
+	devices.POST("", manage, _global.createDevice)
+	devices.GET("/:id", read, _global.getDevice)
+	devices.PATCH("/:id", manage, _global.updateDevice)
+	devices.DELETE("/:id", manage, _global.deleteDevice)
+	devices.POST("/:id/token", manage, _global.rotateDeviceToken)
+	devices.GET("/:id/status", read, _global.getDeviceStatus)
+	devices.GET("/:id/shadow", read, _global.getShadow)
+	devices.PATCH("/:id/shadow", manage, _global.updateShadow)
+	devices.GET("/:id/latest", read, _global.getLatest)
+
+	transforms := api.Group("/transforms")
+	transforms.GET("", read, _global.listTransforms)
+	transforms.POST("", manage, _global.createTransform)
+	transforms.POST("/test", read, _global.testTransform)
+	transforms.GET("/:id", read, _global.getTransform)
+	transforms.PATCH("/:id", manage, _global.updateTransform)
+	transforms.DELETE("/:id", manage, _global.deleteTransform)
+	transforms.GET("/:id/versions", read, _global.listTransformVersions)
+
+	schemas := api.Group("/schemas")
+	schemas.GET("", read, _global.listSchemas)
+	schemas.POST("", manage, _global.createSchema)
+	schemas.GET("/:id", read, _global.getSchema)
+	schemas.PATCH("/:id", manage, _global.updateSchema)
+	schemas.DELETE("/:id", manage, _global.deleteSchema)
+
+	decoders := api.Group("/decoders")
+	decoders.GET("", read, _global.listDecoders)
+	decoders.POST("", manage, _global.createDecoder)
+	decoders.GET("/:id", read, _global.getDecoder)
+	decoders.PATCH("/:id", manage, _global.updateDecoder)
+	decoders.DELETE("/:id", manage, _global.deleteDecoder)
+
+	descriptors := api.Group("/descriptors")
+	descriptors.GET("", read, _global.listDescriptors)
+	descriptors.POST("", manage, _global.createDescriptor)
+	descriptors.GET("/:id", read, _global.getDescriptor)
+	descriptors.DELETE("/:id", manage, _global.deleteDescriptor)
+
+	dedupPolicies := api.Group("/dedup-policies")
+	dedupPolicies.GET("", read, _global.listDedupPolicies)
+	dedupPolicies.POST("", manage, _global.createDedupPolicy)
+	dedupPolicies.GET("/:id", read, _global.getDedupPolicy)
+	dedupPolicies.PATCH("/:id", manage, _global.updateDedupPolicy)
+	dedupPolicies.DELETE("/:id", manage, _global.deleteDedupPolicy)
+
+	quarantine := api.Group("/quarantine")
+	quarantine.GET("", read, _global.listQuarantine)
+	quarantine.GET("/:id", read, _global.getQuarantined)
+	quarantine.DELETE("/:id", manage, _global.deleteQuarantined)
+
+	deviceTypes := api.Group("/device-types")
+	deviceTypes.GET("", read, _global.listDeviceTypes)
+	deviceTypes.PUT("/:type", manage, _global.putDeviceType)
+	deviceTypes.DELETE("/:type", manage, _global.deleteDeviceType)
+
+	templates := api.Group("/templates")
+	templates.GET("", read, _global.listTopicTemplates)
+	templates.POST("", manage, _global.createTopicTemplate)
+	templates.DELETE("/:id", manage, _global.deleteTopicTemplate)
+
+	api.GET("/tenant", read, _global.getOwnTenant)
+	rules := api.Group("/rules")
+	manageRules := auth.Require(auth.ScopeRules)
+	rules.GET("", read, _global.listRules)
+	rules.POST("", manageRules, _global.createRule)
+	rules.GET("/:id", read, _global.getRule)
+	rules.PATCH("/:id", manageRules, _global.updateRule)
+	rules.DELETE("/:id", manageRules, _global.deleteRule)
+	rules.GET("/:id/recipients", read, _global.getRecipients)
+	rules.PUT("/:id/recipients", manageRules, _global.putRecipients)
+
+	alarms := api.Group("/alarms")
+	alarms.GET("", read, _global.listAlarms)
+	alarms.GET("/:id", read, _global.getAlarm)
+	alarms.POST("/:id/ack", manageRules, _global.ackAlarm)
+	alarms.POST("/:id/clear", manageRules, _global.clearAlarm)
+
+	webhooks := api.Group("/webhooks", admin)
+	webhooks.GET("", _global.listWebhooks)
+	webhooks.POST("", _global.createWebhook)
+	webhooks.GET("/:id", _global.getWebhook)
+	webhooks.PATCH("/:id", _global.updateWebhook)
+	webhooks.DELETE("/:id", _global.deleteWebhook)
+	webhooks.GET("/:id/deliveries", _global.listDeliveries)
+
+	tenants := api.Group("/tenants", auth.Require(auth.ScopeTenants))
+	tenants.GET("", _global.listTenants)
+	tenants.POST("", _global.createTenant)
+	tenants.GET("/:id", _global.getTenant)
+	tenants.PATCH("/:id", _global.updateTenant)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", _global.serverPort),
@@ -163,118 +694,292 @@ func (_global *global) serve() {
 
 	err := srv.ListenAndServe()
 	if http.ErrServerClosed != err {
-		log.Fatalf("Server not gracefully shutdown, err :%v\n", err)
+		_Log.Error("server not gracefully shutdown", "err", err)
+		os.Exit(1)
 	}
 
 	<-down
 }
 
+// authenticator of api routes
+func (_global *global) authenticator() gin.HandlerFunc {
+	if !_global.auth.enabled {
+		_Log.Warn("api authentication is disabled")
+		return auth.Anonymous()
+	}
+	verifier, err := auth.NewJWTVerifier(_global.auth.jwt)
+	tool.CheckThenPanic(err, "load jwt keys")
+	return auth.Middleware(pgKeyStore{_global}, verifier)
+}
+
 func ping(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"message": "pong",
 	})
 }
 
-func (_global *global) mqttSubscribe(c *gin.Context) {
-	defer func() {
-		if err := tool.Error(recover()); err != nil {
-			log.Println(err.Error())
-			c.JSON(200, gin.H{
-				"success": false,
-				"message": err.Error(),
-			})
-		}
-	}()
+func gracefullyShutdown(srv *http.Server, down chan struct{}) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	_Log.Info("shutdown server")
 
-	broker, err := base64.StdEncoding.DecodeString(c.Param("broker"))
-	tool.CheckThenPanic(err, "connect mqtt broker")
-	topic, err := base64.StdEncoding.DecodeString(c.Param("topic"))
-	tool.CheckThenPanic(err, "connect mqtt topic")
-	err = mqtt.SubBrokerTopic(string(broker), string(topic), _global.push)
-	tool.CheckThenPanic(err, "subscribe")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		_Log.Error("server shutdown", "err", err)
+		os.Exit(1)
+	}
 
-	c.JSON(200, gin.H{
-		"success": true,
-		"message": "success",
-	})
+	_Log.Info("server gracefully shutdown")
+	close(down)
 }
 
-func (_global *global) mqttUnSubscribe(c *gin.Context) {
+// push message of tenant received on broker brok to message queue, the tenant and trace context travel in the headers;
+// the content type of MQTT 5 messages picks the decoder of binary payloads
+func (_global *global) push(ctx context.Context, tenantID int64, brok string, msg *connector.Message) (err error) {
+	topic, message := msg.Topic, msg.Payload
+	ctx, span := startPush(ctx, tenantID, msg)
 	defer func() {
-		if err := tool.Error(recover()); err != nil {
-			log.Println(err.Error())
-			c.JSON(200, gin.H{
-				"success": false,
-				"message": err.Error(),
-			})
-		}
+		endPush(span, err)
 	}()
 
-	err = mqtt.UnSubBrokerTopic(c.Param("broker"), c.Param("topic"))
-	tool.CheckThenPanic(err, "subscribe")
+	if sparkplug.IsTopic(topic) {
+		return _global.pushSparkplug(ctx, tenantID, brok, topic, message)
+	}
 
-	c.JSON(200, gin.H{
-		"success": true,
-		"message": "success",
-	})
+	ref, err := _global.devices.resolve(ctx, tenantID, topic)
+	if tool.KindOf(err) == tool.KindForbidden {
+		_Log.Debug("drop message of unknown device", "tenant", tenantID, "topic", topic, "err", err)
+		span.SetAttributes(attribute.Bool("device.rejected", true))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ref.id > 0 {
+		_global.shadows.route(ref.id, brok)
+	}
+	return _global.pushDevice(ctx, tenantID, ref, msg)
 }
 
-func gracefullyShutdown(srv *http.Server, down chan struct{}) {
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutdown server ...")
+// startPush span of a message on its way to the queue
+func startPush(ctx context.Context, tenantID int64, msg *connector.Message) (context.Context, trace.Span) {
+	ctx, span := tracing.Tracer().Start(ctx, "amqp publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "rabbitmq"), attribute.String("mqtt.topic", msg.Topic),
+			attribute.Int64("tenant.id", tenantID)))
+	if msg.SubscriptionID > 0 {
+		span.SetAttributes(attribute.Int("mqtt.subscription_id", msg.SubscriptionID))
+	}
+	return ctx, span
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server shutdown: ", err)
+func endPush(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 	}
+	span.End()
+}
 
-	log.Println("Server gracefully shutdown")
-	close(down)
+// pushDevice message of device ref, or of no device when ref is zero: decode it, then drive presence and shadow or ingest it
+func (_global *global) pushDevice(ctx context.Context, tenantID int64, ref deviceRef, msg *connector.Message) error {
+	span := trace.SpanFromContext(ctx)
+	topic, message := msg.Topic, msg.Payload
+	decoded, err := _global.decoders.decode(ctx, tenantID, topic, msg.ContentType, message)
+	if err != nil {
+		// keep the raw bytes for a fixed decoder or descriptor
+		_global.schemas.quarantine(ctx, tenantID, nil, ref, topic, message, []string{err.Error()})
+		span.SetAttributes(attribute.Bool("message.quarantined", true))
+		return nil
+	}
+	message = decoded
+	// status and attributes topics drive presence and shadow, they are not telemetry
+	switch {
+	case ref.kind == device.KindStatus:
+		online, ok := device.ParseStatus([]byte(message))
+		if !ok {
+			_Log.Warn("drop unreadable status message", "tenant", tenantID, "topic", topic)
+			return nil
+		}
+		_global.presence.report(ctx, ref, online, time.Now())
+		return nil
+	case ref.kind == device.KindAttributes:
+		_global.presence.seen(ctx, ref, time.Now())
+		return _global.shadows.report(ctx, ref.id, message)
+	case ref.id > 0:
+		_global.presence.seen(ctx, ref, time.Now())
+	}
+	return _global.ingest(ctx, tenantID, topic, ref, propertiesOf(msg), message)
 }
 
-// push message to message queue
-func (_global *global) push(topic, message string) {
+// ingest telemetry of device ref: transform, validate and publish it along with its properties, if any
+func (_global *global) ingest(ctx context.Context, tenantID int64, topic string, ref deviceRef, props *messageProperties, message string) (err error) {
+	span := trace.SpanFromContext(ctx)
+	for _, m := range _global.transforms.apply(ctx, tenantID, topic, ref, message) {
+		if !_global.schemas.admit(ctx, tenantID, topic, ref, m) {
+			span.SetAttributes(attribute.Bool("message.quarantined", true))
+			continue
+		}
+		if err = _global.publish(ctx, tenantID, ref, topic, props, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish telemetry onto the queue unless it is a duplicate or the daily quota of tenant is exhausted,
+// its idempotency key travels along for the unique key of stored messages
+func (_global *global) publish(ctx context.Context, tenantID int64, ref deviceRef, topic string, props *messageProperties, message string) (err error) {
+	span := trace.SpanFromContext(ctx)
+	key := _global.dedup.key(ctx, tenantID, topic, ref, message, time.Now())
+	if key != "" {
+		if _global.dedup.seen.seen(key, time.Now()) {
+			_global.usage.duplicate(tenantID)
+			span.SetAttributes(attribute.Bool("message.duplicate", true))
+			return nil
+		}
+		defer func() {
+			if err != nil {
+				// not passed on, its redelivery is welcome
+				_global.dedup.seen.release(key)
+			}
+		}()
+	}
+	ok, first, err := _global.usage.allow(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if first {
+			_Log.Warn("daily message quota exceeded, dropping messages until tomorrow", "tenant", tenantID)
+		}
+		span.SetAttributes(attribute.Bool("tenant.quota_exceeded", true))
+		if confirms := confirmsOf(ctx); confirms != nil {
+			confirms.refuse(tool.Forbidden("daily message quota of tenant [%d] exceeded", tenantID))
+		}
+		return nil
+	}
+
 	q, err := _global.amqpChan.QueueDeclare("hello", false, false, false, false, nil)
-	tool.CheckThenPanic(err, "declare a queue")
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "declare a queue")
+	}
 
-	err = _global.amqpChan.Publish("", q.Name, false, false, amqp.Publishing{
+	headers := amqp.Table{tenantHeader: tenantID}
+	if ref.id > 0 {
+		headers[deviceHeader] = ref.id
+		headers[deviceTypeHeader] = ref.deviceType
+	}
+	if props != nil {
+		b, err := json.Marshal(props)
+		if err != nil {
+			return tool.Wrap(tool.KindInternal, err, "encode message properties")
+		}
+		headers[propertiesHeader] = string(b)
+	}
+	if key != "" {
+		headers[dedupKeyHeader] = key
+	}
+	tracing.Inject(ctx, tracing.AMQPHeaders(headers))
+	publishing := amqp.Publishing{
+		Headers:     headers,
 		ContentType: "text/plain",
+		Timestamp:   time.Now(),
 		Body:        []byte(message),
-	})
-	log.Printf(" [x] Sent %s", message)
-	tool.CheckThenPanic(err, "publish a message")
+	}
+	if confirms := confirmsOf(ctx); confirms != nil {
+		var ack <-chan bool
+		if ack, err = _global.confirmed.publish("", q.Name, publishing); err == nil {
+			confirms.add(ack)
+		}
+	} else {
+		err = _global.amqpChan.Publish("", q.Name, false, false, publishing)
+	}
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "publish a message")
+	}
+	logger.Payload(_Log, "message sent", message, "topic", topic, "tenant", tenantID)
+	return nil
 }
 
-// pull and process message
-func (_global *global) pull() {
+// pull and process message in background
+func (_global *global) pull() error {
 	q, err := _global.amqpChan.QueueDeclare("hello", false, false, false, false, nil)
-	tool.CheckThenPanic(err, "declare a queue")
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "declare a queue")
+	}
 
 	msgs, err := _global.amqpChan.Consume(q.Name, "", true, false, false, false, nil)
-	tool.CheckThenPanic(err, "register a consumer")
-
-	forever := make(chan bool)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "register a consumer")
+	}
 
 	go func() {
 		for msg := range msgs {
-			log.Printf("Received a message: %s", msg.Body)
-			go _global.persistentMessage(string(msg.Body))
+			logger.Payload(_Log, "message received", string(msg.Body), "deliveryTag", msg.DeliveryTag)
+			tenantID, ok := msg.Headers[tenantHeader].(int64)
+			if !ok || tenantID <= 0 {
+				_Log.Error("drop message without tenant", "deliveryTag", msg.DeliveryTag)
+				continue
+			}
+			deviceID, _ := msg.Headers[deviceHeader].(int64)
+			deviceType, _ := msg.Headers[deviceTypeHeader].(string)
+			props, _ := msg.Headers[propertiesHeader].(string)
+			key, _ := msg.Headers[dedupKeyHeader].(string)
+			ts := msg.Timestamp
+			if ts.IsZero() {
+				ts = time.Now()
+			}
+			ctx := tracing.Extract(context.Background(), tracing.AMQPHeaders(msg.Headers))
+			go func(body []byte) {
+				if !_global.persistentMessage(ctx, tenantID, deviceID, string(body), props, key, ts) {
+					_global.usage.duplicate(tenantID)
+					return
+				}
+				if deviceID > 0 {
+					_global.rules.evaluate(ctx, tenantID, deviceID, deviceType, body, ts)
+				}
+			}(msg.Body)
 		}
 	}()
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	_Log.Info("waiting for messages")
+	return nil
 }
 
-// persistentMessage persistent message to database
-func (_global *global) persistentMessage(message string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// persistentMessage persistent message of tenant and its device, if any, to database along with its json properties, if any;
+// the fields of a json object message of a device become its latest values unless newer ones are stored and merge into its reported state.
+// fresh is false for a duplicate of a stored message with the same idempotency key
+func (_global *global) persistentMessage(ctx context.Context, tenantID, deviceID int64, message, props, key string, ts time.Time) (fresh bool) {
+	ctx, span := tracing.Tracer().Start(ctx, "persistent message", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("db.system", "postgresql"), attribute.String("db.operation.name", "insert")))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	log.Println("the message -- " + message)
-	_, err := _global.pgPool.ExecContext(ctx, `insert into messages (msg) values ($1);`, message)
-	tool.CheckThenPrint(err, "persistent message")
+	var inserted int
+	err := _global.pgPool.QueryRowContext(ctx, `with m as (insert into messages (tenant_id, device_id, msg, properties, dedup_key, ts)
+		values ($1, $2, $3, $5, $6, $4) on conflict (tenant_id, dedup_key) do nothing returning device_id, msg),
+		l as (insert into latest_values (device_id, key, value, ts)
+		select m.device_id, e.key, e.value, $4 from m, jsonb_each(case jsonb_typeof(m.msg) when 'object' then m.msg else '{}' end) e
+		where m.device_id is not null
+		on conflict (device_id, key) do update set value = excluded.value, ts = excluded.ts where latest_values.ts <= excluded.ts)
+		select count(*) from m;`,
+		tenantID, sql.NullInt64{Int64: deviceID, Valid: deviceID > 0}, message, ts, sql.NullString{String: props, Valid: props != ""},
+		sql.NullString{String: key, Valid: key != ""}).Scan(&inserted)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		tool.CheckThenLog(_Log, err, "persistent message")
+		return true
+	}
+	if inserted == 0 {
+		span.SetAttributes(attribute.Bool("message.duplicate", true))
+		return false
+	}
+	if deviceID > 0 {
+		_global.latest.written(deviceID, message, ts)
+		tool.CheckThenLog(_Log, _global.shadows.report(ctx, deviceID, message), "merge reported state", "device", deviceID)
+	}
+	return true
 }
@@ -1 +1,13 @@
 package main
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDataservice(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dataservice Suite")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"dataservice/tool"
+	"net/http"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// errorHandler map the last error attached by a handler to a status code,
+// so handlers only need to c.Error(err) and return
+func errorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		last := c.Errors.Last()
+		if last == nil || c.Writer.Written() {
+			return
+		}
+
+		status := statusOf(last.Err)
+		if status >= http.StatusInternalServerError {
+			_Log.Error("request failure", "path", c.FullPath(), "status", status, "err", last.Err)
+		} else {
+			_Log.Warn("request failure", "path", c.FullPath(), "status", status, "err", last.Err)
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": last.Err.Error(),
+		})
+	}
+}
+
+// statusOf error kind
+func statusOf(err error) int {
+	switch tool.KindOf(err) {
+	case tool.KindNotFound:
+		return http.StatusNotFound
+	case tool.KindConflict:
+		return http.StatusConflict
+	case tool.KindUnavailable:
+		return http.StatusServiceUnavailable
+	case tool.KindInvalid:
+		return http.StatusBadRequest
+	case tool.KindUnauthorized:
+		return http.StatusUnauthorized
+	case tool.KindForbidden:
+		return http.StatusForbidden
+	case tool.KindRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
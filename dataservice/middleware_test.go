@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"dataservice/tool"
+
+	gin "github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("errorHandler", func() {
+	gin.SetMode(gin.TestMode)
+
+	DescribeTable("maps error kinds to status codes",
+		func(err error, status int) {
+			router := gin.New()
+			router.Use(errorHandler())
+			router.GET("/", func(c *gin.Context) {
+				c.Error(err)
+			})
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			Ω(w.Code).To(Equal(status))
+
+			body := map[string]interface{}{}
+			Ω(json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+			Ω(body).To(HaveKeyWithValue("success", false))
+			Ω(body).To(HaveKeyWithValue("message", err.Error()))
+		},
+		Entry("not found", tool.NotFound("no such broker"), http.StatusNotFound),
+		Entry("conflict", tool.Conflict("already subscribed"), http.StatusConflict),
+		Entry("unavailable", tool.Wrap(tool.KindUnavailable, errors.New("refused"), "connect"), http.StatusServiceUnavailable),
+		Entry("invalid", tool.Invalid("bad base64"), http.StatusBadRequest),
+		Entry("unauthorized", tool.Unauthorized("missing credential"), http.StatusUnauthorized),
+		Entry("forbidden", tool.Forbidden("missing scope"), http.StatusForbidden),
+		Entry("rate limited", tool.RateLimited("too fast"), http.StatusTooManyRequests),
+		Entry("internal", errors.New("boom"), http.StatusInternalServerError),
+	)
+
+	It("should leave written responses alone", func() {
+		router := gin.New()
+		router.Use(errorHandler())
+		router.GET("/", func(c *gin.Context) {
+			c.Error(tool.NotFound("ignored"))
+			c.JSON(http.StatusOK, gin.H{"success": true})
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		Ω(w.Code).To(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/connector/modbus"
+	"dataservice/device"
+	"dataservice/policy"
+	"dataservice/tool"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// modbusConfig of polling modbus tcp servers
+type modbusConfig struct {
+	enabled      bool
+	timeout      time.Duration
+	syncInterval time.Duration
+	topic        string // with device.IDPlaceholder, the topic readings are handled as
+	policy       *policy.Policy
+}
+
+// ModbusPoller register map of a unit of a modbus tcp server, its readings go to the device every interval seconds
+type ModbusPoller struct {
+	ID        int64             `json:"id"`
+	TenantID  int64             `json:"tenantId"`
+	DeviceID  string            `json:"deviceId"`
+	Address   string            `json:"address"`
+	UnitID    uint8             `json:"unitId"`
+	Interval  int               `json:"interval"`
+	Registers []modbus.Register `json:"registers"`
+	Status    *modbus.Status    `json:"status,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// modbusPollerInput body of create and patch
+type modbusPollerInput struct {
+	DeviceID  *string           `json:"deviceId"`
+	Address   *string           `json:"address"`
+	UnitID    *uint8            `json:"unitId"`
+	Interval  *int              `json:"interval"`
+	Registers []modbus.Register `json:"registers"`
+}
+
+func (input *modbusPollerInput) apply(p *ModbusPoller) {
+	if input.DeviceID != nil {
+		p.DeviceID = *input.DeviceID
+	}
+	if input.Address != nil {
+		p.Address = *input.Address
+	}
+	if input.UnitID != nil {
+		p.UnitID = *input.UnitID
+	}
+	if input.Interval != nil {
+		p.Interval = *input.Interval
+	}
+	if input.Registers != nil {
+		p.Registers = input.Registers
+	}
+}
+
+func (p *ModbusPoller) validate() error {
+	if p.DeviceID == "" {
+		return tool.Invalid("deviceId is required")
+	}
+	host, port, err := net.SplitHostPort(p.Address)
+	if err != nil || host == "" || port == "" {
+		return tool.Invalid("address [%s] is not host:port", p.Address)
+	}
+	if p.Interval < 1 || p.Interval > 86400 {
+		return tool.Invalid("interval must be between 1 and 86400 seconds")
+	}
+	return modbus.ValidateMap(p.Registers)
+}
+
+// checkPolicy reject servers the modbus policy refuses, unresolvable hosts are left to poll time, where every dial is checked
+func (p *ModbusPoller) checkPolicy(ctx context.Context, pol *policy.Policy) error {
+	host, port, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "parse address "+p.Address)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "parse port of "+p.Address)
+	}
+	if _, err := pol.Check(ctx, "tcp", host, n); err != nil && tool.KindOf(err) != tool.KindUnavailable {
+		return err
+	}
+	return nil
+}
+
+func (p *ModbusPoller) device() modbus.Device {
+	return modbus.Device{ID: p.ID, Address: p.Address, Unit: p.UnitID, Interval: time.Duration(p.Interval) * time.Second,
+		Registers: p.Registers}
+}
+
+const modbusPollerColumns = `p.id, p.tenant_id, d.device_id, p.address, p.unit_id, p.interval_seconds, p.registers, p.created_at, p.updated_at`
+
+func scanModbusPoller(row rowScanner) (*ModbusPoller, error) {
+	p := &ModbusPoller{}
+	var registers []byte
+	err := row.Scan(&p.ID, &p.TenantID, &p.DeviceID, &p.Address, &p.UnitID, &p.Interval, &registers, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(registers, &p.Registers); err != nil {
+		return nil, tool.Wrap(tool.KindInternal, err, "decode register map")
+	}
+	return p, nil
+}
+
+func queryModbusPollers(ctx context.Context, pgPool *sql.DB, where string, args ...interface{}) ([]*ModbusPoller, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+modbusPollerColumns+` from modbus_pollers p join devices d on d.id = p.device_id `+
+		where+` order by p.id;`, args...)
+	if err != nil {
+		return nil, dbError(err, "query modbus pollers")
+	}
+	defer rows.Close()
+
+	pollers := []*ModbusPoller{}
+	for rows.Next() {
+		p, err := scanModbusPoller(rows)
+		if err != nil {
+			return nil, dbError(err, "scan modbus poller")
+		}
+		pollers = append(pollers, p)
+	}
+	return pollers, dbError(rows.Err(), "query modbus pollers")
+}
+
+func (_global *global) queryModbusPoller(ctx context.Context, tenantID, id int64) (*ModbusPoller, error) {
+	p, err := scanModbusPoller(_global.pgPool.QueryRowContext(ctx, `select `+modbusPollerColumns+`
+		from modbus_pollers p join devices d on d.id = p.device_id where p.tenant_id = $1 and p.id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query modbus poller "+strconv.FormatInt(id, 10))
+	}
+	return p, nil
+}
+
+// modbusPollers apply the stored pollers to connectors of this instance, changes made on other instances
+// are picked up with the next sync
+type modbusPollers struct {
+	sync.Mutex
+	pgPool     *sql.DB
+	connectors *connector.Registry
+	cfg        modbusConfig
+	dial       modbus.DialFunc
+	applied    map[int64]time.Time // updated at of the pollers applied
+	process    func(tenantID int64, deviceID string) connector.Processor
+}
+
+func newModbusPollers(pgPool *sql.DB, connectors *connector.Registry, cfg modbusConfig,
+	process func(tenantID int64, deviceID string) connector.Processor) *modbusPollers {
+	return &modbusPollers{pgPool: pgPool, connectors: connectors, cfg: cfg, dial: cfg.policy.DialContext(&net.Dialer{Timeout: cfg.timeout}),
+		applied: make(map[int64]time.Time), process: process}
+}
+
+// modbusKey of the connector of poller id
+func modbusKey(id int64) string {
+	return "modbus/" + strconv.FormatInt(id, 10)
+}
+
+// sync the connectors with the stored pollers, a changed poller is connected again; nil-safe for instances that do not poll
+func (m *modbusPollers) sync(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	pollers, err := queryModbusPollers(ctx, m.pgPool, "")
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	stored := make(map[int64]bool, len(pollers))
+	for _, p := range pollers {
+		stored[p.ID] = true
+		if at, ok := m.applied[p.ID]; ok && at.Equal(p.UpdatedAt) {
+			continue
+		}
+		m.close(p.ID)
+		d := p.device()
+		open := func(ctx context.Context) (connector.Connector, error) {
+			return modbus.Open(d, m.dial, m.cfg.timeout)
+		}
+		topic := strings.ReplaceAll(m.cfg.topic, device.IDPlaceholder, p.DeviceID)
+		err := m.connectors.Subscribe(context.Background(), modbusKey(p.ID), open, m.process(p.TenantID, p.DeviceID),
+			connector.Subscription{Topic: topic, QoS: 1})
+		if err != nil {
+			_Log.Error("poll modbus device", "poller", p.ID, "err", err)
+			continue
+		}
+		m.applied[p.ID] = p.UpdatedAt
+	}
+	for id := range m.applied {
+		if !stored[id] {
+			m.close(id)
+		}
+	}
+	return nil
+}
+
+// close the connector of poller id
+func (m *modbusPollers) close(id int64) {
+	if err := m.connectors.Close(modbusKey(id)); err != nil && tool.KindOf(err) != tool.KindNotFound {
+		_Log.Error("stop modbus poller", "poller", id, "err", err)
+	}
+	delete(m.applied, id)
+}
+
+// status of poller id, nil when this instance does not poll it
+func (m *modbusPollers) status(id int64) *modbus.Status {
+	if m == nil {
+		return nil
+	}
+	c, ok := m.connectors.Get(modbusKey(id))
+	if !ok {
+		return nil
+	}
+	polled, ok := c.(*modbus.Connector)
+	if !ok {
+		return nil
+	}
+	status := polled.PollStatus()
+	return &status
+}
+
+// run sync every interval until ctx is done, polling stops on the way out
+func (m *modbusPollers) run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		sctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		tool.ErrorThenPrint(m.sync(sctx), "sync modbus pollers")
+		cancel()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			m.Lock()
+			for id := range m.applied {
+				m.close(id)
+			}
+			m.Unlock()
+			return
+		}
+	}
+}
+
+// processReading of the modbus poller of device of tenant into the message pipeline
+func (_global *global) processReading(tenantID int64, deviceID string) connector.Processor {
+	return func(ctx context.Context, msg *connector.Message) (err error) {
+		ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		defer cancel()
+
+		cached, err := _global.devices.lookup(ctx, tenantID, deviceID)
+		if err != nil {
+			return err
+		}
+		if cached.id == 0 {
+			return tool.NotFound("device [%s] is gone", deviceID)
+		}
+		ref := deviceRef{id: cached.id, tenantID: tenantID, deviceID: deviceID, deviceType: cached.deviceType, kind: device.KindTelemetry}
+		ctx, span := startPush(ctx, tenantID, msg)
+		defer func() {
+			endPush(span, err)
+		}()
+		return _global.pushDevice(ctx, tenantID, ref, msg)
+	}
+}
+
+// deviceOf poller, the devices.id of its device id in its tenant
+func (_global *global) deviceOf(ctx context.Context, p *ModbusPoller) (int64, error) {
+	var id int64
+	err := _global.pgPool.QueryRowContext(ctx, `select id from devices where tenant_id = $1 and device_id = $2;`, p.TenantID, p.DeviceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, tool.NotFound("there is no such device [%s]", p.DeviceID)
+	}
+	return id, dbError(err, "look up device")
+}
+
+func (_global *global) listModbusPollers(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	pollers, err := queryModbusPollers(ctx, _global.pgPool, "where p.tenant_id = $1", tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	for _, p := range pollers {
+		p.Status = _global.pollers.status(p.ID)
+	}
+	c.JSON(http.StatusOK, pollers)
+}
+
+func (_global *global) getModbusPoller(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	p, err := _global.queryModbusPoller(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	p.Status = _global.pollers.status(p.ID)
+	c.JSON(http.StatusOK, p)
+}
+
+func (_global *global) createModbusPoller(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input modbusPollerInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	p := &ModbusPoller{TenantID: tenantOf(c), UnitID: 1}
+	input.apply(p)
+	if err := p.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := p.checkPolicy(ctx, _global.modbusPoll.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	deviceID, err := _global.deviceOf(ctx, p)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	registers, err := json.Marshal(p.Registers)
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInvalid, err, "encode register map"))
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `insert into modbus_pollers (tenant_id, device_id, address, unit_id, interval_seconds, registers)
+		values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`,
+		p.TenantID, deviceID, p.Address, p.UnitID, p.Interval, registers).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert modbus poller"))
+		return
+	}
+	tool.CheckThenLog(_Log, _global.pollers.sync(ctx), "sync modbus pollers")
+	p.Status = _global.pollers.status(p.ID)
+	c.JSON(http.StatusCreated, p)
+}
+
+func (_global *global) updateModbusPoller(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input modbusPollerInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	p, err := _global.queryModbusPoller(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(p)
+	if err := p.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := p.checkPolicy(ctx, _global.modbusPoll.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	deviceID, err := _global.deviceOf(ctx, p)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	registers, err := json.Marshal(p.Registers)
+	if err != nil {
+		c.Error(tool.Wrap(tool.KindInvalid, err, "encode register map"))
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update modbus_pollers set device_id = $3, address = $4, unit_id = $5, interval_seconds = $6,
+		registers = $7, updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		p.TenantID, p.ID, deviceID, p.Address, p.UnitID, p.Interval, registers).Scan(&p.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update modbus poller"))
+		return
+	}
+	tool.CheckThenLog(_Log, _global.pollers.sync(ctx), "sync modbus pollers")
+	p.Status = _global.pollers.status(p.ID)
+	c.JSON(http.StatusOK, p)
+}
+
+func (_global *global) deleteModbusPoller(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	res, err := _global.pgPool.ExecContext(ctx, `delete from modbus_pollers where tenant_id = $1 and id = $2;`, tenantOf(c), id)
+	if err != nil {
+		c.Error(dbError(err, "delete modbus poller"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such modbus poller [%d]", id))
+		return
+	}
+	tool.CheckThenLog(_Log, _global.pollers.sync(ctx), "sync modbus pollers")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"dataservice/connector"
+	"dataservice/connector/modbus"
+	"dataservice/policy"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("modbus poller", func() {
+	valid := func() *ModbusPoller {
+		return &ModbusPoller{DeviceID: "pump-1", Address: "10.0.0.7:502", UnitID: 1, Interval: 10,
+			Registers: []modbus.Register{{Name: "rpm"}}}
+	}
+
+	It("should apply input and fill in register defaults", func() {
+		p := valid()
+		address, interval := "plc:1502", 5
+		input := modbusPollerInput{Address: &address, Interval: &interval}
+		input.apply(p)
+		Ω(p.validate()).To(Succeed())
+		Ω(p.Address).To(Equal("plc:1502"))
+		Ω(p.Registers).To(Equal([]modbus.Register{{Name: "rpm", Table: modbus.TableHolding, Type: modbus.TypeUint16, Scale: 1,
+			ByteOrder: modbus.OrderABCD}}), "registers are kept when not in the input")
+
+		d := p.device()
+		Ω(d.Interval).To(Equal(5 * time.Second))
+		Ω(d.Unit).To(Equal(byte(1)))
+	})
+
+	DescribeTable("reject invalid pollers",
+		func(change func(p *ModbusPoller)) {
+			p := valid()
+			change(p)
+			Ω(p.validate()).ToNot(Succeed())
+		},
+		Entry("device", func(p *ModbusPoller) { p.DeviceID = "" }),
+		Entry("address without port", func(p *ModbusPoller) { p.Address = "10.0.0.7" }),
+		Entry("address without host", func(p *ModbusPoller) { p.Address = ":502" }),
+		Entry("interval", func(p *ModbusPoller) { p.Interval = 0 }),
+		Entry("interval beyond a day", func(p *ModbusPoller) { p.Interval = 86401 }),
+		Entry("empty register map", func(p *ModbusPoller) { p.Registers = nil }),
+		Entry("register type", func(p *ModbusPoller) { p.Registers[0].Type = "int8" }),
+	)
+
+	It("should check servers against the modbus policy", func() {
+		p, err := policy.Parse([]string{"tcp"}, nil, []string{"127.0.0.0/8"}, []string{"502"})
+		Ω(err).ToNot(HaveOccurred())
+		ctx := context.Background()
+		Ω(valid().checkPolicy(ctx, p)).To(Succeed())
+		Ω(tool.KindOf((&ModbusPoller{Address: "127.0.0.1:502"}).checkPolicy(ctx, p))).To(Equal(tool.KindForbidden))
+		Ω(tool.KindOf((&ModbusPoller{Address: "10.0.0.7:1502"}).checkPolicy(ctx, p))).To(Equal(tool.KindForbidden))
+		Ω((&ModbusPoller{Address: "plc.invalid:502"}).checkPolicy(ctx, p)).To(Succeed(), "unresolvable hosts are left to poll time")
+	})
+
+	It("should tell the status of pollers by their connectors", func() {
+		connectors := connector.NewRegistry()
+		defer connectors.Stop()
+		m := newModbusPollers(nil, connectors, modbusConfig{timeout: time.Second}, nil)
+		open := func(ctx context.Context) (connector.Connector, error) {
+			return modbus.Open(modbus.Device{ID: 3, Address: "plc.invalid:502", Interval: time.Hour, Registers: []modbus.Register{{Name: "rpm"}}},
+				nil, time.Second)
+		}
+		Ω(m.status(3)).To(BeNil())
+		Ω(connectors.Subscribe(context.Background(), modbusKey(3), open, func(ctx context.Context, msg *connector.Message) error {
+			return nil
+		}, connector.Subscription{Topic: "modbus/pump-1"})).To(Succeed())
+		Ω(m.status(3)).ToNot(BeNil())
+		Ω(m.status(4)).To(BeNil())
+	})
+
+	It("should have no status without polling", func() {
+		var m *modbusPollers
+		Ω(m.status(1)).To(BeNil())
+		Ω(m.sync(nil)).To(Succeed())
+	})
+})
@@ -0,0 +1,131 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"dataservice/tool"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP server mails are sent through
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string // empty for no authentication
+	Password string
+	From     string
+	StartTLS bool // require upgrading the connection before authenticating
+	Timeout  time.Duration
+	// TLSConfig of STARTTLS, the certificate is verified against Host unless it names another server
+	TLSConfig *tls.Config
+}
+
+// ParseAddresses of recipients, bare addresses are returned
+func ParseAddresses(addresses []string) ([]string, error) {
+	parsed := make([]string, 0, len(addresses))
+	for _, s := range addresses {
+		addr, err := mail.ParseAddress(strings.TrimSpace(s))
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse address "+s)
+		}
+		parsed = append(parsed, addr.Address)
+	}
+	return parsed, nil
+}
+
+// Compose a plain text mail
+func Compose(from string, to []string, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", from)
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		buf.WriteString(line + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// Send mail to recipients
+func (s *SMTP) Send(to []string, subject, body string) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	conn, err := net.DialTimeout("tcp", addr, s.Timeout)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "dial smtp server "+addr)
+	}
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return tool.Wrap(tool.KindUnavailable, err, "greet smtp server "+addr)
+	}
+	defer c.Close()
+
+	if err := s.send(c, to, Compose(s.From, to, subject, body, time.Now())); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, fmt.Sprintf("send mail through %s", addr))
+	}
+	return c.Quit()
+}
+
+func (s *SMTP) send(c *smtp.Client, to []string, msg []byte) error {
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if s.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not offer STARTTLS")
+		}
+		config := &tls.Config{}
+		if s.TLSConfig != nil {
+			config = s.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = s.Host
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,179 @@
+package notify_test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"dataservice/notify"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// received mail by the stand-in
+type received struct {
+	auth     string
+	from     string
+	to       []string
+	data     string
+	startTLS bool
+}
+
+// standIn smtp server speaking just enough of the protocol for net/smtp
+type standIn struct {
+	ln    net.Listener
+	tls   *tls.Config // offered through STARTTLS when set
+	mails chan received
+}
+
+func newStandIn(tlsConfig *tls.Config) *standIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).ToNot(HaveOccurred())
+	s := &standIn{ln: ln, tls: tlsConfig, mails: make(chan received, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standIn) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *standIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var m received
+	tp.PrintfLine("220 stand-in")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if s.tls != nil && !m.startTLS {
+				tp.PrintfLine("250-stand-in\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-stand-in\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, m.startTLS = tlsConn, true
+			tp = textproto.NewConn(tlsConn)
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			m.auth = string(creds)
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			m.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = append(m.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, _ := io.ReadAll(tp.DotReader())
+			m.data = string(data)
+			tp.PrintfLine("250 queued")
+			s.mails <- m
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown")
+		}
+	}
+}
+
+var _ = Describe("smtp", func() {
+	It("should parse recipients", func() {
+		addresses, err := notify.ParseAddresses([]string{"ops@example.com", " Ops <night@example.com>"})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(addresses).To(Equal([]string{"ops@example.com", "night@example.com"}))
+
+		_, err = notify.ParseAddresses([]string{"not an address"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should compose plain text mails", func() {
+		msg := string(notify.Compose("alarms@example.com", []string{"a@example.com", "b@example.com"}, "température\nhigh", "line 1\nline 2",
+			time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Ω(msg).To(ContainSubstring("To: a@example.com, b@example.com\r\n"))
+		Ω(msg).To(ContainSubstring("Subject: =?utf-8?q?temp=C3=A9rature_high?=\r\n"))
+		Ω(msg).To(ContainSubstring("Date: Thu, 01 Jan 2026 00:00:00 +0000\r\n"))
+		Ω(msg).To(HaveSuffix("\r\n\r\nline 1\r\nline 2\r\n"))
+	})
+
+	It("should send with authentication", func() {
+		server := newStandIn(nil)
+		defer server.ln.Close()
+
+		s := &notify.SMTP{Host: "127.0.0.1", Port: server.port(), Username: "user", Password: "pass", From: "Alarms <alarms@example.com>", Timeout: time.Second}
+		Ω(s.Send([]string{"ops@example.com"}, "overheat", "pump-1 is hot")).To(Succeed())
+
+		var m received
+		Eventually(server.mails).Should(Receive(&m))
+		Ω(m.auth).To(Equal("\x00user\x00pass"))
+		Ω(m.from).To(Equal("alarms@example.com"))
+		Ω(m.to).To(Equal([]string{"ops@example.com"}))
+		Ω(m.data).To(ContainSubstring("Subject: overheat\n"))
+		Ω(m.data).To(ContainSubstring("pump-1 is hot"))
+		Ω(m.startTLS).To(BeFalse())
+	})
+
+	It("should upgrade with STARTTLS", func() {
+		ts := httptest.NewTLSServer(http.NotFoundHandler())
+		defer ts.Close()
+		server := newStandIn(ts.TLS)
+		defer server.ln.Close()
+
+		s := &notify.SMTP{Host: "127.0.0.1", Port: server.port(), Username: "user", Password: "pass", From: "alarms@example.com",
+			StartTLS: true, Timeout: time.Second, TLSConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig}
+		Ω(s.Send([]string{"ops@example.com"}, "overheat", "pump-1 is hot")).To(Succeed())
+
+		var m received
+		Eventually(server.mails).Should(Receive(&m))
+		Ω(m.startTLS).To(BeTrue())
+		Ω(m.auth).To(Equal("\x00user\x00pass"))
+	})
+
+	It("should refuse to send in the clear when STARTTLS is required", func() {
+		server := newStandIn(nil)
+		defer server.ln.Close()
+
+		s := &notify.SMTP{Host: "127.0.0.1", Port: server.port(), From: "alarms@example.com", StartTLS: true, Timeout: time.Second}
+		err := s.Send([]string{"ops@example.com"}, "overheat", "pump-1 is hot")
+		Ω(tool.KindOf(err)).To(Equal(tool.KindUnavailable))
+		Ω(err.Error()).To(ContainSubstring("STARTTLS"))
+		Consistently(server.mails, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should fail when the server is down", func() {
+		server := newStandIn(nil)
+		port := server.port()
+		server.ln.Close()
+
+		s := &notify.SMTP{Host: "127.0.0.1", Port: port, From: "alarms@example.com", Timeout: time.Second}
+		Ω(tool.KindOf(s.Send([]string{"ops@example.com"}, "x", "y"))).To(Equal(tool.KindUnavailable))
+	})
+})
@@ -0,0 +1,222 @@
+package policy
+
+import (
+	"context"
+	"dataservice/logger"
+	"dataservice/tool"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PortRange inclusive range of ports
+type PortRange struct {
+	From, To int
+}
+
+// Policy of the hosts the service may dial on behalf of tenants, nil allows everything
+type Policy struct {
+	Schemes   []string
+	Hosts     []string // patterns as of path.Match, empty allows any host
+	DenyCIDRs []*net.IPNet
+	Ports     []PortRange // empty allows any port
+	// Resolve host names, nil for the default resolver
+	Resolve func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// DefaultDenyCIDRs unspecified, loopback, link-local, private, carrier-grade nat and unique local ranges
+var DefaultDenyCIDRs = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10"}
+
+var _Audit = logger.Component("audit")
+
+// Parse policy from config values, ports are "1883" or "8000-9000"
+func Parse(schemes, hosts, denyCIDRs, ports []string) (*Policy, error) {
+	p := &Policy{}
+	for _, scheme := range schemes {
+		p.Schemes = append(p.Schemes, strings.ToLower(scheme))
+	}
+	for _, host := range hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse host pattern "+host)
+		}
+		p.Hosts = append(p.Hosts, strings.ToLower(host))
+	}
+	for _, cidr := range denyCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse cidr "+cidr)
+		}
+		p.DenyCIDRs = append(p.DenyCIDRs, ipNet)
+	}
+	for _, port := range ports {
+		r, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		p.Ports = append(p.Ports, r)
+	}
+	return p, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return PortRange{}, tool.Wrap(tool.KindInvalid, err, "parse port range "+s)
+	}
+	t, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return PortRange{}, tool.Wrap(tool.KindInvalid, err, "parse port range "+s)
+	}
+	if f < 1 || t > 65535 || f > t {
+		return PortRange{}, tool.Invalid("port range [%s] out of bounds", s)
+	}
+	return PortRange{From: f, To: t}, nil
+}
+
+// Check scheme, host and port, then resolve host: every address it resolves to must be allowed; unresolvable
+// hosts are unavailable rather than forbidden. A nil policy resolves nothing.
+func (p *Policy) Check(ctx context.Context, scheme, host string, port int) ([]net.IP, error) {
+	if p == nil {
+		return nil, nil
+	}
+	ips, err := p.check(ctx, strings.ToLower(scheme), strings.ToLower(host), port)
+	if err != nil && tool.KindOf(err) == tool.KindForbidden {
+		_Audit.Warn("dial rejected by policy", "event", "dial.rejected", "scheme", scheme, "host", host, "port", port,
+			"reason", err.Error())
+	}
+	return ips, err
+}
+
+func (p *Policy) check(ctx context.Context, scheme, host string, port int) ([]net.IP, error) {
+	if !p.allowScheme(scheme) {
+		return nil, tool.Forbidden("scheme [%s] is not allowed", scheme)
+	}
+	if !p.allowHost(host) {
+		return nil, tool.Forbidden("host [%s] is not allowed", host)
+	}
+	if !p.allowPort(port) {
+		return nil, tool.Forbidden("port [%d] is not allowed", port)
+	}
+
+	resolve := p.Resolve
+	if resolve == nil {
+		resolve = lookupIP
+	}
+	ips, err := resolve(ctx, host)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindUnavailable, err, "resolve host "+host)
+	}
+	if len(ips) == 0 {
+		return nil, tool.Unavailable("host [%s] has no address", host)
+	}
+	for _, ip := range ips {
+		if p.denied(ip) {
+			return nil, tool.Forbidden("address [%s] of host [%s] is denied", ip, host)
+		}
+	}
+	return ips, nil
+}
+
+// DialContext of d checking the host and port of every address it dials and the address each connection
+// actually goes to, so a host resolving elsewhere at dial time is refused too; schemes are up to the caller
+func (p *Policy) DialContext(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if p == nil {
+		return d.DialContext
+	}
+	dialer := *d
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return tool.Wrap(tool.KindInvalid, err, "parse dialed address")
+		}
+		if ip := net.ParseIP(host); ip == nil || p.denied(ip) {
+			_Audit.Warn("dial rejected by policy", "event", "dial.rejected", "address", address)
+			return tool.Forbidden("address [%s] is denied", host)
+		}
+		return nil
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse address "+address)
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, tool.Wrap(tool.KindInvalid, err, "parse port of "+address)
+		}
+		if !p.allowHost(strings.ToLower(host)) || !p.allowPort(n) {
+			_Audit.Warn("dial rejected by policy", "event", "dial.rejected", "address", address)
+			return nil, tool.Forbidden("address [%s] is not allowed", address)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+func (p *Policy) denied(ip net.IP) bool {
+	for _, deny := range p.DenyCIDRs {
+		if deny.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowScheme tell whether scheme may be dialed
+func (p *Policy) AllowScheme(scheme string) bool {
+	return p == nil || p.allowScheme(strings.ToLower(scheme))
+}
+
+func (p *Policy) allowScheme(scheme string) bool {
+	for _, s := range p.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowHost(host string) bool {
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowPort(port int) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, r := range p.Ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
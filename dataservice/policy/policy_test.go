@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"context"
+	"dataservice/tool"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("policy", func() {
+	var policy *Policy
+
+	BeforeEach(func() {
+		var err error
+		policy, err = Parse([]string{"tcp", "HTTPS"}, []string{"*.example.com", "localhost"},
+			[]string{"127.0.0.0/8", "10.0.0.0/8", "::1/128"}, []string{"443", "8000-8999"})
+		Ω(err).ToNot(HaveOccurred())
+		policy.Resolve = func(ctx context.Context, host string) ([]net.IP, error) {
+			switch host {
+			case "hook.example.com":
+				return []net.IP{net.ParseIP("203.0.113.7")}, nil
+			case "internal.example.com":
+				return []net.IP{net.ParseIP("203.0.113.8"), net.ParseIP("10.1.2.3")}, nil
+			}
+			return nil, errors.New("no such host")
+		}
+	})
+
+	DescribeTable("check",
+		func(scheme, host string, port int, kind tool.Kind, allowed bool) {
+			ips, err := policy.Check(context.Background(), scheme, host, port)
+			if allowed {
+				Ω(err).ToNot(HaveOccurred())
+				Ω(ips).ToNot(BeEmpty())
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(kind), "%v", err)
+			}
+		},
+		Entry("allowed", "https", "hook.example.com", 443, tool.KindInternal, true),
+		Entry("case of scheme", "HTTPS", "hook.example.com", 8080, tool.KindInternal, true),
+		Entry("scheme", "http", "hook.example.com", 443, tool.KindForbidden, false),
+		Entry("host", "https", "evil.com", 443, tool.KindForbidden, false),
+		Entry("port", "https", "hook.example.com", 22, tool.KindForbidden, false),
+		Entry("any denied address", "https", "internal.example.com", 443, tool.KindForbidden, false),
+		Entry("unresolvable", "https", "gone.example.com", 443, tool.KindUnavailable, false),
+	)
+
+	It("should allow everything without policy", func() {
+		var p *Policy
+		_, err := p.Check(context.Background(), "http", "localhost", 80)
+		Ω(err).ToNot(HaveOccurred())
+	})
+
+	It("should refuse dials to denied addresses whatever the host resolves to", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ToNot(HaveOccurred())
+		defer l.Close()
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		policy.Ports = nil
+
+		dial := policy.DialContext(&net.Dialer{Timeout: time.Second})
+		_, err = dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden), "%v", err)
+		_, err = dial(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden), "host is not allowed")
+
+		policy.DenyCIDRs = nil
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		Ω(err).ToNot(HaveOccurred())
+		conn.Close()
+	})
+
+	It("should refuse dials to ports out of the policy", func() {
+		dial := policy.DialContext(&net.Dialer{Timeout: time.Second})
+		_, err := dial(context.Background(), "tcp", "hook.example.com:22")
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden))
+	})
+
+	It("should reject malformed config", func() {
+		_, err := Parse(nil, nil, []string{"10.0.0.0"}, nil)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = Parse(nil, nil, nil, []string{"9000-8000"})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = Parse(nil, []string{"[a-"}, nil, nil)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+})
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/tool"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// presenceInterval of last seen flushes and offline sweeps
+const presenceInterval = 10 * time.Second
+
+// reasons of status transitions
+const (
+	reasonMessage = "message" // a message of the device arrived
+	reasonStatus  = "status"  // the device or its last will published a status
+	reasonTimeout = "timeout" // nothing arrived within the offline timeout of its type
+)
+
+// DeviceStatus of a device as derived from its messages and status topics
+type DeviceStatus struct {
+	ID              int64      `json:"id"`
+	DeviceID        string     `json:"deviceId"`
+	Online          bool       `json:"online"`
+	LastSeenAt      *time.Time `json:"lastSeenAt"`
+	StatusChangedAt *time.Time `json:"statusChangedAt"`
+	OfflineTimeout  int64      `json:"offlineTimeout"` // seconds
+}
+
+// DeviceEvent status transition published onto the events exchange
+type DeviceEvent struct {
+	Type       string     `json:"type"`
+	TenantID   int64      `json:"tenantId"`
+	ID         int64      `json:"id"`
+	DeviceID   string     `json:"deviceId"`
+	DeviceType string     `json:"deviceType"`
+	Reason     string     `json:"reason"`
+	LastSeenAt *time.Time `json:"lastSeenAt"`
+	At         time.Time  `json:"at"`
+}
+
+// DeviceType offline timeout of devices of a type
+type DeviceType struct {
+	Type           string `json:"type"`
+	OfflineTimeout int64  `json:"offlineTimeout"` // seconds
+}
+
+type deviceTypeKey struct {
+	tenantID   int64
+	deviceType string
+}
+
+type presenceState struct {
+	ref       deviceRef
+	lastSeen  time.Time
+	online    bool
+	changedAt time.Time
+	dirty     bool
+}
+
+// presenceTracker keep last seen and online state of devices in memory, flushed periodically
+type presenceTracker struct {
+	sync.Mutex
+	pgPool         *sql.DB
+	defaultTimeout time.Duration
+	timeouts       map[deviceTypeKey]time.Duration
+	devices        map[int64]*presenceState
+	publish        func(ctx context.Context, routingKey string, event interface{}) error
+	onOnline       func(ctx context.Context, ref deviceRef) // optional, called on every transition to online
+}
+
+func newPresenceTracker(pgPool *sql.DB, defaultTimeout time.Duration,
+	publish func(ctx context.Context, routingKey string, event interface{}) error) *presenceTracker {
+	return &presenceTracker{
+		pgPool:         pgPool,
+		defaultTimeout: defaultTimeout,
+		timeouts:       make(map[deviceTypeKey]time.Duration),
+		devices:        make(map[int64]*presenceState),
+		publish:        publish,
+	}
+}
+
+// timeout of a device type, caller holds the lock
+func (p *presenceTracker) timeout(tenantID int64, deviceType string) time.Duration {
+	if d, ok := p.timeouts[deviceTypeKey{tenantID, deviceType}]; ok {
+		return d
+	}
+	return p.defaultTimeout
+}
+
+// state of device, created on first sight, caller holds the lock
+func (p *presenceTracker) state(ref deviceRef) *presenceState {
+	s := p.devices[ref.id]
+	if s == nil {
+		s = &presenceState{}
+		p.devices[ref.id] = s
+	}
+	s.ref = ref
+	return s
+}
+
+// transition state and describe it as event, caller holds the lock
+func (s *presenceState) transition(online bool, reason string, at time.Time) *DeviceEvent {
+	s.online, s.changedAt, s.dirty = online, at, true
+	event := &DeviceEvent{
+		Type:       "device.offline",
+		TenantID:   s.ref.tenantID,
+		ID:         s.ref.id,
+		DeviceID:   s.ref.deviceID,
+		DeviceType: s.ref.deviceType,
+		Reason:     reason,
+		At:         at,
+	}
+	if online {
+		event.Type = "device.online"
+	}
+	if !s.lastSeen.IsZero() {
+		lastSeen := s.lastSeen
+		event.LastSeenAt = &lastSeen
+	}
+	return event
+}
+
+// seen a message of device at
+func (p *presenceTracker) seen(ctx context.Context, ref deviceRef, at time.Time) {
+	p.emit(ctx, p.mark(ref, true, reasonMessage, at))
+}
+
+// report status of device published on a status topic, offline is usually its last will
+func (p *presenceTracker) report(ctx context.Context, ref deviceRef, online bool, at time.Time) {
+	p.emit(ctx, p.mark(ref, online, reasonStatus, at))
+}
+
+func (p *presenceTracker) mark(ref deviceRef, online bool, reason string, at time.Time) *DeviceEvent {
+	p.Lock()
+	defer p.Unlock()
+
+	s := p.state(ref)
+	if online {
+		if at.After(s.lastSeen) {
+			s.lastSeen, s.dirty = at, true
+		}
+		if !s.online {
+			return s.transition(true, reason, at)
+		}
+		return nil
+	}
+	if s.online {
+		return s.transition(false, reason, at)
+	}
+	return nil
+}
+
+// sweep devices silent for longer than the timeout of their type
+func (p *presenceTracker) sweep(ctx context.Context, now time.Time) {
+	var events []*DeviceEvent
+	p.Lock()
+	for _, s := range p.devices {
+		if s.online && now.Sub(s.lastSeen) > p.timeout(s.ref.tenantID, s.ref.deviceType) {
+			events = append(events, s.transition(false, reasonTimeout, now))
+		}
+	}
+	p.Unlock()
+
+	for _, event := range events {
+		p.emit(ctx, event)
+	}
+}
+
+func (p *presenceTracker) emit(ctx context.Context, event *DeviceEvent) {
+	if event == nil {
+		return
+	}
+	_Log.Info("device status changed", "tenant", event.TenantID, "device", event.DeviceID, "event", event.Type, "reason", event.Reason)
+	if p.publish != nil {
+		tool.CheckThenLog(_Log, p.publish(ctx, event.Type, event), "publish device event", "device", event.DeviceID)
+	}
+	if event.Type == "device.online" && p.onOnline != nil {
+		p.onOnline(ctx, deviceRef{id: event.ID, tenantID: event.TenantID, deviceID: event.DeviceID, deviceType: event.DeviceType})
+	}
+}
+
+// forget device, it is deleted
+func (p *presenceTracker) forget(id int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.devices, id)
+}
+
+// typeTimeout of device type
+func (p *presenceTracker) typeTimeout(tenantID int64, deviceType string) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.timeout(tenantID, deviceType)
+}
+
+// setTimeout of device type, zero restores the default
+func (p *presenceTracker) setTimeout(tenantID int64, deviceType string, timeout time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	if timeout > 0 {
+		p.timeouts[deviceTypeKey{tenantID, deviceType}] = timeout
+	} else {
+		delete(p.timeouts, deviceTypeKey{tenantID, deviceType})
+	}
+}
+
+// status of device in memory, ok is false when it was not seen since start
+func (p *presenceTracker) status(id int64) (s presenceState, timeout time.Duration, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	state := p.devices[id]
+	if state == nil {
+		return s, 0, false
+	}
+	return *state, p.timeout(state.ref.tenantID, state.ref.deviceType), true
+}
+
+// load devices online as of the last flush so they time out, and the timeouts of types
+func (p *presenceTracker) load(ctx context.Context) error {
+	if err := p.loadTimeouts(ctx); err != nil {
+		return err
+	}
+	rows, err := p.pgPool.QueryContext(ctx, `select id, tenant_id, device_id, type, last_seen_at, status_changed_at from devices
+		where online and last_seen_at is not null;`)
+	if err != nil {
+		return dbError(err, "query online devices")
+	}
+	defer rows.Close()
+
+	p.Lock()
+	defer p.Unlock()
+	for rows.Next() {
+		s := &presenceState{online: true}
+		var changedAt sql.NullTime
+		if err := rows.Scan(&s.ref.id, &s.ref.tenantID, &s.ref.deviceID, &s.ref.deviceType, &s.lastSeen, &changedAt); err != nil {
+			return dbError(err, "scan online device")
+		}
+		s.changedAt = changedAt.Time
+		p.devices[s.ref.id] = s
+	}
+	return dbError(rows.Err(), "query online devices")
+}
+
+func (p *presenceTracker) loadTimeouts(ctx context.Context) error {
+	rows, err := p.pgPool.QueryContext(ctx, `select tenant_id, type, offline_timeout from device_types;`)
+	if err != nil {
+		return dbError(err, "query device types")
+	}
+	defer rows.Close()
+
+	timeouts := make(map[deviceTypeKey]time.Duration)
+	for rows.Next() {
+		var key deviceTypeKey
+		var seconds int64
+		if err := rows.Scan(&key.tenantID, &key.deviceType, &seconds); err != nil {
+			return dbError(err, "scan device type")
+		}
+		timeouts[key] = time.Duration(seconds) * time.Second
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err, "query device types")
+	}
+
+	p.Lock()
+	p.timeouts = timeouts
+	p.Unlock()
+	return nil
+}
+
+// flush changed states, offline devices are dropped from memory once written
+func (p *presenceTracker) flush(ctx context.Context) error {
+	var dirty []presenceState
+	p.Lock()
+	for id, s := range p.devices {
+		if s.dirty {
+			dirty = append(dirty, *s)
+			s.dirty = false
+		} else if !s.online {
+			delete(p.devices, id)
+		}
+	}
+	p.Unlock()
+
+	for i, s := range dirty {
+		var lastSeen, changedAt sql.NullTime
+		lastSeen.Time, lastSeen.Valid = s.lastSeen, !s.lastSeen.IsZero()
+		changedAt.Time, changedAt.Valid = s.changedAt, !s.changedAt.IsZero()
+		_, err := p.pgPool.ExecContext(ctx, `update devices set last_seen_at = greatest(last_seen_at, $2), online = $3,
+			status_changed_at = coalesce($4, status_changed_at) where id = $1;`, s.ref.id, lastSeen, s.online, changedAt)
+		if err != nil {
+			// written again with the next flush
+			p.Lock()
+			for _, s := range dirty[i:] {
+				if state := p.devices[s.ref.id]; state != nil {
+					state.dirty = true
+				}
+			}
+			p.Unlock()
+			return dbError(err, "flush device presence")
+		}
+	}
+	return p.loadTimeouts(ctx)
+}
+
+// run sweep and flush periodically until ctx is done, with a last flush on the way out
+func (p *presenceTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			p.sweep(ctx, now)
+			fctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.ErrorThenPrint(p.flush(fctx), "flush device presence")
+			cancel()
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			tool.ErrorThenPrint(p.flush(fctx), "flush device presence")
+			cancel()
+			return
+		}
+	}
+}
+
+func (_global *global) getDeviceStatus(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	status := &DeviceStatus{ID: d.ID, DeviceID: d.DeviceID}
+	var lastSeen, changedAt sql.NullTime
+	err = _global.pgPool.QueryRowContext(ctx, `select online, last_seen_at, status_changed_at from devices where id = $1;`, d.ID).
+		Scan(&status.Online, &lastSeen, &changedAt)
+	if err != nil {
+		c.Error(dbError(err, "query device status"))
+		return
+	}
+	if lastSeen.Valid {
+		status.LastSeenAt = &lastSeen.Time
+	}
+	if changedAt.Valid {
+		status.StatusChangedAt = &changedAt.Time
+	}
+
+	// memory is ahead of the database until the next flush
+	var timeout time.Duration
+	if s, t, ok := _global.presence.status(d.ID); ok {
+		status.Online, timeout = s.online, t
+		if !s.lastSeen.IsZero() {
+			status.LastSeenAt = &s.lastSeen
+		}
+		if !s.changedAt.IsZero() {
+			status.StatusChangedAt = &s.changedAt
+		}
+	} else {
+		timeout = _global.presence.typeTimeout(d.TenantID, d.Type)
+	}
+	status.OfflineTimeout = int64(timeout / time.Second)
+	c.JSON(http.StatusOK, status)
+}
+
+func (_global *global) listDeviceTypes(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select type, offline_timeout from device_types where tenant_id = $1 order by type;`, tenantOf(c))
+	if err != nil {
+		c.Error(dbError(err, "query device types"))
+		return
+	}
+	defer rows.Close()
+
+	types := []*DeviceType{}
+	for rows.Next() {
+		t := &DeviceType{}
+		if err := rows.Scan(&t.Type, &t.OfflineTimeout); err != nil {
+			c.Error(dbError(err, "scan device type"))
+			return
+		}
+		types = append(types, t)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query device types"))
+		return
+	}
+	c.JSON(http.StatusOK, types)
+}
+
+// putDeviceType set the offline timeout of a type
+func (_global *global) putDeviceType(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	t := &DeviceType{}
+	if err := bindInput(c, t); err != nil {
+		c.Error(err)
+		return
+	}
+	t.Type = strings.TrimSpace(c.Param("type"))
+	if t.OfflineTimeout <= 0 {
+		c.Error(tool.Invalid("offlineTimeout must be a positive number of seconds"))
+		return
+	}
+	tenantID := tenantOf(c)
+	_, err := _global.pgPool.ExecContext(ctx, `insert into device_types (tenant_id, type, offline_timeout) values ($1, $2, $3)
+		on conflict (tenant_id, type) do update set offline_timeout = excluded.offline_timeout;`, tenantID, t.Type, t.OfflineTimeout)
+	if err != nil {
+		c.Error(dbError(err, "put device type"))
+		return
+	}
+	_global.presence.setTimeout(tenantID, t.Type, time.Duration(t.OfflineTimeout)*time.Second)
+	c.JSON(http.StatusOK, t)
+}
+
+func (_global *global) deleteDeviceType(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	tenantID, deviceType := tenantOf(c), strings.TrimSpace(c.Param("type"))
+	res, err := _global.pgPool.ExecContext(ctx, `delete from device_types where tenant_id = $1 and type = $2;`, tenantID, deviceType)
+	if err != nil {
+		c.Error(dbError(err, "delete device type"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such device type [%s]", deviceType))
+		return
+	}
+	_global.presence.setTimeout(tenantID, deviceType, 0)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("presence", func() {
+	var p *presenceTracker
+	var events []*DeviceEvent
+	ctx := context.Background()
+	pump := deviceRef{id: 7, tenantID: 1, deviceID: "pump-1", deviceType: "pump"}
+	meter := deviceRef{id: 8, tenantID: 1, deviceID: "meter-1", deviceType: "meter"}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		events = nil
+		p = newPresenceTracker(nil, 5*time.Minute, func(ctx context.Context, routingKey string, event interface{}) error {
+			Ω(routingKey).To(Equal(event.(*DeviceEvent).Type))
+			events = append(events, event.(*DeviceEvent))
+			return nil
+		})
+		p.setTimeout(1, "meter", time.Hour)
+	})
+
+	It("should go online on the first message only", func() {
+		p.seen(ctx, pump, start)
+		p.seen(ctx, pump, start.Add(time.Second))
+
+		Ω(events).To(HaveLen(1))
+		Ω(events[0].Type).To(Equal("device.online"))
+		Ω(events[0].Reason).To(Equal(reasonMessage))
+		s, timeout, ok := p.status(pump.id)
+		Ω(ok).To(BeTrue())
+		Ω(s.online).To(BeTrue())
+		Ω(s.lastSeen).To(Equal(start.Add(time.Second)))
+		Ω(timeout).To(Equal(5 * time.Minute))
+	})
+
+	It("should go offline after the timeout of the device type", func() {
+		p.seen(ctx, pump, start)
+		p.seen(ctx, meter, start)
+
+		p.sweep(ctx, start.Add(4*time.Minute))
+		Ω(events).To(HaveLen(2))
+		p.sweep(ctx, start.Add(6*time.Minute))
+		Ω(events).To(HaveLen(3))
+		Ω(events[2].Type).To(Equal("device.offline"))
+		Ω(events[2].DeviceID).To(Equal("pump-1"))
+		Ω(events[2].Reason).To(Equal(reasonTimeout))
+		Ω(*events[2].LastSeenAt).To(Equal(start))
+
+		p.sweep(ctx, start.Add(2*time.Hour))
+		Ω(events).To(HaveLen(4))
+		Ω(events[3].DeviceID).To(Equal("meter-1"))
+	})
+
+	It("should go offline on a last will and back online with the next message", func() {
+		p.seen(ctx, pump, start)
+		p.report(ctx, pump, false, start.Add(time.Second))
+		p.report(ctx, pump, false, start.Add(2*time.Second))
+		p.seen(ctx, pump, start.Add(3*time.Second))
+
+		Ω(events).To(HaveLen(3))
+		Ω(events[1].Type).To(Equal("device.offline"))
+		Ω(events[1].Reason).To(Equal(reasonStatus))
+		Ω(events[2].Type).To(Equal("device.online"))
+	})
+
+	It("should not report a last will of a device never seen", func() {
+		p.report(ctx, pump, false, start)
+		Ω(events).To(BeEmpty())
+	})
+})
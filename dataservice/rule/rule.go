@@ -0,0 +1,115 @@
+package rule
+
+import (
+	"dataservice/tool"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparison operators of conditions
+var ops = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+var conditionPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*(>=|<=|==|!=|>|<)\s*(\S+)\s*$`)
+
+// Condition on a numeric field of telemetry, like temperature > 80
+type Condition struct {
+	Key       string
+	Op        string
+	Threshold float64
+}
+
+// ParseCondition of the form "<key> <op> <number>"
+func ParseCondition(s string) (Condition, error) {
+	m := conditionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Condition{}, tool.Invalid("condition [%s] is not like \"temperature > 80\"", s)
+	}
+	threshold, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return Condition{}, tool.Wrap(tool.KindInvalid, err, "parse threshold of condition "+s)
+	}
+	return Condition{Key: m[1], Op: m[2], Threshold: threshold}, nil
+}
+
+// Holds report whether v meets the condition
+func (c Condition) Holds(v float64) bool {
+	return ops[c.Op](v, c.Threshold)
+}
+
+func (c Condition) String() string {
+	return c.Key + " " + c.Op + " " + strconv.FormatFloat(c.Threshold, 'g', -1, 64)
+}
+
+// Value of key in a json object message, nested keys are separated by dots,
+// ok is false when it is absent or not a number
+func Value(message []byte, key string) (v float64, ok bool) {
+	var doc interface{}
+	if json.Unmarshal(message, &doc) != nil {
+		return 0, false
+	}
+	for _, part := range strings.Split(key, ".") {
+		obj, isObj := doc.(map[string]interface{})
+		if !isObj {
+			return 0, false
+		}
+		if doc, ok = obj[part]; !ok {
+			return 0, false
+		}
+	}
+	v, ok = doc.(float64)
+	return
+}
+
+// Transition of a window
+type Transition int
+
+// transitions
+const (
+	None Transition = iota
+	Raise
+	Clear
+)
+
+// Window state of a rule on one device, the condition must hold for For before the alarm is raised
+type Window struct {
+	For    time.Duration
+	Active bool
+
+	since time.Time // start of the current run of values meeting the condition
+	last  time.Time
+}
+
+// Observe whether the value at ts meets the condition, older values than the last one are ignored
+func (w *Window) Observe(holds bool, ts time.Time) Transition {
+	if ts.Before(w.last) {
+		return None
+	}
+	w.last = ts
+
+	if !holds {
+		w.since = time.Time{}
+		if w.Active {
+			w.Active = false
+			return Clear
+		}
+		return None
+	}
+	if w.since.IsZero() {
+		w.since = ts
+	}
+	if !w.Active && ts.Sub(w.since) >= w.For {
+		w.Active = true
+		return Raise
+	}
+	return None
+}
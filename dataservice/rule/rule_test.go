@@ -0,0 +1,97 @@
+package rule_test
+
+import (
+	"time"
+
+	"dataservice/rule"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("condition", func() {
+	DescribeTable("parse",
+		func(s string, c rule.Condition, valid bool) {
+			parsed, err := rule.ParseCondition(s)
+			if valid {
+				Ω(err).ToNot(HaveOccurred())
+				Ω(parsed).To(Equal(c))
+			} else {
+				Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+			}
+		},
+		Entry("greater", "temperature > 80", rule.Condition{Key: "temperature", Op: ">", Threshold: 80}, true),
+		Entry("no spaces", "battery<=3.3", rule.Condition{Key: "battery", Op: "<=", Threshold: 3.3}, true),
+		Entry("nested key", "power.phase-1 != 0", rule.Condition{Key: "power.phase-1", Op: "!=", Threshold: 0}, true),
+		Entry("negative", "t < -10", rule.Condition{Key: "t", Op: "<", Threshold: -10}, true),
+		Entry("no operator", "temperature 80", rule.Condition{}, false),
+		Entry("no number", "temperature > hot", rule.Condition{}, false),
+		Entry("empty", "", rule.Condition{}, false),
+	)
+
+	It("should compare values", func() {
+		c, err := rule.ParseCondition("temperature >= 80")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(c.Holds(80)).To(BeTrue())
+		Ω(c.Holds(79.9)).To(BeFalse())
+		Ω(c.String()).To(Equal("temperature >= 80"))
+	})
+
+	DescribeTable("value",
+		func(message, key string, v float64, ok bool) {
+			got, found := rule.Value([]byte(message), key)
+			Ω(found).To(Equal(ok))
+			Ω(got).To(Equal(v))
+		},
+		Entry("top level", `{"temperature": 81.5}`, "temperature", 81.5, true),
+		Entry("nested", `{"power": {"l1": 3}}`, "power.l1", 3.0, true),
+		Entry("absent", `{"humidity": 40}`, "temperature", 0.0, false),
+		Entry("not a number", `{"temperature": "hot"}`, "temperature", 0.0, false),
+		Entry("not an object", `[1, 2]`, "temperature", 0.0, false),
+		Entry("not json", `hello`, "temperature", 0.0, false),
+	)
+})
+
+var _ = Describe("window", func() {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	It("should raise once the condition held for the duration and clear when it stops", func() {
+		w := &rule.Window{For: 5 * time.Minute}
+		Ω(w.Observe(true, at(0))).To(Equal(rule.None))
+		Ω(w.Observe(true, at(4*time.Minute))).To(Equal(rule.None))
+		Ω(w.Observe(true, at(5*time.Minute))).To(Equal(rule.Raise))
+		Ω(w.Observe(true, at(6*time.Minute))).To(Equal(rule.None))
+		Ω(w.Active).To(BeTrue())
+		Ω(w.Observe(false, at(7*time.Minute))).To(Equal(rule.Clear))
+		Ω(w.Observe(false, at(8*time.Minute))).To(Equal(rule.None))
+	})
+
+	It("should start over when the condition breaks", func() {
+		w := &rule.Window{For: 5 * time.Minute}
+		w.Observe(true, at(0))
+		w.Observe(false, at(3*time.Minute))
+		Ω(w.Observe(true, at(6*time.Minute))).To(Equal(rule.None))
+		Ω(w.Observe(true, at(11*time.Minute))).To(Equal(rule.Raise))
+	})
+
+	It("should raise at once without duration", func() {
+		w := &rule.Window{}
+		Ω(w.Observe(true, at(0))).To(Equal(rule.Raise))
+	})
+
+	It("should ignore values older than the last one", func() {
+		w := &rule.Window{For: time.Minute}
+		w.Observe(true, at(0))
+		Ω(w.Observe(false, at(-time.Second))).To(Equal(rule.None))
+		Ω(w.Observe(true, at(time.Minute))).To(Equal(rule.Raise))
+	})
+
+	It("should clear an alarm restored as active", func() {
+		w := &rule.Window{For: time.Minute, Active: true}
+		Ω(w.Observe(true, at(0))).To(Equal(rule.None))
+		Ω(w.Observe(false, at(time.Second))).To(Equal(rule.Clear))
+	})
+})
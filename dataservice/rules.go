@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/rule"
+	"dataservice/tool"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// rulesRefresh how often rules and alarms changed by other instances are picked up
+const rulesRefresh = 30 * time.Second
+
+// replayLimit bound the messages replayed per rule on start
+const replayLimit = 100000
+
+// severities of alarms
+var severities = map[string]bool{"critical": true, "major": true, "minor": true, "warning": true, "info": true}
+
+// Rule raising an alarm when its condition holds on a device for a duration
+type Rule struct {
+	ID         int64     `json:"id"`
+	TenantID   int64     `json:"tenantId"`
+	Name       string    `json:"name"`
+	Condition  string    `json:"condition"`
+	Duration   int64     `json:"duration"`   // seconds
+	DeviceType string    `json:"deviceType"` // empty for devices of any type
+	Severity   string    `json:"severity"`
+	Enabled    bool      `json:"enabled"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+
+	cond rule.Condition
+}
+
+// ruleInput body of create and patch
+type ruleInput struct {
+	Name       *string `json:"name"`
+	Condition  *string `json:"condition"`
+	Duration   *int64  `json:"duration"`
+	DeviceType *string `json:"deviceType"`
+	Severity   *string `json:"severity"`
+	Enabled    *bool   `json:"enabled"`
+}
+
+func (input *ruleInput) apply(r *Rule) {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+	set(&r.Name, input.Name)
+	set(&r.Condition, input.Condition)
+	set(&r.DeviceType, input.DeviceType)
+	set(&r.Severity, input.Severity)
+	if input.Duration != nil {
+		r.Duration = *input.Duration
+	}
+	if input.Enabled != nil {
+		r.Enabled = *input.Enabled
+	}
+}
+
+// validate rule fields and parse its condition
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if r.Duration < 0 {
+		return tool.Invalid("duration must not be negative")
+	}
+	if r.Severity == "" {
+		r.Severity = "major"
+	}
+	if !severities[r.Severity] {
+		return tool.Invalid("unknown severity [%s]", r.Severity)
+	}
+	cond, err := rule.ParseCondition(r.Condition)
+	if err != nil {
+		return err
+	}
+	r.cond = cond
+	return nil
+}
+
+func (r *Rule) duration() time.Duration {
+	return time.Duration(r.Duration) * time.Second
+}
+
+// applies to devices of deviceType
+func (r *Rule) applies(deviceType string) bool {
+	return r.DeviceType == "" || r.DeviceType == deviceType
+}
+
+const ruleColumns = `id, tenant_id, name, condition, duration, device_type, severity, enabled, created_at, updated_at`
+
+func scanRule(row rowScanner) (*Rule, error) {
+	r := &Rule{}
+	err := row.Scan(&r.ID, &r.TenantID, &r.Name, &r.Condition, &r.Duration, &r.DeviceType, &r.Severity, &r.Enabled, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+func queryRules(ctx context.Context, pgPool *sql.DB, query string, args ...interface{}) ([]*Rule, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+ruleColumns+` from rules `+query, args...)
+	if err != nil {
+		return nil, dbError(err, "query rules")
+	}
+	defer rows.Close()
+
+	rules := []*Rule{}
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return nil, dbError(err, "scan rule")
+		}
+		rules = append(rules, r)
+	}
+	return rules, dbError(rows.Err(), "query rules")
+}
+
+type windowKey struct {
+	ruleID, deviceID int64
+}
+
+// transition of a rule on a device, to be persisted as alarm
+type transition struct {
+	rule     *Rule
+	deviceID int64
+	value    float64
+	at       time.Time
+	kind     rule.Transition
+}
+
+// ruleEngine evaluate enabled rules on telemetry, windows are held in memory per rule and device
+type ruleEngine struct {
+	sync.Mutex
+	pgPool   *sql.DB
+	rules    map[int64]*Rule   // by id
+	byTenant map[int64][]*Rule // enabled rules
+	windows  map[windowKey]*rule.Window
+	publish  func(ctx context.Context, routingKey string, event interface{}) error
+}
+
+func newRuleEngine(pgPool *sql.DB, publish func(ctx context.Context, routingKey string, event interface{}) error) *ruleEngine {
+	return &ruleEngine{
+		pgPool:   pgPool,
+		rules:    make(map[int64]*Rule),
+		byTenant: make(map[int64][]*Rule),
+		windows:  make(map[windowKey]*rule.Window),
+		publish:  publish,
+	}
+}
+
+// install rules, windows of changed or removed rules are dropped
+func (e *ruleEngine) install(rules []*Rule) {
+	e.Lock()
+	defer e.Unlock()
+
+	next, byTenant := make(map[int64]*Rule, len(rules)), make(map[int64][]*Rule)
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		if err := r.validate(); err != nil {
+			_Log.Warn("skip broken rule", "rule", r.ID, "err", err)
+			continue
+		}
+		next[r.ID] = r
+		byTenant[r.TenantID] = append(byTenant[r.TenantID], r)
+	}
+	for key := range e.windows {
+		old, now := e.rules[key.ruleID], next[key.ruleID]
+		if now == nil || old == nil || !old.UpdatedAt.Equal(now.UpdatedAt) {
+			delete(e.windows, key)
+		}
+	}
+	e.rules, e.byTenant = next, byTenant
+}
+
+// reload rules of every tenant
+func (e *ruleEngine) reload(ctx context.Context) error {
+	rules, err := queryRules(ctx, e.pgPool, `where enabled;`)
+	if err != nil {
+		return err
+	}
+	e.install(rules)
+	return nil
+}
+
+// observe value of rule on device, caller holds the lock
+func (e *ruleEngine) observe(r *Rule, deviceID int64, v float64, at time.Time) *transition {
+	key := windowKey{r.ID, deviceID}
+	w := e.windows[key]
+	if w == nil {
+		w = &rule.Window{For: r.duration()}
+		e.windows[key] = w
+	}
+	kind := w.Observe(r.cond.Holds(v), at)
+	if kind == rule.None {
+		return nil
+	}
+	return &transition{rule: r, deviceID: deviceID, value: v, at: at, kind: kind}
+}
+
+// match message of device against the rules of its tenant
+func (e *ruleEngine) match(tenantID, deviceID int64, deviceType string, message []byte, at time.Time) (transitions []*transition) {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, r := range e.byTenant[tenantID] {
+		if !r.applies(deviceType) {
+			continue
+		}
+		if v, ok := rule.Value(message, r.cond.Key); ok {
+			if t := e.observe(r, deviceID, v, at); t != nil {
+				transitions = append(transitions, t)
+			}
+		}
+	}
+	return
+}
+
+// evaluate message of device and persist the alarms it raises or clears
+func (e *ruleEngine) evaluate(ctx context.Context, tenantID, deviceID int64, deviceType string, message []byte, at time.Time) {
+	transitions := e.match(tenantID, deviceID, deviceType, message, at)
+	if len(transitions) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	for _, t := range transitions {
+		tool.CheckThenLog(_Log, e.persist(ctx, t), "persist alarm", "rule", t.rule.ID, "device", t.deviceID)
+	}
+}
+
+// reset window of rule on device, so an alarm cleared by hand is raised only after the full duration again
+func (e *ruleEngine) reset(ruleID, deviceID int64) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.windows, windowKey{ruleID, deviceID})
+}
+
+// rebuild windows from open alarms and the recent messages of every rule
+func (e *ruleEngine) rebuild(ctx context.Context) error {
+	if err := e.reload(ctx); err != nil {
+		return err
+	}
+	open, err := e.openAlarms(ctx)
+	if err != nil {
+		return err
+	}
+	e.settle(open)
+
+	e.Lock()
+	rules := make([]*Rule, 0, len(e.rules))
+	for _, r := range e.rules {
+		rules = append(rules, r)
+	}
+	e.Unlock()
+
+	for _, r := range rules {
+		if err := e.replay(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openAlarms raised by rules and not cleared yet
+func (e *ruleEngine) openAlarms(ctx context.Context) (map[windowKey]bool, error) {
+	rows, err := e.pgPool.QueryContext(ctx, `select rule_id, device_id from alarms where status <> 'cleared' and rule_id is not null;`)
+	if err != nil {
+		return nil, dbError(err, "query open alarms")
+	}
+	defer rows.Close()
+
+	open := make(map[windowKey]bool)
+	for rows.Next() {
+		var key windowKey
+		if err := rows.Scan(&key.ruleID, &key.deviceID); err != nil {
+			return nil, dbError(err, "scan open alarm")
+		}
+		open[key] = true
+	}
+	return open, dbError(rows.Err(), "query open alarms")
+}
+
+// settle windows on the open alarms shared by all instances: the window of an open alarm is active, so a reading
+// clears it here even when another instance raised it, and an active window whose alarm was cleared elsewhere starts over
+func (e *ruleEngine) settle(open map[windowKey]bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	for key, w := range e.windows {
+		if w.Active && !open[key] {
+			delete(e.windows, key)
+		}
+	}
+	for key := range open {
+		r := e.rules[key.ruleID]
+		if r == nil {
+			continue
+		}
+		if w := e.windows[key]; w != nil {
+			w.Active = true
+		} else {
+			e.windows[key] = &rule.Window{For: r.duration(), Active: true}
+		}
+	}
+}
+
+// refresh rules and open alarms changed by other instances
+func (e *ruleEngine) refresh(ctx context.Context) error {
+	if err := e.reload(ctx); err != nil {
+		return err
+	}
+	open, err := e.openAlarms(ctx)
+	if err != nil {
+		return err
+	}
+	e.settle(open)
+	return nil
+}
+
+// replay messages of the last two durations of rule, at least a minute; past the limit the newest ones count
+func (e *ruleEngine) replay(ctx context.Context, r *Rule) error {
+	window := 2 * r.duration()
+	if window < time.Minute {
+		window = time.Minute
+	}
+	rows, err := e.pgPool.QueryContext(ctx, `select m.device_id, m.msg, m.ts from messages m join devices d on d.id = m.device_id
+		where m.tenant_id = $1 and ($2 = '' or d.type = $2) and m.ts > now() - $3::bigint * interval '1 second'
+		order by m.ts desc limit $4;`, r.TenantID, r.DeviceType, int64(window/time.Second), replayLimit)
+	if err != nil {
+		return dbError(err, "replay messages of rule")
+	}
+	defer rows.Close()
+
+	type replayed struct {
+		deviceID int64
+		message  []byte
+		at       time.Time
+	}
+	var messages []replayed
+	for rows.Next() {
+		var m replayed
+		if err := rows.Scan(&m.deviceID, &m.message, &m.at); err != nil {
+			return dbError(err, "scan replayed message")
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err, "replay messages of rule")
+	}
+
+	// newest first from the query, oldest first into the windows
+	var transitions []*transition
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if v, ok := rule.Value(m.message, r.cond.Key); ok {
+			e.Lock()
+			t := e.observe(r, m.deviceID, v, m.at)
+			e.Unlock()
+			if t != nil {
+				transitions = append(transitions, t)
+			}
+		}
+	}
+	for _, t := range transitions {
+		tool.CheckThenLog(_Log, e.persist(ctx, t), "persist alarm", "rule", t.rule.ID, "device", t.deviceID)
+	}
+	return nil
+}
+
+// run refresh rules and open alarms periodically until ctx is done
+func (e *ruleEngine) run(ctx context.Context) {
+	ticker := time.NewTicker(rulesRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.CheckThenLog(_Log, e.refresh(rctx), "refresh rules")
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (_global *global) queryRule(ctx context.Context, tenantID, id int64) (*Rule, error) {
+	r, err := scanRule(_global.pgPool.QueryRowContext(ctx, `select `+ruleColumns+` from rules where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query rule")
+	}
+	return r, nil
+}
+
+// reloadRules after a change through the api, a failure is left to the periodic refresh
+func (_global *global) reloadRules(ctx context.Context) {
+	tool.CheckThenLog(_Log, _global.rules.reload(ctx), "reload rules")
+}
+
+func (_global *global) listRules(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	rules, err := queryRules(ctx, _global.pgPool, `where tenant_id = $1 order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func (_global *global) getRule(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	r, err := _global.queryRule(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func (_global *global) createRule(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input ruleInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	r := &Rule{TenantID: tenantOf(c), Enabled: true}
+	input.apply(r)
+	if err := r.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into rules (tenant_id, name, condition, duration, device_type, severity, enabled)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id, created_at, updated_at;`,
+		r.TenantID, r.Name, r.Condition, r.Duration, r.DeviceType, r.Severity, r.Enabled).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert rule"))
+		return
+	}
+	_global.reloadRules(ctx)
+	c.JSON(http.StatusCreated, r)
+}
+
+func (_global *global) updateRule(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input ruleInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	r, err := _global.queryRule(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(r)
+	if err := r.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update rules set name = $3, condition = $4, duration = $5, device_type = $6, severity = $7,
+		enabled = $8, updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		r.TenantID, r.ID, r.Name, r.Condition, r.Duration, r.DeviceType, r.Severity, r.Enabled).Scan(&r.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update rule"))
+		return
+	}
+	_global.reloadRules(ctx)
+	c.JSON(http.StatusOK, r)
+}
+
+// deleteRule clear its open alarms, they are kept as history
+func (_global *global) deleteRule(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	err = _global.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `update alarms set status = 'cleared', cleared_at = now()
+			where tenant_id = $1 and rule_id = $2 and status <> 'cleared';`, tenantID, id)
+		if err != nil {
+			return dbError(err, "clear alarms of rule")
+		}
+		res, err := tx.ExecContext(ctx, `delete from rules where tenant_id = $1 and id = $2;`, tenantID, id)
+		if err != nil {
+			return dbError(err, "delete rule")
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return tool.NotFound("there is no such rule [%d]", id)
+		}
+		return nil
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	_global.reloadRules(ctx)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"dataservice/rule"
+	"dataservice/tool"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rules", func() {
+	var e *ruleEngine
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	hot := &Rule{ID: 1, TenantID: 1, Name: "hot", Condition: "temperature > 80", Duration: 300, DeviceType: "pump", Enabled: true, UpdatedAt: start}
+	low := &Rule{ID: 2, TenantID: 1, Name: "low", Condition: "battery < 3.3", Enabled: true, UpdatedAt: start}
+	other := &Rule{ID: 3, TenantID: 2, Name: "other", Condition: "temperature > 0", Enabled: true, UpdatedAt: start}
+
+	copyOf := func(r *Rule) *Rule { c := *r; return &c }
+
+	BeforeEach(func() {
+		e = newRuleEngine(nil, nil)
+		e.install([]*Rule{copyOf(hot), copyOf(low), copyOf(other)})
+	})
+
+	It("should validate rules", func() {
+		r := &Rule{Name: "hot", Condition: "temperature > 80"}
+		Ω(r.validate()).To(Succeed())
+		Ω(r.Severity).To(Equal("major"))
+		Ω(r.cond).To(Equal(rule.Condition{Key: "temperature", Op: ">", Threshold: 80}))
+
+		Ω(tool.KindOf((&Rule{Condition: "t > 1"}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&Rule{Name: "x", Condition: "t > 1", Duration: -1}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&Rule{Name: "x", Condition: "t > 1", Severity: "fatal"}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&Rule{Name: "x", Condition: "t is 1"}).validate())).To(Equal(tool.KindInvalid))
+	})
+
+	It("should raise once the condition held for the duration on devices of the type", func() {
+		Ω(e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(0))).To(BeEmpty())
+		Ω(e.match(1, 7, "pump", []byte(`{"temperature": 85}`), at(4*time.Minute))).To(BeEmpty())
+		ts := e.match(1, 7, "pump", []byte(`{"temperature": 90}`), at(5*time.Minute))
+		Ω(ts).To(HaveLen(1))
+		Ω(ts[0].rule.ID).To(Equal(int64(1)))
+		Ω(ts[0].kind).To(Equal(rule.Raise))
+		Ω(ts[0].value).To(Equal(90.0))
+
+		Ω(e.match(1, 8, "meter", []byte(`{"temperature": 90}`), at(0))).To(BeEmpty())
+		Ω(e.match(1, 8, "meter", []byte(`{"temperature": 90}`), at(time.Hour))).To(BeEmpty())
+
+		ts = e.match(1, 7, "pump", []byte(`{"temperature": 70}`), at(6*time.Minute))
+		Ω(ts).To(HaveLen(1))
+		Ω(ts[0].kind).To(Equal(rule.Clear))
+	})
+
+	It("should raise at once without duration and keep tenants apart", func() {
+		ts := e.match(1, 8, "meter", []byte(`{"battery": 3.1, "temperature": 90}`), at(0))
+		Ω(ts).To(HaveLen(1))
+		Ω(ts[0].rule.ID).To(Equal(int64(2)))
+
+		ts = e.match(2, 9, "", []byte(`{"temperature": 1}`), at(0))
+		Ω(ts).To(HaveLen(1))
+		Ω(ts[0].rule.ID).To(Equal(int64(3)))
+	})
+
+	It("should drop windows of changed rules only", func() {
+		e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(0))
+		e.match(1, 8, "meter", []byte(`{"battery": 3.1}`), at(0))
+		Ω(e.windows).To(HaveLen(2))
+
+		changed := copyOf(hot)
+		changed.UpdatedAt = at(time.Minute)
+		e.install([]*Rule{changed, copyOf(low)})
+		Ω(e.windows).To(HaveLen(1))
+		Ω(e.windows).To(HaveKey(windowKey{2, 8}))
+
+		disabled := copyOf(low)
+		disabled.Enabled = false
+		e.install([]*Rule{disabled})
+		Ω(e.windows).To(BeEmpty())
+		Ω(e.match(1, 8, "meter", []byte(`{"battery": 3.1}`), at(time.Minute))).To(BeEmpty())
+	})
+
+	It("should need the full duration again after a reset", func() {
+		e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(0))
+		Ω(e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(5*time.Minute))).To(HaveLen(1))
+		e.reset(1, 7)
+		Ω(e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(6*time.Minute))).To(BeEmpty())
+		Ω(e.match(1, 7, "pump", []byte(`{"temperature": 81}`), at(11*time.Minute))).To(HaveLen(1))
+	})
+
+	It("should settle windows on the open alarms of every instance", func() {
+		e.settle(map[windowKey]bool{{1, 7}: true, {9, 7}: true})
+		ts := e.match(1, 7, "pump", []byte(`{"temperature": 70}`), at(0))
+		Ω(ts).To(HaveLen(1), "an alarm raised elsewhere is cleared here")
+		Ω(ts[0].kind).To(Equal(rule.Clear))
+		Ω(e.windows).NotTo(HaveKey(windowKey{9, 7}), "alarms of unknown rules are skipped")
+
+		e.match(1, 8, "pump", []byte(`{"temperature": 81}`), at(0))
+		Ω(e.match(1, 8, "pump", []byte(`{"temperature": 81}`), at(5*time.Minute))).To(HaveLen(1))
+		e.settle(map[windowKey]bool{})
+		Ω(e.match(1, 8, "pump", []byte(`{"temperature": 81}`), at(6*time.Minute))).To(BeEmpty(), "an alarm cleared elsewhere needs the full duration again")
+		Ω(e.match(1, 8, "pump", []byte(`{"temperature": 81}`), at(11*time.Minute))).To(HaveLen(1))
+	})
+})
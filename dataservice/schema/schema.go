@@ -0,0 +1,88 @@
+package schema
+
+import (
+	"bytes"
+	"dataservice/tool"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// maxErrors reported of one message
+const maxErrors = 20
+
+// Schema compiled json schema
+type Schema struct {
+	compiled *jsonschema.Schema
+}
+
+// Compile json schema document, references are resolved within the document only
+func Compile(doc []byte) (*Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, errors.New("external references are not allowed: " + s)
+	}
+	if err := c.AddResource("schema.json", bytes.NewReader(doc)); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "read schema")
+	}
+	compiled, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "compile schema")
+	}
+	return &Schema{compiled: compiled}, nil
+}
+
+// Validate json payload, violations are like "/temperature: expected number, but got string",
+// err is set when the payload is not json
+func (s *Schema) Validate(payload []byte) (violations []string, err error) {
+	doc, err := Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	err = s.compiled.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return nil, err
+	}
+	var leaves func(ve *jsonschema.ValidationError)
+	leaves = func(ve *jsonschema.ValidationError) {
+		if len(violations) >= maxErrors {
+			return
+		}
+		if len(ve.Causes) == 0 {
+			location := ve.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			violations = append(violations, location+": "+ve.Message)
+		}
+		for _, cause := range ve.Causes {
+			leaves(cause)
+		}
+	}
+	leaves(ve)
+	return violations, nil
+}
+
+// Decode json payload as the validator reads it
+func Decode(payload []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "payload is not json")
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, tool.Invalid("payload is not json: trailing data")
+	}
+	return doc, nil
+}
+
+// Join violations into one line
+func Join(violations []string) string {
+	return strings.Join(violations, "; ")
+}
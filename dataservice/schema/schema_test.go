@@ -0,0 +1,70 @@
+package schema_test
+
+import (
+	"dataservice/schema"
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("schema", func() {
+	doc := `{
+		"type": "object",
+		"required": ["temperature"],
+		"properties": {
+			"temperature": {"type": "number", "minimum": -50, "maximum": 150},
+			"unit": {"enum": ["C", "F"]}
+		}
+	}`
+
+	It("should accept valid payloads", func() {
+		s, err := schema.Compile([]byte(doc))
+		Ω(err).ToNot(HaveOccurred())
+		violations, err := s.Validate([]byte(`{"temperature": 21.5, "unit": "C"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(violations).To(BeEmpty())
+	})
+
+	It("should report every violation with its location", func() {
+		s, err := schema.Compile([]byte(doc))
+		Ω(err).ToNot(HaveOccurred())
+		violations, err := s.Validate([]byte(`{"temperature": 200, "unit": "K"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(violations).To(HaveLen(2))
+		Ω(schema.Join(violations)).To(ContainSubstring("/temperature: must be <= 150"))
+		Ω(schema.Join(violations)).To(ContainSubstring("/unit: "))
+
+		violations, err = s.Validate([]byte(`{"unit": "C"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(violations).To(Equal([]string{"/: missing properties: 'temperature'"}))
+	})
+
+	It("should tell payloads which are not json", func() {
+		s, err := schema.Compile([]byte(doc))
+		Ω(err).ToNot(HaveOccurred())
+		_, err = s.Validate([]byte(`temperature=20`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = s.Validate([]byte(`{} {}`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should reject broken schemas and external references", func() {
+		_, err := schema.Compile([]byte(`{"type": 1}`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = schema.Compile([]byte(`not json`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = schema.Compile([]byte(`{"$ref": "file:///etc/passwd"}`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		_, err = schema.Compile([]byte(`{"$ref": "https://example.com/schema.json"}`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should resolve references within the document", func() {
+		s, err := schema.Compile([]byte(`{"$defs": {"t": {"type": "number"}}, "properties": {"a": {"$ref": "#/$defs/t"}}}`))
+		Ω(err).ToNot(HaveOccurred())
+		violations, err := s.Validate([]byte(`{"a": "x"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(violations).To(HaveLen(1))
+	})
+})
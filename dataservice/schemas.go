@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/schema"
+	"dataservice/tool"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Schema json schema telemetry of matching topics and device types must satisfy
+type Schema struct {
+	ID          int64           `json:"id"`
+	TenantID    int64           `json:"tenantId"`
+	Name        string          `json:"name"`
+	TopicFilter string          `json:"topicFilter"` // empty for any topic
+	DeviceType  string          `json:"deviceType"`  // empty for any device or none
+	Schema      json.RawMessage `json:"schema"`
+	Enabled     bool            `json:"enabled"`
+	Validated   int64           `json:"validated"` // messages checked, as flushed so far
+	Rejected    int64           `json:"rejected"`  // messages quarantined, as flushed so far
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+
+	compiled *schema.Schema
+}
+
+// schemaInput body of create and patch
+type schemaInput struct {
+	Name        *string          `json:"name"`
+	TopicFilter *string          `json:"topicFilter"`
+	DeviceType  *string          `json:"deviceType"`
+	Schema      *json.RawMessage `json:"schema"`
+	Enabled     *bool            `json:"enabled"`
+}
+
+func (input *schemaInput) apply(s *Schema) {
+	if input.Name != nil {
+		s.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.TopicFilter != nil {
+		s.TopicFilter = strings.TrimSpace(*input.TopicFilter)
+	}
+	if input.DeviceType != nil {
+		s.DeviceType = strings.TrimSpace(*input.DeviceType)
+	}
+	if input.Schema != nil {
+		s.Schema = *input.Schema
+	}
+	if input.Enabled != nil {
+		s.Enabled = *input.Enabled
+	}
+}
+
+// validate schema and compile its document
+func (s *Schema) validate() (err error) {
+	if s.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if s.TopicFilter == "" && s.DeviceType == "" {
+		return tool.Invalid("topicFilter or deviceType is required")
+	}
+	if s.TopicFilter != "" {
+		if err := connector.ValidFilter(s.TopicFilter); err != nil {
+			return err
+		}
+	}
+	if len(s.Schema) == 0 {
+		return tool.Invalid("schema is required")
+	}
+	s.compiled, err = schema.Compile(s.Schema)
+	return err
+}
+
+// applies to messages on topic of a device of deviceType
+func (s *Schema) applies(topic, deviceType string) bool {
+	return (s.TopicFilter == "" || connector.MatchTopic(s.TopicFilter, topic)) && (s.DeviceType == "" || s.DeviceType == deviceType)
+}
+
+const schemaColumns = `id, tenant_id, name, topic_filter, device_type, schema, enabled, validated, rejected, created_at, updated_at`
+
+func scanSchema(row rowScanner) (*Schema, error) {
+	s := &Schema{}
+	var doc []byte
+	err := row.Scan(&s.ID, &s.TenantID, &s.Name, &s.TopicFilter, &s.DeviceType, &doc, &s.Enabled, &s.Validated, &s.Rejected, &s.CreatedAt, &s.UpdatedAt)
+	s.Schema = doc
+	return s, err
+}
+
+func querySchemas(ctx context.Context, pgPool *sql.DB, query string, args ...interface{}) ([]*Schema, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+schemaColumns+` from schemas `+query, args...)
+	if err != nil {
+		return nil, dbError(err, "query schemas")
+	}
+	defer rows.Close()
+
+	schemas := []*Schema{}
+	for rows.Next() {
+		s, err := scanSchema(rows)
+		if err != nil {
+			return nil, dbError(err, "scan schema")
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, dbError(rows.Err(), "query schemas")
+}
+
+// Quarantined message which failed validation, a payload which is not utf-8 is base64 encoded
+type Quarantined struct {
+	ID         int64     `json:"id"`
+	TenantID   int64     `json:"tenantId"`
+	SchemaID   *int64    `json:"schemaId"` // nil for payloads which are not json or not decodable
+	DeviceID   *int64    `json:"deviceId"`
+	Topic      string    `json:"topic"`
+	Payload    string    `json:"payload"`
+	Encoding   string    `json:"encoding"` // utf-8 or base64
+	Errors     []string  `json:"errors"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+type cachedSchemas struct {
+	schemas []*Schema
+	expires time.Time
+}
+
+type schemaCounts struct {
+	validated, rejected int64
+}
+
+// payloadValidator check telemetry against the schemas of its tenant before it is queued,
+// messages which are not json or violate a schema go to quarantine
+type payloadValidator struct {
+	sync.Mutex
+	pgPool  *sql.DB
+	tenants map[int64]cachedSchemas
+	pending map[int64]*schemaCounts // by schema, not flushed yet
+}
+
+func newPayloadValidator(pgPool *sql.DB) *payloadValidator {
+	return &payloadValidator{pgPool: pgPool, tenants: make(map[int64]cachedSchemas), pending: make(map[int64]*schemaCounts)}
+}
+
+func (v *payloadValidator) tenantSchemas(ctx context.Context, tenantID int64) ([]*Schema, error) {
+	v.Lock()
+	cached, ok := v.tenants[tenantID]
+	v.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.schemas, nil
+	}
+
+	loaded, err := querySchemas(ctx, v.pgPool, `where tenant_id = $1 and enabled order by id;`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	schemas := loaded[:0]
+	for _, s := range loaded {
+		if err := s.validate(); err != nil {
+			_Log.Warn("skip broken schema", "schema", s.ID, "err", err)
+			continue
+		}
+		schemas = append(schemas, s)
+	}
+	v.Lock()
+	v.tenants[tenantID] = cachedSchemas{schemas: schemas, expires: time.Now().Add(registryTTL)}
+	v.Unlock()
+	return schemas, nil
+}
+
+// forget cached schemas of tenant
+func (v *payloadValidator) forget(tenantID int64) {
+	v.Lock()
+	defer v.Unlock()
+
+	delete(v.tenants, tenantID)
+}
+
+// admit message into the queue, a rejected one is quarantined
+func (v *payloadValidator) admit(ctx context.Context, tenantID int64, topic string, ref deviceRef, message string) bool {
+	if !json.Valid([]byte(message)) {
+		v.quarantine(ctx, tenantID, nil, ref, topic, message, []string{"payload is not json"})
+		return false
+	}
+	schemas, err := v.tenantSchemas(ctx, tenantID)
+	if err != nil {
+		_Log.Error("load schemas, admit message unchecked", "tenant", tenantID, "err", err)
+		return true
+	}
+	s, violations := v.check(schemas, topic, ref, message)
+	if len(violations) == 0 {
+		return true
+	}
+	v.quarantine(ctx, tenantID, &s.ID, ref, topic, message, violations)
+	return false
+}
+
+// check message against the matching schemas, the first one it violates is returned
+func (v *payloadValidator) check(schemas []*Schema, topic string, ref deviceRef, message string) (*Schema, []string) {
+	for _, s := range schemas {
+		if !s.applies(topic, ref.deviceType) {
+			continue
+		}
+		violations, err := s.compiled.Validate([]byte(message))
+		if err != nil {
+			violations = []string{err.Error()}
+		}
+		v.count(s.ID, len(violations) > 0)
+		if len(violations) > 0 {
+			return s, violations
+		}
+	}
+	return nil, nil
+}
+
+func (v *payloadValidator) count(schemaID int64, rejected bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	c := v.pending[schemaID]
+	if c == nil {
+		c = &schemaCounts{}
+		v.pending[schemaID] = c
+	}
+	c.validated++
+	if rejected {
+		c.rejected++
+	}
+}
+
+func (v *payloadValidator) quarantine(ctx context.Context, tenantID int64, schemaID *int64, ref deviceRef, topic, message string, violations []string) {
+	_Log.Warn("quarantine message", "tenant", tenantID, "topic", topic, "errors", schema.Join(violations))
+	_, err := v.pgPool.ExecContext(ctx, `insert into quarantine (tenant_id, schema_id, device_id, topic, payload, errors)
+		values ($1, $2, $3, $4, $5, $6);`, tenantID, schemaID, sql.NullInt64{Int64: ref.id, Valid: ref.id > 0}, topic, []byte(message), pq.Array(violations))
+	tool.CheckThenLog(_Log, dbError(err, "insert quarantine"), "quarantine message", "tenant", tenantID, "topic", topic)
+}
+
+// flush counters into the schemas
+func (v *payloadValidator) flush(ctx context.Context) error {
+	v.Lock()
+	pending := v.pending
+	v.pending = make(map[int64]*schemaCounts)
+	v.Unlock()
+
+	for schemaID, c := range pending {
+		_, err := v.pgPool.ExecContext(ctx, `update schemas set validated = validated + $2, rejected = rejected + $3 where id = $1;`,
+			schemaID, c.validated, c.rejected)
+		if err != nil {
+			// keep what is not written yet for the next flush
+			v.Lock()
+			for schemaID, c := range pending {
+				kept := v.pending[schemaID]
+				if kept == nil {
+					kept = &schemaCounts{}
+					v.pending[schemaID] = kept
+				}
+				kept.validated += c.validated
+				kept.rejected += c.rejected
+			}
+			v.Unlock()
+			return dbError(err, "flush schema counters")
+		}
+		delete(pending, schemaID)
+	}
+	return nil
+}
+
+// run flush counters periodically until ctx is done
+func (v *payloadValidator) run(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.ErrorThenPrint(v.flush(fctx), "flush schema counters")
+			cancel()
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			tool.ErrorThenPrint(v.flush(fctx), "flush schema counters")
+			cancel()
+			return
+		}
+	}
+}
+
+func (_global *global) querySchema(ctx context.Context, tenantID, id int64) (*Schema, error) {
+	s, err := scanSchema(_global.pgPool.QueryRowContext(ctx, `select `+schemaColumns+` from schemas where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query schema")
+	}
+	return s, nil
+}
+
+func (_global *global) listSchemas(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	schemas, err := querySchemas(ctx, _global.pgPool, `where tenant_id = $1 order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, schemas)
+}
+
+func (_global *global) getSchema(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	s, err := _global.querySchema(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func (_global *global) createSchema(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input schemaInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	s := &Schema{TenantID: tenantOf(c), Enabled: true}
+	input.apply(s)
+	if err := s.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into schemas (tenant_id, name, topic_filter, device_type, schema, enabled)
+		values ($1, $2, $3, $4, $5, $6) returning id, created_at, updated_at;`,
+		s.TenantID, s.Name, s.TopicFilter, s.DeviceType, []byte(s.Schema), s.Enabled).Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert schema"))
+		return
+	}
+	_global.schemas.forget(s.TenantID)
+	c.JSON(http.StatusCreated, s)
+}
+
+func (_global *global) updateSchema(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input schemaInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	s, err := _global.querySchema(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(s)
+	if err := s.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err = _global.pgPool.QueryRowContext(ctx, `update schemas set name = $3, topic_filter = $4, device_type = $5, schema = $6, enabled = $7,
+		updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		s.TenantID, s.ID, s.Name, s.TopicFilter, s.DeviceType, []byte(s.Schema), s.Enabled).Scan(&s.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update schema"))
+		return
+	}
+	_global.schemas.forget(s.TenantID)
+	c.JSON(http.StatusOK, s)
+}
+
+func (_global *global) deleteSchema(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	res, err := _global.pgPool.ExecContext(ctx, `delete from schemas where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		c.Error(dbError(err, "delete schema"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such schema [%d]", id))
+		return
+	}
+	_global.schemas.forget(tenantID)
+	c.Status(http.StatusNoContent)
+}
+
+const quarantineColumns = `id, tenant_id, schema_id, device_id, topic, payload, errors, received_at`
+
+func scanQuarantined(row rowScanner) (*Quarantined, error) {
+	q := &Quarantined{}
+	var payload []byte
+	if err := row.Scan(&q.ID, &q.TenantID, &q.SchemaID, &q.DeviceID, &q.Topic, &payload, pq.Array(&q.Errors), &q.ReceivedAt); err != nil {
+		return nil, err
+	}
+	q.Payload, q.Encoding = string(payload), "utf-8"
+	if !utf8.Valid(payload) {
+		q.Payload, q.Encoding = base64.StdEncoding.EncodeToString(payload), "base64"
+	}
+	return q, nil
+}
+
+// listQuarantine newest first, the latest hundred, filtered by ?schemaId= and ?deviceId=
+func (_global *global) listQuarantine(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var filters [2]int64
+	for i, name := range []string{"schemaId", "deviceId"} {
+		if s := c.Query(name); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				c.Error(tool.Invalid("%s [%s] is not a number", name, s))
+				return
+			}
+			filters[i] = id
+		}
+	}
+	rows, err := _global.pgPool.QueryContext(ctx, `select `+quarantineColumns+` from quarantine
+		where tenant_id = $1 and ($2 = 0 or schema_id = $2) and ($3 = 0 or device_id = $3) order by id desc limit 100;`,
+		tenantOf(c), filters[0], filters[1])
+	if err != nil {
+		c.Error(dbError(err, "query quarantine"))
+		return
+	}
+	defer rows.Close()
+
+	quarantined := []*Quarantined{}
+	for rows.Next() {
+		q, err := scanQuarantined(rows)
+		if err != nil {
+			c.Error(dbError(err, "scan quarantined message"))
+			return
+		}
+		quarantined = append(quarantined, q)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query quarantine"))
+		return
+	}
+	c.JSON(http.StatusOK, quarantined)
+}
+
+func (_global *global) getQuarantined(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	q, err := scanQuarantined(_global.pgPool.QueryRowContext(ctx, `select `+quarantineColumns+` from quarantine where tenant_id = $1 and id = $2;`,
+		tenantOf(c), id))
+	if err != nil {
+		c.Error(dbError(err, "query quarantined message"))
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+func (_global *global) deleteQuarantined(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	res, err := _global.pgPool.ExecContext(ctx, `delete from quarantine where tenant_id = $1 and id = $2;`, tenantOf(c), id)
+	if err != nil {
+		c.Error(dbError(err, "delete quarantined message"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such quarantined message [%d]", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("schemas", func() {
+	var v *payloadValidator
+	pump := deviceRef{id: 7, tenantID: 1, deviceID: "pump-1", deviceType: "pump"}
+	compiled := func(s *Schema) *Schema {
+		Ω(s.validate()).To(Succeed())
+		return s
+	}
+	var schemas []*Schema
+
+	BeforeEach(func() {
+		v = newPayloadValidator(nil)
+		schemas = []*Schema{
+			compiled(&Schema{ID: 1, Name: "telemetry", TopicFilter: "devices/+/telemetry", Schema: json.RawMessage(`{"type": "object"}`)}),
+			compiled(&Schema{ID: 2, Name: "pump", DeviceType: "pump", Schema: json.RawMessage(`{"required": ["rpm"], "properties": {"rpm": {"type": "integer"}}}`)}),
+		}
+	})
+
+	It("should validate schemas", func() {
+		Ω((&Schema{Name: "s", DeviceType: "pump"}).validate()).ToNot(Succeed())
+		Ω((&Schema{Name: "s", Schema: json.RawMessage(`{}`)}).validate()).ToNot(Succeed())
+		Ω((&Schema{Name: "s", DeviceType: "pump", Schema: json.RawMessage(`{"type": 1}`)}).validate()).ToNot(Succeed())
+		Ω((&Schema{Name: "s", TopicFilter: "a/#/b", Schema: json.RawMessage(`{}`)}).validate()).ToNot(Succeed())
+	})
+
+	It("should admit messages satisfying every matching schema", func() {
+		s, violations := v.check(schemas, "devices/pump-1/telemetry", pump, `{"rpm": 1200}`)
+		Ω(s).To(BeNil())
+		Ω(violations).To(BeEmpty())
+		Ω(*v.pending[1]).To(Equal(schemaCounts{validated: 1}))
+		Ω(*v.pending[2]).To(Equal(schemaCounts{validated: 1}))
+
+		s, violations = v.check(schemas, "other", deviceRef{}, `[1, 2]`)
+		Ω(s).To(BeNil())
+		Ω(violations).To(BeEmpty())
+	})
+
+	It("should reject messages violating a schema and count them", func() {
+		s, violations := v.check(schemas, "devices/pump-1/telemetry", pump, `{"rpm": 1.5}`)
+		Ω(s.ID).To(Equal(int64(2)))
+		Ω(violations).To(HaveLen(1))
+		Ω(violations[0]).To(HavePrefix("/rpm: "))
+
+		s, _ = v.check(schemas, "devices/pump-1/telemetry", pump, `"text"`)
+		Ω(s.ID).To(Equal(int64(1)))
+		Ω(*v.pending[1]).To(Equal(schemaCounts{validated: 2, rejected: 1}))
+		Ω(*v.pending[2]).To(Equal(schemaCounts{validated: 1, rejected: 1}))
+	})
+})
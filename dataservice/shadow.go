@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/device"
+	"dataservice/tool"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Shadow document of a device, version counts every change of desired state
+type Shadow struct {
+	ID        int64                  `json:"id"`
+	DeviceID  string                 `json:"deviceId"`
+	Reported  map[string]interface{} `json:"reported"`
+	Desired   map[string]interface{} `json:"desired"`
+	Delta     map[string]interface{} `json:"delta"`
+	Version   int64                  `json:"version"`
+	UpdatedAt *time.Time             `json:"updatedAt"`
+	Delivered *bool                  `json:"delivered,omitempty"`
+}
+
+// shadowInput body of patch, version is the one the change is based on, 0 for a device without shadow
+type shadowInput struct {
+	Desired map[string]interface{} `json:"desired"`
+	Version *int64                 `json:"version"`
+}
+
+// shadowDelta message sent to the device
+type shadowDelta struct {
+	Version   int64                  `json:"version"`
+	State     map[string]interface{} `json:"state"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// shadowService keep device shadows, deltas go out through the broker a device was last seen on and to its observers
+type shadowService struct {
+	sync.Mutex
+	pgPool     *sql.DB
+	deltaTopic string // with device.IDPlaceholder
+	qos        byte
+	routes     map[int64]string
+	publish    func(brok, topic string, qos byte, retained bool, payload []byte) error
+	notify     func(id int64, payload []byte) bool // observers of the delta of device id, nil without them
+}
+
+func newShadowService(pgPool *sql.DB, deltaTopic string, qos byte,
+	publish func(brok, topic string, qos byte, retained bool, payload []byte) error) *shadowService {
+	return &shadowService{
+		pgPool:     pgPool,
+		deltaTopic: deltaTopic,
+		qos:        qos,
+		routes:     make(map[int64]string),
+		publish:    publish,
+	}
+}
+
+// route remember the broker device was seen on
+func (s *shadowService) route(id int64, brok string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.routes[id] = brok
+}
+
+func (s *shadowService) forget(id int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.routes, id)
+}
+
+// report merge a json object message into the reported state of device id, other payloads are ignored;
+// the version is left alone, so reports never fail a patch of the desired state based on it
+func (s *shadowService) report(ctx context.Context, id int64, message string) error {
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &state); err != nil || len(state) == 0 {
+		return nil
+	}
+	// merged in place, so concurrent reports of a device never conflict
+	_, err := s.pgPool.ExecContext(ctx, `insert into device_shadows (device_id, reported) values ($1, jsonb_strip_nulls($2::jsonb))
+		on conflict (device_id) do update set reported = jsonb_strip_nulls(device_shadows.reported || $2::jsonb),
+		updated_at = now();`, id, message)
+	return dbError(err, "merge reported state")
+}
+
+// query shadow of device, a device without shadow has an empty one of version 0
+func (s *shadowService) query(ctx context.Context, id int64, deviceID string) (*Shadow, error) {
+	sh := &Shadow{ID: id, DeviceID: deviceID}
+	var reported, desired []byte
+	var updatedAt time.Time
+	err := s.pgPool.QueryRowContext(ctx, `select reported, desired, version, updated_at from device_shadows where device_id = $1;`, id).
+		Scan(&reported, &desired, &sh.Version, &updatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		reported, desired = []byte(`{}`), []byte(`{}`)
+	case err != nil:
+		return nil, dbError(err, "query shadow")
+	default:
+		sh.UpdatedAt = &updatedAt
+	}
+	if err := json.Unmarshal(reported, &sh.Reported); err != nil {
+		return nil, tool.Wrap(tool.KindInternal, err, "decode reported state")
+	}
+	if err := json.Unmarshal(desired, &sh.Desired); err != nil {
+		return nil, tool.Wrap(tool.KindInternal, err, "decode desired state")
+	}
+	sh.Delta = device.Delta(sh.Desired, sh.Reported)
+	return sh, nil
+}
+
+// updateDesired merge patch into the desired state of shadow, Conflict when it moved past version
+func (s *shadowService) updateDesired(ctx context.Context, id int64, deviceID string, patch map[string]interface{}, version int64) (*Shadow, error) {
+	sh, err := s.query(ctx, id, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if sh.Version != version {
+		return nil, tool.Conflict("shadow of device [%s] is at version %d, not %d", deviceID, sh.Version, version)
+	}
+	sh.Desired = device.Merge(sh.Desired, patch)
+	desired, err := json.Marshal(sh.Desired)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "encode desired state")
+	}
+
+	var updatedAt time.Time
+	if version == 0 {
+		err = s.pgPool.QueryRowContext(ctx, `insert into device_shadows (device_id, desired) values ($1, $2)
+			on conflict (device_id) do nothing returning version, updated_at;`, id, desired).Scan(&sh.Version, &updatedAt)
+	} else {
+		err = s.pgPool.QueryRowContext(ctx, `update device_shadows set desired = $2, version = version + 1, updated_at = now()
+			where device_id = $1 and version = $3 returning version, updated_at;`, id, desired, version).Scan(&sh.Version, &updatedAt)
+	}
+	if err == sql.ErrNoRows {
+		return nil, tool.Conflict("shadow of device [%s] changed since version %d", deviceID, version)
+	}
+	if err != nil {
+		return nil, dbError(err, "update desired state")
+	}
+	sh.UpdatedAt = &updatedAt
+	sh.Delta = device.Delta(sh.Desired, sh.Reported)
+	return sh, nil
+}
+
+// deliver delta of shadow to the device, delivered is false when it has neither a route nor observers yet
+func (s *shadowService) deliver(sh *Shadow) (delivered bool, err error) {
+	if len(sh.Delta) == 0 {
+		return false, nil
+	}
+	payload, err := json.Marshal(shadowDelta{Version: sh.Version, State: sh.Delta, Timestamp: time.Now()})
+	if err != nil {
+		return false, tool.Wrap(tool.KindInternal, err, "encode shadow delta")
+	}
+	notified := s.notify != nil && s.notify(sh.ID, payload)
+	s.Lock()
+	brok, ok := s.routes[sh.ID]
+	s.Unlock()
+	if !ok {
+		return notified, nil
+	}
+
+	topic := strings.ReplaceAll(s.deltaTopic, device.IDPlaceholder, sh.DeviceID)
+	if err := s.publish(brok, topic, s.qos, false, payload); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// online send the pending delta to a device coming back
+func (s *shadowService) online(ctx context.Context, ref deviceRef) {
+	sh, err := s.query(ctx, ref.id, ref.deviceID)
+	if err == nil {
+		_, err = s.deliver(sh)
+	}
+	tool.CheckThenLog(_Log, err, "deliver shadow delta", "device", ref.deviceID)
+}
+
+func (_global *global) getShadow(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	sh, err := _global.shadows.query(ctx, d.ID, d.DeviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, sh)
+}
+
+// updateShadow merge desired state, keys set to null are removed, the delta is sent to the device at once
+func (_global *global) updateShadow(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input shadowInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	if input.Version == nil {
+		c.Error(tool.Invalid("version is required"))
+		return
+	}
+	if len(input.Desired) == 0 {
+		c.Error(tool.Invalid("desired is required"))
+		return
+	}
+	d, err := _global.queryDevice(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	sh, err := _global.shadows.updateDesired(ctx, d.ID, d.DeviceID, input.Desired, *input.Version)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	delivered, err := _global.shadows.deliver(sh)
+	tool.CheckThenLog(_Log, err, "deliver shadow delta", "device", d.DeviceID)
+	sh.Delivered = &delivered
+	c.JSON(http.StatusOK, sh)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("shadow", func() {
+	type published struct {
+		brok, topic string
+		qos         byte
+		payload     []byte
+	}
+	var s *shadowService
+	var sent []published
+
+	BeforeEach(func() {
+		sent = nil
+		s = newShadowService(nil, "devices/{deviceId}/shadow/delta", 1, func(brok, topic string, qos byte, retained bool, payload []byte) error {
+			sent = append(sent, published{brok, topic, qos, payload})
+			return nil
+		})
+	})
+
+	It("should deliver the delta through the broker the device was seen on", func() {
+		s.route(7, "1/3")
+		delivered, err := s.deliver(&Shadow{ID: 7, DeviceID: "pump-1", Version: 4, Delta: map[string]interface{}{"mode": "eco"}})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(delivered).To(BeTrue())
+
+		Ω(sent).To(HaveLen(1))
+		Ω(sent[0].brok).To(Equal("1/3"))
+		Ω(sent[0].topic).To(Equal("devices/pump-1/shadow/delta"))
+		Ω(sent[0].qos).To(Equal(byte(1)))
+		var delta shadowDelta
+		Ω(json.Unmarshal(sent[0].payload, &delta)).To(Succeed())
+		Ω(delta.Version).To(Equal(int64(4)))
+		Ω(delta.State).To(Equal(map[string]interface{}{"mode": "eco"}))
+	})
+
+	It("should hold the delta of devices not seen yet", func() {
+		delivered, err := s.deliver(&Shadow{ID: 7, DeviceID: "pump-1", Delta: map[string]interface{}{"mode": "eco"}})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(delivered).To(BeFalse())
+		Ω(sent).To(BeEmpty())
+	})
+
+	It("should notify the observers of the delta", func() {
+		var notified []int64
+		s.notify = func(id int64, payload []byte) bool {
+			notified = append(notified, id)
+			return id == 7
+		}
+		delivered, err := s.deliver(&Shadow{ID: 7, DeviceID: "pump-1", Delta: map[string]interface{}{"mode": "eco"}})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(delivered).To(BeTrue(), "observers need no route")
+		Ω(sent).To(BeEmpty())
+
+		delivered, err = s.deliver(&Shadow{ID: 8, DeviceID: "pump-2", Delta: map[string]interface{}{"mode": "eco"}})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(delivered).To(BeFalse())
+		Ω(notified).To(Equal([]int64{7, 8}))
+	})
+
+	It("should send nothing without delta", func() {
+		s.route(7, "1/3")
+		delivered, err := s.deliver(&Shadow{ID: 7, DeviceID: "pump-1", Delta: map[string]interface{}{}})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(delivered).To(BeFalse())
+		Ω(sent).To(BeEmpty())
+	})
+})
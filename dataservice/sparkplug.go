@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"dataservice/sparkplug"
+	"dataservice/tool"
+	"encoding/json"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// edgeDeviceID of the edge node of t, or of its device unless device is empty, as group/node[/device]
+func edgeDeviceID(t sparkplug.Topic, device string) string {
+	id := t.Group + "/" + t.Node
+	if device != "" {
+		id += "/" + device
+	}
+	return id
+}
+
+// pushSparkplug message of an edge node received on broker brok, births and deaths drive presence
+// and the metrics are stored by name as telemetry of the node or device; unknown nodes and devices are registered
+// when a template matching the topic, like spBv1.0/{deviceId}/#, says so
+func (_global *global) pushSparkplug(ctx context.Context, tenantID int64, brok, topic, message string) error {
+	span := trace.SpanFromContext(ctx)
+	t, err := sparkplug.ParseTopic(topic)
+	if err != nil {
+		_Log.Debug("drop message of unknown sparkplug topic", "tenant", tenantID, "topic", topic, "err", err)
+		return nil
+	}
+	switch t.Type {
+	case sparkplug.NCmd, sparkplug.DCmd, sparkplug.State:
+		// commands and states of host applications, ours included
+		return nil
+	}
+	p, err := sparkplug.Decode([]byte(message))
+	if err != nil {
+		_global.schemas.quarantine(ctx, tenantID, nil, deviceRef{}, topic, message, []string{err.Error()})
+		span.SetAttributes(attribute.Bool("message.quarantined", true))
+		return nil
+	}
+
+	now := time.Now()
+	r := _global.edgeNodes.Handle(brok, t, p, now)
+	if r.Stale {
+		_Log.Debug("drop death of an earlier session", "tenant", tenantID, "topic", topic)
+		return nil
+	}
+	if r.Rebirth {
+		cmd := sparkplug.Topic{Group: t.Group, Type: sparkplug.NCmd, Node: t.Node}
+		_Log.Warn("lost track of edge node, request rebirth", "tenant", tenantID, "topic", topic, "seq", p.Seq)
+		tool.CheckThenLog(_Log, _global.connectors.Publish(brok, cmd.String(), 0, false, sparkplug.EncodeRebirth(uint64(now.UnixMilli()))),
+			"request rebirth", "topic", cmd.String())
+	}
+	for _, presence := range r.Presence {
+		ref, err := _global.devices.admit(ctx, tenantID, topic, edgeDeviceID(t, presence.Device))
+		if tool.KindOf(err) == tool.KindForbidden {
+			_Log.Debug("drop presence of unknown device", "tenant", tenantID, "topic", topic, "err", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_global.presence.report(ctx, ref, presence.Online, now)
+	}
+	if len(r.Values) == 0 {
+		return nil
+	}
+
+	ref, err := _global.devices.admit(ctx, tenantID, topic, edgeDeviceID(t, t.Device))
+	if tool.KindOf(err) == tool.KindForbidden {
+		_Log.Debug("drop message of unknown device", "tenant", tenantID, "topic", topic, "err", err)
+		span.SetAttributes(attribute.Bool("device.rejected", true))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_global.presence.seen(ctx, ref, now)
+	b, err := json.Marshal(r.Values)
+	if err != nil {
+		return tool.Wrap(tool.KindInternal, err, "encode metrics")
+	}
+	return _global.ingest(ctx, tenantID, topic, ref, nil, string(b))
+}
@@ -0,0 +1,168 @@
+package sparkplug
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RebirthInterval between rebirth requests to the same edge node
+const RebirthInterval = 30 * time.Second
+
+// Presence of the node, Device empty, or of one of its devices
+type Presence struct {
+	Device string
+	Online bool
+}
+
+// Result of a message for the host
+type Result struct {
+	Presence []Presence
+	Values   map[string]interface{} // metrics by name, empty when there are none
+	Rebirth  bool                   // the host lost track of the node, it should be asked to publish its births again
+	Stale    bool                   // a death of an earlier session, it is ignored
+}
+
+type nodeKey struct {
+	scope, group, node string
+}
+
+// session of an edge node from its birth to its death
+type session struct {
+	born      bool
+	bdSeq     uint64
+	seq       uint64
+	aliases   map[uint64]string
+	types     map[string]DataType
+	devices   map[string]bool // born devices
+	rebirthAt time.Time
+}
+
+// Host track the sessions of edge nodes as a sparkplug b host application,
+// scope separates nodes of the same group and id on different brokers
+type Host struct {
+	sync.Mutex
+	nodes map[nodeKey]*session
+}
+
+// NewHost without sessions
+func NewHost() *Host {
+	return &Host{nodes: make(map[nodeKey]*session)}
+}
+
+// Handle message of topic with payload p received at now
+func (h *Host) Handle(scope string, t Topic, p *Payload, now time.Time) Result {
+	h.Lock()
+	defer h.Unlock()
+
+	key := nodeKey{scope, t.Group, t.Node}
+	s := h.nodes[key]
+	if s == nil {
+		s = &session{}
+		h.nodes[key] = s
+	}
+
+	var r Result
+	switch t.Type {
+	case NBirth:
+		bdSeq, _ := p.BdSeq()
+		*s = session{born: true, bdSeq: bdSeq, seq: p.Seq, aliases: make(map[uint64]string), types: make(map[string]DataType),
+			devices: make(map[string]bool), rebirthAt: s.rebirthAt}
+		s.learn(p)
+		r.Presence = []Presence{{Online: true}}
+	case NDeath:
+		// the will of an earlier connection may arrive after the new birth
+		if bdSeq, ok := p.BdSeq(); !s.born || ok && bdSeq != s.bdSeq {
+			r.Stale = true
+			return r
+		}
+		s.born = false
+		r.Presence = []Presence{{Online: false}}
+		for device, born := range s.devices {
+			if born {
+				r.Presence = append(r.Presence, Presence{Device: device, Online: false})
+			}
+		}
+		return r
+	case DBirth, DDeath, NData, DData:
+		if !s.born || p.HasSeq && p.Seq != (s.seq+1)%256 {
+			r.Rebirth = true
+		}
+		s.seq = p.Seq
+		switch t.Type {
+		case DBirth:
+			if s.born {
+				s.devices[t.Device] = true
+				s.learn(p)
+			}
+			r.Presence = []Presence{{Device: t.Device, Online: true}}
+		case DDeath:
+			if s.born {
+				s.devices[t.Device] = false
+			}
+			r.Presence = []Presence{{Device: t.Device, Online: false}}
+			return s.throttle(r, now)
+		}
+	default:
+		return r
+	}
+
+	r.Values = make(map[string]interface{})
+	for _, m := range p.Metrics {
+		name := m.Name
+		if name == "" && m.HasAlias {
+			name = s.aliases[m.Alias]
+		}
+		if name == "" {
+			r.Rebirth = true
+			continue
+		}
+		// protocol metrics and backfilled history are no telemetry
+		if name == MetricBdSeq || strings.HasPrefix(name, "Node Control/") || strings.HasPrefix(name, "Device Control/") || m.IsHistorical {
+			continue
+		}
+		if v, ok := m.Value(s.types[name]); ok {
+			r.Values[name] = v
+		}
+	}
+	return s.throttle(r, now)
+}
+
+// learn aliases and data types of the metrics of a birth
+func (s *session) learn(p *Payload) {
+	for _, m := range p.Metrics {
+		if m.Name == "" {
+			continue
+		}
+		if m.HasAlias {
+			s.aliases[m.Alias] = m.Name
+		}
+		if m.DataType != Unknown {
+			s.types[m.Name] = m.DataType
+		}
+	}
+}
+
+// throttle rebirth requests of the session
+func (s *session) throttle(r Result, now time.Time) Result {
+	if r.Rebirth {
+		if now.Sub(s.rebirthAt) < RebirthInterval {
+			r.Rebirth = false
+		} else {
+			s.rebirthAt = now
+		}
+	}
+	return r
+}
+
+// Forget sessions of scope
+func (h *Host) Forget(scope string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for key := range h.nodes {
+		if key.scope == scope {
+			delete(h.nodes, key)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package sparkplug
+
+import (
+	"dataservice/tool"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of org.eclipse.tahu.protobuf.Payload
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+)
+
+// field numbers of Payload.Metric
+const (
+	metricName         = 1
+	metricAlias        = 2
+	metricTimestamp    = 3
+	metricDataType     = 4
+	metricIsHistorical = 5
+	metricIsTransient  = 6
+	metricIsNull       = 7
+	metricIntValue     = 10
+	metricLongValue    = 11
+	metricFloatValue   = 12
+	metricDoubleValue  = 13
+	metricBoolValue    = 14
+	metricStringValue  = 15
+	metricBytesValue   = 16
+	metricDataSetValue = 17
+	metricTemplate     = 18
+	metricExtension    = 19
+)
+
+// Decode sparkplug b payload, fields which are not known are skipped
+func Decode(b []byte) (*Payload, error) {
+	p := &Payload{}
+	err := fields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == payloadTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Timestamp = v
+			return n, nil
+		case num == payloadSeq && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Seq, p.HasSeq = v, true
+			return n, nil
+		case num == payloadMetrics && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := decodeMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			p.Metrics = append(p.Metrics, m)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func decodeMetric(b []byte) (*Metric, error) {
+	m := &Metric{}
+	err := fields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case metricAlias:
+				m.Alias, m.HasAlias = v, true
+			case metricTimestamp:
+				m.Timestamp = v
+			case metricDataType:
+				m.DataType = DataType(v)
+			case metricIsHistorical:
+				m.IsHistorical = v != 0
+			case metricIsTransient:
+				m.IsTransient = v != 0
+			case metricIsNull:
+				m.IsNull = v != 0
+			case metricIntValue:
+				m.kind, m.long = intValue, uint64(uint32(v))
+			case metricLongValue:
+				m.kind, m.long = longValue, v
+			case metricBoolValue:
+				m.kind, m.bool = boolValue, v != 0
+			}
+			return n, nil
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if num == metricFloatValue {
+				m.kind, m.float = floatValue, float64(math.Float32frombits(v))
+			}
+			return n, nil
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if num == metricDoubleValue {
+				m.kind, m.float = doubleValue, math.Float64frombits(v)
+			}
+			return n, nil
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case metricName:
+				m.Name = string(v)
+			case metricStringValue:
+				m.kind, m.str = stringValue, string(v)
+			case metricBytesValue:
+				m.kind, m.bytes = bytesValue, append([]byte(nil), v...)
+			case metricDataSetValue, metricTemplate, metricExtension:
+				m.kind = otherValue
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fields of a message handed to consume one by one, consume returns the length of the value or a negative protowire error
+func fields(b []byte, consume func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return tool.Wrap(tool.KindInvalid, protowire.ParseError(n), "decode sparkplug payload")
+		}
+		b = b[n:]
+		n, err := consume(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return tool.Wrap(tool.KindInvalid, protowire.ParseError(n), "decode sparkplug payload")
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// EncodeRebirth NCMD payload asking an edge node to publish its births again
+func EncodeRebirth(at uint64) []byte {
+	var metric []byte
+	metric = protowire.AppendTag(metric, metricName, protowire.BytesType)
+	metric = protowire.AppendString(metric, MetricRebirth)
+	metric = protowire.AppendTag(metric, metricTimestamp, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, at)
+	metric = protowire.AppendTag(metric, metricDataType, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(Boolean))
+	metric = protowire.AppendTag(metric, metricBoolValue, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, 1)
+
+	var b []byte
+	b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, at)
+	b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+	b = protowire.AppendBytes(b, metric)
+	return b
+}
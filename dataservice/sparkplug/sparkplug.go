@@ -0,0 +1,206 @@
+package sparkplug
+
+import (
+	"dataservice/tool"
+	"encoding/base64"
+	"math"
+	"strings"
+	"time"
+)
+
+// Namespace of sparkplug b topics
+const Namespace = "spBv1.0"
+
+// message types
+const (
+	NBirth = "NBIRTH"
+	NDeath = "NDEATH"
+	NData  = "NDATA"
+	NCmd   = "NCMD"
+	DBirth = "DBIRTH"
+	DDeath = "DDEATH"
+	DData  = "DDATA"
+	DCmd   = "DCMD"
+	State  = "STATE"
+)
+
+// well known metric names
+const (
+	MetricBdSeq   = "bdSeq"
+	MetricRebirth = "Node Control/Rebirth"
+)
+
+// DataType of a metric
+type DataType uint32
+
+// data types, the array types are not supported
+const (
+	Unknown  DataType = 0
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	DataSet  DataType = 16
+	Bytes    DataType = 17
+	File     DataType = 18
+	Template DataType = 19
+)
+
+// Topic of a sparkplug b message, spBv1.0/group/type/node[/device]
+type Topic struct {
+	Group  string
+	Type   string
+	Node   string
+	Device string // empty for node messages
+}
+
+// IsTopic of the sparkplug b namespace
+func IsTopic(topic string) bool {
+	return strings.HasPrefix(topic, Namespace+"/")
+}
+
+// ParseTopic of sparkplug b, STATE topics of host applications are parsed with the host id as node
+func ParseTopic(topic string) (Topic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[0] != Namespace {
+		return Topic{}, tool.Invalid("[%s] is not a sparkplug b topic", topic)
+	}
+	if parts[1] == State {
+		return Topic{Type: State, Node: parts[2]}, nil
+	}
+	t := Topic{Group: parts[1], Type: parts[2]}
+	switch t.Type {
+	case NBirth, NDeath, NData, NCmd:
+		if len(parts) != 4 {
+			return Topic{}, tool.Invalid("[%s] is not a sparkplug b node topic", topic)
+		}
+		t.Node = parts[3]
+	case DBirth, DDeath, DData, DCmd:
+		if len(parts) != 5 {
+			return Topic{}, tool.Invalid("[%s] is not a sparkplug b device topic", topic)
+		}
+		t.Node, t.Device = parts[3], parts[4]
+	default:
+		return Topic{}, tool.Invalid("unknown sparkplug b message type [%s]", t.Type)
+	}
+	for _, p := range parts[1:] {
+		if p == "" {
+			return Topic{}, tool.Invalid("[%s] has an empty element", topic)
+		}
+	}
+	return t, nil
+}
+
+// String of topic
+func (t Topic) String() string {
+	if t.Type == State {
+		return Namespace + "/" + State + "/" + t.Node
+	}
+	s := Namespace + "/" + t.Group + "/" + t.Type + "/" + t.Node
+	if t.Device != "" {
+		s += "/" + t.Device
+	}
+	return s
+}
+
+// value kinds, which field of the metric carried its value
+const (
+	noValue = iota
+	intValue
+	longValue
+	floatValue
+	doubleValue
+	boolValue
+	stringValue
+	bytesValue
+	otherValue // dataset, template or extension, not supported
+)
+
+// Metric of a payload
+type Metric struct {
+	Name         string
+	Alias        uint64
+	HasAlias     bool
+	Timestamp    uint64 // ms since epoch, 0 when not set
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	IsNull       bool
+
+	kind  int
+	long  uint64 // int and long values
+	float float64
+	bool  bool
+	str   string
+	bytes []byte
+}
+
+// Value of metric as json friendly value of dataType, which is its own unless it is omitted as in data messages;
+// ok is false for unsupported types
+func (m *Metric) Value(dataType DataType) (v interface{}, ok bool) {
+	if m.DataType != Unknown {
+		dataType = m.DataType
+	}
+	if m.IsNull {
+		return nil, true
+	}
+	switch m.kind {
+	case intValue, longValue:
+		switch dataType {
+		case Int8:
+			return int8(m.long), true
+		case Int16:
+			return int16(m.long), true
+		case Int32:
+			return int32(m.long), true
+		case Int64:
+			return int64(m.long), true
+		case DateTime:
+			return time.UnixMilli(int64(m.long)).UTC(), true
+		case Boolean:
+			return m.long != 0, true
+		}
+		return m.long, true
+	case floatValue, doubleValue:
+		if math.IsNaN(m.float) || math.IsInf(m.float, 0) {
+			return nil, true
+		}
+		return m.float, true
+	case boolValue:
+		return m.bool, true
+	case stringValue:
+		return m.str, true
+	case bytesValue:
+		return base64.StdEncoding.EncodeToString(m.bytes), true
+	}
+	return nil, false
+}
+
+// Payload of a sparkplug b message
+type Payload struct {
+	Timestamp uint64 // ms since epoch
+	Metrics   []*Metric
+	Seq       uint64
+	HasSeq    bool
+}
+
+// BdSeq birth death sequence number the payload carries as metric
+func (p *Payload) BdSeq() (uint64, bool) {
+	for _, m := range p.Metrics {
+		if m.Name == MetricBdSeq && (m.kind == intValue || m.kind == longValue) {
+			return m.long, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,13 @@
+package sparkplug_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSparkplug(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sparkplug Suite")
+}
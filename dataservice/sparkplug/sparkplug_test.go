@@ -0,0 +1,180 @@
+package sparkplug_test
+
+import (
+	"dataservice/sparkplug"
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metric of a test payload, value is encoded by its go type
+type metric struct {
+	name     string
+	alias    uint64
+	dataType sparkplug.DataType
+	value    interface{}
+}
+
+func payload(seq uint64, metrics ...metric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1700000000000)
+	for _, m := range metrics {
+		var mb []byte
+		if m.name != "" {
+			mb = protowire.AppendTag(mb, 1, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.name)
+		}
+		if m.alias > 0 {
+			mb = protowire.AppendTag(mb, 2, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.alias)
+		}
+		if m.dataType != sparkplug.Unknown {
+			mb = protowire.AppendTag(mb, 4, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(m.dataType))
+		}
+		switch v := m.value.(type) {
+		case uint32:
+			mb = protowire.AppendTag(mb, 10, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(v))
+		case uint64:
+			mb = protowire.AppendTag(mb, 11, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, v)
+		case float32:
+			mb = protowire.AppendTag(mb, 12, protowire.Fixed32Type)
+			mb = protowire.AppendFixed32(mb, math.Float32bits(v))
+		case float64:
+			mb = protowire.AppendTag(mb, 13, protowire.Fixed64Type)
+			mb = protowire.AppendFixed64(mb, math.Float64bits(v))
+		case bool:
+			mb = protowire.AppendTag(mb, 14, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, protowire.EncodeBool(v))
+		case string:
+			mb = protowire.AppendTag(mb, 15, protowire.BytesType)
+			mb = protowire.AppendString(mb, v)
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	return protowire.AppendVarint(b, seq)
+}
+
+func decoded(b []byte) *sparkplug.Payload {
+	p, err := sparkplug.Decode(b)
+	Ω(err).ToNot(HaveOccurred())
+	return p
+}
+
+var _ = Describe("sparkplug", func() {
+	It("should parse topics", func() {
+		t, err := sparkplug.ParseTopic("spBv1.0/plant1/DDATA/edge1/pump7")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(t).To(Equal(sparkplug.Topic{Group: "plant1", Type: sparkplug.DData, Node: "edge1", Device: "pump7"}))
+		Ω(t.String()).To(Equal("spBv1.0/plant1/DDATA/edge1/pump7"))
+
+		t, err = sparkplug.ParseTopic("spBv1.0/plant1/NBIRTH/edge1")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(t.Device).To(BeEmpty())
+		t, err = sparkplug.ParseTopic("spBv1.0/STATE/scada")
+		Ω(err).ToNot(HaveOccurred())
+		Ω(t.Type).To(Equal(sparkplug.State))
+
+		for _, topic := range []string{"spBv1.0/plant1/NDATA/edge1/pump7", "spBv1.0/plant1/DDATA/edge1", "spBv1.0/plant1/XDATA/edge1", "spAv1.0/g/NDATA/n", "spBv1.0//NDATA/n"} {
+			_, err := sparkplug.ParseTopic(topic)
+			Ω(err).To(HaveOccurred(), topic)
+		}
+		Ω(sparkplug.IsTopic("spBv1.0/plant1/NDATA/edge1")).To(BeTrue())
+		Ω(sparkplug.IsTopic("devices/spBv1.0")).To(BeFalse())
+	})
+
+	It("should decode payloads and metric values of their data type", func() {
+		p := decoded(payload(3,
+			metric{name: "temp", alias: 1, dataType: sparkplug.Float, value: float32(21.5)},
+			metric{name: "offset", dataType: sparkplug.Int16, value: uint32(0xfffe)},
+			metric{name: "count", dataType: sparkplug.Int64, value: uint64(math.MaxUint64)},
+			metric{name: "label", dataType: sparkplug.String, value: "ok"},
+			metric{name: "at", dataType: sparkplug.DateTime, value: uint64(0)},
+		))
+		Ω(p.Seq).To(Equal(uint64(3)))
+		Ω(p.Timestamp).To(Equal(uint64(1700000000000)))
+		Ω(p.Metrics).To(HaveLen(5))
+		values := []interface{}{}
+		for _, m := range p.Metrics {
+			v, ok := m.Value(sparkplug.Unknown)
+			Ω(ok).To(BeTrue())
+			values = append(values, v)
+		}
+		Ω(values).To(Equal([]interface{}{float64(21.5), int16(-2), int64(-1), "ok", time.Unix(0, 0).UTC()}))
+
+		_, err := sparkplug.Decode([]byte{0x12, 0x05, 0x0a})
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("should encode rebirth requests", func() {
+		p := decoded(sparkplug.EncodeRebirth(42))
+		Ω(p.Metrics).To(HaveLen(1))
+		Ω(p.Metrics[0].Name).To(Equal(sparkplug.MetricRebirth))
+		v, _ := p.Metrics[0].Value(sparkplug.Unknown)
+		Ω(v).To(Equal(true))
+	})
+
+	Describe("host", func() {
+		node := sparkplug.Topic{Group: "g", Node: "edge1"}
+		of := func(typ, device string) sparkplug.Topic {
+			t := node
+			t.Type, t.Device = typ, device
+			return t
+		}
+		now := time.Now()
+
+		It("should resolve aliases of births and track presence", func() {
+			h := sparkplug.NewHost()
+			r := h.Handle("b", of(sparkplug.NBirth, ""), decoded(payload(0,
+				metric{name: "bdSeq", dataType: sparkplug.Int64, value: uint64(5)},
+				metric{name: "Node Control/Rebirth", dataType: sparkplug.Boolean, value: false},
+				metric{name: "uptime", alias: 1, dataType: sparkplug.Int32, value: uint32(10)},
+			)), now)
+			Ω(r.Presence).To(Equal([]sparkplug.Presence{{Online: true}}))
+			Ω(r.Values).To(Equal(map[string]interface{}{"uptime": int32(10)}))
+			Ω(r.Rebirth).To(BeFalse())
+
+			r = h.Handle("b", of(sparkplug.DBirth, "pump7"), decoded(payload(1,
+				metric{name: "rpm", alias: 2, dataType: sparkplug.UInt16, value: uint32(1200)},
+			)), now)
+			Ω(r.Presence).To(Equal([]sparkplug.Presence{{Device: "pump7", Online: true}}))
+			Ω(r.Values).To(Equal(map[string]interface{}{"rpm": uint64(1200)}))
+
+			r = h.Handle("b", of(sparkplug.DData, "pump7"), decoded(payload(2, metric{alias: 2, value: uint32(1300)})), now)
+			Ω(r.Values).To(Equal(map[string]interface{}{"rpm": uint64(1300)}))
+			Ω(r.Rebirth).To(BeFalse())
+
+			r = h.Handle("b", of(sparkplug.NDeath, ""), decoded(payload(0, metric{name: "bdSeq", dataType: sparkplug.Int64, value: uint64(4)})), now)
+			Ω(r.Stale).To(BeTrue())
+			r = h.Handle("b", of(sparkplug.NDeath, ""), decoded(payload(0, metric{name: "bdSeq", dataType: sparkplug.Int64, value: uint64(5)})), now)
+			Ω(r.Presence).To(ConsistOf(sparkplug.Presence{Online: false}, sparkplug.Presence{Device: "pump7", Online: false}))
+		})
+
+		It("should ask for a rebirth when it lost track of the node", func() {
+			h := sparkplug.NewHost()
+			r := h.Handle("b", of(sparkplug.NData, ""), decoded(payload(7, metric{alias: 1, value: uint32(1)})), now)
+			Ω(r.Rebirth).To(BeTrue())
+			Ω(r.Values).To(BeEmpty())
+			r = h.Handle("b", of(sparkplug.NData, ""), decoded(payload(8, metric{alias: 1, value: uint32(1)})), now.Add(time.Second))
+			Ω(r.Rebirth).To(BeFalse(), "throttled")
+
+			h.Handle("b", of(sparkplug.NBirth, ""), decoded(payload(0, metric{name: "x", alias: 1, dataType: sparkplug.Double, value: 1.0})), now)
+			r = h.Handle("b", of(sparkplug.NData, ""), decoded(payload(1, metric{alias: 1, value: 2.0})), now)
+			Ω(r.Rebirth).To(BeFalse())
+			r = h.Handle("b", of(sparkplug.NData, ""), decoded(payload(3, metric{alias: 1, value: 3.0})), now.Add(sparkplug.RebirthInterval))
+			Ω(r.Rebirth).To(BeTrue(), "seq 2 is missing")
+			Ω(r.Values).To(Equal(map[string]interface{}{"x": 3.0}))
+
+			r = h.Handle("other", of(sparkplug.NData, ""), decoded(payload(1, metric{name: "x", value: 1.0})), now)
+			Ω(r.Rebirth).To(BeTrue(), "sessions are scoped")
+		})
+	})
+})
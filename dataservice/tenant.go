@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/auth"
+	"dataservice/tool"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// usageFlushInterval of the message counters
+const usageFlushInterval = 10 * time.Second
+
+// Tenant record, a zero quota is unlimited
+type Tenant struct {
+	ID                int64        `json:"id"`
+	Name              string       `json:"name"`
+	MaxBrokers        int          `json:"maxBrokers"`
+	MaxSubscriptions  int          `json:"maxSubscriptions"`
+	MaxMessagesPerDay int64        `json:"maxMessagesPerDay"`
+	Usage             *TenantUsage `json:"usage,omitempty"`
+	CreatedAt         time.Time    `json:"createdAt"`
+}
+
+// TenantUsage counted against the quotas
+type TenantUsage struct {
+	Brokers         int   `json:"brokers"`
+	Subscriptions   int   `json:"subscriptions"`
+	MessagesToday   int64 `json:"messagesToday"`
+	DuplicatesToday int64 `json:"duplicatesToday"` // dropped as redeliveries, not counted as messages
+}
+
+type tenantInput struct {
+	Name              *string `json:"name"`
+	MaxBrokers        *int    `json:"maxBrokers"`
+	MaxSubscriptions  *int    `json:"maxSubscriptions"`
+	MaxMessagesPerDay *int64  `json:"maxMessagesPerDay"`
+}
+
+func (input *tenantInput) apply(t *Tenant) {
+	if input.Name != nil {
+		t.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.MaxBrokers != nil {
+		t.MaxBrokers = *input.MaxBrokers
+	}
+	if input.MaxSubscriptions != nil {
+		t.MaxSubscriptions = *input.MaxSubscriptions
+	}
+	if input.MaxMessagesPerDay != nil {
+		t.MaxMessagesPerDay = *input.MaxMessagesPerDay
+	}
+}
+
+func (t *Tenant) validate() error {
+	if t.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if t.MaxBrokers < 0 || t.MaxSubscriptions < 0 || t.MaxMessagesPerDay < 0 {
+		return tool.Invalid("quotas must not be negative")
+	}
+	return nil
+}
+
+// tenantOf request, every authenticated request acts within a tenant
+func tenantOf(c *gin.Context) int64 {
+	if p := auth.PrincipalOf(c); p != nil {
+		return p.TenantID
+	}
+	return 0
+}
+
+const tenantColumns = `id, name, max_brokers, max_subscriptions, max_messages_per_day, created_at`
+
+func scanTenant(row rowScanner) (*Tenant, error) {
+	t := &Tenant{}
+	err := row.Scan(&t.ID, &t.Name, &t.MaxBrokers, &t.MaxSubscriptions, &t.MaxMessagesPerDay, &t.CreatedAt)
+	return t, err
+}
+
+func (_global *global) queryTenant(ctx context.Context, id int64) (*Tenant, error) {
+	t, err := scanTenant(_global.pgPool.QueryRowContext(ctx, `select `+tenantColumns+` from tenants where id = $1;`, id))
+	if err != nil {
+		return nil, dbError(err, "query tenant")
+	}
+	return t, nil
+}
+
+// withUsage attach current usage of tenant
+func (_global *global) withUsage(ctx context.Context, t *Tenant) (*Tenant, error) {
+	u := &TenantUsage{MessagesToday: _global.usage.today(t.ID), DuplicatesToday: _global.usage.duplicatesToday(t.ID)}
+	err := _global.pgPool.QueryRowContext(ctx, `select
+		(select count(*) from brokers where tenant_id = $1),
+		(select count(*) from subscriptions s join brokers b on b.id = s.broker_id where b.tenant_id = $1);`, t.ID,
+	).Scan(&u.Brokers, &u.Subscriptions)
+	if err != nil {
+		return nil, dbError(err, "query tenant usage")
+	}
+	t.Usage = u
+	return t, nil
+}
+
+// checkBrokerQuota lock tenant in tx and check one more broker fits its quota
+func checkBrokerQuota(ctx context.Context, tx *sql.Tx, tenantID int64) error {
+	var max, used int
+	err := tx.QueryRowContext(ctx, `select max_brokers, (select count(*) from brokers where tenant_id = $1)
+		from tenants where id = $1 for update;`, tenantID).Scan(&max, &used)
+	if err != nil {
+		return dbError(err, "check broker quota")
+	}
+	if max > 0 && used >= max {
+		return tool.Forbidden("broker quota of %d reached", max)
+	}
+	return nil
+}
+
+// checkSubscriptionQuota lock tenant in tx and check one more subscription fits its quota
+func checkSubscriptionQuota(ctx context.Context, tx *sql.Tx, tenantID int64) error {
+	var max, used int
+	err := tx.QueryRowContext(ctx, `select max_subscriptions,
+		(select count(*) from subscriptions s join brokers b on b.id = s.broker_id where b.tenant_id = $1)
+		from tenants where id = $1 for update;`, tenantID).Scan(&max, &used)
+	if err != nil {
+		return dbError(err, "check subscription quota")
+	}
+	if max > 0 && used >= max {
+		return tool.Forbidden("subscription quota of %d reached", max)
+	}
+	return nil
+}
+
+// messageUsage count messages and duplicates per tenant per day in memory, shared through tenant_usage
+type messageUsage struct {
+	sync.Mutex
+	pgPool            *sql.DB
+	day               string
+	counts            map[int64]int64 // today including other instances as of the last flush
+	pending           map[int64]int64 // counted here, not flushed yet
+	duplicates        map[int64]int64 // as counts
+	pendingDuplicates map[int64]int64 // as pending
+	limits            map[int64]int64
+	exceeded          map[int64]bool
+	load              func(ctx context.Context, tenantID int64, day string) (limit, used int64, err error)
+}
+
+func newMessageUsage(pgPool *sql.DB) *messageUsage {
+	u := &messageUsage{
+		pgPool:            pgPool,
+		day:               time.Now().UTC().Format("2006-01-02"),
+		counts:            make(map[int64]int64),
+		pending:           make(map[int64]int64),
+		duplicates:        make(map[int64]int64),
+		pendingDuplicates: make(map[int64]int64),
+		limits:            make(map[int64]int64),
+		exceeded:          make(map[int64]bool),
+	}
+	u.load = u.loadLimit
+	return u
+}
+
+// rollover reset counters on a new day, caller holds the lock
+func (u *messageUsage) rollover(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	if day != u.day {
+		u.day = day
+		u.counts = make(map[int64]int64)
+		u.duplicates = make(map[int64]int64)
+		u.exceeded = make(map[int64]bool)
+	}
+}
+
+// duplicate count one dropped duplicate of tenant
+func (u *messageUsage) duplicate(tenantID int64) {
+	u.Lock()
+	defer u.Unlock()
+
+	u.rollover(time.Now())
+	u.duplicates[tenantID]++
+	u.pendingDuplicates[tenantID]++
+}
+
+// allow count one message of tenant, first reports the first refusal of the day; the quota of an unseen tenant
+// is loaded outside the lock and a failed load refuses the message rather than leave the tenant unlimited
+func (u *messageUsage) allow(ctx context.Context, tenantID int64) (ok, first bool, err error) {
+	u.Lock()
+	u.rollover(time.Now())
+	_, known := u.limits[tenantID]
+	day := u.day
+	u.Unlock()
+	if !known {
+		limit, used, err := u.load(ctx, tenantID, day)
+		if err != nil {
+			return false, false, err
+		}
+		u.Lock()
+		u.limits[tenantID] = limit
+		if day == u.day && used > u.counts[tenantID] {
+			u.counts[tenantID] = used
+		}
+		u.Unlock()
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.rollover(time.Now())
+	limit := u.limits[tenantID]
+	if limit > 0 && u.counts[tenantID] >= limit {
+		first = !u.exceeded[tenantID]
+		u.exceeded[tenantID] = true
+		return false, first, nil
+	}
+	u.counts[tenantID]++
+	u.pending[tenantID]++
+	return true, false, nil
+}
+
+// loadLimit of tenant along with what all instances flushed of day, tenants without a row have no quota
+func (u *messageUsage) loadLimit(ctx context.Context, tenantID int64, day string) (limit, used int64, err error) {
+	err = u.pgPool.QueryRowContext(ctx, `select t.max_messages_per_day, coalesce(u.messages, 0) from tenants t
+		left join tenant_usage u on u.tenant_id = t.id and u.day = $2 where t.id = $1;`, tenantID, day).Scan(&limit, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	return limit, used, dbError(err, "load message quota")
+}
+
+func (u *messageUsage) today(tenantID int64) int64 {
+	u.Lock()
+	defer u.Unlock()
+
+	u.rollover(time.Now())
+	return u.counts[tenantID]
+}
+
+func (u *messageUsage) duplicatesToday(tenantID int64) int64 {
+	u.Lock()
+	defer u.Unlock()
+
+	u.rollover(time.Now())
+	return u.duplicates[tenantID]
+}
+
+// forget cached limit of tenant, it is reloaded on the next message
+func (u *messageUsage) forget(tenantID int64) {
+	u.Lock()
+	defer u.Unlock()
+
+	delete(u.limits, tenantID)
+	delete(u.exceeded, tenantID)
+}
+
+// flush pending counts and refresh counts and limits written by other instances, so that in a cluster
+// each instance refuses messages once the instances together used up the quota, give or take a flush interval
+func (u *messageUsage) flush(ctx context.Context) error {
+	u.Lock()
+	pending, duplicates, day := u.pending, u.pendingDuplicates, u.day
+	u.pending, u.pendingDuplicates = make(map[int64]int64), make(map[int64]int64)
+	u.Unlock()
+
+	for tenantID := range duplicates {
+		pending[tenantID] += 0
+	}
+	for tenantID, n := range pending {
+		_, err := u.pgPool.ExecContext(ctx, `insert into tenant_usage (tenant_id, day, messages, duplicates) values ($1, $2, $3, $4)
+			on conflict (tenant_id, day) do update set messages = tenant_usage.messages + excluded.messages,
+			duplicates = tenant_usage.duplicates + excluded.duplicates;`, tenantID, day, n, duplicates[tenantID])
+		if err != nil {
+			// keep what is not written yet for the next flush
+			u.Lock()
+			for tenantID, n := range pending {
+				u.pending[tenantID] += n
+			}
+			for tenantID, n := range duplicates {
+				u.pendingDuplicates[tenantID] += n
+			}
+			u.Unlock()
+			return dbError(err, "flush message usage")
+		}
+		delete(pending, tenantID)
+		delete(duplicates, tenantID)
+	}
+
+	rows, err := u.pgPool.QueryContext(ctx, `select t.id, t.max_messages_per_day, coalesce(u.messages, 0), coalesce(u.duplicates, 0) from tenants t
+		left join tenant_usage u on u.tenant_id = t.id and u.day = $1;`, day)
+	if err != nil {
+		return dbError(err, "refresh message usage")
+	}
+	defer rows.Close()
+
+	u.Lock()
+	defer u.Unlock()
+	for rows.Next() {
+		var tenantID, limit, used, duplicates int64
+		if err := rows.Scan(&tenantID, &limit, &used, &duplicates); err != nil {
+			return dbError(err, "scan message usage")
+		}
+		u.limits[tenantID] = limit
+		if day == u.day && used+u.pending[tenantID] > u.counts[tenantID] {
+			u.counts[tenantID] = used + u.pending[tenantID]
+		}
+		if day == u.day && duplicates+u.pendingDuplicates[tenantID] > u.duplicates[tenantID] {
+			u.duplicates[tenantID] = duplicates + u.pendingDuplicates[tenantID]
+		}
+	}
+	return dbError(rows.Err(), "refresh message usage")
+}
+
+// run flush periodically until ctx is done, with a last flush on the way out
+func (u *messageUsage) run(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			tool.ErrorThenPrint(u.flush(fctx), "flush message usage")
+			cancel()
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			tool.ErrorThenPrint(u.flush(fctx), "flush message usage")
+			cancel()
+			return
+		}
+	}
+}
+
+func (_global *global) listTenants(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select `+tenantColumns+` from tenants order by id;`)
+	if err != nil {
+		c.Error(dbError(err, "query tenants"))
+		return
+	}
+	defer rows.Close()
+
+	tenants := []*Tenant{}
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			c.Error(dbError(err, "scan tenant"))
+			return
+		}
+		tenants = append(tenants, t)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query tenants"))
+		return
+	}
+	c.JSON(http.StatusOK, tenants)
+}
+
+func (_global *global) getTenant(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	_global.respondTenant(c, ctx, id)
+}
+
+// getOwnTenant of the caller, with its quotas and usage
+func (_global *global) getOwnTenant(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	_global.respondTenant(c, ctx, tenantOf(c))
+}
+
+func (_global *global) respondTenant(c *gin.Context, ctx context.Context, id int64) {
+	t, err := _global.queryTenant(ctx, id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if t, err = _global.withUsage(ctx, t); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func (_global *global) createTenant(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input tenantInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	t := &Tenant{}
+	input.apply(t)
+	if err := t.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.pgPool.QueryRowContext(ctx, `insert into tenants (name, max_brokers, max_subscriptions, max_messages_per_day)
+		values ($1, $2, $3, $4) returning id, created_at;`, t.Name, t.MaxBrokers, t.MaxSubscriptions, t.MaxMessagesPerDay,
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert tenant"))
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+func (_global *global) updateTenant(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input tenantInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	t, err := _global.queryTenant(ctx, id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(t)
+	if err := t.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	_, err = _global.pgPool.ExecContext(ctx, `update tenants set name = $2, max_brokers = $3, max_subscriptions = $4, max_messages_per_day = $5
+		where id = $1;`, t.ID, t.Name, t.MaxBrokers, t.MaxSubscriptions, t.MaxMessagesPerDay)
+	if err != nil {
+		c.Error(dbError(err, "update tenant"))
+		return
+	}
+	_global.usage.forget(t.ID)
+	c.JSON(http.StatusOK, t)
+}
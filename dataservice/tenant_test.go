@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"dataservice/tool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tenant", func() {
+	It("should patch only given quotas", func() {
+		t := &Tenant{Name: "acme", MaxBrokers: 2, MaxSubscriptions: 10}
+		var input tenantInput
+		Ω(json.Unmarshal([]byte(`{"maxBrokers": 5, "maxMessagesPerDay": 1000}`), &input)).To(Succeed())
+		input.apply(t)
+
+		Ω(t.Name).To(Equal("acme"))
+		Ω(t.MaxBrokers).To(Equal(5))
+		Ω(t.MaxSubscriptions).To(Equal(10))
+		Ω(t.MaxMessagesPerDay).To(Equal(int64(1000)))
+		Ω(t.validate()).To(Succeed())
+	})
+
+	It("should reject negative quotas", func() {
+		Ω(tool.KindOf((&Tenant{Name: "acme", MaxBrokers: -1}).validate())).To(Equal(tool.KindInvalid))
+		Ω(tool.KindOf((&Tenant{}).validate())).To(Equal(tool.KindInvalid))
+	})
+})
+
+var _ = Describe("message usage", func() {
+	var u *messageUsage
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		u = newMessageUsage(nil)
+		u.limits[1] = 2
+		u.limits[2] = 0
+	})
+
+	It("should refuse messages over the daily quota and report it once", func() {
+		ok, _, _ := u.allow(ctx, 1)
+		Ω(ok).To(BeTrue())
+		ok, _, _ = u.allow(ctx, 1)
+		Ω(ok).To(BeTrue())
+
+		ok, first, _ := u.allow(ctx, 1)
+		Ω(ok).To(BeFalse())
+		Ω(first).To(BeTrue())
+		ok, first, _ = u.allow(ctx, 1)
+		Ω(ok).To(BeFalse())
+		Ω(first).To(BeFalse())
+
+		Ω(u.today(1)).To(Equal(int64(2)))
+		Ω(u.pending[1]).To(Equal(int64(2)))
+	})
+
+	It("should not limit tenants without quota", func() {
+		for i := 0; i < 100; i++ {
+			ok, _, _ := u.allow(ctx, 2)
+			Ω(ok).To(BeTrue())
+		}
+		Ω(u.today(2)).To(Equal(int64(100)))
+	})
+
+	It("should count tenants apart", func() {
+		u.allow(ctx, 1)
+		u.allow(ctx, 1)
+		ok, _, _ := u.allow(ctx, 2)
+		Ω(ok).To(BeTrue())
+		Ω(u.today(1)).To(Equal(int64(2)))
+		Ω(u.today(2)).To(Equal(int64(1)))
+	})
+
+	It("should start over on a new day", func() {
+		u.allow(ctx, 1)
+		u.allow(ctx, 1)
+		u.allow(ctx, 1)
+
+		u.day = time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+		ok, _, _ := u.allow(ctx, 1)
+		Ω(ok).To(BeTrue())
+		Ω(u.today(1)).To(Equal(int64(1)))
+	})
+
+	It("should refuse messages while the quota cannot load and not cache the failure", func() {
+		u.load = func(ctx context.Context, tenantID int64, day string) (int64, int64, error) {
+			return 0, 0, tool.Unavailable("database is down")
+		}
+		ok, _, err := u.allow(ctx, 3)
+		Ω(ok).To(BeFalse())
+		Ω(tool.KindOf(err)).To(Equal(tool.KindUnavailable))
+		Ω(u.limits).ToNot(HaveKey(int64(3)))
+
+		u.load = func(ctx context.Context, tenantID int64, day string) (int64, int64, error) {
+			return 5, 5, nil
+		}
+		ok, first, err := u.allow(ctx, 3)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(ok).To(BeFalse(), "other instances used up the quota")
+		Ω(first).To(BeTrue())
+	})
+
+	It("should count duplicates apart from messages", func() {
+		u.allow(ctx, 1)
+		u.duplicate(1)
+		u.duplicate(1)
+		Ω(u.today(1)).To(Equal(int64(1)))
+		Ω(u.duplicatesToday(1)).To(Equal(int64(2)))
+		Ω(u.pendingDuplicates[1]).To(Equal(int64(2)))
+	})
+})
@@ -0,0 +1,129 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind of error, decides how callers and the HTTP layer react to it
+type Kind int
+
+// kinds of error
+const (
+	KindInternal Kind = iota
+	KindNotFound
+	KindConflict
+	KindUnavailable
+	KindInvalid
+	KindUnauthorized
+	KindForbidden
+	KindRateLimited
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not found"
+	case KindConflict:
+		return "conflict"
+	case KindUnavailable:
+		return "upstream unavailable"
+	case KindInvalid:
+		return "invalid input"
+	case KindUnauthorized:
+		return "unauthorized"
+	case KindForbidden:
+		return "forbidden"
+	case KindRateLimited:
+		return "rate limited"
+	default:
+		return "internal"
+	}
+}
+
+// KindError error with a kind, optionally wrapping a cause
+type KindError struct {
+	Kind Kind
+	Msg  string
+	Err  error
+}
+
+func (e *KindError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s -- %s", e.Msg, e.Err)
+}
+
+func (e *KindError) Unwrap() error {
+	return e.Err
+}
+
+// Is match errors of the same kind, so errors.Is(err, tool.ErrNotFound) works
+func (e *KindError) Is(target error) bool {
+	t, ok := target.(*KindError)
+	return ok && t.Msg == "" && t.Err == nil && t.Kind == e.Kind
+}
+
+// sentinels for errors.Is
+var (
+	ErrNotFound     = &KindError{Kind: KindNotFound}
+	ErrConflict     = &KindError{Kind: KindConflict}
+	ErrUnavailable  = &KindError{Kind: KindUnavailable}
+	ErrInvalid      = &KindError{Kind: KindInvalid}
+	ErrUnauthorized = &KindError{Kind: KindUnauthorized}
+	ErrForbidden    = &KindError{Kind: KindForbidden}
+	ErrRateLimited  = &KindError{Kind: KindRateLimited}
+)
+
+// Wrap err with kind and msg, nil err stays nil
+func Wrap(kind Kind, err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return &KindError{Kind: kind, Msg: msg, Err: err}
+}
+
+// NotFound error
+func NotFound(format string, args ...interface{}) error {
+	return &KindError{Kind: KindNotFound, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Conflict error
+func Conflict(format string, args ...interface{}) error {
+	return &KindError{Kind: KindConflict, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Unavailable error
+func Unavailable(format string, args ...interface{}) error {
+	return &KindError{Kind: KindUnavailable, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Invalid error
+func Invalid(format string, args ...interface{}) error {
+	return &KindError{Kind: KindInvalid, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Unauthorized error
+func Unauthorized(format string, args ...interface{}) error {
+	return &KindError{Kind: KindUnauthorized, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Forbidden error
+func Forbidden(format string, args ...interface{}) error {
+	return &KindError{Kind: KindForbidden, Msg: fmt.Sprintf(format, args...)}
+}
+
+// RateLimited error
+func RateLimited(format string, args ...interface{}) error {
+	return &KindError{Kind: KindRateLimited, Msg: fmt.Sprintf(format, args...)}
+}
+
+// KindOf err, errors without a kind are internal
+func KindOf(err error) Kind {
+	var ke *KindError
+	if errors.As(err, &ke) {
+		return ke.Kind
+	}
+	return KindInternal
+}
@@ -0,0 +1,36 @@
+package tool
+
+import (
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("errors", func() {
+	It("should keep kind through wrapping", func() {
+		err := fmt.Errorf("handler -- %w", NotFound("there is no such broker [%s]", "tcp://a:1883"))
+		Ω(KindOf(err)).To(Equal(KindNotFound))
+		Ω(errors.Is(err, ErrNotFound)).To(BeTrue())
+		Ω(errors.Is(err, ErrConflict)).To(BeFalse())
+		Ω(err.Error()).To(ContainSubstring("tcp://a:1883"))
+	})
+
+	It("should wrap cause", func() {
+		cause := errors.New("connection refused")
+		err := Wrap(KindUnavailable, cause, "connect broker")
+		Ω(KindOf(err)).To(Equal(KindUnavailable))
+		Ω(errors.Is(err, cause)).To(BeTrue())
+		Ω(err.Error()).To(Equal("connect broker -- connection refused"))
+	})
+
+	It("should keep nil", func() {
+		Ω(Wrap(KindInvalid, nil, "decode")).To(BeNil())
+	})
+
+	It("should treat plain errors as internal", func() {
+		Ω(KindOf(errors.New("boom"))).To(Equal(KindInternal))
+		Ω(KindOf(nil)).To(Equal(KindInternal))
+	})
+})
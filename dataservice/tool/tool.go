@@ -2,7 +2,7 @@ package tool
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 )
 
 // Error get error from any interface{}
@@ -19,34 +19,38 @@ func Error(x interface{}) (err error) {
 	return
 }
 
-// CheckThenPanic check err, if nil print ok, else panic error.
-func CheckThenPanic(err error, msg string) {
+// CheckThenPanic check err, if nil log ok at debug level, else panic error.
+func CheckThenPanic(err error, msg string, args ...any) {
 	if err != nil {
-		panic(fmt.Errorf("%s <FAILURE> -- %s", msg, err))
-	} else {
-		log.Printf("%s <SUCCESS>", msg)
+		panic(fmt.Errorf("%s <FAILURE> -- %w", msg, err))
 	}
+	slog.Debug(msg, args...)
+}
+
+// CheckThenPrint check err, if nil log ok at debug level, else log error.
+func CheckThenPrint(err error, msg string, args ...any) {
+	CheckThenLog(slog.Default(), err, msg, args...)
 }
 
-// CheckThenPrint check err, if nil print ok, else print error.
-func CheckThenPrint(err error, msg string) {
+// CheckThenLog check err with logger l, if nil log ok at debug level, else log error.
+func CheckThenLog(l *slog.Logger, err error, msg string, args ...any) {
 	if err != nil {
-		log.Printf("%s <FAILURE> -- %s", msg, err)
+		l.Error(msg, append(args, "err", err)...)
 	} else {
-		log.Printf("%s <SUCCESS>", msg)
+		l.Debug(msg, args...)
 	}
 }
 
 // ErrorThenPanic check error and panic
 func ErrorThenPanic(err error, msg string) {
 	if err != nil {
-		panic(fmt.Errorf("%s -- %s", msg, err))
+		panic(fmt.Errorf("%s -- %w", msg, err))
 	}
 }
 
-// ErrorThenPrint check error and print
-func ErrorThenPrint(err error, msg string) {
+// ErrorThenPrint check error and log
+func ErrorThenPrint(err error, msg string, args ...any) {
 	if err != nil {
-		log.Printf("%s -- %s", msg, err)
+		slog.Error(msg, append(args, "err", err)...)
 	}
 }
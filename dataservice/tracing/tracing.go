@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "dataservice"
+	shutdownTimeout     = 5 * time.Second
+)
+
+// Config of trace exporting
+type Config struct {
+	Endpoint    string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+}
+
+// Init install the global tracer provider, spans are exported via OTLP/HTTP to
+// cfg.Endpoint, an empty endpoint keeps propagation but exports nothing.
+func Init(cfg Config) (freeFunc func(), err error) {
+	var opts []sdktrace.TracerProviderOption
+
+	if cfg.Endpoint != "" {
+		clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return Install(cfg, opts...), nil
+}
+
+// Install set up the global tracer provider with extra options, such as an
+// in-memory exporter in tests.
+func Install(cfg Config, opts ...sdktrace.TracerProviderOption) (freeFunc func()) {
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	opts = append(opts,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	provider := sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = provider.Shutdown(ctx)
+	}
+}
+
+// Tracer of the service
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// AMQPHeaders adapts amqp headers to a propagation carrier
+type AMQPHeaders amqp.Table
+
+// Get value of key
+func (h AMQPHeaders) Get(key string) string {
+	if v, ok := h[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// Set key to value
+func (h AMQPHeaders) Set(key, value string) {
+	h[key] = value
+}
+
+// Keys in headers
+func (h AMQPHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// UserProperties adapts MQTT 5 user properties to a propagation carrier
+type UserProperties map[string]string
+
+// Get value of key
+func (p UserProperties) Get(key string) string {
+	return p[key]
+}
+
+// Set key to value
+func (p UserProperties) Set(key, value string) {
+	p[key] = value
+}
+
+// Keys in properties
+func (p UserProperties) Keys() []string {
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject trace context of ctx into carrier
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+}
+
+// Extract trace context from carrier into ctx
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/streadway/amqp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var _ = Describe("tracing", func() {
+	var exporter *tracetest.InMemoryExporter
+	var free func()
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		free = Install(Config{ServiceName: "test"}, sdktrace.WithSyncer(exporter))
+	})
+
+	AfterEach(func() {
+		free()
+	})
+
+	It("should continue trace through amqp headers", func() {
+		By("publish")
+		ctx, receive := Tracer().Start(context.Background(), "mqtt receive")
+		headers := amqp.Table{}
+		Inject(ctx, AMQPHeaders(headers))
+		receive.End()
+		Ω(headers).To(HaveKey("traceparent"))
+
+		By("consume")
+		ctx = Extract(context.Background(), AMQPHeaders(headers))
+		_, persist := Tracer().Start(ctx, "persistent message")
+		persist.End()
+
+		spans := exporter.GetSpans()
+		Ω(spans).To(HaveLen(2))
+		Ω(spans[1].Parent.SpanID()).To(Equal(spans[0].SpanContext.SpanID()))
+		Ω(spans[1].SpanContext.TraceID()).To(Equal(spans[0].SpanContext.TraceID()))
+	})
+
+	It("should honor trace context in user properties", func() {
+		ctx, upstream := Tracer().Start(context.Background(), "device publish")
+		props := UserProperties{}
+		Inject(ctx, props)
+		upstream.End()
+
+		ctx = Extract(context.Background(), props)
+		_, receive := Tracer().Start(ctx, "mqtt receive")
+		receive.End()
+
+		spans := exporter.GetSpans()
+		Ω(spans).To(HaveLen(2))
+		Ω(spans[1].Parent.SpanID()).To(Equal(spans[0].SpanContext.SpanID()))
+	})
+
+	It("should ignore non-string header values", func() {
+		headers := AMQPHeaders{"traceparent": int32(1)}
+		Ω(headers.Get("traceparent")).To(BeEmpty())
+	})
+})
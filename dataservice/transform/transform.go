@@ -0,0 +1,175 @@
+package transform
+
+import (
+	"dataservice/tool"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// limits of scripts and their runs
+const (
+	MaxSource   = 64 << 10
+	MaxMessages = 100
+	maxLogs     = 50
+	// loadTimeout bound the top level code of a script run on compile
+	loadTimeout = time.Second
+	// poolSize of the idle runtimes kept by each script
+	poolSize = 8
+)
+
+// Meta of the message handed to a script as its second argument
+type Meta struct {
+	Topic      string `json:"topic"`
+	DeviceID   string `json:"deviceId"`
+	DeviceType string `json:"deviceType"`
+	TenantID   int64  `json:"tenantId"`
+}
+
+// Result of a run, no messages means the message is dropped
+type Result struct {
+	Messages []json.RawMessage `json:"messages"`
+	Logs     []string          `json:"logs"`
+}
+
+// Script defining function transform(msg, meta), msg is the decoded json payload or the payload as
+// string when it is not json, it returns a message, an array of messages, or null to drop the message.
+// Runs share pooled runtimes, so top level code runs once per runtime and globals may outlive a message.
+type Script struct {
+	program  *goja.Program
+	runtimes chan *runtime // idle ones
+}
+
+// runtime a script is loaded into, it serves one run at a time
+type runtime struct {
+	vm        *goja.Runtime
+	transform goja.Callable
+	logs      *[]string // of the current run
+}
+
+// Compile script, it must define transform
+func Compile(source string) (*Script, error) {
+	if len(source) > MaxSource {
+		return nil, tool.Invalid("script is larger than %d bytes", MaxSource)
+	}
+	program, err := goja.Compile("transform.js", source, true)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "compile script")
+	}
+	s := &Script{program: program, runtimes: make(chan *runtime, poolSize)}
+	rt, err := s.load(loadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.runtimes <- rt
+	return s, nil
+}
+
+// load script into a new runtime, which has no access to anything but the language itself and console.log
+func (s *Script) load(timeout time.Duration) (*runtime, error) {
+	vm := goja.New()
+	rt := &runtime{vm: vm}
+	vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+	console := vm.NewObject()
+	_ = console.Set("log", func(call goja.FunctionCall) goja.Value {
+		if rt.logs != nil && len(*rt.logs) < maxLogs {
+			args := make([]string, len(call.Arguments))
+			for i, arg := range call.Arguments {
+				args[i] = arg.String()
+			}
+			*rt.logs = append(*rt.logs, strings.Join(args, " "))
+		}
+		return goja.Undefined()
+	})
+	_ = vm.Set("console", console)
+
+	timer := time.AfterFunc(timeout, func() { vm.Interrupt("timeout") })
+	defer timer.Stop()
+	if _, err := vm.RunProgram(s.program); err != nil {
+		return nil, runError(err, timeout, "run script")
+	}
+	fn, ok := goja.AssertFunction(vm.Get("transform"))
+	if !ok {
+		return nil, tool.Invalid("script does not define function transform(msg, meta)")
+	}
+	rt.transform = fn
+	return rt, nil
+}
+
+// acquire an idle runtime or load a new one
+func (s *Script) acquire(timeout time.Duration) (*runtime, error) {
+	select {
+	case rt := <-s.runtimes:
+		return rt, nil
+	default:
+		return s.load(timeout)
+	}
+}
+
+// release runtime rt for the next runs unless enough are idle
+func (s *Script) release(rt *runtime) {
+	rt.logs = nil
+	select {
+	case s.runtimes <- rt:
+	default:
+	}
+}
+
+func runError(err error, timeout time.Duration, msg string) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return tool.Invalid("script ran longer than %s", timeout)
+	}
+	return tool.Wrap(tool.KindInvalid, err, msg)
+}
+
+// Run script on payload, it is interrupted after timeout; runtimes of runs which fail are not reused
+func (s *Script) Run(payload []byte, meta Meta, timeout time.Duration) (*Result, error) {
+	rt, err := s.acquire(timeout)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Messages: []json.RawMessage{}, Logs: []string{}}
+	rt.logs = &result.Logs
+
+	var msg interface{}
+	if json.Unmarshal(payload, &msg) != nil {
+		msg = string(payload)
+	}
+	timer := time.AfterFunc(timeout, func() { rt.vm.Interrupt("timeout") })
+	out, err := rt.transform(goja.Undefined(), rt.vm.ToValue(msg), rt.vm.ToValue(meta))
+	if interrupted := !timer.Stop(); err != nil || interrupted {
+		if err == nil {
+			err = &goja.InterruptedError{}
+		}
+		return result, runError(err, timeout, "run transform")
+	}
+	defer s.release(rt)
+
+	if goja.IsUndefined(out) || goja.IsNull(out) {
+		return result, nil
+	}
+	exported := out.Export()
+	items, isArray := exported.([]interface{})
+	if !isArray {
+		items = []interface{}{exported}
+	}
+	if len(items) > MaxMessages {
+		return result, tool.Invalid("script returned %d messages, more than %d", len(items), MaxMessages)
+	}
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return result, tool.Wrap(tool.KindInvalid, err, fmt.Sprintf("encode message %d", i))
+		}
+		result.Messages = append(result.Messages, b)
+	}
+	return result, nil
+}
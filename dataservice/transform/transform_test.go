@@ -0,0 +1,122 @@
+package transform_test
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"dataservice/tool"
+	"dataservice/transform"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transform", func() {
+	meta := transform.Meta{Topic: "devices/pump-1/telemetry", DeviceID: "pump-1", DeviceType: "pump", TenantID: 1}
+	run := func(source, payload string) (*transform.Result, error) {
+		s, err := transform.Compile(source)
+		Ω(err).ToNot(HaveOccurred())
+		return s.Run([]byte(payload), meta, 100*time.Millisecond)
+	}
+	messages := func(r *transform.Result) []string {
+		out := []string{}
+		for _, m := range r.Messages {
+			out = append(out, string(m))
+		}
+		return out
+	}
+
+	It("should rename fields and convert units", func() {
+		r, err := run(`function transform(msg, meta) {
+			return {device: meta.deviceId, temperature: (msg.tempF - 32) * 5 / 9};
+		}`, `{"tempF": 212}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(r.Messages).To(HaveLen(1))
+		Ω(r.Messages[0]).To(MatchJSON(`{"device": "pump-1", "temperature": 100}`))
+	})
+
+	It("should split a message into many", func() {
+		r, err := run(`function transform(msg) {
+			return msg.readings.map(function (v, i) { return {channel: i, value: v}; });
+		}`, `{"readings": [1, 2, 3]}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(messages(r)).To(Equal([]string{`{"channel":0,"value":1}`, `{"channel":1,"value":2}`, `{"channel":2,"value":3}`}))
+	})
+
+	It("should drop messages", func() {
+		r, err := run(`function transform(msg) { return msg.test ? null : msg; }`, `{"test": true}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(r.Messages).To(BeEmpty())
+	})
+
+	It("should hand over payloads which are not json as string", func() {
+		r, err := run(`function transform(msg) { console.log("raw", msg); var p = msg.split(","); return {a: +p[0], b: +p[1]}; }`, `1,2`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(r.Messages[0]).To(MatchJSON(`{"a": 1, "b": 2}`))
+		Ω(r.Logs).To(Equal([]string{"raw 1,2"}))
+	})
+
+	It("should interrupt scripts running too long", func() {
+		r, err := run(`function transform(msg) { while (true) {} }`, `{}`)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+		Ω(err.Error()).To(ContainSubstring("longer than"))
+		Ω(r.Messages).To(BeEmpty())
+
+		_, err = transform.Compile(`while (true) {} function transform(msg) { return msg; }`)
+		Ω(err.Error()).To(ContainSubstring("longer than"))
+	})
+
+	It("should keep scripts in the sandbox", func() {
+		r, err := run(`function transform(msg) {
+			return {require: typeof require, process: typeof process, fetch: typeof fetch, setTimeout: typeof setTimeout};
+		}`, `{}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(r.Messages[0]).To(MatchJSON(`{"require": "undefined", "process": "undefined", "fetch": "undefined", "setTimeout": "undefined"}`))
+	})
+
+	It("should run top level code once per pooled runtime", func() {
+		s, err := transform.Compile(`var loads = 0; loads++; function transform(msg) { console.log("run"); return {loads: loads}; }`)
+		Ω(err).ToNot(HaveOccurred())
+		for i := 0; i < 2; i++ {
+			r, err := s.Run([]byte(`{}`), meta, time.Second)
+			Ω(err).ToNot(HaveOccurred())
+			Ω(r.Messages[0]).To(MatchJSON(`{"loads": 1}`))
+			Ω(r.Logs).To(Equal([]string{"run"}))
+		}
+	})
+
+	It("should not reuse runtimes of interrupted runs", func() {
+		s, err := transform.Compile(`var runs = 0; function transform(msg) { runs++; if (msg.spin) { while (true) {} } return {runs: runs}; }`)
+		Ω(err).ToNot(HaveOccurred())
+		_, err = s.Run([]byte(`{"spin": true}`), meta, 50*time.Millisecond)
+		Ω(err.Error()).To(ContainSubstring("longer than"))
+		r, err := s.Run([]byte(`{}`), meta, time.Second)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(r.Messages[0]).To(MatchJSON(`{"runs": 1}`))
+	})
+
+	DescribeTable("reject",
+		func(source, payload, reason string) {
+			s, err := transform.Compile(source)
+			if err == nil {
+				_, err = s.Run([]byte(payload), meta, time.Second)
+			}
+			Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+			Ω(err.Error()).To(ContainSubstring(reason))
+		},
+		Entry("syntax errors", `function transform(msg) {`, `{}`, "compile"),
+		Entry("no transform", `function other(msg) { return msg; }`, `{}`, "does not define"),
+		Entry("throwing", `function transform(msg) { throw new Error("bad reading"); }`, `{}`, "bad reading"),
+		Entry("too many messages", `function transform(msg) { return new Array(101).fill(1); }`, `{}`, "more than 100"),
+		Entry("huge sources", "function transform(msg) { return msg; }//"+strings.Repeat("x", transform.MaxSource), `{}`, "larger than"),
+	)
+
+	It("should encode messages as json", func() {
+		r, err := run(`function transform(msg) { return [msg, null, 42]; }`, `{"a": [1]}`)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(json.Valid(r.Messages[1])).To(BeTrue())
+		Ω(messages(r)).To(Equal([]string{`{"a":[1]}`, `42`}))
+	})
+})
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/connector"
+	"dataservice/tool"
+	"dataservice/transform"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// Transform script applied to the telemetry of matching topics and device types before it is stored
+type Transform struct {
+	ID          int64     `json:"id"`
+	TenantID    int64     `json:"tenantId"`
+	Name        string    `json:"name"`
+	TopicFilter string    `json:"topicFilter"` // empty for any topic
+	DeviceType  string    `json:"deviceType"`  // empty for any device or none
+	Version     int       `json:"version"`     // active version
+	Script      string    `json:"script"`      // of the active version
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+
+	compiled *transform.Script
+}
+
+// TransformVersion script of a version
+type TransformVersion struct {
+	Version   int       `json:"version"`
+	Script    string    `json:"script"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// transformInput body of create and patch, a new script becomes a new version,
+// a version alone activates an older one
+type transformInput struct {
+	Name        *string `json:"name"`
+	TopicFilter *string `json:"topicFilter"`
+	DeviceType  *string `json:"deviceType"`
+	Script      *string `json:"script"`
+	Version     *int    `json:"version"`
+	Enabled     *bool   `json:"enabled"`
+}
+
+// transformTestInput body of testTransform, a string payload is handed over as raw text
+type transformTestInput struct {
+	Script     string          `json:"script"`
+	Payload    json.RawMessage `json:"payload"`
+	Topic      string          `json:"topic"`
+	DeviceID   string          `json:"deviceId"`
+	DeviceType string          `json:"deviceType"`
+}
+
+// transformTestResult of testTransform
+type transformTestResult struct {
+	*transform.Result
+	Error string `json:"error,omitempty"`
+}
+
+func (t *Transform) validate() error {
+	if t.Name == "" {
+		return tool.Invalid("name is required")
+	}
+	if t.TopicFilter == "" && t.DeviceType == "" {
+		return tool.Invalid("topicFilter or deviceType is required")
+	}
+	if t.TopicFilter != "" {
+		if err := connector.ValidFilter(t.TopicFilter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applies to messages on topic of a device of deviceType
+func (t *Transform) applies(topic, deviceType string) bool {
+	return (t.TopicFilter == "" || connector.MatchTopic(t.TopicFilter, topic)) && (t.DeviceType == "" || t.DeviceType == deviceType)
+}
+
+const transformColumns = `t.id, t.tenant_id, t.name, t.topic_filter, t.device_type, t.version, v.script, t.enabled, t.created_at, t.updated_at`
+
+func queryTransforms(ctx context.Context, pgPool *sql.DB, query string, args ...interface{}) ([]*Transform, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+transformColumns+` from transforms t
+		join transform_versions v on v.transform_id = t.id and v.version = t.version `+query, args...)
+	if err != nil {
+		return nil, dbError(err, "query transforms")
+	}
+	defer rows.Close()
+
+	transforms := []*Transform{}
+	for rows.Next() {
+		t := &Transform{}
+		if err := rows.Scan(&t.ID, &t.TenantID, &t.Name, &t.TopicFilter, &t.DeviceType, &t.Version, &t.Script, &t.Enabled,
+			&t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, dbError(err, "scan transform")
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, dbError(rows.Err(), "query transforms")
+}
+
+type cachedTransforms struct {
+	transforms []*Transform
+	expires    time.Time
+}
+
+// transformer run the enabled transforms of a tenant in order, each on the messages of the one before
+type transformer struct {
+	sync.Mutex
+	pgPool  *sql.DB
+	timeout time.Duration
+	tenants map[int64]cachedTransforms
+}
+
+func newTransformer(pgPool *sql.DB, timeout time.Duration) *transformer {
+	return &transformer{pgPool: pgPool, timeout: timeout, tenants: make(map[int64]cachedTransforms)}
+}
+
+func (tr *transformer) tenantTransforms(ctx context.Context, tenantID int64) ([]*Transform, error) {
+	tr.Lock()
+	cached, ok := tr.tenants[tenantID]
+	tr.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.transforms, nil
+	}
+
+	loaded, err := queryTransforms(ctx, tr.pgPool, `where t.tenant_id = $1 and t.enabled order by t.id;`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	transforms := loaded[:0]
+	for _, t := range loaded {
+		if t.compiled, err = transform.Compile(t.Script); err != nil {
+			_Log.Warn("skip broken transform", "transform", t.ID, "version", t.Version, "err", err)
+			continue
+		}
+		transforms = append(transforms, t)
+	}
+	tr.Lock()
+	tr.tenants[tenantID] = cachedTransforms{transforms: transforms, expires: time.Now().Add(registryTTL)}
+	tr.Unlock()
+	return transforms, nil
+}
+
+// forget cached transforms of tenant
+func (tr *transformer) forget(tenantID int64) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	delete(tr.tenants, tenantID)
+}
+
+// apply transforms to message, no messages means it is dropped;
+// a failing transform passes the message on untouched so a broken script does not lose data
+func (tr *transformer) apply(ctx context.Context, tenantID int64, topic string, ref deviceRef, message string) []string {
+	transforms, err := tr.tenantTransforms(ctx, tenantID)
+	if err != nil {
+		_Log.Error("load transforms, pass message on untouched", "tenant", tenantID, "err", err)
+		return []string{message}
+	}
+	return tr.run(transforms, tenantID, topic, ref, message)
+}
+
+func (tr *transformer) run(transforms []*Transform, tenantID int64, topic string, ref deviceRef, message string) []string {
+	messages := []string{message}
+	meta := transform.Meta{Topic: topic, DeviceID: ref.deviceID, DeviceType: ref.deviceType, TenantID: tenantID}
+	for _, t := range transforms {
+		if !t.applies(topic, ref.deviceType) {
+			continue
+		}
+		var next []string
+		for _, m := range messages {
+			r, err := t.compiled.Run([]byte(m), meta, tr.timeout)
+			if err != nil {
+				_Log.Warn("transform failed, pass message on untouched", "transform", t.ID, "version", t.Version, "topic", topic, "err", err)
+				next = append(next, m)
+				continue
+			}
+			for _, out := range r.Messages {
+				next = append(next, string(out))
+			}
+		}
+		// each run is capped, the chain is capped too so splitting stages do not multiply
+		if len(next) > transform.MaxMessages {
+			_Log.Warn("transform chain split too much, drop surplus messages", "transform", t.ID, "version", t.Version, "topic", topic,
+				"messages", len(next), "max", transform.MaxMessages)
+			next = next[:transform.MaxMessages]
+		}
+		messages = next
+	}
+	return messages
+}
+
+func (_global *global) queryTransform(ctx context.Context, tenantID, id int64) (*Transform, error) {
+	transforms, err := queryTransforms(ctx, _global.pgPool, `where t.tenant_id = $1 and t.id = $2;`, tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(transforms) == 0 {
+		return nil, tool.NotFound("there is no such transform [%d]", id)
+	}
+	return transforms[0], nil
+}
+
+func (_global *global) listTransforms(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	transforms, err := queryTransforms(ctx, _global.pgPool, `where t.tenant_id = $1 order by t.id;`, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, transforms)
+}
+
+func (_global *global) getTransform(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	t, err := _global.queryTransform(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func (_global *global) createTransform(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input transformInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	t := &Transform{TenantID: tenantOf(c), Version: 1, Enabled: true}
+	if input.Name != nil {
+		t.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.TopicFilter != nil {
+		t.TopicFilter = strings.TrimSpace(*input.TopicFilter)
+	}
+	if input.DeviceType != nil {
+		t.DeviceType = strings.TrimSpace(*input.DeviceType)
+	}
+	if input.Enabled != nil {
+		t.Enabled = *input.Enabled
+	}
+	if input.Script == nil {
+		c.Error(tool.Invalid("script is required"))
+		return
+	}
+	t.Script = *input.Script
+	if err := t.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if _, err := transform.Compile(t.Script); err != nil {
+		c.Error(err)
+		return
+	}
+	err := _global.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `insert into transforms (tenant_id, name, topic_filter, device_type, version, enabled)
+			values ($1, $2, $3, $4, 1, $5) returning id, created_at, updated_at;`,
+			t.TenantID, t.Name, t.TopicFilter, t.DeviceType, t.Enabled).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+		if err != nil {
+			return dbError(err, "insert transform")
+		}
+		_, err = tx.ExecContext(ctx, `insert into transform_versions (transform_id, version, script) values ($1, 1, $2);`, t.ID, t.Script)
+		return dbError(err, "insert transform version")
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	_global.transforms.forget(t.TenantID)
+	c.JSON(http.StatusCreated, t)
+}
+
+func (_global *global) updateTransform(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input transformInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	if input.Script != nil && input.Version != nil {
+		c.Error(tool.Invalid("either a new script or the version to activate"))
+		return
+	}
+	if input.Script != nil {
+		if _, err := transform.Compile(*input.Script); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	tenantID := tenantOf(c)
+	var t *Transform
+	err = _global.inTx(ctx, func(tx *sql.Tx) error {
+		t = &Transform{}
+		err := tx.QueryRowContext(ctx, `select id, tenant_id, name, topic_filter, device_type, version, enabled from transforms
+			where tenant_id = $1 and id = $2 for update;`, tenantID, id).Scan(&t.ID, &t.TenantID, &t.Name, &t.TopicFilter, &t.DeviceType, &t.Version, &t.Enabled)
+		if err != nil {
+			return dbError(err, "query transform")
+		}
+		if input.Name != nil {
+			t.Name = strings.TrimSpace(*input.Name)
+		}
+		if input.TopicFilter != nil {
+			t.TopicFilter = strings.TrimSpace(*input.TopicFilter)
+		}
+		if input.DeviceType != nil {
+			t.DeviceType = strings.TrimSpace(*input.DeviceType)
+		}
+		if input.Enabled != nil {
+			t.Enabled = *input.Enabled
+		}
+		if err := t.validate(); err != nil {
+			return err
+		}
+
+		switch {
+		case input.Script != nil:
+			err = tx.QueryRowContext(ctx, `insert into transform_versions (transform_id, version, script)
+				select $1, max(version) + 1, $2 from transform_versions where transform_id = $1 returning version;`, t.ID, *input.Script).Scan(&t.Version)
+			if err != nil {
+				return dbError(err, "insert transform version")
+			}
+		case input.Version != nil:
+			var exists bool
+			err = tx.QueryRowContext(ctx, `select exists (select 1 from transform_versions where transform_id = $1 and version = $2);`,
+				t.ID, *input.Version).Scan(&exists)
+			if err != nil {
+				return dbError(err, "query transform version")
+			}
+			if !exists {
+				return tool.NotFound("there is no version [%d] of transform [%d]", *input.Version, t.ID)
+			}
+			t.Version = *input.Version
+		}
+		_, err = tx.ExecContext(ctx, `update transforms set name = $3, topic_filter = $4, device_type = $5, version = $6, enabled = $7,
+			updated_at = now() where tenant_id = $1 and id = $2;`, t.TenantID, t.ID, t.Name, t.TopicFilter, t.DeviceType, t.Version, t.Enabled)
+		return dbError(err, "update transform")
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	_global.transforms.forget(tenantID)
+	if t, err = _global.queryTransform(ctx, tenantID, id); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func (_global *global) deleteTransform(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	tenantID := tenantOf(c)
+	res, err := _global.pgPool.ExecContext(ctx, `delete from transforms where tenant_id = $1 and id = $2;`, tenantID, id)
+	if err != nil {
+		c.Error(dbError(err, "delete transform"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such transform [%d]", id))
+		return
+	}
+	_global.transforms.forget(tenantID)
+	c.Status(http.StatusNoContent)
+}
+
+// listTransformVersions newest first
+func (_global *global) listTransformVersions(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if _, err := _global.queryTransform(ctx, tenantOf(c), id); err != nil {
+		c.Error(err)
+		return
+	}
+	rows, err := _global.pgPool.QueryContext(ctx, `select version, script, created_at from transform_versions
+		where transform_id = $1 order by version desc;`, id)
+	if err != nil {
+		c.Error(dbError(err, "query transform versions"))
+		return
+	}
+	defer rows.Close()
+
+	versions := []*TransformVersion{}
+	for rows.Next() {
+		v := &TransformVersion{}
+		if err := rows.Scan(&v.Version, &v.Script, &v.CreatedAt); err != nil {
+			c.Error(dbError(err, "scan transform version"))
+			return
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query transform versions"))
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// testTransform run a script against a sample payload, failures of the script are part of the result
+func (_global *global) testTransform(c *gin.Context) {
+	var input transformTestInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	payload := []byte(input.Payload)
+	var raw string
+	if json.Unmarshal(input.Payload, &raw) == nil {
+		payload = []byte(raw)
+	}
+
+	result := transformTestResult{Result: &transform.Result{Messages: []json.RawMessage{}, Logs: []string{}}}
+	script, err := transform.Compile(input.Script)
+	if err == nil {
+		var r *transform.Result
+		meta := transform.Meta{Topic: input.Topic, DeviceID: input.DeviceID, DeviceType: input.DeviceType, TenantID: tenantOf(c)}
+		if r, err = script.Run(payload, meta, _global.transformTimeout); r != nil {
+			result.Result = r
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"dataservice/transform"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transforms", func() {
+	tr := newTransformer(nil, 100*time.Millisecond)
+	pump := deviceRef{id: 7, tenantID: 1, deviceID: "pump-1", deviceType: "pump"}
+	compiled := func(t *Transform) *Transform {
+		var err error
+		t.compiled, err = transform.Compile(t.Script)
+		Ω(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	It("should validate transforms", func() {
+		Ω((&Transform{Name: "f", TopicFilter: "devices/+/telemetry"}).validate()).To(Succeed())
+		Ω((&Transform{Name: "f", DeviceType: "pump"}).validate()).To(Succeed())
+		Ω((&Transform{Name: "f"}).validate()).ToNot(Succeed())
+		Ω((&Transform{TopicFilter: "#"}).validate()).ToNot(Succeed())
+		Ω((&Transform{Name: "f", TopicFilter: "a/#/b"}).validate()).ToNot(Succeed())
+	})
+
+	It("should chain matching transforms in order", func() {
+		transforms := []*Transform{
+			compiled(&Transform{ID: 1, TopicFilter: "devices/+/telemetry", Script: `function transform(msg) { return msg.readings; }`}),
+			compiled(&Transform{ID: 2, DeviceType: "meter", Script: `function transform(msg) { return null; }`}),
+			compiled(&Transform{ID: 3, DeviceType: "pump", Script: `function transform(msg, meta) { return {device: meta.deviceId, c: msg.f - 32}; }`}),
+		}
+		out := tr.run(transforms, 1, "devices/pump-1/telemetry", pump, `{"readings": [{"f": 32}, {"f": 50}]}`)
+		Ω(out).To(Equal([]string{`{"c":0,"device":"pump-1"}`, `{"c":18,"device":"pump-1"}`}))
+
+		out = tr.run(transforms, 1, "other/topic", deviceRef{}, `{"f": 1}`)
+		Ω(out).To(Equal([]string{`{"f": 1}`}))
+	})
+
+	It("should drop messages and pass them on untouched when a script fails", func() {
+		drop := compiled(&Transform{ID: 1, TopicFilter: "#", Script: `function transform(msg) { return msg.test ? null : msg; }`})
+		Ω(tr.run([]*Transform{drop}, 1, "a", pump, `{"test": true}`)).To(BeEmpty())
+
+		broken := compiled(&Transform{ID: 2, TopicFilter: "#", Script: `function transform(msg) { return msg.a.b; }`})
+		Ω(tr.run([]*Transform{broken}, 1, "a", pump, `{"x": 1}`)).To(Equal([]string{`{"x": 1}`}))
+	})
+
+	It("should cap the messages of a chain of splitting transforms", func() {
+		split := `function transform(msg) { var out = []; for (var i = 0; i < 100; i++) { out.push({i: i}); } return out; }`
+		transforms := []*Transform{
+			compiled(&Transform{ID: 1, TopicFilter: "#", Script: split}),
+			compiled(&Transform{ID: 2, TopicFilter: "#", Script: split}),
+		}
+		Ω(tr.run(transforms, 1, "a", pump, `{}`)).To(HaveLen(transform.MaxMessages))
+	})
+})
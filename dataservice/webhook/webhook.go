@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"dataservice/tool"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SignatureHeader carry the hmac of the body when the webhook has a secret
+const SignatureHeader = "X-Signature-256"
+
+// Match routing key against an amqp style topic pattern, * is exactly one word and # zero or more words
+func Match(pattern, key string) bool {
+	return match(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func match(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if match(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && match(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && match(pattern[1:], key[1:])
+	}
+}
+
+// Sign body with secret, as sent in SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseTemplate of a json payload, the event is available as .Event and its type as .Type,
+// json renders a value as json
+func ParseTemplate(s string) (*template.Template, error) {
+	t, err := template.New("payload").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(s)
+	if err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "parse template")
+	}
+	return t, nil
+}
+
+// Render payload of event, the event itself without template
+func Render(t *template.Template, eventType string, event []byte) ([]byte, error) {
+	if t == nil {
+		return event, nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(event, &decoded); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "decode event")
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]interface{}{"Type": eventType, "Event": decoded}); err != nil {
+		return nil, tool.Wrap(tool.KindInvalid, err, "render template")
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, tool.Invalid("template of %s does not render json", eventType)
+	}
+	return buf.Bytes(), nil
+}
+
+// Backoff before the attempt following attempt, doubling from base up to max
+func Backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Retryable report whether a response status is worth another attempt
+func Retryable(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
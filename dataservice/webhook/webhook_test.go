@@ -0,0 +1,67 @@
+package webhook_test
+
+import (
+	"time"
+
+	"dataservice/tool"
+	"dataservice/webhook"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("webhook", func() {
+	DescribeTable("match",
+		func(pattern, key string, matched bool) {
+			Ω(webhook.Match(pattern, key)).To(Equal(matched))
+		},
+		Entry("exact", "device.offline", "device.offline", true),
+		Entry("other", "device.offline", "device.online", false),
+		Entry("one word", "alarm.*", "alarm.raised", true),
+		Entry("one word only", "*", "alarm.raised", false),
+		Entry("everything", "#", "alarm.raised", true),
+		Entry("trailing many", "alarm.#", "alarm", true),
+		Entry("leading many", "#.offline", "device.offline", true),
+		Entry("longer pattern", "device.offline.x", "device.offline", false),
+	)
+
+	It("should sign with hmac sha256", func() {
+		// echo -n '{"a":1}' | openssl dgst -sha256 -hmac secret
+		Ω(webhook.Sign("secret", []byte(`{"a":1}`))).To(Equal("sha256=aa9e2e3575f5d7098b6caccd790888c36d5fdb63342a73bada2d6a51747a8494"))
+	})
+
+	It("should render templates to json", func() {
+		t, err := webhook.ParseTemplate(`{"text": {{json (printf "%s is %s" .Event.deviceId .Type)}}, "missing": {{json .Event.nothing}}}`)
+		Ω(err).ToNot(HaveOccurred())
+		body, err := webhook.Render(t, "device.offline", []byte(`{"deviceId": "pump-1"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(body).To(MatchJSON(`{"text": "pump-1 is device.offline", "missing": null}`))
+
+		body, err = webhook.Render(nil, "device.offline", []byte(`{"deviceId": "pump-1"}`))
+		Ω(err).ToNot(HaveOccurred())
+		Ω(body).To(MatchJSON(`{"deviceId": "pump-1"}`))
+	})
+
+	It("should reject broken templates", func() {
+		_, err := webhook.ParseTemplate(`{{.Event`)
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+
+		t, err := webhook.ParseTemplate(`{"text": {{.Event.deviceId}}}`)
+		Ω(err).ToNot(HaveOccurred())
+		_, err = webhook.Render(t, "device.offline", []byte(`{"deviceId": "pump-1"}`))
+		Ω(tool.KindOf(err)).To(Equal(tool.KindInvalid))
+	})
+
+	It("should back off exponentially up to the maximum", func() {
+		Ω(webhook.Backoff(time.Second, time.Minute, 1)).To(Equal(time.Second))
+		Ω(webhook.Backoff(time.Second, time.Minute, 3)).To(Equal(4 * time.Second))
+		Ω(webhook.Backoff(time.Second, time.Minute, 30)).To(Equal(time.Minute))
+	})
+
+	It("should retry server errors and throttling only", func() {
+		Ω(webhook.Retryable(503)).To(BeTrue())
+		Ω(webhook.Retryable(429)).To(BeTrue())
+		Ω(webhook.Retryable(404)).To(BeFalse())
+	})
+})
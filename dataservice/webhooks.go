@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"dataservice/policy"
+	"dataservice/tool"
+	"dataservice/tracing"
+	"dataservice/webhook"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	gin "github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/streadway/amqp"
+)
+
+// webhooksQueue durable queue of events to be turned into deliveries, shared by every instance
+const webhooksQueue = "webhooks"
+
+// webhookPoll how often due deliveries are looked for when nothing wakes the dispatcher
+const webhookPoll = 5 * time.Second
+
+// delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookConfig of deliveries
+type webhookConfig struct {
+	workers     int
+	timeout     time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	policy      *policy.Policy // of the urls deliveries may dial
+}
+
+// webhookPorts by scheme when the url has none
+var webhookPorts = map[string]int{"http": 80, "https": 443}
+
+// Webhook posting events of its tenant to an url
+type Webhook struct {
+	ID       int64             `json:"id"`
+	TenantID int64             `json:"tenantId"`
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Events   []string          `json:"events"`   // patterns of event types, like alarm.* or #
+	Template string            `json:"template"` // of the json payload, empty for the event itself
+	Signed   bool              `json:"signed"`
+	Enabled  bool              `json:"enabled"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	secret string
+	tmpl   *template.Template
+}
+
+// webhookInput body of create and patch, the secret is write only
+type webhookInput struct {
+	Name     *string            `json:"name"`
+	URL      *string            `json:"url"`
+	Headers  *map[string]string `json:"headers"`
+	Secret   *string            `json:"secret"`
+	Events   *[]string          `json:"events"`
+	Template *string            `json:"template"`
+	Enabled  *bool              `json:"enabled"`
+}
+
+func (input *webhookInput) apply(w *Webhook) {
+	if input.Name != nil {
+		w.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.URL != nil {
+		w.URL = strings.TrimSpace(*input.URL)
+	}
+	if input.Headers != nil {
+		w.Headers = *input.Headers
+	}
+	if input.Secret != nil {
+		w.secret = *input.Secret
+	}
+	if input.Events != nil {
+		w.Events = *input.Events
+	}
+	if input.Template != nil {
+		w.Template = *input.Template
+	}
+	if input.Enabled != nil {
+		w.Enabled = *input.Enabled
+	}
+}
+
+// validate webhook and parse its template
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return tool.Invalid("url [%s] is not an absolute http or https url", w.URL)
+	}
+	if w.Headers == nil {
+		w.Headers = map[string]string{}
+	}
+	for name, value := range w.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+			return tool.Invalid("header [%s] is malformed", name)
+		}
+		if strings.EqualFold(name, webhook.SignatureHeader) {
+			return tool.Invalid("header [%s] is reserved", name)
+		}
+	}
+	if len(w.Events) == 0 {
+		w.Events = []string{"#"}
+	}
+	for _, pattern := range w.Events {
+		if strings.TrimSpace(pattern) == "" {
+			return tool.Invalid("event pattern must not be empty")
+		}
+	}
+	w.tmpl = nil
+	if w.Template != "" {
+		if w.tmpl, err = webhook.ParseTemplate(w.Template); err != nil {
+			return err
+		}
+	}
+	w.Signed = w.secret != ""
+	return nil
+}
+
+// checkPolicy reject urls deliveries would refuse to dial, unresolvable hosts are left to delivery time
+func (w *Webhook) checkPolicy(ctx context.Context, p *policy.Policy) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return tool.Wrap(tool.KindInvalid, err, "parse webhook url")
+	}
+	port := webhookPorts[strings.ToLower(u.Scheme)]
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			return tool.Wrap(tool.KindInvalid, err, "parse webhook port")
+		}
+	}
+	if _, err := p.Check(ctx, u.Scheme, u.Hostname(), port); err != nil && tool.KindOf(err) != tool.KindUnavailable {
+		return err
+	}
+	return nil
+}
+
+// matches event type
+func (w *Webhook) matches(eventType string) bool {
+	for _, pattern := range w.Events {
+		if webhook.Match(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+const webhookColumns = `id, tenant_id, name, url, headers, secret, events, template, enabled, created_at, updated_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	w := &Webhook{}
+	var headers []byte
+	err := row.Scan(&w.ID, &w.TenantID, &w.Name, &w.URL, &headers, &w.secret, pq.Array(&w.Events), &w.Template, &w.Enabled, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headers, &w.Headers); err != nil {
+		return nil, err
+	}
+	w.Signed = w.secret != ""
+	return w, nil
+}
+
+func queryWebhooks(ctx context.Context, pgPool *sql.DB, query string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := pgPool.QueryContext(ctx, `select `+webhookColumns+` from webhooks `+query, args...)
+	if err != nil {
+		return nil, dbError(err, "query webhooks")
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, dbError(err, "scan webhook")
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, dbError(rows.Err(), "query webhooks")
+}
+
+// Delivery of an event to a webhook
+type Delivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhookId"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  *int            `json:"responseCode"`
+	Error         string          `json:"error"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	LastAttemptAt *time.Time      `json:"lastAttemptAt"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt"`
+	DeliveredAt   *time.Time      `json:"deliveredAt"`
+}
+
+// pendingDelivery claimed for an attempt, with what is needed to send it
+type pendingDelivery struct {
+	id       int64
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	headers  map[string]string
+	secret   string
+}
+
+// webhookDispatcher turn events into deliveries and attempt them with backoff,
+// deliveries are claimed from the table so pending ones survive restarts and are shared by instances
+type webhookDispatcher struct {
+	webhookConfig
+	pgPool *sql.DB
+	client *http.Client
+	slots  chan struct{} // of attempts in flight
+	wake   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newWebhookDispatcher(pgPool *sql.DB, config webhookConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		webhookConfig: config,
+		pgPool:        pgPool,
+		client:        newWebhookClient(config),
+		slots:         make(chan struct{}, config.workers),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// newWebhookClient dialing through the policy, every connection is checked against it at dial time;
+// redirects are not followed, they would lead deliveries to urls nobody checked
+func newWebhookClient(config webhookConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would dial on behalf of deliveries, past the policy
+	transport.DialContext = config.policy.DialContext(&net.Dialer{Timeout: config.timeout})
+	return &http.Client{
+		Timeout:   config.timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// consume events from the exchange, an event is acknowledged once its deliveries are recorded
+func (d *webhookDispatcher) consume(ch *amqp.Channel) error {
+	q, err := ch.QueueDeclare(webhooksQueue, true, false, false, false, nil)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "declare webhooks queue")
+	}
+	if err := ch.QueueBind(q.Name, "#", eventsExchange, false, nil); err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "bind webhooks queue")
+	}
+	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return tool.Wrap(tool.KindUnavailable, err, "register webhooks consumer")
+	}
+
+	go func() {
+		for msg := range msgs {
+			ctx, cancel := context.WithTimeout(tracing.Extract(context.Background(), tracing.AMQPHeaders(msg.Headers)), dbTimeout)
+			err := d.enqueue(ctx, msg.RoutingKey, msg.Body)
+			cancel()
+			if err != nil {
+				_Log.Error("record webhook deliveries, requeue event", "event", msg.RoutingKey, "err", err)
+				tool.CheckThenLog(_Log, msg.Nack(false, true), "requeue event")
+				time.Sleep(time.Second)
+				continue
+			}
+			tool.CheckThenLog(_Log, msg.Ack(false), "ack event")
+		}
+	}()
+	return nil
+}
+
+// enqueue deliveries of event to the matching webhooks of its tenant
+func (d *webhookDispatcher) enqueue(ctx context.Context, eventType string, event []byte) error {
+	var owner struct {
+		TenantID int64 `json:"tenantId"`
+	}
+	if err := json.Unmarshal(event, &owner); err != nil || owner.TenantID == 0 {
+		_Log.Warn("drop event without tenant", "event", eventType)
+		return nil
+	}
+	hooks, err := queryWebhooks(ctx, d.pgPool, `where tenant_id = $1 and enabled;`, owner.TenantID)
+	if err != nil {
+		return err
+	}
+
+	enqueued := false
+	for _, w := range hooks {
+		if !w.matches(eventType) {
+			continue
+		}
+		status, next, message := deliveryPending, sql.NullTime{Time: time.Now(), Valid: true}, ""
+		payload := []byte("null")
+		if err := w.validate(); err != nil {
+			status, next, message = deliveryFailed, sql.NullTime{}, err.Error()
+		} else if payload, err = webhook.Render(w.tmpl, eventType, event); err != nil {
+			status, next, message, payload = deliveryFailed, sql.NullTime{}, err.Error(), []byte("null")
+		}
+		_, err := d.pgPool.ExecContext(ctx, `insert into webhook_deliveries (webhook_id, event, payload, status, error, next_attempt_at)
+			values ($1, $2, $3, $4, $5, $6);`, w.ID, eventType, string(payload), status, message, next)
+		if err != nil {
+			return dbError(err, "insert webhook delivery")
+		}
+		enqueued = enqueued || status == deliveryPending
+	}
+	if enqueued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run attempt due deliveries until ctx is done, attempts in flight are waited for
+func (d *webhookDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		d.dispatch(ctx)
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-ctx.Done():
+			d.wg.Wait()
+			return
+		}
+	}
+}
+
+// dispatch as many due deliveries as there are free slots
+func (d *webhookDispatcher) dispatch(ctx context.Context) {
+	free := cap(d.slots) - len(d.slots)
+	if free == 0 {
+		return
+	}
+	cctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	pending, err := d.claim(cctx, free)
+	cancel()
+	if err != nil {
+		_Log.Error("claim webhook deliveries", "err", err)
+		return
+	}
+	for _, p := range pending {
+		d.slots <- struct{}{}
+		d.wg.Add(1)
+		go func(p *pendingDelivery) {
+			defer func() {
+				<-d.slots
+				d.wg.Done()
+				select {
+				case d.wake <- struct{}{}:
+				default:
+				}
+			}()
+			code, err := d.send(ctx, p)
+			if ctx.Err() != nil {
+				return // the claim expires and another attempt follows
+			}
+			rctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			defer cancel()
+			tool.CheckThenLog(_Log, d.record(rctx, p, code, err), "record webhook delivery", "delivery", p.id)
+		}(p)
+	}
+}
+
+// claim up to n due deliveries, claimed deliveries are due again once an attempt surely ended
+func (d *webhookDispatcher) claim(ctx context.Context, n int) ([]*pendingDelivery, error) {
+	rows, err := d.pgPool.QueryContext(ctx, `update webhook_deliveries d set next_attempt_at = now() + $2::bigint * interval '1 second'
+		from webhooks w where w.id = d.webhook_id and d.id in (select x.id from webhook_deliveries x join webhooks y on y.id = x.webhook_id
+			where x.status = 'pending' and x.next_attempt_at <= now() and y.enabled order by x.next_attempt_at limit $1 for update of x skip locked)
+		returning d.id, d.event, d.payload, d.attempts, w.url, w.headers, w.secret;`, n, int64(2*d.timeout/time.Second)+1)
+	if err != nil {
+		return nil, dbError(err, "claim webhook deliveries")
+	}
+	defer rows.Close()
+
+	var pending []*pendingDelivery
+	for rows.Next() {
+		p := &pendingDelivery{}
+		var payload string
+		var headers []byte
+		if err := rows.Scan(&p.id, &p.event, &payload, &p.attempts, &p.url, &headers, &p.secret); err != nil {
+			return nil, dbError(err, "scan webhook delivery")
+		}
+		p.payload = []byte(payload)
+		if err := json.Unmarshal(headers, &p.headers); err != nil {
+			return nil, tool.Wrap(tool.KindInternal, err, "decode webhook headers")
+		}
+		pending = append(pending, p)
+	}
+	return pending, dbError(rows.Err(), "claim webhook deliveries")
+}
+
+// send delivery once, the response status is returned as long as there is a response
+func (d *webhookDispatcher) send(ctx context.Context, p *pendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, strings.NewReader(string(p.payload)))
+	if err != nil {
+		return 0, err
+	}
+	if !d.policy.AllowScheme(req.URL.Scheme) {
+		return 0, tool.Forbidden("scheme [%s] is not allowed", req.URL.Scheme)
+	}
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", p.event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(p.id, 10))
+	if p.secret != "" {
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign(p.secret, p.payload))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// outcome of an attempt, after is the backoff of a pending delivery
+func (d *webhookDispatcher) outcome(attempts, code int, err error) (status string, after time.Duration, message string) {
+	if err == nil && code >= 200 && code < 300 {
+		return deliveryDelivered, 0, ""
+	}
+	message = fmt.Sprintf("unexpected status %d", code)
+	if err != nil {
+		message = err.Error()
+	}
+	if (err != nil || webhook.Retryable(code)) && attempts < d.maxAttempts {
+		return deliveryPending, webhook.Backoff(d.backoff, d.maxBackoff, attempts), message
+	}
+	return deliveryFailed, 0, message
+}
+
+// record attempt of delivery
+func (d *webhookDispatcher) record(ctx context.Context, p *pendingDelivery, code int, err error) error {
+	attempts := p.attempts + 1
+	status, after, message := d.outcome(attempts, code, err)
+	if status != deliveryDelivered {
+		_Log.Warn("webhook delivery attempt failed", "delivery", p.id, "attempts", attempts, "status", status, "err", message)
+	}
+	_, err = d.pgPool.ExecContext(ctx, `update webhook_deliveries set status = $2, attempts = $3, response_code = $4, error = $5,
+		last_attempt_at = now(), next_attempt_at = case when $2 = 'pending' then now() + $6::bigint * interval '1 millisecond' end,
+		delivered_at = case when $2 = 'delivered' then now() end where id = $1;`,
+		p.id, status, attempts, sql.NullInt64{Int64: int64(code), Valid: code > 0}, message, after.Milliseconds())
+	return dbError(err, "update webhook delivery")
+}
+
+func (_global *global) queryWebhook(ctx context.Context, tenantID, id int64) (*Webhook, error) {
+	w, err := scanWebhook(_global.pgPool.QueryRowContext(ctx, `select `+webhookColumns+` from webhooks where tenant_id = $1 and id = $2;`, tenantID, id))
+	if err != nil {
+		return nil, dbError(err, "query webhook")
+	}
+	return w, nil
+}
+
+func (_global *global) listWebhooks(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	hooks, err := queryWebhooks(ctx, _global.pgPool, `where tenant_id = $1 order by id;`, tenantOf(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+func (_global *global) getWebhook(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	w, err := _global.queryWebhook(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func (_global *global) createWebhook(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	var input webhookInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	w := &Webhook{TenantID: tenantOf(c), Enabled: true}
+	input.apply(w)
+	if err := w.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := w.checkPolicy(ctx, _global.webhook.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	headers, _ := json.Marshal(w.Headers)
+	err := _global.pgPool.QueryRowContext(ctx, `insert into webhooks (tenant_id, name, url, headers, secret, events, template, enabled)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id, created_at, updated_at;`,
+		w.TenantID, w.Name, w.URL, headers, w.secret, pq.Array(w.Events), w.Template, w.Enabled).Scan(&w.ID, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "insert webhook"))
+		return
+	}
+	c.JSON(http.StatusCreated, w)
+}
+
+// updateWebhook, deliveries already recorded keep their payload but go to the new url
+func (_global *global) updateWebhook(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	var input webhookInput
+	if err := bindInput(c, &input); err != nil {
+		c.Error(err)
+		return
+	}
+	w, err := _global.queryWebhook(ctx, tenantOf(c), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	input.apply(w)
+	if err := w.validate(); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := w.checkPolicy(ctx, _global.webhook.policy); err != nil {
+		c.Error(err)
+		return
+	}
+	headers, _ := json.Marshal(w.Headers)
+	err = _global.pgPool.QueryRowContext(ctx, `update webhooks set name = $3, url = $4, headers = $5, secret = $6, events = $7, template = $8,
+		enabled = $9, updated_at = now() where tenant_id = $1 and id = $2 returning updated_at;`,
+		w.TenantID, w.ID, w.Name, w.URL, headers, w.secret, pq.Array(w.Events), w.Template, w.Enabled).Scan(&w.UpdatedAt)
+	if err != nil {
+		c.Error(dbError(err, "update webhook"))
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func (_global *global) deleteWebhook(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	res, err := _global.pgPool.ExecContext(ctx, `delete from webhooks where tenant_id = $1 and id = $2;`, tenantOf(c), id)
+	if err != nil {
+		c.Error(dbError(err, "delete webhook"))
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.Error(tool.NotFound("there is no such webhook [%d]", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listDeliveries of a webhook, the latest hundred, filtered by ?status=
+func (_global *global) listDeliveries(c *gin.Context) {
+	ctx, cancel := dbContext(c)
+	defer cancel()
+
+	id, err := pathID(c, "id")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", deliveryPending, deliveryDelivered, deliveryFailed:
+	default:
+		c.Error(tool.Invalid("unknown delivery status [%s]", status))
+		return
+	}
+	if _, err := _global.queryWebhook(ctx, tenantOf(c), id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	rows, err := _global.pgPool.QueryContext(ctx, `select id, webhook_id, event, payload, status, attempts, response_code, error,
+		created_at, last_attempt_at, next_attempt_at, delivered_at from webhook_deliveries
+		where webhook_id = $1 and ($2 = '' or status = $2) order by id desc limit 100;`, id, status)
+	if err != nil {
+		c.Error(dbError(err, "query webhook deliveries"))
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		d := &Delivery{}
+		var payload string
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error,
+			&d.CreatedAt, &d.LastAttemptAt, &d.NextAttemptAt, &d.DeliveredAt); err != nil {
+			c.Error(dbError(err, "scan webhook delivery"))
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		c.Error(dbError(err, "query webhook deliveries"))
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
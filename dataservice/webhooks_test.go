@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"dataservice/policy"
+	"dataservice/tool"
+	"dataservice/webhook"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("webhooks", func() {
+	d := newWebhookDispatcher(nil, webhookConfig{workers: 1, timeout: time.Second, maxAttempts: 3, backoff: time.Second, maxBackoff: time.Minute})
+
+	It("should validate webhooks", func() {
+		w := &Webhook{URL: "https://example.com/hook", secret: "s"}
+		Ω(w.validate()).To(Succeed())
+		Ω(w.Events).To(Equal([]string{"#"}))
+		Ω(w.Signed).To(BeTrue())
+		Ω(w.matches("alarm.raised")).To(BeTrue())
+
+		w = &Webhook{URL: "https://example.com/hook", Events: []string{"alarm.*", "device.offline"}}
+		Ω(w.validate()).To(Succeed())
+		Ω(w.matches("alarm.cleared")).To(BeTrue())
+		Ω(w.matches("device.online")).To(BeFalse())
+
+		for _, w := range []*Webhook{
+			{URL: "ftp://example.com"},
+			{URL: "/relative"},
+			{URL: "http://example.com", Headers: map[string]string{"Bad Name": "x"}},
+			{URL: "http://example.com", Headers: map[string]string{webhook.SignatureHeader: "x"}},
+			{URL: "http://example.com", Events: []string{""}},
+			{URL: "http://example.com", Template: "{{"},
+		} {
+			Ω(tool.KindOf(w.validate())).To(Equal(tool.KindInvalid), w.URL)
+		}
+	})
+
+	It("should post the payload signed with the headers", func() {
+		var got *http.Request
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		p := &pendingDelivery{id: 42, event: "device.offline", payload: []byte(`{"deviceId":"pump-1"}`), url: server.URL,
+			headers: map[string]string{"Authorization": "Bearer t"}, secret: "secret"}
+		code, err := d.send(context.Background(), p)
+		Ω(err).ToNot(HaveOccurred())
+		Ω(code).To(Equal(http.StatusAccepted))
+		Ω(got.Method).To(Equal(http.MethodPost))
+		Ω(body).To(MatchJSON(`{"deviceId":"pump-1"}`))
+		Ω(got.Header.Get("Authorization")).To(Equal("Bearer t"))
+		Ω(got.Header.Get("Content-Type")).To(Equal("application/json"))
+		Ω(got.Header.Get("X-Webhook-Event")).To(Equal("device.offline"))
+		Ω(got.Header.Get("X-Webhook-Delivery")).To(Equal("42"))
+		Ω(got.Header.Get(webhook.SignatureHeader)).To(Equal(webhook.Sign("secret", body)))
+	})
+
+	It("should refuse urls denied by the policy and not follow redirects", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		}))
+		defer server.Close()
+
+		code, err := d.send(context.Background(), &pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(code).To(Equal(http.StatusFound))
+
+		p, err := policy.Parse([]string{"https"}, nil, []string{"127.0.0.0/8"}, nil)
+		Ω(err).ToNot(HaveOccurred())
+		denied := newWebhookDispatcher(nil, webhookConfig{workers: 1, timeout: time.Second, maxAttempts: 3, backoff: time.Second, policy: p})
+		_, err = denied.send(context.Background(), &pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden), "scheme")
+		p.Schemes = append(p.Schemes, "http")
+		_, err = denied.send(context.Background(), &pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+		Ω(tool.KindOf(err)).To(Equal(tool.KindForbidden), "%v", err)
+
+		w := &Webhook{URL: "http://127.0.0.1:8080/hook"}
+		Ω(tool.KindOf(w.checkPolicy(context.Background(), p))).To(Equal(tool.KindForbidden))
+		w = &Webhook{URL: "https://hook.invalid/hook"}
+		Ω(w.checkPolicy(context.Background(), p)).To(Succeed(), "unresolvable hosts are left to delivery time")
+	})
+
+	It("should report the status of a failing endpoint", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		code, err := d.send(context.Background(), &pendingDelivery{id: 1, payload: []byte(`{}`), url: server.URL})
+		Ω(err).ToNot(HaveOccurred())
+		Ω(code).To(Equal(http.StatusServiceUnavailable))
+		_, err = d.send(context.Background(), &pendingDelivery{id: 1, payload: []byte(`{}`), url: "http://127.0.0.1:1"})
+		Ω(err).To(HaveOccurred())
+	})
+
+	It("should retry with backoff until the attempts run out", func() {
+		status, after, _ := d.outcome(1, http.StatusOK, nil)
+		Ω(status).To(Equal(deliveryDelivered))
+		Ω(after).To(BeZero())
+
+		status, after, message := d.outcome(1, http.StatusBadGateway, nil)
+		Ω(status).To(Equal(deliveryPending))
+		Ω(after).To(Equal(time.Second))
+		Ω(message).To(Equal("unexpected status 502"))
+
+		status, after, message = d.outcome(2, 0, errors.New("connection refused"))
+		Ω(status).To(Equal(deliveryPending))
+		Ω(after).To(Equal(2 * time.Second))
+		Ω(message).To(Equal("connection refused"))
+
+		status, _, _ = d.outcome(3, http.StatusBadGateway, nil)
+		Ω(status).To(Equal(deliveryFailed))
+		status, _, _ = d.outcome(1, http.StatusNotFound, nil)
+		Ω(status).To(Equal(deliveryFailed))
+	})
+})
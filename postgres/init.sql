@@ -1,13 +1,308 @@
+CREATE TABLE tenants (
+        id BIGSERIAL PRIMARY KEY,
+        name TEXT NOT NULL UNIQUE,
+        max_brokers INT NOT NULL DEFAULT 0,
+        max_subscriptions INT NOT NULL DEFAULT 0,
+        max_messages_per_day BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+INSERT INTO tenants (name) VALUES ('default');
+
+CREATE TABLE tenant_usage (
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        day DATE NOT NULL,
+        messages BIGINT NOT NULL DEFAULT 0,
+        duplicates BIGINT NOT NULL DEFAULT 0,
+        PRIMARY KEY (tenant_id, day)
+);
+
+CREATE TABLE devices (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        device_id TEXT NOT NULL,
+        name TEXT NOT NULL DEFAULT '',
+        type TEXT NOT NULL DEFAULT '',
+        metadata JSONB NOT NULL DEFAULT '{}',
+        token_hash TEXT UNIQUE,
+        auto_registered BOOLEAN NOT NULL DEFAULT FALSE,
+        last_seen_at TIMESTAMPTZ,
+        online BOOLEAN NOT NULL DEFAULT FALSE,
+        status_changed_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (tenant_id, device_id)
+);
+
+CREATE TABLE topic_templates (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        template TEXT NOT NULL,
+        unknown_devices TEXT NOT NULL DEFAULT 'reject' CHECK (unknown_devices IN ('register', 'reject')),
+        device_type TEXT NOT NULL DEFAULT '',
+        kind TEXT NOT NULL DEFAULT 'telemetry' CHECK (kind IN ('telemetry', 'status', 'attributes')),
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (tenant_id, template)
+);
+
+CREATE TABLE device_types (
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        type TEXT NOT NULL,
+        offline_timeout INT NOT NULL CHECK (offline_timeout > 0),
+        PRIMARY KEY (tenant_id, type)
+);
+
+CREATE TABLE device_shadows (
+        device_id BIGINT PRIMARY KEY REFERENCES devices (id) ON DELETE CASCADE,
+        reported JSONB NOT NULL DEFAULT '{}',
+        desired JSONB NOT NULL DEFAULT '{}',
+        version BIGINT NOT NULL DEFAULT 1,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE latest_values (
+        device_id BIGINT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+        key TEXT NOT NULL,
+        value JSONB NOT NULL,
+        ts TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (device_id, key)
+);
+
+-- device_id has no foreign key, messages outlive their devices
 CREATE TABLE messages (
         id BIGSERIAL PRIMARY KEY,
-        msg JSONB NOT NULL
+        tenant_id BIGINT NOT NULL,
+        device_id BIGINT,
+        msg JSONB NOT NULL,
+        properties JSONB,
+        dedup_key TEXT,
+        ts TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 CREATE INDEX idxmsg ON messages USING GIN (msg);
+CREATE UNIQUE INDEX idxmsgdedup ON messages (tenant_id, dedup_key);
+CREATE INDEX idxmsgtenant ON messages (tenant_id, id);
+CREATE INDEX idxmsgdevice ON messages (device_id, id) WHERE device_id IS NOT NULL;
+CREATE INDEX idxmsgts ON messages (tenant_id, ts) WHERE device_id IS NOT NULL;
+
+CREATE TABLE transforms (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        topic_filter TEXT NOT NULL DEFAULT '',
+        device_type TEXT NOT NULL DEFAULT '',
+        version INT NOT NULL DEFAULT 1,
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        CHECK (topic_filter <> '' OR device_type <> ''),
+        UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE transform_versions (
+        transform_id BIGINT NOT NULL REFERENCES transforms (id) ON DELETE CASCADE,
+        version INT NOT NULL,
+        script TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        PRIMARY KEY (transform_id, version)
+);
+
+CREATE TABLE schemas (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        topic_filter TEXT NOT NULL DEFAULT '',
+        device_type TEXT NOT NULL DEFAULT '',
+        schema JSONB NOT NULL,
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        validated BIGINT NOT NULL DEFAULT 0,
+        rejected BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        CHECK (topic_filter <> '' OR device_type <> ''),
+        UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE quarantine (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        schema_id BIGINT REFERENCES schemas (id) ON DELETE SET NULL,
+        device_id BIGINT,
+        topic TEXT NOT NULL,
+        payload BYTEA NOT NULL,
+        errors TEXT[] NOT NULL,
+        received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idxquarantinetenant ON quarantine (tenant_id, id);
+
+CREATE TABLE descriptors (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        kind TEXT NOT NULL CHECK (kind IN ('proto', 'descriptor_set')),
+        content BYTEA NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE decoders (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        format TEXT NOT NULL,
+        topic_filter TEXT NOT NULL DEFAULT '',
+        content_type TEXT NOT NULL DEFAULT '',
+        descriptor_id BIGINT REFERENCES descriptors (id) ON DELETE RESTRICT,
+        message_type TEXT NOT NULL DEFAULT '',
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        CHECK (topic_filter <> '' OR content_type <> ''),
+        UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE dedup_policies (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        topic_filter TEXT NOT NULL DEFAULT '',
+        mode TEXT NOT NULL CHECK (mode IN ('content', 'messageId', 'none')),
+        id_field TEXT NOT NULL DEFAULT '',
+        timestamp_field TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE rules (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        condition TEXT NOT NULL,
+        duration INT NOT NULL DEFAULT 0 CHECK (duration >= 0),
+        device_type TEXT NOT NULL DEFAULT '',
+        severity TEXT NOT NULL DEFAULT 'major' CHECK (severity IN ('critical', 'major', 'minor', 'warning', 'info')),
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- alarms outlive their rules and devices as history
+CREATE TABLE rule_recipients (
+        rule_id BIGINT NOT NULL REFERENCES rules (id) ON DELETE CASCADE,
+        email TEXT NOT NULL,
+        PRIMARY KEY (rule_id, email)
+);
+
+CREATE TABLE alarms (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        rule_id BIGINT REFERENCES rules (id) ON DELETE SET NULL,
+        device_id BIGINT NOT NULL,
+        severity TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'acknowledged', 'cleared')),
+        message TEXT NOT NULL DEFAULT '',
+        value DOUBLE PRECISION NOT NULL,
+        raised_at TIMESTAMPTZ NOT NULL,
+        acknowledged_at TIMESTAMPTZ,
+        acknowledged_by TEXT,
+        cleared_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX idxalarmopen ON alarms (rule_id, device_id) WHERE status <> 'cleared';
+CREATE INDEX idxalarmtenant ON alarms (tenant_id, id);
+
+CREATE TABLE webhooks (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL DEFAULT '',
+        url TEXT NOT NULL,
+        headers JSONB NOT NULL DEFAULT '{}',
+        secret TEXT NOT NULL DEFAULT '',
+        events TEXT[] NOT NULL DEFAULT '{#}',
+        template TEXT NOT NULL DEFAULT '',
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idxwebhooktenant ON webhooks (tenant_id);
+
+CREATE TABLE webhook_deliveries (
+        id BIGSERIAL PRIMARY KEY,
+        webhook_id BIGINT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+        event TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+        attempts INT NOT NULL DEFAULT 0,
+        response_code INT,
+        error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        last_attempt_at TIMESTAMPTZ,
+        next_attempt_at TIMESTAMPTZ,
+        delivered_at TIMESTAMPTZ
+);
+CREATE INDEX idxdeliverywebhook ON webhook_deliveries (webhook_id, id);
+CREATE INDEX idxdeliverydue ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
 
 CREATE TABLE brokers (
-        username TEXT,
-        password TEXT,
-        broker TEXT,
-        topic TEXT,
-        PRIMARY KEY (username, broker)
-);
\ No newline at end of file
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL DEFAULT '',
+        url TEXT NOT NULL,
+        username TEXT NOT NULL DEFAULT '',
+        password TEXT NOT NULL DEFAULT '',
+        client_id TEXT NOT NULL DEFAULT '',
+        protocol_version SMALLINT NOT NULL DEFAULT 4 CHECK (protocol_version IN (4, 5)),
+        tls_ca_cert TEXT NOT NULL DEFAULT '',
+        tls_cert TEXT NOT NULL DEFAULT '',
+        tls_key TEXT NOT NULL DEFAULT '',
+        tls_insecure BOOLEAN NOT NULL DEFAULT FALSE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (tenant_id, url, username)
+);
+
+CREATE TABLE subscriptions (
+        id BIGSERIAL PRIMARY KEY,
+        broker_id BIGINT NOT NULL REFERENCES brokers (id) ON DELETE CASCADE,
+        topic TEXT NOT NULL,
+        qos SMALLINT NOT NULL DEFAULT 2 CHECK (qos BETWEEN 0 AND 2),
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        UNIQUE (broker_id, topic)
+);
+
+-- instances of a cluster, alive while they renew seen_at
+CREATE TABLE cluster_members (
+        instance TEXT PRIMARY KEY,
+        seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- the instance connecting a broker, others take it over once the lease expires
+CREATE TABLE broker_leases (
+        broker_id BIGINT PRIMARY KEY REFERENCES brokers (id) ON DELETE CASCADE,
+        owner TEXT NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idxleaseowner ON broker_leases (owner);
+
+-- register maps of modbus tcp units polled into devices
+CREATE TABLE modbus_pollers (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        device_id BIGINT NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+        address TEXT NOT NULL,
+        unit_id SMALLINT NOT NULL DEFAULT 1 CHECK (unit_id BETWEEN 0 AND 255),
+        interval_seconds INT NOT NULL CHECK (interval_seconds > 0),
+        registers JSONB NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idxmodbustenant ON modbus_pollers (tenant_id);
+
+CREATE TABLE api_keys (
+        id BIGSERIAL PRIMARY KEY,
+        tenant_id BIGINT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        key_hash TEXT NOT NULL UNIQUE,
+        scopes TEXT[] NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        last_used_at TIMESTAMPTZ,
+        revoked_at TIMESTAMPTZ
+);